@@ -1,6 +1,6 @@
 module go-iot
 
-go 1.21
+go 1.22.0
 
 require (
 	github.com/dop251/goja v0.0.0-20230111111035-473251c96b4c
@@ -11,9 +11,11 @@ require (
 	github.com/go-redis/redis/v8 v8.11.5
 	github.com/goburrow/modbus v0.1.0
 	github.com/google/uuid v1.3.0
+	github.com/gopcua/opcua v0.6.0
 	github.com/gorilla/websocket v1.5.3
 	github.com/mitchellh/mapstructure v1.5.0
 	github.com/mochi-mqtt/server/v2 v2.7.7
+	github.com/pion/dtls/v3 v3.0.2
 	github.com/plgd-dev/go-coap/v3 v3.3.6
 	github.com/robfig/cron/v3 v3.0.0
 	github.com/spf13/cast v1.5.1
@@ -42,7 +44,6 @@ require (
 	github.com/magiconair/properties v1.8.7 // indirect
 	github.com/mohae/deepcopy v0.0.0-20170929034955-c48cc78d4826 // indirect
 	github.com/pelletier/go-toml/v2 v2.0.8 // indirect
-	github.com/pion/dtls/v3 v3.0.2 // indirect
 	github.com/pion/logging v0.2.2 // indirect
 	github.com/pion/transport/v3 v3.0.7 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
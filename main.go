@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"go-iot/pkg/api/web"
 	"go-iot/pkg/cluster"
+	"go-iot/pkg/codec"
 	"go-iot/pkg/core"
 	"go-iot/pkg/es"
 	"go-iot/pkg/logger"
@@ -37,6 +38,8 @@ func main() {
 	redis.Config(opt)
 	// 规则引擎配置
 	ruleengine.Config(opt)
+	// 脚本执行限制
+	codec.Config(opt)
 	// 初始化数据库
 	models.InitDb()
 	// 启动web服务
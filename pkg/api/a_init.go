@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"go-iot/pkg/boot"
 	"go-iot/pkg/cluster"
+	"go-iot/pkg/codec"
 	"go-iot/pkg/core"
 	"go-iot/pkg/models"
 	"go-iot/pkg/models/base"
@@ -11,6 +12,7 @@ import (
 	"go-iot/pkg/models/network"
 	"go-iot/pkg/models/notify"
 	"go-iot/pkg/models/rule"
+	"go-iot/pkg/models/scriptlib"
 	"go-iot/pkg/network/servers"
 	notify1 "go-iot/pkg/notify"
 	"go-iot/pkg/ruleengine"
@@ -22,6 +24,7 @@ func init() {
 	boot.AddStartLinstener(func() {
 		start := &start{}
 		start.initResources()
+		start.loadScriptLibs()
 		go start.startRuningNetServer()
 		go start.startRuningRule()
 		go start.startRuningNotify()
@@ -57,6 +60,22 @@ func (i *start) initResources() {
 	logs.Infof("menu resource inited")
 }
 
+// 加载脚本库, 需要在启动网络服务与规则之前完成
+func (i *start) loadScriptLibs() {
+	list, err := scriptlib.ListAllScriptLib()
+	if err != nil {
+		logs.Errorf("list script lib error: %v", err)
+		return
+	}
+	for _, v := range list {
+		err = codec.RegScriptLib(v.Name, v.Version, v.Script)
+		if err != nil {
+			logs.Errorf("load script lib [%s@%d] error: %v", v.Name, v.Version, err)
+		}
+	}
+	logs.Infof("script lib loaded: %d", len(list))
+}
+
 func (i *start) startRuningRule() {
 	logs.Infof("start runing rule")
 	var page models.PageQuery
@@ -168,33 +187,45 @@ func (i *start) startRuningNetClient() {
 		}
 		for _, nw := range list {
 			if len(nw.Configuration) > 0 {
-				var devicePage models.PageQuery
-				devicePage.PageSize = 300
-				devicePage.Condition = []core.SearchTerm{{Key: "State", Value: core.OFFLINE}, {Key: "productId", Value: nw.ProductId}}
-				r1, err := device.PageDevice(&devicePage, nil)
-				if err != nil {
-					logs.Errorf("start netclient error: %v", err)
-					continue
-				}
-				devicePage.SearchAfter = r1.SearchAfter
-				devices := r1.List
-				if len(devices) == 0 {
-					break
+				i.connectClientDevices(nw.ProductId)
+			}
+		}
+	}
+	logs.Infof("start runing netclient done")
+}
+
+// 连接产品下已启用的设备, 包括服务停止前在线的设备
+func (i *start) connectClientDevices(productId string) {
+	var devicePage models.PageQuery
+	devicePage.PageSize = 300
+	devicePage.Condition = []core.SearchTerm{{Key: "State", Value: core.NoActive, Oper: core.NEQ}, {Key: "productId", Value: productId}}
+	for {
+		r1, err := device.PageDevice(&devicePage, nil)
+		if err != nil {
+			logs.Errorf("start netclient error: %v", err)
+			return
+		}
+		devicePage.SearchAfter = r1.SearchAfter
+		devices := r1.List
+		if len(devices) == 0 {
+			return
+		}
+		for _, dev := range devices {
+			var err error
+			if cluster.Enabled() {
+				if cluster.Shard(dev.Id) {
+					err = connectClientDevice(dev.Id)
 				}
-				for _, dev := range devices {
-					if cluster.Enabled() {
-						if cluster.Shard(dev.Id) {
-							err = connectClientDevice(dev.Id)
-						}
-					} else {
-						err = connectClientDevice(dev.Id)
-					}
-					if err != nil {
-						logs.Errorf("start netclient error: %v", err)
-					}
+			} else {
+				err = connectClientDevice(dev.Id)
+			}
+			if err != nil {
+				logs.Errorf("start netclient error: %v", err)
+				// 停止前在线的设备连接失败时更新为离线
+				if dev.State == core.ONLINE {
+					device.UpdateOnlineStatus(dev.Id, core.OFFLINE)
 				}
 			}
 		}
 	}
-	logs.Infof("start runing netclient done")
 }
@@ -1,16 +1,21 @@
 package api
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"go-iot/pkg/api/web"
 	"go-iot/pkg/cluster"
+	"go-iot/pkg/common"
 	"go-iot/pkg/core"
 	"go-iot/pkg/models"
 	deviceDao "go-iot/pkg/models/device"
 	networkDao "go-iot/pkg/models/network"
 	"go-iot/pkg/network"
+	"go-iot/pkg/network/clients"
 	"go-iot/pkg/network/servers"
+	"io"
 	"net/http"
 	"strings"
 	"time"
@@ -48,9 +53,14 @@ func init() {
 	web.RegisterAPI("/device/batch/deploy", "POST", d.BatchDeploy)
 	web.RegisterAPI("/device/batch/undeploy", "POST", d.BatchUndeploy)
 	web.RegisterAPI("/device/{id}/invoke", "POST", d.CmdInvoke)
+	web.RegisterAPI("/device/{id}/property/read", "POST", d.ReadProperty)
+	web.RegisterAPI("/device/{id}/property/write", "POST", d.WriteProperty)
 	web.RegisterAPI("/device/{id}/properties", "POST", d.QueryProperty)
 	web.RegisterAPI("/device/{id}/logs", "POST", d.QueryLogs)
 	web.RegisterAPI("/device/{id}/event/{eventId}", "POST", d.QueryEvent)
+	web.RegisterAPI("/device/{id}/shadow", "GET", d.GetShadow)
+	web.RegisterAPI("/device/{id}/shadow", "PUT", d.UpdateShadow)
+	web.RegisterAPI("/device/{id}/secret", "POST", d.ResetSecret)
 
 	RegResource(deviceResource)
 }
@@ -74,6 +84,10 @@ func (d *deviceApi) Page(w http.ResponseWriter, r *http.Request) {
 		ctl.RespError(err)
 		return
 	}
+	// 不返回设备密钥
+	for i := range res.List {
+		res.List[i].Secret = ""
+	}
 	ctl.RespOkData(res)
 }
 
@@ -99,6 +113,7 @@ func (d *deviceApi) GetOne(w http.ResponseWriter, r *http.Request) {
 	alins.Metadata = product.Metadata
 	alins.ProductName = product.Name
 	alins.DeviceModel = *ob
+	alins.Secret = ""
 	ctl.RespOkData(alins)
 }
 
@@ -132,6 +147,7 @@ func (d *deviceApi) GetDetail(w http.ResponseWriter, r *http.Request) {
 		alins.NetworkType = nw.Type
 	}
 	alins.DeviceModel = *ob
+	alins.Secret = ""
 	if ob.State != core.NoActive {
 		dev := core.GetDevice(ob.Id)
 		// 设备在其它节点时转发给其它节点执行
@@ -245,9 +261,16 @@ func (d *deviceApi) GetConnectionInfo(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	session := core.GetSession(deviceId)
+	// client设备的连接与重连状态
+	status := clients.GetStatus(deviceId)
 	if session != nil {
 		info := session.GetInfo()
+		if status != nil {
+			info["client"] = status
+		}
 		ctl.RespOkData(info)
+	} else if status != nil {
+		ctl.RespOkData(map[string]any{"client": status})
 	} else {
 		ctl.RespOk()
 	}
@@ -345,6 +368,8 @@ func (d *deviceApi) Disconnect(w http.ResponseWriter, r *http.Request) {
 		ctl.Resp(*resp)
 		return
 	}
+	// 主动断开时停止重连
+	reconnecting := clients.Stop(deviceId)
 	session := core.GetSession(deviceId)
 	if session != nil {
 		err := session.Disconnect()
@@ -352,7 +377,7 @@ func (d *deviceApi) Disconnect(w http.ResponseWriter, r *http.Request) {
 			ctl.RespError(err)
 			return
 		}
-	} else {
+	} else if !reconnecting {
 		ctl.RespError(errors.New("设备离线"))
 		return
 	}
@@ -416,21 +441,87 @@ func (d *deviceApi) CmdInvoke(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	ob.DeviceId = deviceId
-	_, err = getDeviceAndCheckCreateId(ctl, deviceId)
+	ob.Kind = core.FUNC_INVOKE
+	if invokeDevice(ctl, deviceId, func() *common.Err {
+		return core.DoCmdInvoke(ob)
+	}) {
+		ctl.RespOk()
+	}
+}
+
+// 读取设备属性，成功后返回设备影子中的属性值
+func (d *deviceApi) ReadProperty(w http.ResponseWriter, r *http.Request) {
+	ctl := NewAuthController(w, r)
+	if ctl.isForbidden(deviceResource, SaveAction) {
+		return
+	}
+	deviceId := ctl.Param("id")
+
+	var ob struct {
+		core.FuncInvoke
+		Properties []string `json:"properties"`
+	}
+	err := ctl.BindJSON(&ob)
+	if err != nil {
+		ctl.RespError(err)
+		return
+	}
+	message := ob.FuncInvoke
+	message.DeviceId = deviceId
+	message.Data = map[string]any{"properties": ob.Properties}
+	if invokeDevice(ctl, deviceId, func() *common.Err {
+		return core.DoReadProperty(message)
+	}) {
+		shadow := core.GetShadow(deviceId)
+		values := map[string]core.ShadowValue{}
+		for _, id := range ob.Properties {
+			if v, ok := shadow.Reported[id]; ok {
+				values[id] = v
+			}
+		}
+		ctl.RespOkData(values)
+	}
+}
+
+// 写入设备属性
+func (d *deviceApi) WriteProperty(w http.ResponseWriter, r *http.Request) {
+	ctl := NewAuthController(w, r)
+	if ctl.isForbidden(deviceResource, SaveAction) {
+		return
+	}
+	deviceId := ctl.Param("id")
+
+	var ob core.FuncInvoke
+	err := ctl.BindJSON(&ob)
 	if err != nil {
 		ctl.RespError(err)
 		return
 	}
+	ob.DeviceId = deviceId
+	if invokeDevice(ctl, deviceId, func() *common.Err {
+		return core.DoWriteProperty(ob)
+	}) {
+		ctl.RespOk()
+	}
+}
+
+// 对设备进行调用，设备在其它节点时转发给其它节点执行，返回true时表示在本节点调用成功
+func invokeDevice(ctl *AuthController, deviceId string, invoke func() *common.Err) bool {
+	_, err := getDeviceAndCheckCreateId(ctl, deviceId)
+	if err != nil {
+		ctl.RespError(err)
+		return false
+	}
 	deviceOper := core.GetDevice(deviceId)
 	if deviceOper == nil {
 		ctl.RespError(errors.New("设备未激活"))
-		return
+		return false
 	}
 	sendCluster := cluster.Enabled() && deviceOper.ClusterId != cluster.GetClusterId()
 	productOper := core.GetProduct(deviceOper.ProductId)
 	if productOper == nil {
 		ctl.RespError(fmt.Errorf("产品'%s'不存在或未发布", deviceOper.ProductId))
-		return
+		return false
 	}
 	// 无状态网络不用走集群
 	if network.IsStateless(productOper.NetworkType) {
@@ -441,18 +532,17 @@ func (d *deviceApi) CmdInvoke(w http.ResponseWriter, r *http.Request) {
 		resp, err := cluster.SingleInvoke(deviceOper.ClusterId, ctl.Request)
 		if err != nil {
 			ctl.RespError(err)
-			return
+			return false
 		}
 		ctl.Resp(*resp)
-		return
-	} else {
-		err1 := core.DoCmdInvoke(ob)
-		if err1 != nil {
-			ctl.RespErr(err1)
-			return
-		}
+		return false
 	}
-	ctl.RespOk()
+	err1 := invoke()
+	if err1 != nil {
+		ctl.RespErr(err1)
+		return false
+	}
+	return true
 }
 
 // 查询设备属性
@@ -471,6 +561,131 @@ func (d *deviceApi) QueryEvent(w http.ResponseWriter, r *http.Request) {
 	queryDeviceTimeseriesData(ctl, core.TIME_TYPE_EVENT)
 }
 
+// 查询设备影子
+func (d *deviceApi) GetShadow(w http.ResponseWriter, r *http.Request) {
+	ctl := NewAuthController(w, r)
+	if ctl.isForbidden(deviceResource, QueryAction) {
+		return
+	}
+	deviceId := ctl.Param("id")
+	_, err := getDeviceAndCheckCreateId(ctl, deviceId)
+	if err != nil {
+		ctl.RespError(err)
+		return
+	}
+	if core.GetDevice(deviceId) == nil {
+		ctl.RespError(errors.New("设备未激活"))
+		return
+	}
+	shadow := core.GetShadow(deviceId)
+	var alins = struct {
+		*core.Shadow
+		Delta map[string]any `json:"delta"`
+	}{Shadow: shadow, Delta: shadow.Delta()}
+	ctl.RespOkData(alins)
+}
+
+// 修改设备影子期望值，设备在线时下发差异
+func (d *deviceApi) UpdateShadow(w http.ResponseWriter, r *http.Request) {
+	ctl := NewAuthController(w, r)
+	if ctl.isForbidden(deviceResource, SaveAction) {
+		return
+	}
+	deviceId := ctl.Param("id")
+	var ob struct {
+		Desired map[string]any `json:"desired"`
+	}
+	err := ctl.BindJSON(&ob)
+	if err != nil {
+		ctl.RespError(err)
+		return
+	}
+	_, err = getDeviceAndCheckCreateId(ctl, deviceId)
+	if err != nil {
+		ctl.RespError(err)
+		return
+	}
+	deviceOper := core.GetDevice(deviceId)
+	if deviceOper == nil {
+		ctl.RespError(errors.New("设备未激活"))
+		return
+	}
+	productOper := core.GetProduct(deviceOper.ProductId)
+	if productOper == nil {
+		ctl.RespError(fmt.Errorf("产品'%s'不存在或未发布", deviceOper.ProductId))
+		return
+	}
+	propMap := productOper.GetTsl().PropertiesMap()
+	for key := range ob.Desired {
+		if _, ok := propMap[key]; !ok {
+			ctl.RespError(fmt.Errorf("属性[%s]不存在", key))
+			return
+		}
+	}
+	// 设备在其它节点时转发给其它节点执行
+	if cluster.Enabled() && len(deviceOper.ClusterId) > 0 && deviceOper.ClusterId != cluster.GetClusterId() {
+		resp, err := cluster.SingleInvoke(deviceOper.ClusterId, ctl.Request)
+		if err != nil {
+			ctl.RespError(err)
+			return
+		}
+		ctl.Resp(*resp)
+		return
+	}
+	core.UpdateShadowDesired(deviceId, ob.Desired)
+	err = core.PushShadowDelta(deviceId)
+	if err != nil {
+		ctl.RespError(err)
+		return
+	}
+	ctl.RespOk()
+}
+
+// 重置设备密钥, 未指定时随机生成, 密钥只在此处返回一次
+func (d *deviceApi) ResetSecret(w http.ResponseWriter, r *http.Request) {
+	ctl := NewAuthController(w, r)
+	if ctl.isForbidden(deviceResource, SaveAction) {
+		return
+	}
+	deviceId := ctl.Param("id")
+	var ob struct {
+		Secret string `json:"secret"`
+	}
+	err := ctl.BindJSON(&ob)
+	if err != nil && err != io.EOF {
+		ctl.RespError(err)
+		return
+	}
+	_, err = getDeviceAndCheckCreateId(ctl, deviceId)
+	if err != nil {
+		ctl.RespError(err)
+		return
+	}
+	secret := strings.TrimSpace(ob.Secret)
+	if len(secret) == 0 {
+		b := make([]byte, 16)
+		if _, err = rand.Read(b); err != nil {
+			ctl.RespError(err)
+			return
+		}
+		secret = hex.EncodeToString(b)
+	} else if len(secret) > 64 {
+		ctl.RespError(errors.New("密钥长度不能超过64"))
+		return
+	}
+	err = deviceDao.UpdateDevice(&models.Device{Id: deviceId, Secret: secret})
+	if err != nil {
+		ctl.RespError(err)
+		return
+	}
+	// 已启用的设备立即生效
+	if devopr := core.GetDevice(deviceId); devopr != nil {
+		devopr.Secret = secret
+		core.PutDevice(devopr)
+	}
+	ctl.RespOkData(secret)
+}
+
 // 批量启用、禁用设备
 func batchEnableDevice(ctl *AuthController, deviceIds []string, term core.SearchTerm, tagertState string) {
 	token := fmt.Sprintf("batch-%s-device-%v", tagertState, time.Now().UnixMicro())
@@ -515,6 +730,7 @@ func batchEnableDevice(ctl *AuthController, deviceIds []string, term core.Search
 					model := models.DeviceModel{}
 					model.FromEnitty(dev)
 					devopr.Config = model.Metaconfig
+					devopr.Secret = dev.Secret
 					core.PutDevice(devopr)
 				}
 				err = deviceDao.UpdateOnlineStatusList(ids, tagertState)
@@ -566,6 +782,7 @@ func enableDevice(ctl *AuthController, deviceId string, isDeploy bool) {
 			deviceDao.UpdateDevice(&entity)
 		}
 		devopr.Config = dev.Metaconfig
+		devopr.Secret = dev.Secret
 		core.PutDevice(devopr)
 	} else {
 		devopr := core.GetDevice(deviceId)
@@ -6,16 +6,19 @@ import (
 	"fmt"
 	"go-iot/pkg/api/web"
 	"go-iot/pkg/cluster"
+	"go-iot/pkg/codec"
 	"go-iot/pkg/core"
 	"go-iot/pkg/models"
 	product "go-iot/pkg/models/device"
 	networkmd "go-iot/pkg/models/network"
 	"go-iot/pkg/network"
+	"go-iot/pkg/network/clients"
 	"go-iot/pkg/network/servers"
 	"go-iot/pkg/tsl"
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 )
 
@@ -57,10 +60,16 @@ func init() {
 	web.RegisterAPI("/product/{id}/deploy", "POST", api.deploy)
 	web.RegisterAPI("/product/{id}/undeploy", "POST", api.undeploy)
 	web.RegisterAPI("/product/{id}/tsl", "PUT", api.saveTsl)
+	web.RegisterAPI("/product/{id}/tsl/versions", "GET", api.tslVersions)
+	web.RegisterAPI("/product/{id}/tsl/diff", "GET", api.tslDiff)
 	web.RegisterAPI("/product/{id}/script", "PUT", api.saveScript)
+	web.RegisterAPI("/product/{id}/invalid-data", "GET", api.invalidData)
+	web.RegisterAPI("/product/{id}/script/stats", "GET", api.scriptStats)
+	web.RegisterAPI("/product/{id}/codec/test", "POST", api.codecTest)
 	web.RegisterAPI("/product/network/{productId}", "GET", api.getNetwork)
 	web.RegisterAPI("/product/network", "PUT", api.updateNetwork)
 	web.RegisterAPI("/product/network/{productId}/run", "POST", api.startNetwork)
+	web.RegisterAPI("/product/network/{productId}/reload", "POST", api.reloadNetwork)
 	web.RegisterAPI("/product/{id}/export", "GET", api.exportProduct)
 	web.RegisterAPI("/product/import", "POST", api.importProduct)
 
@@ -171,6 +180,64 @@ func (a *productApi) get(w http.ResponseWriter, r *http.Request) {
 	ctl.RespOkData(p)
 }
 
+// 查询不满足物模型约束的数据个数
+func (a *productApi) invalidData(w http.ResponseWriter, r *http.Request) {
+	ctl := NewAuthController(w, r)
+	if ctl.isForbidden(productResource, QueryAction) {
+		return
+	}
+	id := ctl.Param("id")
+	_, err := getProductAndCheckCreate(ctl, id)
+	if err != nil {
+		ctl.RespError(err)
+		return
+	}
+	ctl.RespOkData(map[string]any{"count": core.GetInvalidDataCount(id)})
+}
+
+// 查询脚本执行统计
+func (a *productApi) scriptStats(w http.ResponseWriter, r *http.Request) {
+	ctl := NewAuthController(w, r)
+	if ctl.isForbidden(productResource, QueryAction) {
+		return
+	}
+	id := ctl.Param("id")
+	_, err := getProductAndCheckCreate(ctl, id)
+	if err != nil {
+		ctl.RespError(err)
+		return
+	}
+	ctl.RespOkData(codec.GetScriptStats(id))
+}
+
+// 使用样例数据调试编解码脚本, 脚本为空时使用已保存的脚本
+func (a *productApi) codecTest(w http.ResponseWriter, r *http.Request) {
+	ctl := NewAuthController(w, r)
+	if ctl.isForbidden(productResource, SaveAction) {
+		return
+	}
+	var ob codec.SandboxRequest
+	if err := ctl.BindJSON(&ob); err != nil {
+		ctl.RespError(err)
+		return
+	}
+	id := ctl.Param("id")
+	p, err := getProductAndCheckCreate(ctl, id)
+	if err != nil {
+		ctl.RespError(err)
+		return
+	}
+	if len(ob.Script) == 0 {
+		ob.Script = p.Script
+	}
+	result, err := codec.RunSandbox(id, ob)
+	if err != nil {
+		ctl.RespError(err)
+		return
+	}
+	ctl.RespOkData(result)
+}
+
 // 删除型号
 func (a *productApi) delete(w http.ResponseWriter, r *http.Request) {
 	ctl := NewAuthController(w, r)
@@ -211,6 +278,17 @@ func (a *productApi) delete(w http.ResponseWriter, r *http.Request) {
 		ctl.RespError(err)
 		return
 	}
+	err = product.DeleteProductTsl(productId)
+	if err != nil {
+		ctl.RespError(err)
+		return
+	}
+	err = product.DeleteProductScript(productId)
+	if err != nil {
+		ctl.RespError(err)
+		return
+	}
+	codec.RemoveScriptCodec(productId)
 	ctl.RespOk()
 }
 
@@ -230,13 +308,13 @@ func (a *productApi) deploy(w http.ResponseWriter, r *http.Request) {
 		ctl.RespError(errors.New("产品没有配置物模型，请先配置"))
 		return
 	}
-	tsl := tsl.TslData{}
-	err = tsl.FromJson(ob.Metadata)
+	model := tsl.TslData{}
+	err = model.FromJson(ob.Metadata)
 	if err != nil {
 		ctl.RespError(err)
 		return
 	}
-	if len(tsl.Properties) == 0 {
+	if len(model.Properties) == 0 {
 		ctl.RespError(errors.New("物模型属性为空，请先添加属性"))
 		return
 	}
@@ -245,17 +323,134 @@ func (a *productApi) deploy(w http.ResponseWriter, r *http.Request) {
 		ctl.RespError(err)
 		return
 	}
-	core.PutProduct(p1)
-	err = p1.GetTimeSeries().PublishModel(p1, tsl)
+	latest, err := product.GetProductTsl(id, 0)
+	if err != nil {
+		ctl.RespError(err)
+		return
+	}
+	old, err := parseProductTsl(latest)
+	if err != nil {
+		ctl.RespError(err)
+		return
+	}
+	// 存在不兼容的变更时需要强制发布
+	changes, err := core.MigrateModel(p1, old, model, ctl.Query("force") == "true")
+	if err == core.ErrIncompatibleModel {
+		var ids []string
+		for _, c := range changes {
+			if c.Kind == tsl.ChangeIncompatible {
+				ids = append(ids, c.Id)
+			}
+		}
+		ctl.RespError(fmt.Errorf("%v: %s, 请确认后强制发布", err, strings.Join(ids, ",")))
+		return
+	}
 	if err != nil {
 		ctl.RespError(err)
 		return
 	}
+	core.PutProduct(p1)
+	if latest == nil || len(changes) > 0 {
+		_, err = product.AddProductTsl(id, ob.Metadata, ctl.GetCurrentUser().Id)
+		if err != nil {
+			ctl.RespError(err)
+			return
+		}
+	}
 	ob.State = true
 	product.UpdateProductState(&ob.Product)
 	ctl.RespOk()
 }
 
+// 物模型版本列表
+func (a *productApi) tslVersions(w http.ResponseWriter, r *http.Request) {
+	ctl := NewAuthController(w, r)
+	if ctl.isForbidden(productResource, QueryAction) {
+		return
+	}
+	id := ctl.Param("id")
+	_, err := getProductAndCheckCreate(ctl, id)
+	if err != nil {
+		ctl.RespError(err)
+		return
+	}
+	list, err := product.ListProductTsl(id)
+	if err != nil {
+		ctl.RespError(err)
+		return
+	}
+	ctl.RespOkData(list)
+}
+
+// 当前物模型与已发布版本的差异, 默认对比最新发布的版本
+func (a *productApi) tslDiff(w http.ResponseWriter, r *http.Request) {
+	ctl := NewAuthController(w, r)
+	if ctl.isForbidden(productResource, QueryAction) {
+		return
+	}
+	id := ctl.Param("id")
+	ob, err := getProductAndCheckCreate(ctl, id)
+	if err != nil {
+		ctl.RespError(err)
+		return
+	}
+	var version int
+	if v := ctl.Query("version"); len(v) > 0 {
+		version, err = strconv.Atoi(v)
+		if err != nil {
+			ctl.RespErrorParam("version")
+			return
+		}
+	}
+	pt, err := product.GetProductTsl(id, version)
+	if err != nil {
+		ctl.RespError(err)
+		return
+	}
+	if pt == nil && version > 0 {
+		ctl.RespError(fmt.Errorf("物模型版本[%d]不存在", version))
+		return
+	}
+	old, err := parseProductTsl(pt)
+	if err != nil {
+		ctl.RespError(err)
+		return
+	}
+	model := tsl.NewTslData()
+	if len(strings.TrimSpace(ob.Metadata)) > 0 {
+		err = model.FromJson(ob.Metadata)
+		if err != nil {
+			ctl.RespError(err)
+			return
+		}
+	}
+	changes := tsl.Diff(old, model)
+	if changes == nil {
+		changes = []tsl.TslChange{}
+	}
+	result := map[string]any{
+		"changes":      changes,
+		"incompatible": tsl.HasIncompatible(changes),
+	}
+	if pt != nil {
+		result["version"] = pt.Version
+	}
+	ctl.RespOkData(result)
+}
+
+// 解析已发布的物模型, 未发布时返回nil
+func parseProductTsl(pt *models.ProductTsl) (*tsl.TslData, error) {
+	if pt == nil {
+		return nil, nil
+	}
+	model := tsl.NewTslData()
+	err := model.FromJson(pt.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	return model, nil
+}
+
 // 撤销发布
 func (a *productApi) undeploy(w http.ResponseWriter, r *http.Request) {
 	ctl := NewAuthController(w, r)
@@ -314,13 +509,16 @@ func (a *productApi) saveTsl(w http.ResponseWriter, r *http.Request) {
 	ctl.RespOk()
 }
 
-// 保存编解码脚本
+// 保存编解码脚本, 同时保存为新的脚本版本
 func (a *productApi) saveScript(w http.ResponseWriter, r *http.Request) {
 	ctl := NewAuthController(w, r)
 	if ctl.isForbidden(productResource, SaveAction) {
 		return
 	}
-	var ob models.Product
+	var ob struct {
+		Script  string `json:"script"`
+		Comment string `json:"comment"` // 版本说明
+	}
 	var err error
 	if err = ctl.BindJSON(&ob); err != nil {
 		ctl.RespError(err)
@@ -339,7 +537,12 @@ func (a *productApi) saveScript(w http.ResponseWriter, r *http.Request) {
 		ctl.RespError(err)
 		return
 	}
-	ctl.RespOk()
+	ps, err := product.AddProductScript(productId, ob.Script, ob.Comment, ctl.GetCurrentUser().Id)
+	if err != nil {
+		ctl.RespError(err)
+		return
+	}
+	ctl.RespOkData(map[string]any{"version": ps.Version})
 }
 
 // 查询网络配置
@@ -487,6 +690,7 @@ func (a *productApi) startNetwork(w http.ResponseWriter, r *http.Request) {
 			ctl.RespError(err)
 			return
 		}
+		codec.RemoveScriptCodec(productId)
 	} else {
 		ctl.RespError(errors.New("state must be start or stop"))
 		return
@@ -499,6 +703,50 @@ func (a *productApi) startNetwork(w http.ResponseWriter, r *http.Request) {
 	ctl.RespOk()
 }
 
+// 在线更新网络配置, 不断开已连接的设备, 返回是否重启了网络服务
+func (a *productApi) reloadNetwork(w http.ResponseWriter, r *http.Request) {
+	ctl := NewAuthController(w, r)
+	if ctl.isForbidden(productResource, SaveAction) {
+		return
+	}
+	productId := ctl.Param("productId")
+	_, err := getProductAndCheckCreate(ctl, productId)
+	if err != nil {
+		ctl.RespError(err)
+		return
+	}
+	nw, err := networkmd.GetByProductId(productId)
+	if err != nil {
+		ctl.RespError(err)
+		return
+	}
+	if nw == nil {
+		ctl.RespError(errors.New("产品没有配置网络"))
+		return
+	}
+	config, err := convertCodecNetwork(*nw)
+	if err != nil {
+		ctl.RespError(err)
+		return
+	}
+	// 客户端类型的网络更新产品下已连接的设备
+	var result *network.ReloadResult
+	if network.IsNetClientType(config.Type) {
+		result, err = clients.Reload(config)
+	} else {
+		result, err = servers.ReloadServer(config)
+	}
+	if err != nil {
+		ctl.RespError(err)
+		return
+	}
+	if ctl.IsNotClusterRequest() {
+		// 调用集群接口
+		cluster.BroadcastInvoke(ctl.Request)
+	}
+	ctl.RespOkData(result)
+}
+
 // 产品导出
 func (a *productApi) exportProduct(w http.ResponseWriter, r *http.Request) {
 	ctl := NewAuthController(w, r)
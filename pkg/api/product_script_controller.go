@@ -0,0 +1,266 @@
+package api
+
+import (
+	"errors"
+	"go-iot/pkg/api/web"
+	"go-iot/pkg/cluster"
+	"go-iot/pkg/codec"
+	"go-iot/pkg/core"
+	product "go-iot/pkg/models/device"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// 脚本版本管理, 支持灰度发布与回滚
+func init() {
+	api := &productScriptApi{}
+
+	web.RegisterAPI("/product/{id}/script/versions", "GET", api.versions)
+	web.RegisterAPI("/product/{id}/script/versions/{version}", "GET", api.get)
+	web.RegisterAPI("/product/{id}/script/versions/{version}/activate", "POST", api.activate)
+	web.RegisterAPI("/product/{id}/script/versions/{version}/canary", "POST", api.canary)
+	web.RegisterAPI("/product/{id}/script/rollback", "POST", api.rollback)
+}
+
+type productScriptApi struct {
+}
+
+// 灰度设置
+type scriptCanary struct {
+	Devices []string `json:"devices"` // 灰度设备id
+	Percent int      `json:"percent"` // 灰度设备比例
+}
+
+// 脚本版本列表
+func (a *productScriptApi) versions(w http.ResponseWriter, r *http.Request) {
+	ctl := NewAuthController(w, r)
+	if ctl.isForbidden(productResource, QueryAction) {
+		return
+	}
+	id := ctl.Param("id")
+	_, err := getProductAndCheckCreate(ctl, id)
+	if err != nil {
+		ctl.RespError(err)
+		return
+	}
+	list, err := product.ListProductScript(id)
+	if err != nil {
+		ctl.RespError(err)
+		return
+	}
+	ctl.RespOkData(list)
+}
+
+// 获取脚本版本的内容
+func (a *productScriptApi) get(w http.ResponseWriter, r *http.Request) {
+	ctl := NewAuthController(w, r)
+	if ctl.isForbidden(productResource, QueryAction) {
+		return
+	}
+	id := ctl.Param("id")
+	_, err := getProductAndCheckCreate(ctl, id)
+	if err != nil {
+		ctl.RespError(err)
+		return
+	}
+	version, err := strconv.Atoi(ctl.Param("version"))
+	if err != nil {
+		ctl.RespErrorParam("version")
+		return
+	}
+	ob, err := product.GetProductScript(id, version)
+	if err != nil {
+		ctl.RespError(err)
+		return
+	}
+	if ob == nil {
+		ctl.RespError(errors.New("脚本版本不存在"))
+		return
+	}
+	ctl.RespOkData(ob)
+}
+
+// 设为正式版本, 所有设备使用该版本并取消灰度
+func (a *productScriptApi) activate(w http.ResponseWriter, r *http.Request) {
+	ctl := NewAuthController(w, r)
+	if ctl.isForbidden(productResource, SaveAction) {
+		return
+	}
+	id := ctl.Param("id")
+	_, err := getProductAndCheckCreate(ctl, id)
+	if err != nil {
+		ctl.RespError(err)
+		return
+	}
+	version, err := strconv.Atoi(ctl.Param("version"))
+	if err != nil {
+		ctl.RespErrorParam("version")
+		return
+	}
+	if ctl.IsNotClusterRequest() {
+		if err = checkScriptVersion(id, version); err != nil {
+			ctl.RespError(err)
+			return
+		}
+		if _, err = product.ActivateProductScript(id, version, false); err != nil {
+			ctl.RespError(err)
+			return
+		}
+		cluster.BroadcastInvoke(ctl.Request)
+	}
+	if err = applyScriptRelease(id); err != nil {
+		ctl.RespError(err)
+		return
+	}
+	ctl.RespOk()
+}
+
+// 设为灰度版本, 按设备id或设备比例选择使用该版本的设备
+func (a *productScriptApi) canary(w http.ResponseWriter, r *http.Request) {
+	ctl := NewAuthController(w, r)
+	if ctl.isForbidden(productResource, SaveAction) {
+		return
+	}
+	id := ctl.Param("id")
+	_, err := getProductAndCheckCreate(ctl, id)
+	if err != nil {
+		ctl.RespError(err)
+		return
+	}
+	version, err := strconv.Atoi(ctl.Param("version"))
+	if err != nil {
+		ctl.RespErrorParam("version")
+		return
+	}
+	if ctl.IsNotClusterRequest() {
+		var ob scriptCanary
+		if err = ctl.BindJSON(&ob); err != nil {
+			ctl.RespError(err)
+			return
+		}
+		active, err := product.GetProductScriptByState(id, product.ScriptActive)
+		if err != nil {
+			ctl.RespError(err)
+			return
+		}
+		if active == nil {
+			ctl.RespError(errors.New("没有正式版本, 请先设置正式版本"))
+			return
+		}
+		if err = checkScriptVersion(id, version); err != nil {
+			ctl.RespError(err)
+			return
+		}
+		if _, err = product.CanaryProductScript(id, version, ob.Devices, ob.Percent); err != nil {
+			ctl.RespError(err)
+			return
+		}
+		cluster.BroadcastInvoke(ctl.Request)
+	}
+	if err = applyScriptRelease(id); err != nil {
+		ctl.RespError(err)
+		return
+	}
+	ctl.RespOk()
+}
+
+// 回滚, 有灰度时取消灰度, 否则恢复为上一个正式版本
+func (a *productScriptApi) rollback(w http.ResponseWriter, r *http.Request) {
+	ctl := NewAuthController(w, r)
+	if ctl.isForbidden(productResource, SaveAction) {
+		return
+	}
+	id := ctl.Param("id")
+	_, err := getProductAndCheckCreate(ctl, id)
+	if err != nil {
+		ctl.RespError(err)
+		return
+	}
+	if ctl.IsNotClusterRequest() {
+		canary, err := product.CancelCanaryProductScript(id)
+		if err != nil {
+			ctl.RespError(err)
+			return
+		}
+		if canary == nil {
+			active, err := product.GetProductScriptByState(id, product.ScriptActive)
+			if err != nil {
+				ctl.RespError(err)
+				return
+			}
+			if active == nil || active.PrevVersion <= 0 {
+				ctl.RespError(errors.New("没有可以回滚的版本"))
+				return
+			}
+			if _, err = product.ActivateProductScript(id, active.PrevVersion, true); err != nil {
+				ctl.RespError(err)
+				return
+			}
+		}
+		cluster.BroadcastInvoke(ctl.Request)
+	}
+	if err = applyScriptRelease(id); err != nil {
+		ctl.RespError(err)
+		return
+	}
+	ctl.RespOk()
+}
+
+// 检查脚本版本能否编译
+func checkScriptVersion(productId string, version int) error {
+	ob, err := product.GetProductScript(productId, version)
+	if err != nil {
+		return err
+	}
+	if ob == nil {
+		return errors.New("脚本版本不存在")
+	}
+	return codec.CheckScript(ob.Script)
+}
+
+// 设置产品的脚本发布信息, 返回正式版本的脚本, 没有正式版本时返回产品保存的脚本
+func loadScriptRelease(productId string, script string) (string, error) {
+	active, err := product.GetProductScriptByState(productId, product.ScriptActive)
+	if err != nil {
+		return "", err
+	}
+	if active == nil {
+		codec.SetScriptRelease(productId, nil)
+		return script, nil
+	}
+	release := &codec.ScriptRelease{Version: active.Version}
+	canary, err := product.GetProductScriptByState(productId, product.ScriptCanary)
+	if err != nil {
+		return "", err
+	}
+	if canary != nil {
+		release.CanaryVersion = canary.Version
+		release.CanaryScript = canary.Script
+		release.CanaryPercent = canary.CanaryPercent
+		for _, v := range strings.Split(canary.CanaryDevices, ",") {
+			if v = strings.TrimSpace(v); len(v) > 0 {
+				release.CanaryDevices = append(release.CanaryDevices, v)
+			}
+		}
+	}
+	codec.SetScriptRelease(productId, release)
+	return active.Script, nil
+}
+
+// 网络已启动时立即使用新的发布信息重建编解码
+func applyScriptRelease(productId string) error {
+	pro, err := product.GetProductMust(productId)
+	if err != nil {
+		return err
+	}
+	script, err := loadScriptRelease(productId, pro.Script)
+	if err != nil {
+		return err
+	}
+	if core.GetCodec(productId) == nil {
+		return nil
+	}
+	_, err = core.NewCodec(pro.CodecId, productId, script)
+	return err
+}
@@ -0,0 +1,223 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"go-iot/pkg/api/web"
+	"go-iot/pkg/cluster"
+	"go-iot/pkg/codec"
+	"go-iot/pkg/models"
+	product "go-iot/pkg/models/device"
+	"go-iot/pkg/models/scriptlib"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var scriptLibResource = Resource{
+	Id:   "script-lib",
+	Name: "脚本库",
+	Action: []ResourceAction{
+		QueryAction,
+		CretaeAction,
+		SaveAction,
+		DeleteAction,
+	},
+}
+
+// 脚本库管理
+func init() {
+	RegResource(scriptLibResource)
+
+	api := &scriptLibApi{}
+	web.RegisterAPI("/script-lib/list", "GET", api.list)
+	web.RegisterAPI("/script-lib/{name}", "POST", api.add)
+	web.RegisterAPI("/script-lib/{name}", "PUT", api.update)
+	web.RegisterAPI("/script-lib/{name}", "GET", api.get)
+	web.RegisterAPI("/script-lib/{name}/versions", "GET", api.versions)
+	web.RegisterAPI("/script-lib/{name}", "DELETE", api.delete)
+}
+
+type scriptLibApi struct {
+}
+
+// 所有脚本库的最新版本
+func (a *scriptLibApi) list(w http.ResponseWriter, r *http.Request) {
+	ctl := NewAuthController(w, r)
+	if ctl.isForbidden(scriptLibResource, QueryAction) {
+		return
+	}
+	list, err := scriptlib.ListScriptLib()
+	if err != nil {
+		ctl.RespError(err)
+		return
+	}
+	ctl.RespOkData(list)
+}
+
+// 新增脚本库
+func (a *scriptLibApi) add(w http.ResponseWriter, r *http.Request) {
+	ctl := NewAuthController(w, r)
+	if ctl.isForbidden(scriptLibResource, CretaeAction) {
+		return
+	}
+	var ob models.ScriptLib
+	if ctl.IsNotClusterRequest() {
+		if err := ctl.BindJSON(&ob); err != nil {
+			ctl.RespError(err)
+			return
+		}
+		old, err := scriptlib.GetScriptLib(ctl.Param("name"), 0)
+		if err != nil {
+			ctl.RespError(err)
+			return
+		}
+		if old != nil {
+			ctl.RespError(fmt.Errorf("脚本库[%s]已存在", ctl.Param("name")))
+			return
+		}
+	}
+	ob.Name = ctl.Param("name")
+	a.save(ctl, &ob)
+}
+
+// 保存脚本库的新版本
+func (a *scriptLibApi) update(w http.ResponseWriter, r *http.Request) {
+	ctl := NewAuthController(w, r)
+	if ctl.isForbidden(scriptLibResource, SaveAction) {
+		return
+	}
+	var ob models.ScriptLib
+	if ctl.IsNotClusterRequest() {
+		if err := ctl.BindJSON(&ob); err != nil {
+			ctl.RespError(err)
+			return
+		}
+		old, err := scriptlib.GetScriptLib(ctl.Param("name"), 0)
+		if err != nil {
+			ctl.RespError(err)
+			return
+		}
+		if old == nil {
+			ctl.RespError(errors.New("脚本库不存在"))
+			return
+		}
+	}
+	ob.Name = ctl.Param("name")
+	a.save(ctl, &ob)
+}
+
+// 保存后注册到编解码并重新编译依赖该库的产品脚本, 集群请求没有请求体, 从数据库加载
+func (a *scriptLibApi) save(ctl *AuthController, ob *models.ScriptLib) {
+	if ctl.IsNotClusterRequest() {
+		if len(strings.TrimSpace(ob.Script)) == 0 {
+			ctl.RespError(errors.New("脚本不能为空"))
+			return
+		}
+		if err := codec.CheckScriptLib(ob.Name, ob.Script); err != nil {
+			ctl.RespError(err)
+			return
+		}
+		ob.CreateId = ctl.GetCurrentUser().Id
+		if err := scriptlib.AddScriptLib(ob); err != nil {
+			ctl.RespError(err)
+			return
+		}
+		cluster.BroadcastInvoke(ctl.Request)
+	}
+	lib, err := scriptlib.GetScriptLib(ob.Name, 0)
+	if err != nil {
+		ctl.RespError(err)
+		return
+	}
+	if lib == nil {
+		ctl.RespError(errors.New("脚本库不存在"))
+		return
+	}
+	if err = codec.RegScriptLib(lib.Name, lib.Version, lib.Script); err != nil {
+		ctl.RespError(err)
+		return
+	}
+	products, err := codec.RecompileDependents(lib.Name)
+	result := map[string]any{
+		"version":    lib.Version,
+		"recompiled": products,
+	}
+	if err != nil {
+		result["error"] = err.Error()
+	}
+	ctl.RespOkData(result)
+}
+
+// 获取脚本库, 默认最新版本
+func (a *scriptLibApi) get(w http.ResponseWriter, r *http.Request) {
+	ctl := NewAuthController(w, r)
+	if ctl.isForbidden(scriptLibResource, QueryAction) {
+		return
+	}
+	var version int
+	var err error
+	if v := ctl.Query("version"); len(v) > 0 {
+		version, err = strconv.Atoi(v)
+		if err != nil {
+			ctl.RespErrorParam("version")
+			return
+		}
+	}
+	ob, err := scriptlib.GetScriptLib(ctl.Param("name"), version)
+	if err != nil {
+		ctl.RespError(err)
+		return
+	}
+	if ob == nil {
+		ctl.RespError(errors.New("脚本库不存在"))
+		return
+	}
+	ctl.RespOkData(ob)
+}
+
+// 脚本库的版本列表
+func (a *scriptLibApi) versions(w http.ResponseWriter, r *http.Request) {
+	ctl := NewAuthController(w, r)
+	if ctl.isForbidden(scriptLibResource, QueryAction) {
+		return
+	}
+	list, err := scriptlib.ListScriptLibVersions(ctl.Param("name"))
+	if err != nil {
+		ctl.RespError(err)
+		return
+	}
+	ctl.RespOkData(list)
+}
+
+// 删除脚本库, 被产品或其它脚本库引用时不能删除
+func (a *scriptLibApi) delete(w http.ResponseWriter, r *http.Request) {
+	ctl := NewAuthController(w, r)
+	if ctl.isForbidden(scriptLibResource, DeleteAction) {
+		return
+	}
+	name := ctl.Param("name")
+	if ctl.IsNotClusterRequest() {
+		scripts, err := product.ListAllProductScripts()
+		if err != nil {
+			ctl.RespError(err)
+			return
+		}
+		products, others := codec.ScriptLibUsedBy(name, scripts)
+		if len(products) > 0 {
+			ctl.RespError(fmt.Errorf("脚本库被产品[%s]引用", strings.Join(products, ",")))
+			return
+		}
+		if len(others) > 0 {
+			ctl.RespError(fmt.Errorf("脚本库被脚本库[%s]引用", strings.Join(others, ",")))
+			return
+		}
+		if err := scriptlib.DeleteScriptLib(name); err != nil {
+			ctl.RespError(err)
+			return
+		}
+		cluster.BroadcastInvoke(ctl.Request)
+	}
+	codec.RemoveScriptLib(name)
+	ctl.RespOk()
+}
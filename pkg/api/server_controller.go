@@ -52,15 +52,6 @@ func init() {
 			ctl.RespError(err)
 			return
 		}
-		nw, err := network.GetNetworkByPort(ob.Port)
-		if err != nil {
-			ctl.RespError(err)
-			return
-		}
-		if nw != nil {
-			ctl.RespError(errors.New("端口已被使用，请更换"))
-			return
-		}
 		err = network.AddNetWork(&ob)
 		if err != nil {
 			ctl.RespError(err)
@@ -80,13 +71,15 @@ func init() {
 			ctl.RespError(err)
 			return
 		}
-		nw, err := network.GetNetworkByPort(ob.Port)
+		old, err := network.GetNetwork(ob.Id)
 		if err != nil {
 			ctl.RespError(err)
 			return
 		}
-		if nw != nil && nw.Id != ob.Id {
-			ctl.RespError(errors.New("端口已被使用，请更换"))
+		ob.Type = old.Type
+		err = network.CheckPort(&ob)
+		if err != nil {
+			ctl.RespError(err)
 			return
 		}
 		err = network.UpdateNetwork(&models.Network{Id: ob.Id, Port: ob.Port})
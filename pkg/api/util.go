@@ -17,16 +17,22 @@ func convertCodecNetwork(nw models.Network) (network.NetworkConf, error) {
 	if err != nil {
 		return network.NetworkConf{}, err
 	}
+	script, err := loadScriptRelease(nw.ProductId, pro.Script)
+	if err != nil {
+		return network.NetworkConf{}, err
+	}
 	config := network.NetworkConf{
 		Name:          nw.Name,
 		Port:          nw.Port,
 		ProductId:     nw.ProductId,
 		Configuration: nw.Configuration,
-		Script:        pro.Script,
+		Script:        script,
 		Type:          nw.Type,
 		CodecId:       pro.CodecId,
 		CertBase64:    nw.CertBase64,
 		KeyBase64:     nw.KeyBase64,
+		CaBase64:      nw.CaBase64,
+		CrlBase64:     nw.CrlBase64,
 	}
 	return config, nil
 }
@@ -0,0 +1,278 @@
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	logs "go-iot/pkg/logger"
+
+	"github.com/dop251/goja"
+)
+
+var (
+	libNamePattern = regexp.MustCompile(`^[A-Za-z][\w\-.]*$`)
+	// require("name")或require("name@version")
+	requirePattern = regexp.MustCompile(`require\(\s*["']([A-Za-z][\w\-.]*)(?:@(\d+))?["']\s*\)`)
+)
+
+var libs = &libRegistry{m: map[string]map[int]*scriptLib{}}
+
+// 编译后的脚本库
+type scriptLib struct {
+	name    string
+	version int
+	program *goja.Program
+	deps    []string
+}
+
+type libRegistry struct {
+	sync.RWMutex
+	m map[string]map[int]*scriptLib
+}
+
+// version为0时获取最新版本
+func (r *libRegistry) get(name string, version int) (*scriptLib, error) {
+	r.RLock()
+	defer r.RUnlock()
+	versions, ok := r.m[name]
+	if ok && version > 0 {
+		if lib, ok := versions[version]; ok {
+			return lib, nil
+		}
+	} else if ok {
+		var latest *scriptLib
+		for _, lib := range versions {
+			if latest == nil || lib.version > latest.version {
+				latest = lib
+			}
+		}
+		if latest != nil {
+			return latest, nil
+		}
+	}
+	if version > 0 {
+		return nil, fmt.Errorf("script lib [%s@%d] not found", name, version)
+	}
+	return nil, fmt.Errorf("script lib [%s] not found", name)
+}
+
+// 库的所有版本依赖的库名
+func (r *libRegistry) deps(name string) []string {
+	r.RLock()
+	defer r.RUnlock()
+	var deps []string
+	for _, lib := range r.m[name] {
+		deps = append(deps, lib.deps...)
+	}
+	return deps
+}
+
+// 从deps出发到target的引用路径, 不能到达时返回nil
+func (r *libRegistry) findPath(target string, deps []string, path []string) []string {
+	for _, dep := range deps {
+		p := append(append([]string{}, path...), dep)
+		if dep == target {
+			return p
+		}
+		if contains(path, dep) {
+			continue
+		}
+		if found := r.findPath(target, r.deps(dep), p); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// 脚本中require的库名
+func ScriptDependencies(script string) []string {
+	var deps []string
+	for _, m := range requirePattern.FindAllStringSubmatch(script, -1) {
+		if !contains(deps, m[1]) {
+			deps = append(deps, m[1])
+		}
+	}
+	return deps
+}
+
+// 编译脚本库并检查循环引用
+func compileScriptLib(name string, version int, script string) (*scriptLib, error) {
+	if !libNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("script lib name [%s] is invalid", name)
+	}
+	if version <= 0 {
+		return nil, errors.New("script lib version must be present")
+	}
+	deps := ScriptDependencies(script)
+	if cycle := libs.findPath(name, deps, []string{name}); cycle != nil {
+		return nil, fmt.Errorf("circular import: %s", strings.Join(cycle, " -> "))
+	}
+	// 按CommonJS模块包装, 行号与库脚本一致
+	program, err := goja.Compile(name+".js", "(function(exports, require, module) {"+script+"\n})", false)
+	if err != nil {
+		return nil, err
+	}
+	return &scriptLib{name: name, version: version, program: program, deps: deps}, nil
+}
+
+// 检查脚本库能否注册
+func CheckScriptLib(name string, script string) error {
+	_, err := compileScriptLib(name, 1, script)
+	return err
+}
+
+// 注册脚本库的版本
+func RegScriptLib(name string, version int, script string) error {
+	lib, err := compileScriptLib(name, version, script)
+	if err != nil {
+		return err
+	}
+	libs.Lock()
+	defer libs.Unlock()
+	if _, ok := libs.m[name]; !ok {
+		libs.m[name] = map[int]*scriptLib{}
+	}
+	libs.m[name][version] = lib
+	return nil
+}
+
+// 删除脚本库的所有版本
+func RemoveScriptLib(name string) {
+	libs.Lock()
+	defer libs.Unlock()
+	delete(libs.m, name)
+}
+
+// 直接或间接依赖脚本库的产品与其它脚本库, scripts为产品保存的脚本与脚本版本
+func ScriptLibUsedBy(name string, scripts map[string][]string) (products []string, others []string) {
+	libs.RLock()
+	var names []string
+	for n := range libs.m {
+		names = append(names, n)
+	}
+	libs.RUnlock()
+	for _, n := range names {
+		if n != name && libs.findPath(name, libs.deps(n), []string{n}) != nil {
+			others = append(others, n)
+		}
+	}
+	for productId, list := range scripts {
+		for _, script := range list {
+			if dependsOn(script, name) {
+				products = append(products, productId)
+				break
+			}
+		}
+	}
+	sort.Strings(products)
+	sort.Strings(others)
+	return products, others
+}
+
+// 重新编译依赖脚本库的产品编解码, 返回重新编译的产品
+func RecompileDependents(name string) ([]string, error) {
+	var products []string
+	var errs []error
+	scriptCodecs.Range(func(key, value any) bool {
+		c := value.(*ScriptCodec)
+		if !c.dependsOn(name) {
+			return true
+		}
+		if err := c.recompile(); err != nil {
+			logs.Errorf("recompile product [%s] script error: %v", key, err)
+			errs = append(errs, fmt.Errorf("product [%s]: %v", key, err))
+			return true
+		}
+		products = append(products, key.(string))
+		return true
+	})
+	sort.Strings(products)
+	return products, errors.Join(errs...)
+}
+
+// 脚本是否直接或间接依赖脚本库
+func dependsOn(script string, name string) bool {
+	deps := ScriptDependencies(script)
+	return contains(deps, name) || libs.findPath(name, deps, nil) != nil
+}
+
+// 每个引擎的require, 模块在引擎内只执行一次
+func newRequire(vm *goja.Runtime) goja.Value {
+	type module struct {
+		value   *goja.Object
+		loading bool
+	}
+	modules := map[string]*module{}
+	var require goja.Value
+	require = vm.ToValue(func(call goja.FunctionCall) goja.Value {
+		spec := call.Argument(0).String()
+		name, version := spec, 0
+		if i := strings.LastIndex(spec, "@"); i > 0 {
+			v, err := strconv.Atoi(spec[i+1:])
+			if err != nil {
+				panic(vm.NewTypeError("script lib version is invalid: %s", spec))
+			}
+			name, version = spec[:i], v
+		}
+		lib, err := libs.get(name, version)
+		if err != nil {
+			panic(vm.NewGoError(err))
+		}
+		key := fmt.Sprintf("%s@%d", lib.name, lib.version)
+		if m, ok := modules[key]; ok {
+			if m.loading {
+				panic(vm.NewGoError(fmt.Errorf("circular import: %s", key)))
+			}
+			return m.value.Get("exports")
+		}
+		m := &module{value: vm.NewObject(), loading: true}
+		exports := vm.NewObject()
+		m.value.Set("exports", exports)
+		modules[key] = m
+		defer func() {
+			m.loading = false
+		}()
+		wrapper, err := vm.RunProgram(lib.program)
+		if err != nil {
+			delete(modules, key)
+			if interrupt(vm, err) {
+				return goja.Undefined()
+			}
+			panic(vm.NewGoError(err))
+		}
+		fn, _ := goja.AssertFunction(wrapper)
+		if _, err = fn(goja.Undefined(), exports, require, m.value); err != nil {
+			delete(modules, key)
+			if interrupt(vm, err) {
+				return goja.Undefined()
+			}
+			panic(vm.NewGoError(fmt.Errorf("require %s error: %v", key, err)))
+		}
+		return m.value.Get("exports")
+	})
+	return require
+}
+
+// 库的执行被中断(超时等)时用同样的值中断调用的脚本, 中断不能被脚本捕获, 也不转为普通错误
+func interrupt(vm *goja.Runtime, err error) bool {
+	var interrupted *goja.InterruptedError
+	if !errors.As(err, &interrupted) {
+		return false
+	}
+	vm.Interrupt(interrupted.Value())
+	return true
+}
+
+func contains(list []string, v string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
@@ -5,14 +5,108 @@ import (
 	"fmt"
 	"go-iot/pkg/core"
 	logs "go-iot/pkg/logger"
+	"go-iot/pkg/option"
+	"runtime/metrics"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/dop251/goja"
 )
 
+var (
+	ErrVmPoolBusy    = errors.New("script engine pool is busy, no free vm")
+	ErrScriptTimeout = errors.New("script execution timeout")
+	ErrScriptMemory  = errors.New("script execution exceeds memory limit")
+)
+
+// 产品配置中的脚本执行限制
+const (
+	ConfigPoolSize    = "scriptPoolSize"    // 引擎池大小
+	ConfigTimeout     = "scriptTimeout"     // 单次执行超时(毫秒)
+	ConfigWaitTimeout = "scriptWaitTimeout" // 等待空闲引擎超时(毫秒)
+	ConfigMaxStack    = "scriptMaxStack"    // 最大调用栈深度
+)
+
+const (
+	defaultPoolSize    = 20
+	defaultTimeout     = 5 * time.Second
+	defaultWaitTimeout = 3 * time.Second
+	defaultMaxStack    = 10000
+	// 超时检查间隔
+	watchInterval = 10 * time.Millisecond
+	// 内存检查间隔
+	memoryCheckInterval = 100 * time.Millisecond
+)
+
+// 进程堆内存上限, 0表示不限制
+// goja不统计单个引擎的内存, 这是全局熔断, 超过时中断所有产品执行中的脚本, 不是产品的内存限制
+var maxHeapMemory atomic.Uint64
+
+// 配置脚本执行的全局限制
+func Config(opt *option.Options) {
+	maxHeapMemory.Store(uint64(opt.ScriptMaxHeapMemory) << 20)
+}
+
+// 脚本执行限制, 0表示不限制
+type VmLimit struct {
+	PoolSize    int
+	Timeout     time.Duration
+	WaitTimeout time.Duration
+	MaxStack    int
+}
+
+// 默认限制
+func DefaultVmLimit() VmLimit {
+	return VmLimit{
+		PoolSize:    defaultPoolSize,
+		Timeout:     defaultTimeout,
+		WaitTimeout: defaultWaitTimeout,
+		MaxStack:    defaultMaxStack,
+	}
+}
+
+// 读取产品配置的执行限制, 未配置的使用默认值
+func VmLimitFromProduct(productId string) (VmLimit, error) {
+	limit := DefaultVmLimit()
+	product := core.GetProduct(productId)
+	if product == nil {
+		return limit, nil
+	}
+	atoi := func(key string, f func(int)) error {
+		str := product.GetConfig(key)
+		if len(str) == 0 {
+			return nil
+		}
+		v, err := strconv.Atoi(str)
+		if err != nil || v < 0 {
+			return fmt.Errorf("product config %s must be a non-negative integer", key)
+		}
+		f(v)
+		return nil
+	}
+	for _, err := range []error{
+		atoi(ConfigPoolSize, func(v int) { limit.PoolSize = v }),
+		atoi(ConfigTimeout, func(v int) { limit.Timeout = time.Duration(v) * time.Millisecond }),
+		atoi(ConfigWaitTimeout, func(v int) { limit.WaitTimeout = time.Duration(v) * time.Millisecond }),
+		atoi(ConfigMaxStack, func(v int) { limit.MaxStack = v }),
+	} {
+		if err != nil {
+			return limit, err
+		}
+	}
+	if limit.PoolSize == 0 {
+		limit.PoolSize = defaultPoolSize
+	}
+	return limit, nil
+}
+
 // javascript vm pool
 type VmPool struct {
 	chVM      chan *goja.Runtime
 	productId string
+	limit     VmLimit
 }
 
 // 创建js引擎池
@@ -22,6 +116,14 @@ func NewVmPool(src string, size int) (*VmPool, error) {
 
 // 创建js引擎池
 func NewVmPool1(src string, size int, productId string) (*VmPool, error) {
+	limit := DefaultVmLimit()
+	limit.PoolSize = size
+	return NewVmPoolWithLimit(src, productId, limit)
+}
+
+// 创建带执行限制的js引擎池
+func NewVmPoolWithLimit(src string, productId string, limit VmLimit) (*VmPool, error) {
+	size := limit.PoolSize
 	if len(src) == 0 {
 		return nil, errors.New("script must be present")
 	}
@@ -29,27 +131,49 @@ func NewVmPool1(src string, size int, productId string) (*VmPool, error) {
 	if err != nil {
 		return nil, err
 	}
-	p := VmPool{chVM: make(chan *goja.Runtime, size), productId: productId}
+	p := VmPool{chVM: make(chan *goja.Runtime, size), productId: productId, limit: limit}
 	for i := 0; i < size; i++ {
-		vm := goja.New()
-		_, err := vm.RunProgram(program)
-		if err != nil {
-			return nil, err
-		}
-		console := vm.NewObject()
-		console.Set("log", func(v ...interface{}) {
+		vm, err := newVm(program, &globe{productId: productId}, limit, func(v ...interface{}) {
 			logs.Debugf("%v", v...)
 			if p.productId != "" {
 				core.DebugLog("", p.productId, fmt.Sprintf("%v", v...))
 			}
 		})
-		vm.Set("console", console)
-		vm.Set("globe", &globe{vm: vm, productId: productId})
+		if err != nil {
+			return nil, err
+		}
 		p.Put(vm)
 	}
 	return &p, nil
 }
 
+// 创建js引擎并执行脚本, log为console.log的输出, 脚本顶层代码同样受执行限制
+func newVm(program *goja.Program, g *globe, limit VmLimit, log func(v ...interface{})) (*goja.Runtime, error) {
+	vm := goja.New()
+	g.vm = vm
+	if limit.MaxStack > 0 {
+		vm.SetMaxCallStackSize(limit.MaxStack)
+	}
+	console := vm.NewObject()
+	console.Set("log", log)
+	vm.Set("console", console)
+	vm.Set("globe", g)
+	vm.Set("require", newRequire(vm))
+	w := watch(vm, limit)
+	_, err := vm.RunProgram(program)
+	w.stop()
+	if err != nil {
+		var interrupted *goja.InterruptedError
+		if errors.As(err, &interrupted) {
+			if e, ok := interrupted.Value().(error); ok {
+				err = e
+			}
+		}
+		return nil, err
+	}
+	return vm, nil
+}
+
 func (p *VmPool) SetProductId(productId string) {
 	p.productId = productId
 }
@@ -59,6 +183,30 @@ func (p *VmPool) Get() *goja.Runtime {
 	return vm
 }
 
+// 获取引擎, 超过等待时间返回ErrVmPoolBusy
+func (p *VmPool) GetTimeout(timeout time.Duration) (*goja.Runtime, error) {
+	if timeout <= 0 {
+		return p.Get(), nil
+	}
+	select {
+	case vm := <-p.chVM:
+		return vm, nil
+	default:
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case vm := <-p.chVM:
+		return vm, nil
+	case <-timer.C:
+		return nil, ErrVmPoolBusy
+	}
+}
+
+func (p *VmPool) Limit() VmLimit {
+	return p.limit
+}
+
 func (p *VmPool) Put(vm *goja.Runtime) {
 	p.chVM <- vm
 }
@@ -66,3 +214,86 @@ func (p *VmPool) Put(vm *goja.Runtime) {
 func (p *VmPool) Close() {
 	close(p.chVM)
 }
+
+// 监控脚本执行, 超时时中断该引擎
+type watchdog struct {
+	vm       *goja.Runtime
+	deadline time.Time // 为零时不限制执行时间
+}
+
+// 执行中的脚本, 共用一个定时器检查超时, 没有执行中的脚本时定时器停止
+var watchdogs = struct {
+	sync.Mutex
+	running map[*watchdog]bool
+	ticking bool
+}{running: map[*watchdog]bool{}}
+
+// 开始监控, 无限制时返回nil
+func watch(vm *goja.Runtime, limit VmLimit) *watchdog {
+	if limit.Timeout <= 0 && maxHeapMemory.Load() == 0 {
+		return nil
+	}
+	w := &watchdog{vm: vm}
+	if limit.Timeout > 0 {
+		w.deadline = time.Now().Add(limit.Timeout)
+	}
+	watchdogs.Lock()
+	watchdogs.running[w] = true
+	if !watchdogs.ticking {
+		watchdogs.ticking = true
+		go tick()
+	}
+	watchdogs.Unlock()
+	return w
+}
+
+// 结束监控, 清除中断状态后引擎可以放回池中
+func (w *watchdog) stop() {
+	if w == nil {
+		return
+	}
+	watchdogs.Lock()
+	delete(watchdogs.running, w)
+	watchdogs.Unlock()
+	w.vm.ClearInterrupt()
+}
+
+// 中断超时的引擎; 进程堆内存超过上限时作为全局熔断中断所有执行中的脚本
+func tick() {
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	lastMemoryCheck := time.Now()
+	for now := range ticker.C {
+		overMemory := false
+		if maxMemory := maxHeapMemory.Load(); maxMemory > 0 && now.Sub(lastMemoryCheck) >= memoryCheckInterval {
+			lastMemoryCheck = now
+			overMemory = heapBytes() > maxMemory
+		}
+		watchdogs.Lock()
+		for w := range watchdogs.running {
+			if overMemory {
+				w.vm.Interrupt(ErrScriptMemory)
+				delete(watchdogs.running, w)
+			} else if !w.deadline.IsZero() && now.After(w.deadline) {
+				w.vm.Interrupt(ErrScriptTimeout)
+				delete(watchdogs.running, w)
+			}
+		}
+		if len(watchdogs.running) == 0 {
+			watchdogs.ticking = false
+			watchdogs.Unlock()
+			return
+		}
+		watchdogs.Unlock()
+	}
+}
+
+// 进程堆内存, 读取metrics不会stop the world
+func heapBytes() uint64 {
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return sample[0].Value.Uint64()
+}
@@ -0,0 +1,93 @@
+package codec
+
+import (
+	"encoding/json"
+	"fmt"
+	"go-iot/pkg/core"
+	"hash/fnv"
+	"sync"
+)
+
+// 记录脚本版本的日志类型
+const LogTypeScript = "script"
+
+var releases sync.Map
+
+// 产品脚本的发布信息, 灰度版本只处理选中的设备
+type ScriptRelease struct {
+	Version       int
+	CanaryVersion int // 0表示没有灰度
+	CanaryScript  string
+	CanaryDevices []string
+	CanaryPercent int
+}
+
+// 设置产品的发布信息, 下次创建编解码时生效, nil时清除
+func SetScriptRelease(productId string, r *ScriptRelease) {
+	if r == nil {
+		releases.Delete(productId)
+		return
+	}
+	releases.Store(productId, r)
+}
+
+func GetScriptRelease(productId string) *ScriptRelease {
+	val, ok := releases.Load(productId)
+	if !ok {
+		return nil
+	}
+	return val.(*ScriptRelease)
+}
+
+// 设备是否使用灰度版本, 按比例灰度时同一设备的结果固定
+func (r *ScriptRelease) IsCanary(deviceId string) bool {
+	if r.CanaryVersion <= 0 || len(deviceId) == 0 {
+		return false
+	}
+	for _, id := range r.CanaryDevices {
+		if id == deviceId {
+			return true
+		}
+	}
+	if r.CanaryPercent <= 0 {
+		return false
+	}
+	h := fnv.New32a()
+	h.Write([]byte(deviceId))
+	return int(h.Sum32()%100) < r.CanaryPercent
+}
+
+// 检查脚本能否编译
+func CheckScript(script string) error {
+	_, err := NewVmPool(script, 1)
+	return err
+}
+
+// 设备最近记录的脚本版本
+var loggedVersions sync.Map
+
+// 保存处理消息的脚本版本到设备日志, 只在设备的脚本版本变化或执行出错时保存
+func saveScriptLog(productId, deviceId, name string, version int, canary bool, err error) {
+	product := core.GetProduct(productId)
+	if product == nil || len(deviceId) == 0 {
+		return
+	}
+	if last, ok := loggedVersions.Swap(deviceId, version); ok && last == version && err == nil {
+		return
+	}
+	content := map[string]any{
+		"function": name,
+		"version":  version,
+		"canary":   canary,
+	}
+	if err != nil {
+		content["error"] = err.Error()
+	}
+	b, _ := json.Marshal(content)
+	product.GetTimeSeries().SaveLogs(product, core.LogData{
+		Type:     LogTypeScript,
+		DeviceId: deviceId,
+		Content:  string(b),
+	})
+	core.DebugLog(deviceId, productId, fmt.Sprintf("script version %d handled %s", version, name))
+}
@@ -0,0 +1,609 @@
+package codec
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"go-iot/pkg/core"
+	"go-iot/pkg/util"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+// 调试时脚本的文件名, 错误信息中的行号以此定位
+const sandboxScriptName = "script.js"
+
+var sandboxFunctions = []string{OnConnect, OnMessage, OnInvoke, On_State_Checker}
+
+var (
+	syntaxErrPos    = regexp.MustCompile(`Line (\d+):(\d+)`)
+	exceptionErrPos = regexp.MustCompile(regexp.QuoteMeta(sandboxScriptName) + `:(\d+):(\d+)`)
+)
+
+// 脚本调试请求, 草稿脚本在独立的引擎中执行, 不保存任何数据
+type SandboxRequest struct {
+	Script     string            `json:"script"`
+	Function   string            `json:"function"` // OnConnect, OnMessage, OnInvoke, OnStateChecker
+	DeviceId   string            `json:"deviceId"`
+	Payload    string            `json:"payload"`
+	PayloadHex bool              `json:"payloadHex"` // payload为16进制字符串
+	Topic      string            `json:"topic"`      // mqtt主题
+	ClientId   string            `json:"clientId"`
+	Username   string            `json:"username"`
+	Url        string            `json:"url"` // http, websocket, coap的请求地址
+	Headers    map[string]string `json:"headers"`
+	FunctionId string            `json:"functionId"` // OnInvoke的功能id
+	Data       map[string]any    `json:"data"`       // OnInvoke的参数
+}
+
+// 脚本调试结果
+type SandboxResult struct {
+	Success    bool             `json:"success"`
+	Result     any              `json:"result,omitempty"` // 函数返回值
+	Properties []map[string]any `json:"properties"`
+	Events     []map[string]any `json:"events"`
+	Calls      []SandboxCall    `json:"calls"` // 按顺序记录的下发, 回复, 上下线等调用
+	Logs       []string         `json:"logs"`
+	Error      *SandboxError    `json:"error,omitempty"`
+	Cost       int64            `json:"cost"` // 毫秒
+}
+
+type SandboxCall struct {
+	Method string `json:"method"`
+	Args   []any  `json:"args"`
+}
+
+type SandboxError struct {
+	Message string `json:"message"`
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+}
+
+// 在独立的引擎中执行脚本函数, 使用产品的执行限制
+func RunSandbox(productId string, req SandboxRequest) (*SandboxResult, error) {
+	if !isSandboxFunction(req.Function) {
+		return nil, fmt.Errorf("function must be one of %s", strings.Join(sandboxFunctions, ", "))
+	}
+	if len(strings.TrimSpace(req.Script)) == 0 {
+		return nil, errors.New("script must be present")
+	}
+	var data []byte
+	if req.PayloadHex {
+		b, err := hex.DecodeString(strings.ReplaceAll(req.Payload, " ", ""))
+		if err != nil {
+			return nil, fmt.Errorf("payload is not hex: %v", err)
+		}
+		data = b
+	} else {
+		data = []byte(req.Payload)
+	}
+	limit, err := VmLimitFromProduct(productId)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &SandboxResult{
+		Properties: []map[string]any{},
+		Events:     []map[string]any{},
+		Calls:      []SandboxCall{},
+		Logs:       []string{},
+	}
+	start := time.Now()
+	defer func() {
+		result.Cost = time.Since(start).Milliseconds()
+	}()
+	program, err := goja.Compile(sandboxScriptName, req.Script, false)
+	if err != nil {
+		result.Error = toSandboxError(err)
+		return result, nil
+	}
+	ctx := &sandboxContext{
+		DeviceId:  req.DeviceId,
+		ProductId: productId,
+		req:       req,
+		data:      data,
+		result:    result,
+	}
+	ctx.session = &sandboxSession{ctx: ctx}
+	g := &globe{productId: productId, httpRequest: ctx.httpRequest}
+	vm, err := newVm(program, g, limit, func(v ...interface{}) {
+		ctx.log(fmt.Sprint(v...))
+	})
+	if err != nil {
+		result.Error = toSandboxError(err)
+		return result, nil
+	}
+	fn, ok := goja.AssertFunction(vm.Get(req.Function))
+	if !ok {
+		result.Error = &SandboxError{Message: core.ErrFunctionNotImpl.Error()}
+		return result, nil
+	}
+	w := watch(vm, limit)
+	resp, err := sandboxCall(fn, vm.ToValue(ctx))
+	w.stop()
+	if err != nil {
+		result.Error = toSandboxError(err)
+		return result, nil
+	}
+	if resp != nil && !goja.IsUndefined(resp) && !goja.IsNull(resp) {
+		result.Result = resp.Export()
+	}
+	result.Success = true
+	return result, nil
+}
+
+func sandboxCall(fn goja.Callable, ctx goja.Value) (resp goja.Value, err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("%v", rec)
+		}
+	}()
+	resp, err = fn(goja.Undefined(), ctx)
+	var interrupted *goja.InterruptedError
+	if errors.As(err, &interrupted) {
+		if e, ok := interrupted.Value().(error); ok {
+			err = e
+		}
+	}
+	return resp, err
+}
+
+func isSandboxFunction(name string) bool {
+	for _, v := range sandboxFunctions {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// 从编译或执行错误中取出行号
+func toSandboxError(err error) *SandboxError {
+	e := &SandboxError{Message: err.Error()}
+	var pos []string
+	var exception *goja.Exception
+	if errors.As(err, &exception) {
+		pos = exceptionErrPos.FindStringSubmatch(err.Error())
+	} else {
+		pos = syntaxErrPos.FindStringSubmatch(err.Error())
+	}
+	if len(pos) == 3 {
+		e.Line, _ = strconv.Atoi(pos[1])
+		e.Column, _ = strconv.Atoi(pos[2])
+	}
+	return e
+}
+
+// 调试用的上下文, 提供各网络类型上下文的方法, 只记录调用
+type sandboxContext struct {
+	sync.Mutex
+	DeviceId  string
+	ProductId string
+	req       SandboxRequest
+	data      []byte
+	session   *sandboxSession
+	result    *SandboxResult
+	devices   map[string]*sandboxDevice
+}
+
+func (ctx *sandboxContext) log(msg string) {
+	ctx.Lock()
+	defer ctx.Unlock()
+	ctx.result.Logs = append(ctx.result.Logs, msg)
+}
+
+func (ctx *sandboxContext) call(method string, args ...any) {
+	ctx.Lock()
+	defer ctx.Unlock()
+	if args == nil {
+		args = []any{}
+	}
+	ctx.result.Calls = append(ctx.result.Calls, SandboxCall{Method: method, Args: args})
+}
+
+func (ctx *sandboxContext) GetMessage() interface{} {
+	if ctx.req.Function == OnInvoke {
+		return core.FuncInvoke{
+			FunctionId: ctx.req.FunctionId,
+			DeviceId:   ctx.DeviceId,
+			Data:       ctx.req.Data,
+		}
+	}
+	return ctx.data
+}
+
+func (ctx *sandboxContext) MsgToString() string {
+	return string(ctx.data)
+}
+
+func (ctx *sandboxContext) MsgToHexStr() string {
+	return hex.EncodeToString(ctx.data)
+}
+
+func (ctx *sandboxContext) IsTextMessage() bool {
+	return !ctx.req.PayloadHex
+}
+
+func (ctx *sandboxContext) IsBinaryMessage() bool {
+	return ctx.req.PayloadHex
+}
+
+func (ctx *sandboxContext) Topic() string {
+	return ctx.req.Topic
+}
+
+func (ctx *sandboxContext) MessageID() uint16 {
+	return 0
+}
+
+func (ctx *sandboxContext) GetClientId() string {
+	return ctx.req.ClientId
+}
+
+func (ctx *sandboxContext) GetUserName() string {
+	return ctx.req.Username
+}
+
+func (ctx *sandboxContext) GetHeader(key string) string {
+	for k, v := range ctx.req.Headers {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+	return ""
+}
+
+func (ctx *sandboxContext) GetUrl() string {
+	return ctx.req.Url
+}
+
+func (ctx *sandboxContext) GetQuery(key string) string {
+	u, err := url.Parse(ctx.req.Url)
+	if err != nil {
+		return ""
+	}
+	return u.Query().Get(key)
+}
+
+func (ctx *sandboxContext) GetForm(key string) string {
+	form, err := url.ParseQuery(string(ctx.data))
+	if err != nil {
+		return ""
+	}
+	return form.Get(key)
+}
+
+func (ctx *sandboxContext) GetSession() core.Session {
+	return ctx.session
+}
+
+func (ctx *sandboxContext) GetDevice() *sandboxDevice {
+	return ctx.GetDeviceById(ctx.DeviceId)
+}
+
+// 返回设备的副本, 未保存的设备返回只有id的设备
+func (ctx *sandboxContext) GetDeviceById(deviceId string) *sandboxDevice {
+	if len(deviceId) == 0 {
+		return nil
+	}
+	ctx.Lock()
+	defer ctx.Unlock()
+	if device, ok := ctx.devices[deviceId]; ok {
+		return device
+	}
+	device := core.GetDevice(deviceId)
+	if device == nil {
+		device = core.NewDevice(deviceId, ctx.ProductId, 0)
+	}
+	d := &sandboxDevice{
+		Id:         device.Id,
+		ProductId:  device.ProductId,
+		ParentId:   device.ParentId,
+		DeviceType: device.DeviceType,
+		Name:       device.Name,
+		config:     map[string]string{},
+		data:       map[string]string{},
+		ctx:        ctx,
+	}
+	for k, v := range device.Config {
+		d.config[k] = v
+	}
+	if ctx.devices == nil {
+		ctx.devices = map[string]*sandboxDevice{}
+	}
+	ctx.devices[deviceId] = d
+	return d
+}
+
+func (ctx *sandboxContext) GetChildDevice(childId string) *sandboxDevice {
+	return ctx.GetDeviceById(childId)
+}
+
+func (ctx *sandboxContext) GetProduct() *core.Product {
+	if product := core.GetProduct(ctx.ProductId); product != nil {
+		return product
+	}
+	return &core.Product{Id: ctx.ProductId, Config: map[string]string{}}
+}
+
+func (ctx *sandboxContext) GetConfig(key string) string {
+	device := ctx.GetDevice()
+	if device == nil {
+		return ""
+	}
+	return device.GetConfig(key)
+}
+
+func (ctx *sandboxContext) GetReadProperties() []string {
+	var ids []string
+	if v, ok := ctx.req.Data["properties"].([]any); ok {
+		for _, id := range v {
+			ids = append(ids, fmt.Sprintf("%v", id))
+		}
+	}
+	return ids
+}
+
+func (ctx *sandboxContext) GetChildDeviceId() string {
+	return ""
+}
+
+func (ctx *sandboxContext) DeviceOnline(deviceId string) {
+	ctx.DeviceId = deviceId
+	ctx.call("DeviceOnline", deviceId)
+}
+
+func (ctx *sandboxContext) DeviceOffline(deviceId string) {
+	ctx.call("DeviceOffline", deviceId)
+}
+
+func (ctx *sandboxContext) ChildDeviceOnline(childId string) {
+	ctx.call("ChildDeviceOnline", childId)
+}
+
+func (ctx *sandboxContext) ChildDeviceOffline(childId string) {
+	ctx.call("ChildDeviceOffline", childId)
+}
+
+func (ctx *sandboxContext) AuthFail() {
+	ctx.call("AuthFail")
+}
+
+func (ctx *sandboxContext) SaveProperties(data map[string]any) {
+	ctx.saveProperties(ctx.DeviceId, data)
+}
+
+func (ctx *sandboxContext) SaveChildProperties(childId string, data map[string]any) {
+	ctx.saveProperties(childId, data)
+}
+
+func (ctx *sandboxContext) saveProperties(deviceId string, data map[string]any) {
+	ctx.Lock()
+	defer ctx.Unlock()
+	ctx.result.Properties = append(ctx.result.Properties, map[string]any{
+		"deviceId": deviceId,
+		"data":     data,
+	})
+}
+
+func (ctx *sandboxContext) SaveEvents(eventId string, data any) {
+	ctx.saveEvents(ctx.DeviceId, eventId, data)
+}
+
+func (ctx *sandboxContext) SaveChildEvents(childId string, eventId string, data any) {
+	ctx.saveEvents(childId, eventId, data)
+}
+
+func (ctx *sandboxContext) saveEvents(deviceId string, eventId string, data any) {
+	ctx.Lock()
+	defer ctx.Unlock()
+	ctx.result.Events = append(ctx.result.Events, map[string]any{
+		"deviceId": deviceId,
+		"eventId":  eventId,
+		"data":     data,
+	})
+}
+
+func (ctx *sandboxContext) ReplyOk() {
+	ctx.call("ReplyOk")
+}
+
+func (ctx *sandboxContext) ReplyFail(resp string) {
+	ctx.call("ReplyFail", resp)
+}
+
+func (ctx *sandboxContext) ReplyAsync(resp map[string]any) {
+	ctx.call("ReplyAsync", resp)
+}
+
+func (ctx *sandboxContext) ReplyChildOk(childId string) {
+	ctx.call("ReplyChildOk", childId)
+}
+
+func (ctx *sandboxContext) ReplyChildFail(childId string, resp string) {
+	ctx.call("ReplyChildFail", childId, resp)
+}
+
+// 只记录http请求, 不发送
+func (ctx *sandboxContext) httpRequest(config map[string]any) map[string]any {
+	args := map[string]any{}
+	for k, v := range config {
+		if k != "complete" {
+			args[k] = v
+		}
+	}
+	ctx.call("HttpRequest", args)
+	resp := httpResp{}
+	resp.setStatus(200)
+	resp.setData("")
+	resp.setHeader(map[string]string{})
+	return resp
+}
+
+// 调试用的设备, 提供设备的常用方法, 临时数据与配置的修改只记录调用
+type sandboxDevice struct {
+	Id         string
+	ProductId  string
+	ParentId   string
+	DeviceType string
+	Name       string
+	config     map[string]string
+	data       map[string]string // 调试中设置的临时数据
+	ctx        *sandboxContext
+}
+
+func (d *sandboxDevice) GetId() string {
+	return d.Id
+}
+
+func (d *sandboxDevice) GetProductId() string {
+	return d.ProductId
+}
+
+func (d *sandboxDevice) GetSession() core.Session {
+	return d.ctx.session
+}
+
+func (d *sandboxDevice) GetData(key string) string {
+	if v, ok := d.data[key]; ok {
+		return v
+	}
+	return core.GetDeviceData(d.Id, key)
+}
+
+func (d *sandboxDevice) GetDataInt(key string) int {
+	i, _ := strconv.Atoi(d.GetData(key))
+	return i
+}
+
+func (d *sandboxDevice) SetData(key string, val string) {
+	d.data[key] = val
+	d.ctx.call("SetData", d.Id, key, val)
+}
+
+func (d *sandboxDevice) GetConfig(key string) string {
+	if v, ok := d.config[key]; ok {
+		return v
+	}
+	if p := core.GetProduct(d.ProductId); p != nil {
+		return p.GetConfig(key)
+	}
+	return ""
+}
+
+func (d *sandboxDevice) SetConfig(key string, value string) {
+	d.config[key] = value
+	d.ctx.call("SetConfig", d.Id, key, value)
+}
+
+func (d *sandboxDevice) IsSubDevice() bool {
+	return d.DeviceType == core.SUBDEVICE
+}
+
+func (d *sandboxDevice) Debug(v any) {
+	d.ctx.log(fmt.Sprintf("%v", v))
+}
+
+// 调试用的会话, 只记录下发的数据
+type sandboxSession struct {
+	ctx *sandboxContext
+}
+
+func (s *sandboxSession) SetDeviceId(deviceId string) {
+	s.ctx.DeviceId = deviceId
+}
+
+func (s *sandboxSession) GetDeviceId() string {
+	return s.ctx.DeviceId
+}
+
+func (s *sandboxSession) GetInfo() map[string]any {
+	return map[string]any{}
+}
+
+func (s *sandboxSession) Disconnect() error {
+	s.ctx.call("Disconnect")
+	return nil
+}
+
+func (s *sandboxSession) Close() error {
+	s.ctx.call("Close")
+	return nil
+}
+
+// 字节数组记录为16进制字符串
+func (s *sandboxSession) Send(msg any) error {
+	if _, ok := msg.(string); ok {
+		s.ctx.call("Send", msg)
+		return nil
+	}
+	b, err := util.ToBytes(msg)
+	if err != nil {
+		return err
+	}
+	s.ctx.call("Send", hex.EncodeToString(b))
+	return nil
+}
+
+func (s *sandboxSession) SendHex(msgHex string) error {
+	s.ctx.call("SendHex", msgHex)
+	return nil
+}
+
+func (s *sandboxSession) SendText(msg string) error {
+	s.ctx.call("SendText", msg)
+	return nil
+}
+
+func (s *sandboxSession) SendBinary(msg any) error {
+	if _, ok := msg.(string); !ok {
+		b, err := util.ToBytes(msg)
+		if err != nil {
+			return err
+		}
+		msg = hex.EncodeToString(b)
+	}
+	s.ctx.call("SendBinary", msg)
+	return nil
+}
+
+func (s *sandboxSession) Publish(topic string, payload string) {
+	s.ctx.call("Publish", topic, payload)
+}
+
+func (s *sandboxSession) PublishHex(topic string, payload string) {
+	s.ctx.call("PublishHex", topic, payload)
+}
+
+func (s *sandboxSession) PublishRetained(topic string, payload string) {
+	s.ctx.call("PublishRetained", topic, payload)
+}
+
+func (s *sandboxSession) PublishQos1(topic string, msg interface{}) error {
+	s.ctx.call("PublishQos1", topic, msg)
+	return nil
+}
+
+func (s *sandboxSession) Response(msg string) error {
+	s.ctx.call("Response", msg)
+	return nil
+}
+
+func (s *sandboxSession) ResponseJSON(msg string) error {
+	s.ctx.call("ResponseJSON", msg)
+	return nil
+}
+
+func (s *sandboxSession) ResponseHeader(key string, value string) {
+	s.ctx.call("ResponseHeader", key, value)
+}
+
+func (s *sandboxSession) SetStatesCode(code int) {
+	s.ctx.call("SetStatesCode", code)
+}
@@ -0,0 +1,417 @@
+package codec
+
+import (
+	"encoding/hex"
+	"fmt"
+	"go-iot/pkg/util"
+	"math"
+	"strings"
+
+	"github.com/spf13/cast"
+)
+
+// 字节缓冲区, 按偏移量读写, 类似js的DataView, littleEndian默认为false(大端)
+type Buffer struct {
+	data []byte
+}
+
+func NewBuffer(data []byte) *Buffer {
+	return &Buffer{data: data}
+}
+
+func (b *Buffer) Length() int {
+	return len(b.data)
+}
+
+func (b *Buffer) Bytes() []byte {
+	return b.data
+}
+
+func (b *Buffer) Hex() string {
+	return hex.EncodeToString(b.data)
+}
+
+// 截取[start, end), end为0时截取到末尾, 与原缓冲区共享数据
+func (b *Buffer) Slice(start, end int) (*Buffer, error) {
+	if end == 0 {
+		end = len(b.data)
+	}
+	if start < 0 || end > len(b.data) || start > end {
+		return nil, fmt.Errorf("slice [%d, %d) out of range %d", start, end, len(b.data))
+	}
+	return &Buffer{data: b.data[start:end]}, nil
+}
+
+func (b *Buffer) check(offset, size int) error {
+	if offset < 0 || offset+size > len(b.data) {
+		return fmt.Errorf("offset %d size %d out of range %d", offset, size, len(b.data))
+	}
+	return nil
+}
+
+func (b *Buffer) getUint(offset, size int, littleEndian bool) (uint64, error) {
+	if err := b.check(offset, size); err != nil {
+		return 0, err
+	}
+	var v uint64
+	for i := 0; i < size; i++ {
+		idx := offset + i
+		if littleEndian {
+			idx = offset + size - 1 - i
+		}
+		v = v<<8 | uint64(b.data[idx])
+	}
+	return v, nil
+}
+
+func (b *Buffer) getInt(offset, size int, littleEndian bool) (int64, error) {
+	v, err := b.getUint(offset, size, littleEndian)
+	if err != nil {
+		return 0, err
+	}
+	shift := 64 - size*8
+	return int64(v<<shift) >> shift, nil
+}
+
+func (b *Buffer) setUint(offset, size int, v uint64, littleEndian bool) error {
+	if err := b.check(offset, size); err != nil {
+		return err
+	}
+	for i := size - 1; i >= 0; i-- {
+		idx := offset + i
+		if littleEndian {
+			idx = offset + size - 1 - i
+		}
+		b.data[idx] = byte(v)
+		v >>= 8
+	}
+	return nil
+}
+
+func (b *Buffer) GetInt8(offset int) (int64, error) {
+	return b.getInt(offset, 1, false)
+}
+
+func (b *Buffer) GetUint8(offset int) (uint64, error) {
+	return b.getUint(offset, 1, false)
+}
+
+func (b *Buffer) GetInt16(offset int, littleEndian bool) (int64, error) {
+	return b.getInt(offset, 2, littleEndian)
+}
+
+func (b *Buffer) GetUint16(offset int, littleEndian bool) (uint64, error) {
+	return b.getUint(offset, 2, littleEndian)
+}
+
+func (b *Buffer) GetInt32(offset int, littleEndian bool) (int64, error) {
+	return b.getInt(offset, 4, littleEndian)
+}
+
+func (b *Buffer) GetUint32(offset int, littleEndian bool) (uint64, error) {
+	return b.getUint(offset, 4, littleEndian)
+}
+
+// 超过2^53时js中会丢失精度
+func (b *Buffer) GetInt64(offset int, littleEndian bool) (int64, error) {
+	return b.getInt(offset, 8, littleEndian)
+}
+
+func (b *Buffer) GetUint64(offset int, littleEndian bool) (uint64, error) {
+	return b.getUint(offset, 8, littleEndian)
+}
+
+func (b *Buffer) GetFloat32(offset int, littleEndian bool) (float64, error) {
+	v, err := b.getUint(offset, 4, littleEndian)
+	return float64(math.Float32frombits(uint32(v))), err
+}
+
+func (b *Buffer) GetFloat64(offset int, littleEndian bool) (float64, error) {
+	v, err := b.getUint(offset, 8, littleEndian)
+	return math.Float64frombits(v), err
+}
+
+func (b *Buffer) SetInt8(offset int, value int64) error {
+	return b.setUint(offset, 1, uint64(value), false)
+}
+
+func (b *Buffer) SetUint8(offset int, value int64) error {
+	return b.setUint(offset, 1, uint64(value), false)
+}
+
+func (b *Buffer) SetInt16(offset int, value int64, littleEndian bool) error {
+	return b.setUint(offset, 2, uint64(value), littleEndian)
+}
+
+func (b *Buffer) SetUint16(offset int, value int64, littleEndian bool) error {
+	return b.setUint(offset, 2, uint64(value), littleEndian)
+}
+
+func (b *Buffer) SetInt32(offset int, value int64, littleEndian bool) error {
+	return b.setUint(offset, 4, uint64(value), littleEndian)
+}
+
+func (b *Buffer) SetUint32(offset int, value int64, littleEndian bool) error {
+	return b.setUint(offset, 4, uint64(value), littleEndian)
+}
+
+func (b *Buffer) SetInt64(offset int, value int64, littleEndian bool) error {
+	return b.setUint(offset, 8, uint64(value), littleEndian)
+}
+
+func (b *Buffer) SetUint64(offset int, value uint64, littleEndian bool) error {
+	return b.setUint(offset, 8, value, littleEndian)
+}
+
+func (b *Buffer) SetFloat32(offset int, value float64, littleEndian bool) error {
+	return b.setUint(offset, 4, uint64(math.Float32bits(float32(value))), littleEndian)
+}
+
+func (b *Buffer) SetFloat64(offset int, value float64, littleEndian bool) error {
+	return b.setUint(offset, 8, math.Float64bits(value), littleEndian)
+}
+
+// 读取length个字节的BCD码, 返回数字字符串
+func (b *Buffer) GetBcd(offset, length int) (string, error) {
+	if err := b.check(offset, length); err != nil {
+		return "", err
+	}
+	sb := strings.Builder{}
+	for _, v := range b.data[offset : offset+length] {
+		hi, lo := v>>4, v&0x0f
+		if hi > 9 || lo > 9 {
+			return "", fmt.Errorf("invalid bcd byte 0x%02x", v)
+		}
+		sb.WriteByte('0' + hi)
+		sb.WriteByte('0' + lo)
+	}
+	return sb.String(), nil
+}
+
+// 写入length个字节的BCD码, 数字不足时左侧补0
+func (b *Buffer) SetBcd(offset, length int, digits string) error {
+	if err := b.check(offset, length); err != nil {
+		return err
+	}
+	if len(digits) > length*2 {
+		return fmt.Errorf("bcd %s longer than %d bytes", digits, length)
+	}
+	digits = strings.Repeat("0", length*2-len(digits)) + digits
+	for i := 0; i < length; i++ {
+		hi, lo := digits[i*2]-'0', digits[i*2+1]-'0'
+		if hi > 9 || lo > 9 {
+			return fmt.Errorf("invalid bcd digits %s", digits)
+		}
+		b.data[offset+i] = hi<<4 | lo
+	}
+	return nil
+}
+
+// 读取位域, bitOffset从offset字节的最高位开始计数, 可以跨字节
+func (b *Buffer) GetBits(offset, bitOffset, bitLength int) (uint64, error) {
+	if bitOffset < 0 || bitLength <= 0 || bitLength > 64 {
+		return 0, fmt.Errorf("invalid bits %d:%d", bitOffset, bitLength)
+	}
+	start := offset*8 + bitOffset
+	if err := b.check(start/8, (start%8+bitLength+7)/8); err != nil {
+		return 0, err
+	}
+	var v uint64
+	for i := start; i < start+bitLength; i++ {
+		v = v<<1 | uint64(b.data[i/8]>>(7-i%8)&1)
+	}
+	return v, nil
+}
+
+// 写入位域, 位的计数方式与GetBits一致
+func (b *Buffer) SetBits(offset, bitOffset, bitLength int, value uint64) error {
+	if bitOffset < 0 || bitLength <= 0 || bitLength > 64 {
+		return fmt.Errorf("invalid bits %d:%d", bitOffset, bitLength)
+	}
+	start := offset*8 + bitOffset
+	if err := b.check(start/8, (start%8+bitLength+7)/8); err != nil {
+		return err
+	}
+	for i := start + bitLength - 1; i >= start; i-- {
+		mask := byte(1) << (7 - i%8)
+		if value&1 == 1 {
+			b.data[i/8] |= mask
+		} else {
+			b.data[i/8] &^= mask
+		}
+		value >>= 1
+	}
+	return nil
+}
+
+// 结构体字段定义
+type structField struct {
+	name         string
+	typ          string
+	offset       int // 为-1时紧接上一个字段
+	length       int // bcd, hex, string, bytes的字节数
+	bits         int // bits类型的位数
+	littleEndian bool
+}
+
+var fieldSizes = map[string]int{
+	"int8": 1, "uint8": 1, "int16": 2, "uint16": 2, "int32": 4, "uint32": 4,
+	"int64": 8, "uint64": 8, "float32": 4, "float64": 8,
+}
+
+func parseStructFields(fields []map[string]any, littleEndian bool) ([]structField, error) {
+	result := make([]structField, 0, len(fields))
+	for i, f := range fields {
+		sf := structField{
+			name:         cast.ToString(f["name"]),
+			typ:          strings.ToLower(cast.ToString(f["type"])),
+			offset:       -1,
+			length:       cast.ToInt(f["length"]),
+			bits:         cast.ToInt(f["bits"]),
+			littleEndian: littleEndian,
+		}
+		if v, ok := f["offset"]; ok && v != nil {
+			sf.offset = cast.ToInt(v)
+		}
+		if v, ok := f["littleEndian"]; ok && v != nil {
+			sf.littleEndian = cast.ToBool(v)
+		}
+		if len(sf.name) == 0 {
+			return nil, fmt.Errorf("field %d name must be present", i)
+		}
+		if size, ok := fieldSizes[sf.typ]; ok {
+			sf.length = size
+		} else {
+			switch sf.typ {
+			case "bcd", "hex", "string", "bytes":
+				if sf.length <= 0 {
+					return nil, fmt.Errorf("field [%s] length must be present", sf.name)
+				}
+			case "bits":
+				if sf.bits <= 0 || sf.bits > 64 {
+					return nil, fmt.Errorf("field [%s] bits must be 1-64", sf.name)
+				}
+			default:
+				return nil, fmt.Errorf("field [%s] type [%s] is not supported", sf.name, sf.typ)
+			}
+		}
+		result = append(result, sf)
+	}
+	return result, nil
+}
+
+// 按字段定义顺序遍历, 连续的bits字段共享字节, 其它字段从下一个字节开始
+func eachStructField(fields []structField, fn func(f structField, offset, bitOffset int) error) (int, error) {
+	var bitPos int
+	for _, f := range fields {
+		if f.offset >= 0 {
+			bitPos = f.offset * 8
+		}
+		if f.typ == "bits" {
+			if err := fn(f, bitPos/8, bitPos%8); err != nil {
+				return 0, err
+			}
+			bitPos += f.bits
+			continue
+		}
+		bitPos = (bitPos + 7) / 8 * 8
+		if err := fn(f, bitPos/8, 0); err != nil {
+			return 0, err
+		}
+		bitPos += f.length * 8
+	}
+	return (bitPos + 7) / 8, nil
+}
+
+func unpackStruct(data []byte, fields []structField) (map[string]any, error) {
+	b := NewBuffer(data)
+	result := map[string]any{}
+	_, err := eachStructField(fields, func(f structField, offset, bitOffset int) error {
+		var v any
+		var err error
+		switch f.typ {
+		case "int8", "int16", "int32", "int64":
+			v, err = b.getInt(offset, f.length, f.littleEndian)
+		case "uint8", "uint16", "uint32", "uint64":
+			v, err = b.getUint(offset, f.length, f.littleEndian)
+		case "float32":
+			v, err = b.GetFloat32(offset, f.littleEndian)
+		case "float64":
+			v, err = b.GetFloat64(offset, f.littleEndian)
+		case "bcd":
+			v, err = b.GetBcd(offset, f.length)
+		case "bits":
+			v, err = b.GetBits(offset, bitOffset, f.bits)
+		default:
+			if err = b.check(offset, f.length); err == nil {
+				raw := data[offset : offset+f.length]
+				switch f.typ {
+				case "hex":
+					v = hex.EncodeToString(raw)
+				case "string":
+					v = strings.TrimRight(string(raw), "\x00")
+				default:
+					v = append([]byte{}, raw...)
+				}
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("field [%s]: %v", f.name, err)
+		}
+		result[f.name] = v
+		return nil
+	})
+	return result, err
+}
+
+func packStruct(fields []structField, values map[string]any) ([]byte, error) {
+	size, err := eachStructField(fields, func(f structField, offset, bitOffset int) error { return nil })
+	if err != nil {
+		return nil, err
+	}
+	b := NewBuffer(make([]byte, size))
+	_, err = eachStructField(fields, func(f structField, offset, bitOffset int) error {
+		value := values[f.name]
+		var err error
+		switch f.typ {
+		case "int8", "int16", "int32", "int64", "uint8", "uint16", "uint32":
+			err = b.setUint(offset, f.length, uint64(cast.ToInt64(value)), f.littleEndian)
+		case "uint64":
+			err = b.setUint(offset, f.length, cast.ToUint64(value), f.littleEndian)
+		case "float32":
+			err = b.SetFloat32(offset, cast.ToFloat64(value), f.littleEndian)
+		case "float64":
+			err = b.SetFloat64(offset, cast.ToFloat64(value), f.littleEndian)
+		case "bcd":
+			err = b.SetBcd(offset, f.length, cast.ToString(value))
+		case "bits":
+			err = b.SetBits(offset, bitOffset, f.bits, cast.ToUint64(value))
+		case "hex":
+			var raw []byte
+			if raw, err = hex.DecodeString(cast.ToString(value)); err == nil {
+				err = copyField(b, offset, f.length, raw)
+			}
+		case "string":
+			err = copyField(b, offset, f.length, []byte(cast.ToString(value)))
+		default:
+			var raw []byte
+			if raw, err = util.ToBytes(value); err == nil {
+				err = copyField(b, offset, f.length, raw)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("field [%s]: %v", f.name, err)
+		}
+		return nil
+	})
+	return b.data, err
+}
+
+// 写入定长字段, 不足时补0
+func copyField(b *Buffer, offset, length int, raw []byte) error {
+	if len(raw) > length {
+		return fmt.Errorf("value length %d longer than %d", len(raw), length)
+	}
+	copy(b.data[offset:offset+length], raw)
+	return nil
+}
@@ -2,8 +2,11 @@
 package codec
 
 import (
+	"errors"
 	"fmt"
 	"runtime/debug"
+	"sync"
+	"time"
 
 	"go-iot/pkg/core"
 	logs "go-iot/pkg/logger"
@@ -25,38 +28,81 @@ const (
 	On_Device_Deploy   = "OnDeviceDeploy"
 	On_Device_UnDeploy = "OnDeviceUnDeploy"
 	On_State_Checker   = "OnStateChecker"
+	On_Shadow_Delta    = "OnShadowDelta"
+	On_Read_Property   = "OnReadProperty"
+	On_Write_Property  = "OnWriteProperty"
 )
 
+// 产品当前的脚本编解码, 脚本库变更时重新编译
+var scriptCodecs sync.Map
+
 // js脚本编解码
 type ScriptCodec struct {
+	sync.RWMutex
 	script    string
 	productId string
 	pool      *VmPool
+	// 有发布信息时按设备选择正式或灰度版本, 并记录处理消息的版本
+	release *ScriptRelease
+	canary  *VmPool
 }
 
 func NewScriptCodec(productId, script string) (core.Codec, error) {
-	// 关闭旧VmPool
-	oldCodec := core.GetCodec(productId)
-	if c, ok := oldCodec.(*ScriptCodec); ok {
-		c.pool.Close()
-	}
-	// 创建新的VmPool
-	pool, err := NewVmPool1(script, 20, productId)
-	if err != nil {
-		return nil, err
-	}
 	sc := &ScriptCodec{
 		script:    script,
 		productId: productId,
-		pool:      pool,
+		release:   GetScriptRelease(productId),
+	}
+	err := sc.recompile()
+	if err != nil {
+		return nil, err
 	}
-
-	core.RegCodec(productId, sc)
-	core.RegDeviceLifeCycle(productId, sc)
 
 	return sc, nil
 }
 
+// 注册后随脚本库更新重新编译
+func (c *ScriptCodec) Registered(productId string) {
+	scriptCodecs.Store(productId, c)
+}
+
+// 网络服务停止或产品删除后移除产品的脚本编解码, 脚本库变更时不再重新编译
+func RemoveScriptCodec(productId string) {
+	scriptCodecs.Delete(productId)
+}
+
+// 编译脚本并替换引擎池, 旧VmPool不关闭, 执行中的脚本结束后回收
+func (c *ScriptCodec) recompile() error {
+	limit, err := VmLimitFromProduct(c.productId)
+	if err != nil {
+		return err
+	}
+	pool, err := NewVmPoolWithLimit(c.script, c.productId, limit)
+	if err != nil {
+		return err
+	}
+	var canary *VmPool
+	if c.release != nil && c.release.CanaryVersion > 0 {
+		canary, err = NewVmPoolWithLimit(c.release.CanaryScript, c.productId, limit)
+		if err != nil {
+			return fmt.Errorf("canary script version [%d] error: %v", c.release.CanaryVersion, err)
+		}
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.pool = pool
+	c.canary = canary
+	return nil
+}
+
+// 正式或灰度脚本是否依赖脚本库
+func (c *ScriptCodec) dependsOn(lib string) bool {
+	if dependsOn(c.script, lib) {
+		return true
+	}
+	return c.release != nil && c.release.CanaryVersion > 0 && dependsOn(c.release.CanaryScript, lib)
+}
+
 // 设备连接时
 func (c *ScriptCodec) OnConnect(ctx core.MessageContext) error {
 	_, err := c.FuncInvoke(OnConnect, ctx)
@@ -75,6 +121,24 @@ func (c *ScriptCodec) OnInvoke(ctx core.FuncInvokeContext) error {
 	return err
 }
 
+// 影子差异下发
+func (c *ScriptCodec) OnShadowDelta(ctx core.FuncInvokeContext) error {
+	_, err := c.FuncInvoke(On_Shadow_Delta, ctx)
+	return err
+}
+
+// 读取属性
+func (c *ScriptCodec) OnReadProperty(ctx core.FuncInvokeContext) error {
+	_, err := c.FuncInvoke(On_Read_Property, ctx)
+	return err
+}
+
+// 写入属性
+func (c *ScriptCodec) OnWriteProperty(ctx core.FuncInvokeContext) error {
+	_, err := c.FuncInvoke(On_Write_Property, ctx)
+	return err
+}
+
 // 连接关闭
 func (c *ScriptCodec) OnClose(ctx core.MessageContext) error {
 	return nil
@@ -102,19 +166,38 @@ func (c *ScriptCodec) OnStateChecker(ctx core.DeviceLifecycleContext) (string, e
 }
 
 func (c *ScriptCodec) FuncInvoke(name string, param interface{}) (resp goja.Value, err error) {
-	vm := c.pool.Get()
-	defer c.pool.Put(vm)
+	stats := getStats(c.productId)
+	pool, canary := c.selectPool(param)
+	vm, err := pool.GetTimeout(pool.Limit().WaitTimeout)
+	if err != nil {
+		stats.rejects.Add(1)
+		c.debugLog(param, fmt.Sprintf("productId: [%s] %s error: %v", c.productId, name, err))
+		return nil, err
+	}
 	fn, success := goja.AssertFunction(vm.Get(name))
+	if success && c.release != nil && (name == OnMessage || name == OnInvoke) {
+		// 引擎放回池中后再保存日志
+		version := c.release.Version
+		if canary {
+			version = c.release.CanaryVersion
+		}
+		defer func() {
+			saveScriptLog(c.productId, contextDeviceId(param), name, version, canary, err)
+		}()
+	}
+	defer pool.Put(vm)
 	if success {
+		start := time.Now()
+		w := watch(vm, pool.Limit())
+		defer func() {
+			w.stop()
+			stats.observe(time.Since(start), err)
+		}()
 		defer func() {
 			if rec := recover(); rec != nil {
 				l := fmt.Sprintf("productId: [%s] error: %v", c.productId, rec)
 				logs.Errorf(l)
-				deviceId := ""
-				if ctx, ok := param.(core.DeviceLifecycleContext); ok && ctx.GetDevice() != nil {
-					deviceId = ctx.GetDevice().Id
-				}
-				core.DebugLog(deviceId, c.productId, l)
+				c.debugLog(param, l)
 				logs.Errorf(string(debug.Stack()))
 				err = fmt.Errorf("%v", rec)
 				resp = goja.Undefined()
@@ -122,14 +205,48 @@ func (c *ScriptCodec) FuncInvoke(name string, param interface{}) (resp goja.Valu
 		}()
 		resp, err = fn(goja.Undefined(), vm.ToValue(param))
 		if err != nil {
-			logs.Errorf("productId: [%s], error: %v", c.productId, err)
-			deviceId := ""
-			if ctx, ok := param.(core.DeviceLifecycleContext); ok && ctx.GetDevice() != nil {
-				deviceId = ctx.GetDevice().Id
+			// 超时或超过内存上限被中断
+			var interrupted *goja.InterruptedError
+			if errors.As(err, &interrupted) {
+				if e, ok := interrupted.Value().(error); ok {
+					err = e
+				}
+				if errors.Is(err, ErrScriptTimeout) {
+					stats.timeouts.Add(1)
+				}
 			}
-			core.DebugLog(deviceId, c.productId, err.Error())
+			logs.Errorf("productId: [%s], error: %v", c.productId, err)
+			c.debugLog(param, err.Error())
 		}
 		return resp, err
 	}
 	return nil, core.ErrFunctionNotImpl
 }
+
+// 灰度设备使用灰度版本的引擎池
+func (c *ScriptCodec) selectPool(param interface{}) (*VmPool, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	if c.canary != nil && c.release.IsCanary(contextDeviceId(param)) {
+		return c.canary, true
+	}
+	return c.pool, false
+}
+
+func contextDeviceId(param interface{}) string {
+	switch ctx := param.(type) {
+	case core.FuncInvokeContext:
+		return ctx.DeviceId
+	case interface{ GetDeviceId() string }:
+		return ctx.GetDeviceId()
+	}
+	return ""
+}
+
+func (c *ScriptCodec) debugLog(param interface{}, msg string) {
+	deviceId := ""
+	if ctx, ok := param.(core.DeviceLifecycleContext); ok && ctx.GetDevice() != nil {
+		deviceId = ctx.GetDevice().Id
+	}
+	core.DebugLog(deviceId, c.productId, msg)
+}
@@ -1,10 +1,18 @@
 package codec_test
 
 import (
-	_ "go-iot/pkg/codec"
+	"encoding/hex"
+	"fmt"
+	"go-iot/pkg/codec"
 	"go-iot/pkg/core"
 	"go-iot/pkg/logger"
+	"go-iot/pkg/option"
+	"go-iot/pkg/store"
+	"go-iot/pkg/timeseries"
+	"go-iot/pkg/util"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/dop251/goja"
 	"github.com/stretchr/testify/assert"
@@ -12,6 +20,7 @@ import (
 
 func init() {
 	logger.InitNop()
+	core.RegDeviceStore(store.NewMockDeviceStore())
 }
 
 func TestOtto(t *testing.T) {
@@ -105,3 +114,436 @@ function OnConnect(context) {
 	err = c.OnConnect(&core.BaseContext{DeviceId: "fff"})
 	assert.Nil(t, err)
 }
+
+func TestScriptLimit(t *testing.T) {
+	script := `
+function OnMessage(context) {
+	if (context.DeviceId == "loop") {
+		while (true) {}
+	}
+}
+function OnConnect(context) {
+	function f(n) { return n <= 0 ? 0 : f(n - 1) + 1 }
+	f(1000)
+}
+`
+	product, err := core.NewProduct("limit-product", map[string]string{
+		codec.ConfigPoolSize:    "1",
+		codec.ConfigTimeout:     "100",
+		codec.ConfigWaitTimeout: "20",
+		codec.ConfigMaxStack:    "100",
+	}, core.TIME_SERISE_MOCK, "")
+	assert.Nil(t, err)
+	core.PutProduct(product)
+	core.PutDevice(core.NewDevice("loop", product.Id, 0))
+	core.PutDevice(core.NewDevice("fff", product.Id, 0))
+	c, err := core.NewCodec(core.Script_Codec, product.Id, script)
+	assert.Nil(t, err)
+
+	// 死循环被中断, 引擎可以继续使用
+	start := time.Now()
+	err = c.OnMessage(&core.BaseContext{DeviceId: "loop"})
+	assert.Equal(t, codec.ErrScriptTimeout, err)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Nil(t, c.OnMessage(&core.BaseContext{DeviceId: "fff"}))
+
+	// 引擎都在执行时等待超时
+	done := make(chan error)
+	go func() {
+		done <- c.OnMessage(&core.BaseContext{DeviceId: "loop"})
+	}()
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, codec.ErrVmPoolBusy, c.OnMessage(&core.BaseContext{DeviceId: "fff"}))
+	assert.Equal(t, codec.ErrScriptTimeout, <-done)
+
+	// 调用栈深度限制
+	assert.NotNil(t, c.OnConnect(&core.BaseContext{DeviceId: "fff"}))
+
+	stats := codec.GetScriptStats(product.Id)
+	assert.Equal(t, int64(4), stats.Calls)
+	assert.Equal(t, int64(3), stats.Errors)
+	assert.Equal(t, int64(2), stats.Timeouts)
+	assert.Equal(t, int64(1), stats.Rejects)
+	assert.Greater(t, stats.P99, float64(50))
+
+	// 脚本顶层代码的死循环同样被中断
+	start = time.Now()
+	result, err := codec.RunSandbox(product.Id, codec.SandboxRequest{Script: "while (true) {}\nfunction OnMessage(context) {}", Function: codec.OnMessage})
+	assert.Nil(t, err)
+	assert.False(t, result.Success)
+	assert.Equal(t, codec.ErrScriptTimeout.Error(), result.Error.Message)
+	_, err = core.NewCodec(core.Script_Codec, product.Id, "while (true) {}")
+	assert.ErrorIs(t, err, codec.ErrScriptTimeout)
+	assert.Less(t, time.Since(start), time.Second)
+
+	// 进程堆内存超过全局上限时中断
+	codec.Config(&option.Options{ScriptMaxHeapMemory: 1})
+	limit := codec.DefaultVmLimit()
+	limit.Timeout = 0
+	_, err = codec.NewVmPoolWithLimit("while (true) {}", "", limit)
+	codec.Config(&option.Options{})
+	assert.ErrorIs(t, err, codec.ErrScriptMemory)
+
+	// 默认限制调用栈深度, 无限递归不会耗尽内存
+	_, err = codec.NewVmPool("function f() { return f() }\nf()", 1)
+	var overflow *goja.StackOverflowError
+	assert.ErrorAs(t, err, &overflow)
+
+	product, err = core.NewProduct("bad-limit", map[string]string{codec.ConfigTimeout: "a"}, core.TIME_SERISE_MOCK, "")
+	assert.Nil(t, err)
+	core.PutProduct(product)
+	_, err = core.NewCodec(core.Script_Codec, product.Id, script)
+	assert.NotNil(t, err)
+}
+
+func TestSandbox(t *testing.T) {
+	script := `
+function OnMessage(context) {
+	console.log("topic", context.Topic())
+	var data = JSON.parse(context.MsgToString())
+	context.DeviceOnline(data.id)
+	context.SaveProperties({"temp": data.temp})
+	context.SaveEvents("alarm", {"level": 1})
+	context.GetSession().Publish("/ack", context.GetHeader("x-trace"))
+}
+function OnInvoke(context) {
+	context.GetSession().SendHex("0102" + context.GetMessage().Data.value)
+	context.ReplyOk()
+}
+function OnStateChecker(context) {
+	return "online"
+}
+function OnConnect(context) {
+	undefinedFunc()
+}
+`
+	product, err := core.NewProduct("sandbox-product", map[string]string{}, core.TIME_SERISE_MOCK, "")
+	assert.Nil(t, err)
+	core.PutProduct(product)
+	core.PutDevice(core.NewDevice("sandbox-1", product.Id, 0))
+
+	result, err := codec.RunSandbox(product.Id, codec.SandboxRequest{
+		Script:   script,
+		Function: codec.OnMessage,
+		Payload:  `{"id": "sandbox-1", "temp": 21.5}`,
+		Topic:    "/up",
+		Headers:  map[string]string{"X-Trace": "t1"},
+	})
+	assert.Nil(t, err)
+	assert.True(t, result.Success)
+	assert.Equal(t, []string{"topic/up"}, result.Logs)
+	assert.Equal(t, map[string]any{"deviceId": "sandbox-1", "data": map[string]any{"temp": 21.5}}, result.Properties[0])
+	assert.Equal(t, "alarm", result.Events[0]["eventId"])
+	assert.Equal(t, []codec.SandboxCall{
+		{Method: "DeviceOnline", Args: []any{"sandbox-1"}},
+		{Method: "Publish", Args: []any{"/ack", "t1"}},
+	}, result.Calls)
+	// 没有保存数据, 设备没有上线
+	assert.Nil(t, core.GetSession("sandbox-1"))
+
+	result, err = codec.RunSandbox(product.Id, codec.SandboxRequest{
+		Script:     script,
+		Function:   codec.OnInvoke,
+		DeviceId:   "sandbox-1",
+		FunctionId: "set",
+		Data:       map[string]any{"value": "ff"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []codec.SandboxCall{
+		{Method: "SendHex", Args: []any{"0102ff"}},
+		{Method: "ReplyOk", Args: []any{}},
+	}, result.Calls)
+
+	result, err = codec.RunSandbox(product.Id, codec.SandboxRequest{Script: script, Function: codec.On_State_Checker, DeviceId: "sandbox-1"})
+	assert.Nil(t, err)
+	assert.Equal(t, "online", result.Result)
+
+	// 设备的数据, 配置与http请求只记录, 不保存也不发送
+	device := core.GetDevice("sandbox-1")
+	device.SetConfig("c", "0")
+	result, err = codec.RunSandbox(product.Id, codec.SandboxRequest{
+		Script: `
+function OnMessage(context) {
+	context.GetDevice().SetData("k", "v")
+	context.GetDeviceById("sandbox-1").SetConfig("c", "1")
+	var resp = globe.HttpRequest({url: "http://127.0.0.1:1/x", method: "GET", complete: function() {}})
+	return [context.GetDevice().GetData("k"), context.GetDevice().GetConfig("c"), resp.status]
+}`,
+		Function: codec.OnMessage,
+		DeviceId: "sandbox-1",
+	})
+	assert.Nil(t, err)
+	assert.True(t, result.Success)
+	assert.Equal(t, []any{"v", "1", int64(200)}, result.Result)
+	assert.Equal(t, []codec.SandboxCall{
+		{Method: "SetData", Args: []any{"sandbox-1", "k", "v"}},
+		{Method: "SetConfig", Args: []any{"sandbox-1", "c", "1"}},
+		{Method: "HttpRequest", Args: []any{map[string]any{"url": "http://127.0.0.1:1/x", "method": "GET"}}},
+	}, result.Calls)
+	assert.Empty(t, device.GetData("k"))
+	assert.Equal(t, "0", device.GetConfig("c"))
+
+	// 执行错误与语法错误的行号
+	result, err = codec.RunSandbox(product.Id, codec.SandboxRequest{Script: script, Function: codec.OnConnect})
+	assert.Nil(t, err)
+	assert.False(t, result.Success)
+	assert.Equal(t, 18, result.Error.Line)
+	result, err = codec.RunSandbox(product.Id, codec.SandboxRequest{Script: "function OnMessage(context) {\n  var a = ;\n}", Function: codec.OnMessage})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, result.Error.Line)
+
+	_, err = codec.RunSandbox(product.Id, codec.SandboxRequest{Script: script, Function: "OnFoo"})
+	assert.NotNil(t, err)
+}
+
+type logTimeSeries struct {
+	timeseries.MockTimeSeries
+	sync.Mutex
+	logs []core.LogData
+}
+
+func (t *logTimeSeries) Id() string {
+	return "codec-log"
+}
+
+func (t *logTimeSeries) SaveLogs(product *core.Product, data core.LogData) error {
+	t.Lock()
+	defer t.Unlock()
+	t.logs = append(t.logs, data)
+	return nil
+}
+
+func (t *logTimeSeries) count() int {
+	t.Lock()
+	defer t.Unlock()
+	return len(t.logs)
+}
+
+func TestScriptRelease(t *testing.T) {
+	ts := &logTimeSeries{}
+	core.RegisterTimeSeries(ts)
+	product, err := core.NewProduct("release-product", map[string]string{}, ts.Id(), "")
+	assert.Nil(t, err)
+	core.PutProduct(product)
+	for _, id := range []string{"r-1", "r-2", "r-3"} {
+		core.PutDevice(core.NewDevice(id, product.Id, 0))
+	}
+	stable := `function OnStateChecker(context) { return "v1" }
+function OnMessage(context) { if (context.DeviceId == "r-3") throw "bad" }`
+	canary := `function OnStateChecker(context) { return "v2" }`
+
+	codec.SetScriptRelease(product.Id, &codec.ScriptRelease{
+		Version:       1,
+		CanaryVersion: 2,
+		CanaryScript:  canary,
+		CanaryDevices: []string{"r-2"},
+	})
+	defer codec.SetScriptRelease(product.Id, nil)
+	c, err := core.NewCodec(core.Script_Codec, product.Id, stable)
+	assert.Nil(t, err)
+	lifecycle := c.(core.DeviceLifecycle)
+	state, _ := lifecycle.OnStateChecker(&core.BaseContext{DeviceId: "r-1"})
+	assert.Equal(t, "v1", state)
+	state, _ = lifecycle.OnStateChecker(&core.BaseContext{DeviceId: "r-2"})
+	assert.Equal(t, "v2", state)
+	// 没有设备id时使用正式版本
+	state, _ = lifecycle.OnStateChecker(&core.BaseContext{})
+	assert.Equal(t, "v1", state)
+	// 灰度版本没有实现的函数
+	assert.Nil(t, c.OnMessage(&core.BaseContext{DeviceId: "r-1"}))
+	assert.Equal(t, core.ErrFunctionNotImpl, c.OnMessage(&core.BaseContext{DeviceId: "r-2"}))
+
+	// 回滚灰度
+	codec.SetScriptRelease(product.Id, &codec.ScriptRelease{Version: 1})
+	c, err = core.NewCodec(core.Script_Codec, product.Id, stable)
+	assert.Nil(t, err)
+	state, _ = c.(core.DeviceLifecycle).OnStateChecker(&core.BaseContext{DeviceId: "r-2"})
+	assert.Equal(t, "v1", state)
+
+	// 设备的脚本版本变化或执行出错时记录日志
+	assert.Nil(t, c.OnMessage(&core.BaseContext{DeviceId: "r-1"}))
+	assert.Equal(t, 1, ts.count())
+	codec.SetScriptRelease(product.Id, &codec.ScriptRelease{Version: 2})
+	c, err = core.NewCodec(core.Script_Codec, product.Id, stable)
+	assert.Nil(t, err)
+	assert.Nil(t, c.OnMessage(&core.BaseContext{DeviceId: "r-1"}))
+	assert.Nil(t, c.OnMessage(&core.BaseContext{DeviceId: "r-1"}))
+	assert.Equal(t, 2, ts.count())
+	assert.NotNil(t, c.OnMessage(&core.BaseContext{DeviceId: "r-3"}))
+	assert.NotNil(t, c.OnMessage(&core.BaseContext{DeviceId: "r-3"}))
+	assert.Equal(t, 4, ts.count())
+
+	// 灰度脚本错误时不能创建
+	codec.SetScriptRelease(product.Id, &codec.ScriptRelease{Version: 1, CanaryVersion: 3, CanaryScript: "function (", CanaryPercent: 10})
+	_, err = core.NewCodec(core.Script_Codec, product.Id, stable)
+	assert.NotNil(t, err)
+}
+
+func TestCanaryPercent(t *testing.T) {
+	r := &codec.ScriptRelease{Version: 1, CanaryVersion: 2, CanaryPercent: 30}
+	count := 0
+	for i := 0; i < 1000; i++ {
+		id := fmt.Sprintf("device-%d", i)
+		if r.IsCanary(id) {
+			count++
+		}
+		assert.Equal(t, r.IsCanary(id), r.IsCanary(id))
+	}
+	assert.InDelta(t, 300, count, 60)
+	assert.False(t, r.IsCanary(""))
+	r.CanaryPercent = 100
+	assert.True(t, r.IsCanary("any"))
+}
+
+func TestScriptLib(t *testing.T) {
+	product, err := core.NewProduct("lib-product", map[string]string{}, core.TIME_SERISE_MOCK, "")
+	assert.Nil(t, err)
+	core.PutProduct(product)
+	core.PutDevice(core.NewDevice("lib-1", product.Id, 0))
+	defer codec.RemoveScriptLib("lib-math")
+	defer codec.RemoveScriptLib("lib-fmt")
+
+	assert.Nil(t, codec.RegScriptLib("lib-math", 1, `exports.scale = function(v) { return v * 10 }`))
+	assert.Nil(t, codec.RegScriptLib("lib-fmt", 1, `var m = require("lib-math")
+module.exports = { state: function(v) { return "s" + m.scale(v) } }`))
+	script := `var f = require("lib-fmt")
+var old = require("lib-math@1")
+function OnStateChecker(context) { return f.state(1) + "-" + old.scale(2) }`
+	c, err := core.NewCodec(core.Script_Codec, product.Id, script)
+	assert.Nil(t, err)
+	state, err := c.(core.DeviceLifecycle).OnStateChecker(&core.BaseContext{DeviceId: "lib-1"})
+	assert.Nil(t, err)
+	assert.Equal(t, "s10-20", state)
+
+	// 按保存的脚本与脚本版本检查, 未启动网络的产品同样被引用
+	scripts := map[string][]string{
+		product.Id:      {script},
+		"lib-stopped":   {"", `var m = require("lib-math@1")`},
+		"lib-unrelated": {`function OnConnect(context) {}`},
+	}
+	products, others := codec.ScriptLibUsedBy("lib-math", scripts)
+	assert.Equal(t, []string{product.Id, "lib-stopped"}, products)
+	assert.Equal(t, []string{"lib-fmt"}, others)
+
+	// 循环引用
+	err = codec.RegScriptLib("lib-math", 2, `var f = require("lib-fmt")`)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "circular import")
+
+	// 新版本发布后重新编译依赖的产品
+	assert.Nil(t, codec.RegScriptLib("lib-math", 2, `exports.scale = function(v) { return v * 100 }`))
+	recompiled, err := codec.RecompileDependents("lib-math")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{product.Id}, recompiled)
+	state, err = c.(core.DeviceLifecycle).OnStateChecker(&core.BaseContext{DeviceId: "lib-1"})
+	assert.Nil(t, err)
+	assert.Equal(t, "s100-20", state)
+
+	// 移除的产品不再重新编译
+	codec.RemoveScriptCodec(product.Id)
+	recompiled, err = codec.RecompileDependents("lib-math")
+	assert.Nil(t, err)
+	assert.Empty(t, recompiled)
+
+	// 不存在的库
+	_, err = core.NewCodec(core.Script_Codec, "lib-product", `var x = require("lib-none")`)
+	assert.NotNil(t, err)
+
+	// 在函数中加载的库超时, 按超时统计
+	product, err = core.NewProduct("lib-slow-product", map[string]string{codec.ConfigTimeout: "50"}, core.TIME_SERISE_MOCK, "")
+	assert.Nil(t, err)
+	core.PutProduct(product)
+	defer codec.RemoveScriptLib("lib-slow")
+	assert.Nil(t, codec.RegScriptLib("lib-slow", 1, `var start = Date.now(); while (Date.now() - start < 200) {}`))
+	c, err = core.NewCodec(core.Script_Codec, product.Id, `function OnMessage(context) { require("lib-slow") }`)
+	assert.Nil(t, err)
+	assert.Equal(t, codec.ErrScriptTimeout, c.OnMessage(&core.BaseContext{DeviceId: "lib-1", ProductId: product.Id}))
+	assert.Equal(t, int64(1), codec.GetScriptStats(product.Id).Timeouts)
+}
+
+func TestScriptBuffer(t *testing.T) {
+	product, err := core.NewProduct("buffer-product", map[string]string{}, core.TIME_SERISE_MOCK, "")
+	assert.Nil(t, err)
+	core.PutProduct(product)
+	core.PutDevice(core.NewDevice("buffer-1", product.Id, 0))
+	script := `
+var fields = [
+  {name: "head", type: "uint8"},
+  {name: "temp", type: "int16"},
+  {name: "volt", type: "float32", littleEndian: true},
+  {name: "alarm", type: "bits", bits: 1},
+  {name: "mode", type: "bits", bits: 3},
+  {name: "meter", type: "bcd", length: 3},
+  {name: "name", type: "string", length: 4}
+]
+function OnMessage(context) {
+  var buf = globe.BufferFromHex(context.MsgToHexStr())
+  var frame = globe.Unpack(buf.Bytes(), fields)
+  var crc = globe.ModbusCrc(buf.Slice(0, buf.Length() - 2).Bytes())
+  var out = globe.NewBuffer(12)
+  out.SetInt16(0, -2, true)
+  out.SetUint32(2, 0x01020304)
+  out.SetFloat64(4, 1.5)
+  out.SetBits(0, 0, 4, 5)
+  var key = globe.HexToBytes("0123456789abcdeffedcba9876543210")
+  var enc = globe.Sm4Encrypt(key, key, {padding: "none"})
+  var aes = globe.AesEncrypt("hello", key, {mode: "cbc", iv: key})
+  context.SaveProperties({
+    head: frame.head, temp: frame.temp, volt: frame.volt, alarm: frame.alarm, mode: frame.mode,
+    meter: frame.meter, name: frame.name,
+    crc: crc == buf.GetUint16(buf.Length() - 2, true),
+    int8: buf.GetInt8(1), out: out.Hex(), bcd: buf.GetBcd(8, 3),
+    pack: globe.BytesToHex(globe.Pack(fields, frame)),
+    crc32: globe.Crc32("123456789"),
+    sm4: globe.BytesToHex(enc),
+    aes: globe.BytesToHex(globe.AesDecrypt(aes, key, {mode: "cbc", iv: key})),
+  })
+  context.GetSession().Send(out.Bytes())
+  context.GetSession().Send([0x01, 0x02, 255])
+}
+function OnInvoke(context) {
+  var buf = globe.NewBuffer(2)
+  buf.GetUint32(0)
+}`
+	frame := []byte{0xaa, 0xff, 0x38, 0, 0, 0xc0, 0x3f, 0xb0, 0x12, 0x34, 0x56, 'a', 'b', 0, 0}
+	frame = append(frame, util.CheckSum(frame)...)
+	result, err := codec.RunSandbox(product.Id, codec.SandboxRequest{
+		Script:     script,
+		Function:   "OnMessage",
+		DeviceId:   "buffer-1",
+		Payload:    hex.EncodeToString(frame),
+		PayloadHex: true,
+	})
+	assert.Nil(t, err)
+	assert.True(t, result.Success, result.Error)
+	assert.Len(t, result.Properties, 1)
+	p := result.Properties[0]["data"].(map[string]any)
+	assert.Equal(t, int64(0xaa), p["head"])
+	assert.Equal(t, int64(-200), p["temp"])
+	assert.Equal(t, 1.5, p["volt"])
+	assert.Equal(t, int64(1), p["alarm"])
+	assert.Equal(t, int64(3), p["mode"])
+	assert.Equal(t, "123456", p["meter"])
+	assert.Equal(t, "ab", p["name"])
+	assert.Equal(t, true, p["crc"])
+	assert.Equal(t, int64(-1), p["int8"])
+	assert.Equal(t, "5eff01023ff8000000000000", p["out"])
+	assert.Equal(t, "123456", p["bcd"])
+	assert.Equal(t, hex.EncodeToString(frame[:15]), p["pack"])
+	assert.Equal(t, int64(0xcbf43926), p["crc32"])
+	assert.Equal(t, "681edf34d206965e86b3e94f536e4246", p["sm4"])
+	assert.Equal(t, hex.EncodeToString([]byte("hello")), p["aes"])
+	assert.Len(t, result.Calls, 2)
+	assert.Equal(t, "0102ff", result.Calls[1].Args[0])
+
+	// 越界时脚本报错
+	result, err = codec.RunSandbox(product.Id, codec.SandboxRequest{
+		Script:     script,
+		Function:   "OnInvoke",
+		DeviceId:   "buffer-1",
+		FunctionId: "test",
+	})
+	assert.Nil(t, err)
+	assert.False(t, result.Success)
+	assert.Contains(t, result.Error.Message, "out of range")
+}
@@ -1,17 +1,14 @@
 package codec
 
 import (
-	"crypto/hmac"
-	"crypto/md5"
-	"crypto/sha1"
-	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"go-iot/pkg/core"
 	"go-iot/pkg/logger"
 	"go-iot/pkg/util"
-	"hash"
+	"hash/crc32"
 	"io"
 	"net/http"
 	"net/url"
@@ -20,12 +17,15 @@ import (
 	"time"
 
 	"github.com/dop251/goja"
+	"github.com/spf13/cast"
 )
 
 // js 全局对象，包含常用工具方法
 type globe struct {
 	vm        *goja.Runtime `json:"-"`
 	productId string        `json:"-"`
+	// 替代真实的http请求, 调试脚本时只记录请求
+	httpRequest func(config map[string]any) map[string]any
 }
 
 func (g *globe) getCallStack() string {
@@ -69,23 +69,11 @@ func (g *globe) HmacEncrypt(data, key, signatureMethod string) []byte {
 	if err != nil {
 		panic(g.vm.ToValue(err))
 	}
-
-	// 创建 Hmac 实例，指定签名算法和密钥
-	var hmacInstance hash.Hash
-	if signatureMethod == "sha1" {
-		hmacInstance = hmac.New(sha1.New, signinKey)
-	} else if signatureMethod == "sha256" {
-		hmacInstance = hmac.New(sha256.New, signinKey)
-	} else if signatureMethod == "md5" {
-		hmacInstance = hmac.New(md5.New, signinKey)
-	} else {
-		panic(g.vm.ToValue(fmt.Errorf("unsupported signatureMethod: %s %s", signatureMethod, g.getCallStack())))
+	v, err := util.HmacEncrypt([]byte(data), signinKey, signatureMethod)
+	if err != nil {
+		panic(g.vm.ToValue(fmt.Errorf("%v %s", err, g.getCallStack())))
 	}
-
-	// 更新 Hmac 实例的数据
-	hmacInstance.Write([]byte(data))
-	// 返回加密结果的字节数组
-	return hmacInstance.Sum(nil)
+	return v
 }
 
 type httpResp map[string]any
@@ -108,6 +96,9 @@ func (h httpResp) setHeader(header map[string]string) {
 
 // http请求，使编解码脚本有发送http的能力
 func (g *globe) HttpRequest(config map[string]any) map[string]any {
+	if g.httpRequest != nil {
+		return g.httpRequest(config)
+	}
 	result := httpResp{}
 	result.setStatus(400)
 	path := config["url"]
@@ -194,6 +185,11 @@ func (g *globe) HttpRequest(config map[string]any) map[string]any {
 
 // http请求异步
 func (g *globe) HttpRequestAsync(config map[string]interface{}) {
+	if g.httpRequest != nil {
+		// 调试时同步回调
+		g.complete(config, g.httpRequest(config))
+		return
+	}
 	go func() {
 		defer func() {
 			if rec := recover(); rec != nil {
@@ -202,14 +198,132 @@ func (g *globe) HttpRequestAsync(config map[string]interface{}) {
 				core.DebugLog("", g.productId, l)
 			}
 		}()
-		resp := g.HttpRequest(config)
-		if v, ok := config["complete"]; ok {
-			fn, success := goja.AssertFunction(g.vm.ToValue(v))
-			if success {
-				fn(goja.Undefined(), g.vm.ToValue(resp))
-			} else {
-				core.DebugLog("", g.productId, "HttpRequestAsync complete is not a function")
-			}
-		}
+		g.complete(config, g.HttpRequest(config))
 	}()
 }
+
+// 调用异步请求的complete回调
+func (g *globe) complete(config map[string]any, resp map[string]any) {
+	if v, ok := config["complete"]; ok {
+		fn, success := goja.AssertFunction(g.vm.ToValue(v))
+		if success {
+			fn(goja.Undefined(), g.vm.ToValue(resp))
+		} else {
+			core.DebugLog("", g.productId, "HttpRequestAsync complete is not a function")
+		}
+	}
+}
+
+// 创建指定长度的字节缓冲区
+func (g *globe) NewBuffer(size int) *Buffer {
+	return NewBuffer(make([]byte, size))
+}
+
+// 从字节数组或数字数组创建字节缓冲区, 复制数据
+func (g *globe) BufferFrom(data any) (*Buffer, error) {
+	b, err := util.ToBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	return NewBuffer(append([]byte{}, b...)), nil
+}
+
+// 从16进制字符串创建字节缓冲区
+func (g *globe) BufferFromHex(str string) (*Buffer, error) {
+	b, err := hex.DecodeString(str)
+	if err != nil {
+		return nil, err
+	}
+	return NewBuffer(b), nil
+}
+
+func (g *globe) HexToBytes(str string) ([]byte, error) {
+	return hex.DecodeString(str)
+}
+
+func (g *globe) BytesToHex(data any) (string, error) {
+	b, err := util.ToBytes(data)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// 按字段定义解析字节, 字段为{name, type, length, offset, bits, littleEndian}
+// type支持int8-int64, uint8-uint64, float32, float64, bcd, hex, string, bytes, bits
+func (g *globe) Unpack(data any, fields []map[string]any, littleEndian bool) (map[string]any, error) {
+	b, err := util.ToBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	sf, err := parseStructFields(fields, littleEndian)
+	if err != nil {
+		return nil, err
+	}
+	return unpackStruct(b, sf)
+}
+
+// 按字段定义将对象打包为字节, 字段定义与Unpack一致
+func (g *globe) Pack(fields []map[string]any, values map[string]any, littleEndian bool) ([]byte, error) {
+	sf, err := parseStructFields(fields, littleEndian)
+	if err != nil {
+		return nil, err
+	}
+	return packStruct(sf, values)
+}
+
+// crc32(IEEE)
+func (g *globe) Crc32(data any) (uint32, error) {
+	b, err := util.ToBytes(data)
+	if err != nil {
+		return 0, err
+	}
+	return crc32.ChecksumIEEE(b), nil
+}
+
+// modbus crc16, 发送时低位在前
+func (g *globe) ModbusCrc(data any) (uint16, error) {
+	b, err := util.ToBytes(data)
+	if err != nil {
+		return 0, err
+	}
+	crc := util.CheckSum(b)
+	return uint16(crc[0]) | uint16(crc[1])<<8, nil
+}
+
+// option支持mode(ecb, cbc), padding(pkcs7, zero, none), iv
+func (g *globe) AesEncrypt(data, key any, option map[string]any) ([]byte, error) {
+	return g.crypt("aes", data, key, option, util.Encrypt)
+}
+
+func (g *globe) AesDecrypt(data, key any, option map[string]any) ([]byte, error) {
+	return g.crypt("aes", data, key, option, util.Decrypt)
+}
+
+func (g *globe) Sm4Encrypt(data, key any, option map[string]any) ([]byte, error) {
+	return g.crypt("sm4", data, key, option, util.Encrypt)
+}
+
+func (g *globe) Sm4Decrypt(data, key any, option map[string]any) ([]byte, error) {
+	return g.crypt("sm4", data, key, option, util.Decrypt)
+}
+
+func (g *globe) crypt(algorithm string, data, key any, option map[string]any,
+	fn func([]byte, util.CipherOption) ([]byte, error)) ([]byte, error) {
+	b, err := util.ToBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	o := util.CipherOption{Algorithm: algorithm}
+	if o.Key, err = util.ToBytes(key); err != nil {
+		return nil, err
+	}
+	if option != nil {
+		o.Mode = cast.ToString(option["mode"])
+		o.Padding = cast.ToString(option["padding"])
+		if o.Iv, err = util.ToBytes(option["iv"]); err != nil {
+			return nil, err
+		}
+	}
+	return fn(b, o)
+}
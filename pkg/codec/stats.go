@@ -0,0 +1,76 @@
+package codec
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 计算p99的最近执行耗时个数
+const latencySamples = 1024
+
+var statsMap sync.Map
+
+// 产品脚本执行统计
+type ScriptStats struct {
+	Calls    int64   `json:"calls"`
+	Errors   int64   `json:"errors"`
+	Timeouts int64   `json:"timeouts"`
+	Rejects  int64   `json:"rejects"` // 等待空闲引擎超时
+	P99      float64 `json:"p99"`     // 最近执行耗时的p99(毫秒)
+}
+
+type scriptStats struct {
+	calls    atomic.Int64
+	errors   atomic.Int64
+	timeouts atomic.Int64
+	rejects  atomic.Int64
+
+	mutex     sync.Mutex
+	latencies []time.Duration
+	next      int
+}
+
+func getStats(productId string) *scriptStats {
+	val, _ := statsMap.LoadOrStore(productId, &scriptStats{})
+	return val.(*scriptStats)
+}
+
+func (s *scriptStats) observe(cost time.Duration, err error) {
+	s.calls.Add(1)
+	if err != nil {
+		s.errors.Add(1)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.latencies) < latencySamples {
+		s.latencies = append(s.latencies, cost)
+	} else {
+		s.latencies[s.next] = cost
+		s.next = (s.next + 1) % latencySamples
+	}
+}
+
+func (s *scriptStats) p99() time.Duration {
+	s.mutex.Lock()
+	latencies := append([]time.Duration{}, s.latencies...)
+	s.mutex.Unlock()
+	if len(latencies) == 0 {
+		return 0
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return latencies[(len(latencies)*99-1)/100]
+}
+
+// 查询产品脚本的执行统计
+func GetScriptStats(productId string) ScriptStats {
+	s := getStats(productId)
+	return ScriptStats{
+		Calls:    s.calls.Load(),
+		Errors:   s.errors.Load(),
+		Timeouts: s.timeouts.Load(),
+		Rejects:  s.rejects.Load(),
+		P99:      float64(s.p99().Microseconds()) / 1000,
+	}
+}
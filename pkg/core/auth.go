@@ -0,0 +1,104 @@
+package core
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"go-iot/pkg/util"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// 签名时间戳允许的偏差(秒), 产品配置signWindow可修改
+	CONFIG_SIGN_WINDOW  = "signWindow"
+	defaultSignWindow   = 300
+	signPasswordPartNum = 3
+	// 设备数据中最后一次认证通过的签名时间戳
+	dataSignTimestamp = "signTimestamp"
+)
+
+var ErrSignPassword = errors.New("invalid sign password")
+
+// 签名时间戳的检查与记录, deviceId -> *sync.Mutex
+var signLocks sync.Map
+
+// 生成签名密码, 格式为signMethod:timestamp:sign
+// sign为使用设备密钥对clientId+timestamp的hmac签名(hex), timestamp为毫秒时间戳
+func SignPassword(secret, clientId, signMethod string, timestamp int64) (string, error) {
+	ts := strconv.FormatInt(timestamp, 10)
+	sign, err := util.HmacEncrypt([]byte(clientId+ts), []byte(secret), signMethod)
+	if err != nil {
+		return "", err
+	}
+	return signMethod + ":" + ts + ":" + hex.EncodeToString(sign), nil
+}
+
+// 校验签名密码, sign可以为hex或base64, 时间戳超出window时拒绝以防止重放
+func VerifySignPassword(secret, clientId, password string, window time.Duration) error {
+	parts := strings.SplitN(password, ":", signPasswordPartNum)
+	if len(parts) != signPasswordPartNum {
+		return ErrSignPassword
+	}
+	signMethod, ts, sign := parts[0], parts[1], parts[2]
+	timestamp, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return ErrSignPassword
+	}
+	diff := time.Since(time.UnixMilli(timestamp))
+	if diff > window || diff < -window {
+		return fmt.Errorf("sign timestamp expired: %s", ts)
+	}
+	expect, err := util.HmacEncrypt([]byte(clientId+ts), []byte(secret), signMethod)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(expect)), []byte(strings.ToLower(sign))) == 1 ||
+		subtle.ConstantTimeCompare([]byte(base64.StdEncoding.EncodeToString(expect)), []byte(sign)) == 1 {
+		return nil
+	}
+	return ErrSignPassword
+}
+
+// 使用设备密钥校验签名密码, 设备未设置密钥时返回错误
+// 时间戳需要大于上一次认证通过的时间戳, 防止在时间窗口内重放, 每次连接都需要重新生成签名
+func (d *Device) VerifySign(clientId, password string) error {
+	if len(d.Secret) == 0 {
+		return fmt.Errorf("device [%s] secret not set", d.Id)
+	}
+	window := defaultSignWindow
+	if v, err := strconv.Atoi(d.GetConfig(CONFIG_SIGN_WINDOW)); err == nil && v > 0 {
+		window = v
+	}
+	err := VerifySignPassword(d.Secret, clientId, password, time.Duration(window)*time.Second)
+	if err != nil {
+		return err
+	}
+	timestamp, _ := strconv.ParseInt(strings.SplitN(password, ":", signPasswordPartNum)[1], 10, 64)
+	lock, _ := signLocks.LoadOrStore(d.Id, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+	if last, err := strconv.ParseInt(GetDeviceData(d.Id, dataSignTimestamp), 10, 64); err == nil && timestamp <= last {
+		return fmt.Errorf("sign timestamp replayed: %d", timestamp)
+	}
+	SetDeviceData(d.Id, dataSignTimestamp, strconv.FormatInt(timestamp, 10))
+	return nil
+}
+
+// 设备认证, 使用设备密钥校验签名密码(clientId为设备id), 用于tcp, websocket, http等在脚本中认证
+func (ctx *BaseContext) AuthDevice(deviceId string, password string) bool {
+	device := GetDevice(strings.TrimSpace(deviceId))
+	if device == nil || device.ProductId != ctx.ProductId {
+		return false
+	}
+	err := device.VerifySign(device.Id, password)
+	if err != nil {
+		DebugLog(device.Id, device.ProductId, "auth fail: "+err.Error())
+		return false
+	}
+	return true
+}
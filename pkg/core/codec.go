@@ -27,9 +27,35 @@ func RegCodec(productId string, c Codec) {
 	codecMap.Store(productId, c)
 }
 
+// 创建并注册编解码器
 func NewCodec(codecId, productId, script string) (Codec, error) {
-	c, err := codecFactory[codecId](productId, script)
-	return c, err
+	c, err := CreateCodec(codecId, productId, script)
+	if err != nil {
+		return nil, err
+	}
+	RegisterCodec(productId, c)
+	return c, nil
+}
+
+// 创建编解码器但不注册, 用于生效前校验脚本与配置, 校验通过后调用RegisterCodec
+func CreateCodec(codecId, productId, script string) (Codec, error) {
+	return codecFactory[codecId](productId, script)
+}
+
+// 注册后需要处理的编解码器, 如脚本编解码注册后随脚本库更新重新编译
+type RegisteredCodec interface {
+	Registered(productId string)
+}
+
+// 注册编解码器, 同时注册设备生命周期
+func RegisterCodec(productId string, c Codec) {
+	RegCodec(productId, c)
+	if lifecycle, ok := c.(DeviceLifecycle); ok {
+		RegDeviceLifeCycle(productId, lifecycle)
+	}
+	if registered, ok := c.(RegisteredCodec); ok {
+		registered.Registered(productId)
+	}
 }
 
 var codecFactory = map[string]func(productId, script string) (Codec, error){}
@@ -37,6 +37,13 @@ type (
 		// 连接关闭
 		OnClose(ctx MessageContext) error
 	}
+	// 属性读写，编解码可选实现
+	PropertyCodec interface {
+		// 读取属性, ctx.GetReadProperties()为要读取的属性
+		OnReadProperty(ctx FuncInvokeContext) error
+		// 写入属性, ctx.GetMessage().Data为要写入的属性值
+		OnWriteProperty(ctx FuncInvokeContext) error
+	}
 	DeviceLifecycle interface {
 		// 设备发布
 		OnDeviceDeploy(ctx DeviceLifecycleContext) error
@@ -156,6 +163,7 @@ type Device struct {
 	CreateId   int64             `json:"-"`
 	Config     map[string]string `json:"-"`
 	Name       string            `json:"name"`
+	Secret     string            `json:"-"` // 设备密钥, 用于签名认证
 }
 
 func (d *Device) GetId() string {
@@ -289,6 +297,10 @@ func (ctx *BaseContext) GetSession() Session {
 	return ctx.Session
 }
 
+func (ctx *BaseContext) GetDeviceId() string {
+	return ctx.DeviceId
+}
+
 func (ctx *BaseContext) GetMessage() any {
 	return nil
 }
@@ -315,11 +327,39 @@ func (ctx *BaseContext) SaveProperties(data map[string]any) {
 	if data[tsl.PropertyDeviceId] == "" {
 		panic(errors.New("SaveProperties error: deviceId is empty"))
 	}
+	deviceId := fmt.Sprintf("%v", data[tsl.PropertyDeviceId])
+	propMap := p.GetTsl().PropertiesMap()
+	// 不满足约束的属性不保存
+	invalid := validData(deviceId, ctx.ProductId, "SaveProperties", propMap, data)
+	for key := range invalid {
+		delete(data, key)
+	}
+	// 不可上报的属性不保存, 等待读取、写入回复的属性除外
+	dropped := len(invalid)
+	for key := range data {
+		if prop, ok := propMap[key]; ok && !prop.HasAccessMode(tsl.AccessModeReport) && !pendingProps.has(deviceId, key) {
+			delete(data, key)
+			dropped++
+			DebugLog(deviceId, ctx.ProductId, fmt.Sprintf("SaveProperties property [%s] is not reportable", key))
+		}
+	}
+	// 影子中只保存物模型中的属性
+	reported := map[string]any{}
+	for key, val := range data {
+		if _, ok := propMap[key]; ok {
+			reported[key] = val
+		}
+	}
+	if dropped > 0 && len(reported) == 0 {
+		return
+	}
 	err := p.GetTimeSeries().SaveProperties(p, data)
 	if err != nil {
 		logs.Errorf("SaveProperties error: %v", err)
-		DebugLog(fmt.Sprintf("%v", data[tsl.PropertyDeviceId]), ctx.ProductId, "SaveProperties error: "+err.Error())
+		DebugLog(deviceId, ctx.ProductId, "SaveProperties error: "+err.Error())
+		return
 	}
+	UpdateShadowReported(deviceId, reported)
 }
 
 // 保存设备事件的时序数据
@@ -342,10 +382,96 @@ func (ctx *BaseContext) SaveEvents(eventId string, data any) {
 	if data1[tsl.PropertyDeviceId] == "" {
 		panic(errors.New("SaveEvents error: deviceId is empty"))
 	}
+	deviceId := fmt.Sprintf("%v", data1[tsl.PropertyDeviceId])
+	// 不满足约束的事件不保存
+	if event, ok := p.GetTsl().EventsMap()[eventId]; ok {
+		propMap := map[string]tsl.Property{eventId: event}
+		if obj, ok := event.IsObject(); ok {
+			propMap = obj.PropertiesMap()
+		}
+		if len(validData(deviceId, ctx.ProductId, "SaveEvents", propMap, data1)) > 0 {
+			return
+		}
+	}
 	err := p.GetTimeSeries().SaveEvents(p, eventId, data1)
 	if err != nil {
 		logs.Errorf("SaveEvents error: %v", err)
-		DebugLog(fmt.Sprintf("%v", data1[tsl.PropertyDeviceId]), ctx.ProductId, "SaveEvents error: "+err.Error())
+		DebugLog(deviceId, ctx.ProductId, "SaveEvents error: "+err.Error())
+	}
+}
+
+// 获取网关下的子设备，不是当前网关的子设备时返回nil
+func (ctx *BaseContext) GetChildDevice(childId string) *Device {
+	child := GetDevice(strings.TrimSpace(childId))
+	if child == nil {
+		logs.Warnf("child device [%s] not exist or noActive", childId)
+		return nil
+	}
+	if !child.IsSubDevice() || child.ParentId != ctx.DeviceId {
+		logs.Warnf("device [%s] is not child of gateway [%s]", childId, ctx.DeviceId)
+		return nil
+	}
+	return child
+}
+
+// 子设备上线，子设备使用网关的会话通讯
+func (ctx *BaseContext) ChildDeviceOnline(childId string) {
+	child := ctx.GetChildDevice(childId)
+	if child == nil || ctx.GetSession() == nil {
+		return
+	}
+	oldSession := GetSession(child.Id)
+	replace := oldSession != nil
+	PutSession(child.Id, newChildSession(child.Id, ctx.GetSession()), replace)
+	putChild(ctx.DeviceId, child.Id)
+}
+
+// 子设备离线
+func (ctx *BaseContext) ChildDeviceOffline(childId string) {
+	child := ctx.GetChildDevice(childId)
+	if child == nil {
+		return
+	}
+	DelSession(child.Id)
+}
+
+// 保存子设备属性的时序数据
+func (ctx *BaseContext) SaveChildProperties(childId string, data map[string]any) {
+	child := ctx.GetChildDevice(childId)
+	if child == nil {
+		return
+	}
+	// 复制一份，不修改调用方的数据
+	data1 := make(map[string]any, len(data)+1)
+	for k, v := range data {
+		data1[k] = v
+	}
+	data1[tsl.PropertyDeviceId] = child.Id
+	childCtx := &BaseContext{DeviceId: child.Id, ProductId: child.ProductId, device: child}
+	childCtx.SaveProperties(data1)
+}
+
+// 保存子设备事件的时序数据
+func (ctx *BaseContext) SaveChildEvents(childId string, eventId string, data any) {
+	child := ctx.GetChildDevice(childId)
+	if child == nil {
+		return
+	}
+	childCtx := &BaseContext{DeviceId: child.Id, ProductId: child.ProductId, device: child}
+	childCtx.SaveEvents(eventId, data)
+}
+
+// 子设备命令回复成功
+func (ctx *BaseContext) ReplyChildOk(childId string) {
+	if ctx.GetChildDevice(childId) != nil {
+		replyMap.reply(childId, &FuncInvokeReply{Success: true})
+	}
+}
+
+// 子设备命令回复失败
+func (ctx *BaseContext) ReplyChildFail(childId string, resp string) {
+	if ctx.GetChildDevice(childId) != nil {
+		replyMap.reply(childId, &FuncInvokeReply{Success: false, Msg: resp})
 	}
 }
 
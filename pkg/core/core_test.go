@@ -0,0 +1,309 @@
+package core_test
+
+import (
+	"encoding/base64"
+	_ "go-iot/pkg/codec"
+	"go-iot/pkg/core"
+	"go-iot/pkg/logger"
+	"go-iot/pkg/store"
+	_ "go-iot/pkg/timeseries"
+	"go-iot/pkg/tsl"
+	"go-iot/pkg/util"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const gatewayScript = `
+function OnMessage(context) {
+	context.ChildDeviceOnline("child-1")
+	context.SaveChildProperties("child-1", {"temp": 1})
+}
+function OnInvoke(context) {
+	if (context.GetChildDeviceId() == "child-1") {
+		context.ReplyOk()
+	} else {
+		context.ReplyFail("not child")
+	}
+}
+`
+
+const childTsl = `
+{
+  "functions": [
+    {"id": "switch", "name": "开关", "async": false, "inputs": [{"id": "level", "name": "档位", "type": "int", "max": 3}]}
+  ],
+  "properties": [
+    {"id": "temp", "name": "温度", "type": "int", "max": 100},
+    {"id": "target", "name": "目标温度", "type": "int", "accessMode": ["read", "write"]},
+    {"id": "secret", "name": "密钥", "type": "int", "accessMode": ["write"]}
+  ]
+}
+`
+
+type mockSession struct {
+	deviceId string
+}
+
+func (s *mockSession) Disconnect() error {
+	core.DelSession(s.deviceId)
+	return nil
+}
+func (s *mockSession) GetDeviceId() string {
+	return s.deviceId
+}
+func (s *mockSession) SetDeviceId(deviceId string) {
+	s.deviceId = deviceId
+}
+func (s *mockSession) Close() error {
+	return s.Disconnect()
+}
+func (s *mockSession) GetInfo() map[string]any {
+	return map[string]any{"addr": "127.0.0.1"}
+}
+
+func init() {
+	logger.InitNop()
+	core.RegDeviceStore(store.NewMockDeviceStore())
+	gatewayProduct, _ := core.NewProduct("gateway-product", map[string]string{}, core.TIME_SERISE_MOCK, "")
+	core.PutProduct(gatewayProduct)
+	childProduct, _ := core.NewProduct("child-product", map[string]string{}, core.TIME_SERISE_MOCK, childTsl)
+	core.PutProduct(childProduct)
+
+	gateway := core.NewDevice("gateway-1", gatewayProduct.Id, 0)
+	gateway.DeviceType = core.GATEWAY
+	core.PutDevice(gateway)
+	child := core.NewDevice("child-1", childProduct.Id, 0)
+	child.DeviceType = core.SUBDEVICE
+	child.ParentId = gateway.Id
+	core.PutDevice(child)
+	other := core.NewDevice("child-2", childProduct.Id, 0)
+	other.DeviceType = core.SUBDEVICE
+	other.ParentId = "gateway-2"
+	core.PutDevice(other)
+}
+
+func TestSubDevice(t *testing.T) {
+	c, err := core.NewCodec(core.Script_Codec, "gateway-product", gatewayScript)
+	assert.Nil(t, err)
+
+	// 子设备未上线，网关未上线
+	resp := core.DoCmdInvoke(core.FuncInvoke{DeviceId: "child-1", FunctionId: "switch"})
+	assert.NotNil(t, resp)
+
+	session := &mockSession{}
+	ctx := &core.BaseContext{ProductId: "gateway-product", Session: session}
+	ctx.DeviceOnline("gateway-1")
+	assert.NotNil(t, core.GetSession("gateway-1"))
+
+	err = c.OnMessage(ctx)
+	assert.Nil(t, err)
+	childSession := core.GetSession("child-1")
+	assert.NotNil(t, childSession)
+	assert.Equal(t, "child-1", childSession.GetDeviceId())
+	assert.Equal(t, "gateway-1", childSession.GetInfo()["parentId"])
+	assert.Equal(t, core.ONLINE, core.GetDeviceState("child-1", "child-product"))
+
+	// 不是当前网关的子设备
+	ctx.ChildDeviceOnline("child-2")
+	assert.Nil(t, core.GetSession("child-2"))
+
+	// 通过网关调用子设备
+	resp = core.DoCmdInvoke(core.FuncInvoke{DeviceId: "child-1", FunctionId: "switch"})
+	assert.Nil(t, resp)
+
+	// 子设备离线后不能调用
+	ctx.ChildDeviceOffline("child-1")
+	resp = core.DoCmdInvoke(core.FuncInvoke{DeviceId: "child-1", FunctionId: "switch"})
+	assert.NotNil(t, resp)
+	ctx.ChildDeviceOnline("child-1")
+
+	// 网关下线子设备一起下线
+	session.Disconnect()
+	assert.Nil(t, core.GetSession("gateway-1"))
+	assert.Nil(t, core.GetSession("child-1"))
+}
+
+const shadowScript = `
+function OnShadowDelta(context) {
+	context.SaveProperties(context.GetMessage().Data)
+}
+`
+
+func TestShadow(t *testing.T) {
+	_, err := core.NewCodec(core.Script_Codec, "child-product", shadowScript)
+	assert.Nil(t, err)
+	device := core.NewDevice("shadow-1", "child-product", 0)
+	core.PutDevice(device)
+
+	ctx := &core.BaseContext{DeviceId: "shadow-1", ProductId: "child-product"}
+	ctx.SaveProperties(map[string]any{"temp": 10, "unknown": 1})
+	shadow := core.GetShadow("shadow-1")
+	assert.Equal(t, 10, shadow.Reported["temp"].Value)
+	assert.NotContains(t, shadow.Reported, "unknown")
+	assert.Greater(t, shadow.Reported["temp"].Timestamp, int64(0))
+
+	core.UpdateShadowDesired("shadow-1", map[string]any{"temp": 20})
+	assert.Equal(t, map[string]any{"temp": 20}, core.GetShadow("shadow-1").Delta())
+
+	// 设备不在线不下发
+	assert.Nil(t, core.PushShadowDelta("shadow-1"))
+	assert.Equal(t, 10, core.GetShadow("shadow-1").Reported["temp"].Value)
+
+	session := &mockSession{}
+	online := &core.BaseContext{ProductId: "child-product", Session: session}
+	online.DeviceOnline("shadow-1")
+	assert.Nil(t, core.PushShadowDelta("shadow-1"))
+	assert.Equal(t, 20, core.GetShadow("shadow-1").Reported["temp"].Value)
+	assert.Empty(t, core.GetShadow("shadow-1").Delta())
+
+	core.UpdateShadowDesired("shadow-1", map[string]any{"temp": nil})
+	assert.Empty(t, core.GetShadow("shadow-1").Desired)
+	session.Disconnect()
+}
+
+const propertyScript = `
+function OnReadProperty(context) {
+	var data = {}
+	var props = context.GetReadProperties()
+	for (var i = 0; i < props.length; i++) {
+		data[props[i]] = 25
+	}
+	context.SaveProperties(data)
+	context.ReplyOk()
+}
+function OnWriteProperty(context) {
+	context.SaveProperties(context.GetMessage().Data)
+	context.ReplyOk()
+}
+`
+
+func TestReadWriteProperty(t *testing.T) {
+	core.PutProduct(&core.Product{Id: "property-product", StorePolicy: core.TIME_SERISE_MOCK, TslData: core.GetProduct("child-product").TslData})
+	_, err := core.NewCodec(core.Script_Codec, "property-product", propertyScript)
+	assert.Nil(t, err)
+	device := core.NewDevice("property-1", "property-product", 0)
+	core.PutDevice(device)
+	session := &mockSession{}
+	ctx := &core.BaseContext{ProductId: "property-product", Session: session}
+	ctx.DeviceOnline("property-1")
+	defer session.Disconnect()
+
+	resp := core.DoReadProperty(core.FuncInvoke{DeviceId: "property-1", Data: map[string]any{"properties": []string{"temp", "target"}}})
+	assert.Nil(t, resp)
+	assert.EqualValues(t, 25, core.GetShadow("property-1").Reported["temp"].Value)
+
+	resp = core.DoWriteProperty(core.FuncInvoke{DeviceId: "property-1", Data: map[string]any{"target": 30}})
+	assert.Nil(t, resp)
+	assert.EqualValues(t, 30, core.GetShadow("property-1").Reported["target"].Value)
+
+	// 不可写入
+	resp = core.DoWriteProperty(core.FuncInvoke{DeviceId: "property-1", Data: map[string]any{"temp": 30}})
+	assert.NotNil(t, resp)
+	// 不存在
+	resp = core.DoReadProperty(core.FuncInvoke{DeviceId: "property-1", Data: map[string]any{"properties": []string{"none"}}})
+	assert.NotNil(t, resp)
+
+	// 没有读取时不可上报的属性不保存
+	msgCtx := &core.BaseContext{DeviceId: "property-1", ProductId: "property-product"}
+	msgCtx.SaveProperties(map[string]any{"secret": 1})
+	assert.NotContains(t, core.GetShadow("property-1").Reported, "secret")
+	// 读取的回复通过OnMessage上报
+	resp = core.DoReadProperty(core.FuncInvoke{DeviceId: "property-1", Data: map[string]any{"properties": []string{"target"}}})
+	assert.Nil(t, resp)
+	msgCtx.SaveProperties(map[string]any{"target": 40})
+	assert.EqualValues(t, 40, core.GetShadow("property-1").Reported["target"].Value)
+}
+
+func TestValidData(t *testing.T) {
+	core.NewCodec(core.Script_Codec, "child-product", shadowScript)
+	device := core.NewDevice("valid-1", "child-product", 0)
+	core.PutDevice(device)
+
+	count := core.GetInvalidDataCount("child-product")
+	ctx := &core.BaseContext{DeviceId: "valid-1", ProductId: "child-product"}
+	ctx.SaveProperties(map[string]any{"temp": 200})
+	assert.Equal(t, count+1, core.GetInvalidDataCount("child-product"))
+	assert.NotContains(t, core.GetShadow("valid-1").Reported, "temp")
+
+	ctx.SaveProperties(map[string]any{"temp": 50, "target": "abc"})
+	assert.Equal(t, count+2, core.GetInvalidDataCount("child-product"))
+	assert.EqualValues(t, 50, core.GetShadow("valid-1").Reported["temp"].Value)
+	assert.NotContains(t, core.GetShadow("valid-1").Reported, "target")
+
+	// 不可上报的属性不保存
+	ctx.SaveProperties(map[string]any{"temp": 60, "secret": 1})
+	assert.EqualValues(t, 60, core.GetShadow("valid-1").Reported["temp"].Value)
+	assert.NotContains(t, core.GetShadow("valid-1").Reported, "secret")
+	ctx.SaveProperties(map[string]any{"secret": 2})
+	assert.NotContains(t, core.GetShadow("valid-1").Reported, "secret")
+
+	session := &mockSession{}
+	online := &core.BaseContext{ProductId: "child-product", Session: session}
+	online.DeviceOnline("valid-1")
+	defer session.Disconnect()
+	resp := core.DoCmdInvoke(core.FuncInvoke{DeviceId: "valid-1", FunctionId: "switch", Data: map[string]any{"level": 5}})
+	assert.NotNil(t, resp)
+	assert.Equal(t, 400, resp.Code)
+	assert.Equal(t, count+3, core.GetInvalidDataCount("child-product"))
+}
+
+func TestMigrateModel(t *testing.T) {
+	product := core.GetProduct("child-product")
+	model := tsl.TslData{}
+	err := model.FromJson(`{"properties": [{"id": "temp", "name": "温度", "type": "string"}]}`)
+	assert.Nil(t, err)
+
+	changes, err := core.MigrateModel(product, product.GetTsl(), model, false)
+	assert.Equal(t, core.ErrIncompatibleModel, err)
+	assert.True(t, tsl.HasIncompatible(changes))
+
+	_, err = core.MigrateModel(product, product.GetTsl(), model, true)
+	assert.Nil(t, err)
+	_, err = core.MigrateModel(product, nil, model, false)
+	assert.Nil(t, err)
+}
+
+func TestSignPassword(t *testing.T) {
+	now := time.Now().UnixMilli()
+	password, err := core.SignPassword("secret-1", "sign-1", "sha256", now)
+	assert.Nil(t, err)
+	assert.Nil(t, core.VerifySignPassword("secret-1", "sign-1", password, time.Minute))
+	assert.NotNil(t, core.VerifySignPassword("secret-2", "sign-1", password, time.Minute))
+	assert.NotNil(t, core.VerifySignPassword("secret-1", "sign-2", password, time.Minute))
+	assert.NotNil(t, core.VerifySignPassword("secret-1", "sign-1", "abc", time.Minute))
+
+	// 超出时间窗口
+	expired, err := core.SignPassword("secret-1", "sign-1", "sha1", now-10*time.Minute.Milliseconds())
+	assert.Nil(t, err)
+	assert.NotNil(t, core.VerifySignPassword("secret-1", "sign-1", expired, time.Minute))
+
+	// base64签名
+	ts := strconv.FormatInt(now, 10)
+	sign, err := util.HmacEncrypt([]byte("sign-1"+ts), []byte("secret-1"), "md5")
+	assert.Nil(t, err)
+	assert.Nil(t, core.VerifySignPassword("secret-1", "sign-1", "md5:"+ts+":"+base64.StdEncoding.EncodeToString(sign), time.Minute))
+
+	device := core.NewDevice("sign-1", "child-product", 0)
+	assert.NotNil(t, device.VerifySign("sign-1", password))
+	device.Secret = "secret-1"
+	core.PutDevice(device)
+	assert.Nil(t, device.VerifySign("sign-1", password))
+	// 重放与更早的时间戳拒绝
+	assert.NotNil(t, device.VerifySign("sign-1", password))
+	earlier, err := core.SignPassword("secret-1", "sign-1", "sha256", now-1)
+	assert.Nil(t, err)
+	assert.NotNil(t, device.VerifySign("sign-1", earlier))
+	password, err = core.SignPassword("secret-1", "sign-1", "sha256", now+1)
+	assert.Nil(t, err)
+	ctx := &core.BaseContext{ProductId: "child-product"}
+	assert.True(t, ctx.AuthDevice("sign-1", password))
+	assert.False(t, ctx.AuthDevice("sign-1", password))
+	assert.False(t, ctx.AuthDevice("sign-1", expired))
+	password, err = core.SignPassword("secret-1", "sign-1", "sha256", now+2)
+	assert.Nil(t, err)
+	ctx.ProductId = "other-product"
+	assert.False(t, ctx.AuthDevice("sign-1", password))
+}
@@ -8,6 +8,8 @@ import (
 	"go-iot/pkg/cluster"
 	"go-iot/pkg/common"
 	"go-iot/pkg/redis"
+	"go-iot/pkg/tsl"
+	"sort"
 	"sync"
 	"time"
 
@@ -49,27 +51,83 @@ func DoCmdInvokeCluster(message FuncInvoke) {
 // 进行功能调用
 func DoCmdInvoke(message FuncInvoke) *common.Err {
 	device := GetDevice(message.DeviceId)
+	if device == nil {
+		return common.NewErr400(fmt.Sprintf("设备[%s]不存在或未启用", message.DeviceId))
+	}
 	productId := device.ProductId
-	state := GetDeviceState(message.DeviceId, productId)
+	// 子设备通过网关的会话与编解码进行调用
+	gateway := device
+	if device.IsSubDevice() {
+		gateway = GetDevice(device.ParentId)
+		if gateway == nil {
+			return common.NewErr400(fmt.Sprintf("子设备[%s]的网关[%s]不存在或未启用", device.Id, device.ParentId))
+		}
+	}
+	state := GetDeviceState(gateway.Id, gateway.ProductId)
 	if OFFLINE == state {
 		return common.NewErr400("设备已离线")
 	}
-	session := GetSession(message.DeviceId)
+	// 子设备离线后不再通过网关调用
+	if device.IsSubDevice() && OFFLINE == GetDeviceState(device.Id, device.ProductId) {
+		return common.NewErr400(fmt.Sprintf("子设备[%s]已离线", device.Id))
+	}
+	session := GetSession(gateway.Id)
 	product := GetProduct(productId)
 	if product == nil {
 		return common.NewErr400(fmt.Sprintf("产品[%s]不存在，请确产品已发布", productId))
 	}
-	codec := GetCodec(productId)
+	codec := GetCodec(gateway.ProductId)
 	if codec == nil {
-		return common.NewErr400(fmt.Sprintf("产品[%s]没有配置编解码", productId))
+		return common.NewErr400(fmt.Sprintf("产品[%s]没有配置编解码", gateway.ProductId))
 	}
-	tslF := product.GetTsl().FunctionsMap()
-	if len(tslF) == 0 {
-		return common.NewErr400(fmt.Sprintf("产品[%s]没有配置功能", productId))
+	if len(message.Kind) == 0 {
+		message.Kind = FUNC_INVOKE
 	}
-	function, ok := tslF[message.FunctionId]
-	if !ok {
-		return common.NewErr400(fmt.Sprintf("功能[%s]不存在", message.FunctionId))
+	// 根据调用类型检查物模型，并得到编解码调用方法
+	var async bool
+	var invoke func(ctx FuncInvokeContext) error
+	var propertyIds []string
+	switch message.Kind {
+	case READ_PROPERTY, WRITE_PROPERTY:
+		propCodec, ok := codec.(PropertyCodec)
+		if !ok {
+			return common.NewErr400(fmt.Sprintf("产品[%s]的编解码不支持属性读写", gateway.ProductId))
+		}
+		mode, call := tsl.AccessModeRead, propCodec.OnReadProperty
+		if message.Kind == WRITE_PROPERTY {
+			mode, call = tsl.AccessModeWrite, propCodec.OnWriteProperty
+		}
+		if err := checkPropertyAccess(product, message, mode); err != nil {
+			return err
+		}
+		propertyIds = message.PropertyIds()
+		if message.Kind == WRITE_PROPERTY {
+			if err := validInvokeData(product, message, product.GetTsl().PropertiesMap()); err != nil {
+				return err
+			}
+		}
+		async = message.Async == "true"
+		invoke = call
+	case FUNC_INVOKE:
+		tslF := product.GetTsl().FunctionsMap()
+		if len(tslF) == 0 {
+			return common.NewErr400(fmt.Sprintf("产品[%s]没有配置功能", productId))
+		}
+		function, ok := tslF[message.FunctionId]
+		if !ok {
+			return common.NewErr400(fmt.Sprintf("功能[%s]不存在", message.FunctionId))
+		}
+		inputs := map[string]tsl.Property{}
+		for _, p := range function.Inputs {
+			inputs[p.GetId()] = p
+		}
+		if err := validInvokeData(product, message, inputs); err != nil {
+			return err
+		}
+		async = message.Async == "true" || function.Async
+		invoke = codec.OnInvoke
+	default:
+		return common.NewErr400(fmt.Sprintf("调用类型[%s]不支持", message.Kind))
 	}
 	if len(message.TraceId) == 0 {
 		message.TraceId = uuid.NewString()
@@ -85,23 +143,27 @@ func DoCmdInvoke(message FuncInvoke) *common.Err {
 	)
 	invokeContext := FuncInvokeContext{
 		BaseContext: BaseContext{
-			DeviceId:  message.DeviceId,
-			ProductId: productId,
+			DeviceId:  gateway.Id,
+			ProductId: gateway.ProductId,
 			Session:   session,
 		},
 		message: message,
 	}
-	async := message.Async == "true" || function.Async
+	if device.IsSubDevice() {
+		invokeContext.childDeviceId = device.Id
+	}
+	timeout := (time.Second * 10)
+	if message.Timeout > 0 {
+		timeout = time.Duration(message.Timeout) * time.Second
+	}
+	// 回复可能通过OnMessage异步上报, 等待期间放行读取、写入的属性
+	pendingProps.add(message.DeviceId, propertyIds, timeout)
 	if async {
 		go func() {
-			codec.OnInvoke(invokeContext)
+			invoke(invokeContext)
 		}()
 		return nil
 	} else {
-		timeout := (time.Second * 10)
-		if message.Timeout > 0 {
-			timeout = time.Duration(time.Second * 10)
-		}
 		err := replyMap.addReply(&message, timeout)
 		if err != nil {
 			return common.NewErr500(err.Error())
@@ -112,14 +174,14 @@ func DoCmdInvoke(message FuncInvoke) *common.Err {
 
 		message.Replay = make(chan *FuncInvokeReply)
 		go func(ctx context.Context) {
-			err := codec.OnInvoke(invokeContext)
+			err := invoke(invokeContext)
 			if nil != err {
 				message.Replay <- &FuncInvokeReply{Success: false, Msg: err.Error()}
 			}
 		}(ctx)
 		select {
 		case <-ctx.Done():
-			err = fmt.Errorf("功能[%s]调用超时", message.FunctionId)
+			err = fmt.Errorf("%s调用超时", message.name())
 			replyLogSync(product, message, &FuncInvokeReply{Success: false, Msg: err.Error()})
 			return common.NewErr504(err.Error())
 		case resp := <-message.Replay:
@@ -139,6 +201,51 @@ func DoCmdInvoke(message FuncInvoke) *common.Err {
 	}
 }
 
+// 读取设备属性
+func DoReadProperty(message FuncInvoke) *common.Err {
+	message.Kind = READ_PROPERTY
+	return DoCmdInvoke(message)
+}
+
+// 写入设备属性
+func DoWriteProperty(message FuncInvoke) *common.Err {
+	message.Kind = WRITE_PROPERTY
+	return DoCmdInvoke(message)
+}
+
+// 校验调用参数是否满足物模型约束
+func validInvokeData(product *Product, message FuncInvoke, propMap map[string]tsl.Property) *common.Err {
+	errs := validData(message.DeviceId, product.GetId(), string(message.Type()), propMap, message.Data)
+	if len(errs) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(errs))
+	for key := range errs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return common.NewErr400(fmt.Sprintf("参数[%s]不正确: %v", keys[0], errs[keys[0]]))
+}
+
+// 检查属性是否存在以及访问模式
+func checkPropertyAccess(product *Product, message FuncInvoke, mode string) *common.Err {
+	propMap := product.GetTsl().PropertiesMap()
+	ids := message.PropertyIds()
+	if len(ids) == 0 {
+		return common.NewErr400("属性不能为空")
+	}
+	for _, id := range ids {
+		p, ok := propMap[id]
+		if !ok {
+			return common.NewErr400(fmt.Sprintf("属性[%s]不存在", id))
+		}
+		if !p.HasAccessMode(mode) {
+			return common.NewErr400(fmt.Sprintf("属性[%s]不支持%s", id, mode))
+		}
+	}
+	return nil
+}
+
 // 同步命令回复
 func replyLogSync(product *Product, message FuncInvoke, reply *FuncInvokeReply) {
 	if product != nil {
@@ -172,12 +279,32 @@ func replyLogAsync(product *Product, deviceId string, reply *FuncInvokeReply) {
 // 功能调用
 type FuncInvokeContext struct {
 	BaseContext
-	message FuncInvoke
+	message       FuncInvoke
+	childDeviceId string // 调用子设备时为子设备id，DeviceId为网关id
 }
 
 func (ctx *FuncInvokeContext) DeviceOnline(deviceId string) {
 }
 
+// 获取要读取的属性id，readProperty调用时有值
+func (ctx *FuncInvokeContext) GetReadProperties() []string {
+	return ctx.message.ReadProperties()
+}
+
+// 获取被调用的子设备id，不是子设备调用时为空
+func (ctx *FuncInvokeContext) GetChildDeviceId() string {
+	return ctx.childDeviceId
+}
+
+// 回复被调用的设备(子设备调用时回复子设备)
+func (ctx *FuncInvokeContext) ReplyOk() {
+	replyMap.reply(ctx.message.DeviceId, &FuncInvokeReply{Success: true})
+}
+
+func (ctx *FuncInvokeContext) ReplyFail(resp string) {
+	replyMap.reply(ctx.message.DeviceId, &FuncInvokeReply{Success: false, Msg: resp})
+}
+
 func (ctx *FuncInvokeContext) GetMessage() interface{} {
 	return ctx.message
 }
@@ -224,3 +351,50 @@ func (r *funcInvokeReplyManager) reply(deviceId string, resp *FuncInvokeReply) {
 func (r *funcInvokeReplyManager) deleteReply(deviceId string) {
 	r.m.Delete(deviceId)
 }
+
+// 等待回复的读取、写入属性, deviceId -> 属性id -> 过期时间
+var pendingProps = &pendingPropertyManager{m: map[string]map[string]time.Time{}}
+
+type pendingPropertyManager struct {
+	sync.Mutex
+	m map[string]map[string]time.Time
+}
+
+func (r *pendingPropertyManager) add(deviceId string, ids []string, exprie time.Duration) {
+	if len(ids) == 0 {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	props, ok := r.m[deviceId]
+	if !ok {
+		props = map[string]time.Time{}
+		r.m[deviceId] = props
+	}
+	expireAt := time.Now().Add(exprie)
+	for _, id := range ids {
+		props[id] = expireAt
+	}
+}
+
+// 属性是否在等待读取、写入的回复
+func (r *pendingPropertyManager) has(deviceId string, id string) bool {
+	r.Lock()
+	defer r.Unlock()
+	props, ok := r.m[deviceId]
+	if !ok {
+		return false
+	}
+	now := time.Now()
+	for key, expireAt := range props {
+		if now.After(expireAt) {
+			delete(props, key)
+		}
+	}
+	if len(props) == 0 {
+		delete(r.m, deviceId)
+		return false
+	}
+	_, ok = props[id]
+	return ok
+}
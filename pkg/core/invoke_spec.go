@@ -1,9 +1,16 @@
 package core
 
+import (
+	"fmt"
+	"sort"
+)
+
 type MessageType string
 
 const (
-	FUNC_INVOKE = "FuncInvoke" // 功能调用
+	FUNC_INVOKE    = "FuncInvoke"    // 功能调用
+	READ_PROPERTY  = "readProperty"  // 读取属性
+	WRITE_PROPERTY = "writeProperty" // 写入属性
 )
 
 // 功能调用
@@ -16,10 +23,54 @@ type FuncInvoke struct {
 	Async      string                 `json:"async,omitempty"` // 是否异步执行，为"true"时将覆盖物模型的配置
 	Timeout    int                    `json:"timeout"`         // 同步调用时指定timeout可以覆盖默认超时时间
 	Replay     chan *FuncInvokeReply  `json:"-"`
+	Kind       MessageType            `json:"kind,omitempty"` // 调用类型，为空时是功能调用
 }
 
 func (p *FuncInvoke) Type() MessageType {
-	return FUNC_INVOKE
+	if len(p.Kind) == 0 {
+		return FUNC_INVOKE
+	}
+	return p.Kind
+}
+
+// 要读取的属性id, 保存在Data.properties中
+func (p *FuncInvoke) ReadProperties() []string {
+	var ids []string
+	switch props := p.Data["properties"].(type) {
+	case []string:
+		ids = props
+	case []any:
+		for _, id := range props {
+			ids = append(ids, fmt.Sprintf("%v", id))
+		}
+	}
+	return ids
+}
+
+// 读取、写入属性调用涉及的属性id
+func (p *FuncInvoke) PropertyIds() []string {
+	switch p.Kind {
+	case READ_PROPERTY:
+		return p.ReadProperties()
+	case WRITE_PROPERTY:
+		ids := make([]string, 0, len(p.Data))
+		for id := range p.Data {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		return ids
+	}
+	return nil
+}
+
+func (p *FuncInvoke) name() string {
+	switch p.Kind {
+	case READ_PROPERTY:
+		return "属性读取"
+	case WRITE_PROPERTY:
+		return "属性写入"
+	}
+	return fmt.Sprintf("功能[%s]", p.FunctionId)
 }
 
 type FuncInvokeReply struct {
@@ -22,19 +22,86 @@ func PutSession(deviceId string, session Session, replace bool) {
 	device := GetDevice(deviceId)
 	if device != nil && !replace {
 		DeviceOnlineEvent(deviceId, device.GetProductId())
+		go PushShadowDelta(deviceId)
 	}
 }
 
 // 从Session管理器中删除设备Session
 func DelSession(deviceId string) {
-	if _, ok := sessionManager.LoadAndDelete(deviceId); ok {
+	if val, ok := sessionManager.LoadAndDelete(deviceId); ok {
+		if child, ok := val.(*ChildSession); ok {
+			delChild(child.parent.GetDeviceId(), deviceId)
+		}
 		device := GetDevice(deviceId)
 		if device != nil {
 			DeviceOfflineEvent(deviceId, device.GetProductId())
 		}
+		// 网关下线时子设备一起下线
+		if children, ok := childrenManager.LoadAndDelete(deviceId); ok {
+			children.(*sync.Map).Range(func(key, _ any) bool {
+				DelSession(key.(string))
+				return true
+			})
+		}
+	}
+}
+
+// 网关下的子设备, gatewayId -> *sync.Map(childId)
+var childrenManager sync.Map
+
+func putChild(gatewayId, childId string) {
+	val, _ := childrenManager.LoadOrStore(gatewayId, &sync.Map{})
+	val.(*sync.Map).Store(childId, struct{}{})
+}
+
+func delChild(gatewayId, childId string) {
+	if val, ok := childrenManager.Load(gatewayId); ok {
+		val.(*sync.Map).Delete(childId)
 	}
 }
 
+// 子设备会话，子设备没有自己的连接，通过网关的会话通讯
+type ChildSession struct {
+	deviceId string
+	parent   Session
+}
+
+func newChildSession(deviceId string, parent Session) *ChildSession {
+	return &ChildSession{deviceId: deviceId, parent: parent}
+}
+
+// 子设备离线，不会断开网关连接
+func (s *ChildSession) Disconnect() error {
+	DelSession(s.deviceId)
+	return nil
+}
+
+func (s *ChildSession) GetDeviceId() string {
+	return s.deviceId
+}
+
+func (s *ChildSession) SetDeviceId(deviceId string) {
+}
+
+func (s *ChildSession) Close() error {
+	DelSession(s.deviceId)
+	return nil
+}
+
+func (s *ChildSession) GetInfo() map[string]any {
+	info := map[string]any{}
+	for k, v := range s.parent.GetInfo() {
+		info[k] = v
+	}
+	info["parentId"] = s.parent.GetDeviceId()
+	return info
+}
+
+// 获取网关会话
+func (s *ChildSession) GetParent() Session {
+	return s.parent
+}
+
 // 设备上线事件
 func DeviceOnlineEvent(deviceId, productId string) {
 	evt := eventbus.NewOnlineMessage(deviceId, productId)
@@ -111,4 +178,10 @@ type DeviceStore interface {
 	PutProduct(product *Product)
 	// 删除产品
 	DelProduct(productId string)
+	// 获取设备影子
+	GetShadow(deviceId string) *Shadow
+	// 保存设备影子, section为reported或desired
+	PutShadow(deviceId string, section string, values map[string]ShadowValue)
+	// 删除设备影子中的属性
+	DelShadow(deviceId string, section string, keys ...string)
 }
@@ -0,0 +1,147 @@
+package core
+
+import (
+	"fmt"
+	"go-iot/pkg/tsl"
+	"time"
+
+	logs "go-iot/pkg/logger"
+)
+
+const (
+	SHADOW_REPORTED = "reported" // 设备上报的状态
+	SHADOW_DESIRED  = "desired"  // 期望的状态
+)
+
+type (
+	// 影子属性值
+	ShadowValue struct {
+		Value     any   `json:"value"`
+		Timestamp int64 `json:"timestamp"` // 更新时间(毫秒)
+	}
+	// 设备影子
+	Shadow struct {
+		DeviceId string                 `json:"deviceId"`
+		Reported map[string]ShadowValue `json:"reported"`
+		Desired  map[string]ShadowValue `json:"desired"`
+	}
+	// 影子差异下发，编解码可选实现
+	ShadowCodec interface {
+		// 设备上线或期望值变更时下发差异, ctx.GetMessage().Data为差异数据
+		OnShadowDelta(ctx FuncInvokeContext) error
+	}
+)
+
+func NewShadow(deviceId string) *Shadow {
+	return &Shadow{
+		DeviceId: deviceId,
+		Reported: map[string]ShadowValue{},
+		Desired:  map[string]ShadowValue{},
+	}
+}
+
+// 期望值与上报值的差异
+func (s *Shadow) Delta() map[string]any {
+	delta := map[string]any{}
+	for key, desired := range s.Desired {
+		reported, ok := s.Reported[key]
+		if !ok || fmt.Sprintf("%v", reported.Value) != fmt.Sprintf("%v", desired.Value) {
+			delta[key] = desired.Value
+		}
+	}
+	return delta
+}
+
+// 获取设备影子
+func GetShadow(deviceId string) *Shadow {
+	return defaultStore.GetShadow(deviceId)
+}
+
+// 更新设备上报的状态
+func UpdateShadowReported(deviceId string, data map[string]any) {
+	values := toShadowValues(data)
+	if len(values) == 0 {
+		return
+	}
+	defaultStore.PutShadow(deviceId, SHADOW_REPORTED, values)
+}
+
+// 更新设备期望的状态, 值为nil时删除期望值
+func UpdateShadowDesired(deviceId string, data map[string]any) {
+	var dels []string
+	for key, val := range data {
+		if val == nil {
+			dels = append(dels, key)
+			delete(data, key)
+		}
+	}
+	if len(dels) > 0 {
+		defaultStore.DelShadow(deviceId, SHADOW_DESIRED, dels...)
+	}
+	values := toShadowValues(data)
+	if len(values) > 0 {
+		defaultStore.PutShadow(deviceId, SHADOW_DESIRED, values)
+	}
+}
+
+func toShadowValues(data map[string]any) map[string]ShadowValue {
+	now := time.Now().UnixMilli()
+	values := map[string]ShadowValue{}
+	for key, val := range data {
+		if key == tsl.PropertyDeviceId || key == "createTime" {
+			continue
+		}
+		values[key] = ShadowValue{Value: val, Timestamp: now}
+	}
+	return values
+}
+
+// 下发影子差异到设备，设备不在线或没有差异时不处理
+func PushShadowDelta(deviceId string) error {
+	device := GetDevice(deviceId)
+	if device == nil {
+		return nil
+	}
+	shadow := GetShadow(deviceId)
+	if shadow == nil {
+		return nil
+	}
+	delta := shadow.Delta()
+	if len(delta) == 0 {
+		return nil
+	}
+	// 子设备通过网关下发
+	gateway := device
+	if device.IsSubDevice() {
+		gateway = GetDevice(device.ParentId)
+		if gateway == nil {
+			return nil
+		}
+	}
+	session := GetSession(gateway.Id)
+	if session == nil {
+		return nil
+	}
+	codec, ok := GetCodec(gateway.ProductId).(ShadowCodec)
+	if !ok {
+		return nil
+	}
+	ctx := FuncInvokeContext{
+		BaseContext: BaseContext{
+			DeviceId:  gateway.Id,
+			ProductId: gateway.ProductId,
+			Session:   session,
+		},
+		message: FuncInvoke{DeviceId: deviceId, Data: delta},
+	}
+	if device.IsSubDevice() {
+		ctx.childDeviceId = device.Id
+	}
+	err := codec.OnShadowDelta(ctx)
+	if err != nil && err != ErrFunctionNotImpl {
+		logs.Errorf("device [%s] push shadow delta error: %v", deviceId, err)
+		DebugLog(deviceId, device.ProductId, "push shadow delta error: "+err.Error())
+		return err
+	}
+	return nil
+}
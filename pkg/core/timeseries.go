@@ -1,6 +1,7 @@
 package core
 
 import (
+	"errors"
 	"go-iot/pkg/tsl"
 	"log"
 	"sync"
@@ -57,6 +58,27 @@ type TimeSeriesSave interface {
 	Del(product *Product) error
 }
 
+// 模型迁移, 时序数据存储策略可选实现, 未实现时直接发布模型
+type TimeSeriesMigrate interface {
+	// 从已发布的模型old迁移到model, force为true时允许不兼容的变更
+	MigrateModel(product *Product, old, model tsl.TslData, force bool) error
+}
+
+var ErrIncompatibleModel = errors.New("物模型存在不兼容的类型变更")
+
+// 发布模型, old为上一次发布的物模型, 存在不兼容的变更且未强制时拒绝发布
+func MigrateModel(product *Product, old *tsl.TslData, model tsl.TslData, force bool) ([]tsl.TslChange, error) {
+	changes := tsl.Diff(old, &model)
+	if tsl.HasIncompatible(changes) && !force {
+		return changes, ErrIncompatibleModel
+	}
+	ts := product.GetTimeSeries()
+	if m, ok := ts.(TimeSeriesMigrate); ok && old != nil {
+		return changes, m.MigrateModel(product, *old, model, force)
+	}
+	return changes, ts.PublishModel(product, model)
+}
+
 type LogData struct {
 	Type       string `json:"type"`
 	TraceId    string `json:"traceId"`
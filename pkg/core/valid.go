@@ -0,0 +1,43 @@
+package core
+
+import (
+	"fmt"
+	"go-iot/pkg/tsl"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	logs "go-iot/pkg/logger"
+)
+
+// 不满足物模型约束的数据计数, productId -> *atomic.Int64
+var invalidDataCounter sync.Map
+
+// 获取产品不满足物模型约束的数据个数
+func GetInvalidDataCount(productId string) int64 {
+	if val, ok := invalidDataCounter.Load(productId); ok {
+		return val.(*atomic.Int64).Load()
+	}
+	return 0
+}
+
+// 校验数据，不满足约束的数据输出到调试日志并计数，返回是否有不满足约束的数据
+func validData(deviceId, productId, source string, propMap map[string]tsl.Property, data map[string]any) map[string]error {
+	errs := tsl.ValidData(propMap, data)
+	if len(errs) == 0 {
+		return errs
+	}
+	val, _ := invalidDataCounter.LoadOrStore(productId, &atomic.Int64{})
+	val.(*atomic.Int64).Add(int64(len(errs)))
+	keys := make([]string, 0, len(errs))
+	for key := range errs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		msg := fmt.Sprintf("%s invalid data [%s]: %v", source, key, errs[key])
+		logs.Debugf("device [%s] %s", deviceId, msg)
+		DebugLog(deviceId, productId, msg)
+	}
+	return errs
+}
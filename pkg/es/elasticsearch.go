@@ -45,6 +45,13 @@ func getEsClient() (*elasticsearch.Client, error) {
  * 创建索引模板
  */
 func CreateEsTemplate(properties map[string]any, indexPattern string, templateName string, refresh_interval string) error {
+	return CreateEsTemplateVersion(properties, indexPattern, templateName, refresh_interval, 0)
+}
+
+/**
+ * 创建带版本号的索引模板, version为0时不设置版本
+ */
+func CreateEsTemplateVersion(properties map[string]any, indexPattern string, templateName string, refresh_interval string, version int64) error {
 	settings := map[string]any{
 		"number_of_shards":               DefaultEsConfig.NumberOfShards,
 		"number_of_replicas":             DefaultEsConfig.NumberOfReplicas,
@@ -65,6 +72,9 @@ func CreateEsTemplate(properties map[string]any, indexPattern string, templateNa
 			},
 		},
 	}
+	if version > 0 {
+		payload["version"] = version
+	}
 	data, err := json.Marshal(payload)
 	if err != nil {
 		return fmt.Errorf("%s error: %s", templateName, err.Error())
@@ -85,6 +95,53 @@ func CreateEsTemplate(properties map[string]any, indexPattern string, templateNa
 	return nil
 }
 
+/**
+ * 获取索引模板版本, 模板不存在时返回0
+ */
+func GetEsTemplateVersion(templateName string) (int64, error) {
+	req := esapi.IndicesGetTemplateRequest{
+		Name: []string{templateName},
+	}
+	resp, err := DoRequest(req)
+	if err != nil {
+		return 0, err
+	}
+	if resp.Is404() {
+		return 0, nil
+	}
+	if resp.IsError {
+		return 0, fmt.Errorf("%s error: %s", templateName, resp.Data)
+	}
+	return gjson.Get(resp.Data, "*.version").Int(), nil
+}
+
+/**
+ * 给已存在的索引添加字段
+ */
+func PutEsMapping(properties map[string]any, index ...string) error {
+	data, err := json.Marshal(map[string]any{"properties": properties})
+	if err != nil {
+		return err
+	}
+	logs.Infof(string(data))
+	allowNoIndices := true
+	ignoreUnavailable := true
+	req := esapi.IndicesPutMappingRequest{
+		Index:             index,
+		Body:              bytes.NewReader(data),
+		AllowNoIndices:    &allowNoIndices,
+		IgnoreUnavailable: &ignoreUnavailable,
+	}
+	resp, err := DoRequest(req)
+	if err != nil {
+		return err
+	}
+	if resp.IsError && !resp.Is404() {
+		return fmt.Errorf("%s error: %s", strings.Join(index, ","), resp.Data)
+	}
+	return nil
+}
+
 /**
  * 创建索引
  */
@@ -11,7 +11,7 @@ func InitDb() {
 	orm.RegisterModel(
 		new(User), new(Role), new(UserRelRole),
 		new(MenuResource), new(AuthResource), new(SystemConfig),
-		new(Product), new(Device), new(Network),
+		new(Product), new(ProductTsl), new(ProductScript), new(ScriptLib), new(Device), new(Network),
 		new(Rule), new(RuleRelDevice), new(AlarmLog),
 		new(Notify),
 	)
@@ -133,6 +133,10 @@ func UpdateDevice(ob *models.Device) error {
 		columns = append(columns, "Metaconfig")
 		data["metaconfig"] = ob.Metaconfig
 	}
+	if len(ob.Secret) > 0 {
+		columns = append(columns, "Secret")
+		data["secret"] = ob.Secret
+	}
 	if len(columns) == 0 {
 		return errors.New("no data to update")
 	}
@@ -0,0 +1,224 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"go-iot/pkg/es/orm"
+	"go-iot/pkg/models"
+)
+
+// 脚本版本状态
+const (
+	ScriptActive = "active" // 正式版本
+	ScriptCanary = "canary" // 灰度版本
+)
+
+// 保存脚本版本, 版本号自增
+func AddProductScript(productId, script, comment string, createId int64) (*models.ProductScript, error) {
+	if len(productId) == 0 {
+		return nil, errors.New("productId must be present")
+	}
+	if len(strings.TrimSpace(script)) == 0 {
+		return nil, errors.New("script must be present")
+	}
+	latest, err := GetProductScript(productId, 0)
+	if err != nil {
+		return nil, err
+	}
+	ob := &models.ProductScript{
+		ProductId:  productId,
+		Version:    1,
+		Script:     script,
+		Comment:    comment,
+		CreateId:   createId,
+		CreateTime: models.NewDateTime(),
+	}
+	if latest != nil {
+		ob.Version = latest.Version + 1
+	}
+	o := orm.NewOrm()
+	_, err = o.Insert(ob)
+	if err != nil {
+		return nil, err
+	}
+	return ob, nil
+}
+
+// 查询产品的脚本版本列表, 不包含脚本内容
+func ListProductScript(productId string) ([]models.ProductScript, error) {
+	o := orm.NewOrm()
+	qs := o.QueryTable(models.ProductScript{})
+	qs = qs.Filter("productId", productId)
+	var result []models.ProductScript
+	var cols = []string{"Id", "ProductId", "Version", "Comment", "State", "CanaryDevices", "CanaryPercent", "PrevVersion", "CreateId", "CreateTime"}
+	_, err := qs.Limit(100, 0).OrderBy("-Version").All(&result, cols...)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// 获取指定版本的脚本, version为0时获取最新版本, 不存在时返回nil
+func GetProductScript(productId string, version int) (*models.ProductScript, error) {
+	o := orm.NewOrm()
+	qs := o.QueryTable(models.ProductScript{})
+	qs = qs.Filter("productId", productId)
+	if version > 0 {
+		qs = qs.Filter("version", version)
+	}
+	return firstProductScript(qs)
+}
+
+// 获取正式或灰度版本, 不存在时返回nil
+func GetProductScriptByState(productId, state string) (*models.ProductScript, error) {
+	o := orm.NewOrm()
+	qs := o.QueryTable(models.ProductScript{})
+	qs = qs.Filter("productId", productId)
+	qs = qs.Filter("state", state)
+	return firstProductScript(qs)
+}
+
+func firstProductScript(qs *orm.QuerySeter) (*models.ProductScript, error) {
+	var result []models.ProductScript
+	_, err := qs.Limit(1, 0).OrderBy("-Version").All(&result)
+	if err != nil {
+		return nil, err
+	}
+	if len(result) == 0 {
+		return nil, nil
+	}
+	return &result[0], nil
+}
+
+// 设置正式版本并取消灰度, 回滚时不记录激活前的版本
+func ActivateProductScript(productId string, version int, rollback bool) (*models.ProductScript, error) {
+	ob, err := getProductScriptMust(productId, version)
+	if err != nil {
+		return nil, err
+	}
+	active, err := GetProductScriptByState(productId, ScriptActive)
+	if err != nil {
+		return nil, err
+	}
+	canary, err := GetProductScriptByState(productId, ScriptCanary)
+	if err != nil {
+		return nil, err
+	}
+	if active != nil && active.Version != version {
+		if !rollback {
+			ob.PrevVersion = active.Version
+		}
+		if err = updateProductScriptState(active, ""); err != nil {
+			return nil, err
+		}
+	}
+	if canary != nil && canary.Version != version {
+		if err = updateProductScriptState(canary, ""); err != nil {
+			return nil, err
+		}
+	}
+	if err = updateProductScriptState(ob, ScriptActive); err != nil {
+		return nil, err
+	}
+	return ob, nil
+}
+
+// 设置灰度版本, 按设备id或设备比例灰度
+func CanaryProductScript(productId string, version int, devices []string, percent int) (*models.ProductScript, error) {
+	if len(devices) == 0 && percent <= 0 {
+		return nil, errors.New("canary devices or percent must be present")
+	}
+	if percent < 0 || percent > 100 {
+		return nil, errors.New("canary percent must be between 0 and 100")
+	}
+	ob, err := getProductScriptMust(productId, version)
+	if err != nil {
+		return nil, err
+	}
+	if ob.State == ScriptActive {
+		return nil, fmt.Errorf("script version [%d] is active", version)
+	}
+	canary, err := GetProductScriptByState(productId, ScriptCanary)
+	if err != nil {
+		return nil, err
+	}
+	if canary != nil && canary.Version != version {
+		if err = updateProductScriptState(canary, ""); err != nil {
+			return nil, err
+		}
+	}
+	ob.CanaryDevices = strings.Join(devices, ",")
+	ob.CanaryPercent = percent
+	if err = updateProductScriptState(ob, ScriptCanary); err != nil {
+		return nil, err
+	}
+	return ob, nil
+}
+
+// 取消灰度, 返回取消的灰度版本, 没有灰度时返回nil
+func CancelCanaryProductScript(productId string) (*models.ProductScript, error) {
+	canary, err := GetProductScriptByState(productId, ScriptCanary)
+	if err != nil || canary == nil {
+		return nil, err
+	}
+	return canary, updateProductScriptState(canary, "")
+}
+
+func getProductScriptMust(productId string, version int) (*models.ProductScript, error) {
+	if version <= 0 {
+		return nil, errors.New("version must be present")
+	}
+	ob, err := GetProductScript(productId, version)
+	if err != nil {
+		return nil, err
+	}
+	if ob == nil {
+		return nil, fmt.Errorf("script version [%d] not exist", version)
+	}
+	return ob, nil
+}
+
+func updateProductScriptState(ob *models.ProductScript, state string) error {
+	ob.State = state
+	if state != ScriptCanary {
+		ob.CanaryDevices = ""
+		ob.CanaryPercent = 0
+	}
+	o := orm.NewOrm()
+	_, err := o.Update(ob, "State", "CanaryDevices", "CanaryPercent", "PrevVersion")
+	return err
+}
+
+func DeleteProductScript(productId string) error {
+	if len(productId) == 0 {
+		return errors.New("productId must be present")
+	}
+	o := orm.NewOrm()
+	_, err := o.Delete(&models.ProductScript{ProductId: productId}, "ProductId")
+	return err
+}
+
+// 所有产品保存的脚本与脚本版本, 按产品id分组, 用于检查脚本库的引用
+func ListAllProductScripts() (map[string][]string, error) {
+	o := orm.NewOrm()
+	var products []models.Product
+	_, err := o.QueryTable(models.Product{}).All(&products, "Id", "Script")
+	if err != nil {
+		return nil, err
+	}
+	var versions []models.ProductScript
+	_, err = o.QueryTable(models.ProductScript{}).All(&versions, "ProductId", "Script")
+	if err != nil {
+		return nil, err
+	}
+	result := map[string][]string{}
+	for _, p := range products {
+		result[p.Id] = append(result[p.Id], p.Script)
+	}
+	for _, v := range versions {
+		result[v.ProductId] = append(result[v.ProductId], v.Script)
+	}
+	return result, nil
+}
@@ -0,0 +1,77 @@
+package models
+
+import (
+	"errors"
+
+	"go-iot/pkg/es/orm"
+	"go-iot/pkg/models"
+)
+
+// 保存发布的物模型, 版本号自增
+func AddProductTsl(productId string, metadata string, createId int64) (*models.ProductTsl, error) {
+	if len(productId) == 0 {
+		return nil, errors.New("productId must be present")
+	}
+	latest, err := GetProductTsl(productId, 0)
+	if err != nil {
+		return nil, err
+	}
+	ob := &models.ProductTsl{
+		ProductId:  productId,
+		Version:    1,
+		Metadata:   metadata,
+		CreateId:   createId,
+		CreateTime: models.NewDateTime(),
+	}
+	if latest != nil {
+		ob.Version = latest.Version + 1
+	}
+	o := orm.NewOrm()
+	_, err = o.Insert(ob)
+	if err != nil {
+		return nil, err
+	}
+	return ob, nil
+}
+
+// 查询产品的物模型版本列表, 不包含物模型内容
+func ListProductTsl(productId string) ([]models.ProductTsl, error) {
+	o := orm.NewOrm()
+	qs := o.QueryTable(models.ProductTsl{})
+	qs = qs.Filter("productId", productId)
+	var result []models.ProductTsl
+	var cols = []string{"Id", "ProductId", "Version", "CreateId", "CreateTime"}
+	_, err := qs.Limit(100, 0).OrderBy("-Version").All(&result, cols...)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// 获取指定版本的物模型, version为0时获取最新版本, 不存在时返回nil
+func GetProductTsl(productId string, version int) (*models.ProductTsl, error) {
+	o := orm.NewOrm()
+	qs := o.QueryTable(models.ProductTsl{})
+	qs = qs.Filter("productId", productId)
+	if version > 0 {
+		qs = qs.Filter("version", version)
+	}
+	var result []models.ProductTsl
+	_, err := qs.Limit(1, 0).OrderBy("-Version").All(&result)
+	if err != nil {
+		return nil, err
+	}
+	if len(result) == 0 {
+		return nil, nil
+	}
+	return &result[0], nil
+}
+
+func DeleteProductTsl(productId string) error {
+	if len(productId) == 0 {
+		return errors.New("productId must be present")
+	}
+	o := orm.NewOrm()
+	_, err := o.Delete(&models.ProductTsl{ProductId: productId}, "ProductId")
+	return err
+}
@@ -102,6 +102,42 @@ type Product struct {
 	CreateTime  DateTime       `json:"createTime" orm:"column(create_time_)"`
 }
 
+// 产品物模型版本
+type ProductTsl struct {
+	Id         int64    `json:"id" orm:"pk;column(id_);auto"`
+	ProductId  string   `json:"productId" orm:"column(product_id_);size(32);description(产品ID)"`
+	Version    int      `json:"version" orm:"column(version_);description(版本号)"`
+	Metadata   string   `json:"metadata,omitempty" orm:"column(meta_data_);null;description(物模型)"`
+	CreateId   int64    `json:"createId" orm:"column(create_id_);null"`
+	CreateTime DateTime `json:"createTime" orm:"column(create_time_)"`
+}
+
+// 产品编解码脚本版本
+type ProductScript struct {
+	Id            int64    `json:"id" orm:"pk;column(id_);auto"`
+	ProductId     string   `json:"productId" orm:"column(product_id_);size(32);description(产品ID)"`
+	Version       int      `json:"version" orm:"column(version_);description(版本号)"`
+	Script        string   `json:"script,omitempty" orm:"column(script_);null;description(脚本)"`
+	Comment       string   `json:"comment" orm:"column(comment_);null;description(版本说明)"`
+	State         string   `json:"state" orm:"column(state_);size(16);null;description(active正式版本, canary灰度版本)"`
+	CanaryDevices string   `json:"canaryDevices,omitempty" orm:"column(canary_devices_);null;description(灰度设备id, 逗号分隔)"`
+	CanaryPercent int      `json:"canaryPercent,omitempty" orm:"column(canary_percent_);null;description(灰度设备比例)"`
+	PrevVersion   int      `json:"prevVersion,omitempty" orm:"column(prev_version_);null;description(激活前的正式版本, 用于回滚)"`
+	CreateId      int64    `json:"createId" orm:"column(create_id_);null"`
+	CreateTime    DateTime `json:"createTime" orm:"column(create_time_)"`
+}
+
+// 脚本库, 产品脚本与规则脚本通过require("name")或require("name@version")引用
+type ScriptLib struct {
+	Id         int64    `json:"id" orm:"pk;column(id_);auto"`
+	Name       string   `json:"name" orm:"column(name_);size(64);description(库名)"`
+	Version    int      `json:"version" orm:"column(version_);description(版本号)"`
+	Script     string   `json:"script,omitempty" orm:"column(script_);null;description(脚本)"`
+	Desc       string   `json:"desc" orm:"column(desc_);null;description(说明)"`
+	CreateId   int64    `json:"createId" orm:"column(create_id_);null"`
+	CreateTime DateTime `json:"createTime" orm:"column(create_time_)"`
+}
+
 // 设备
 type Device struct {
 	Id         string         `json:"id,omitempty" orm:"pk;column(id_);size(32);description(设备ID)"`
@@ -111,6 +147,7 @@ type Device struct {
 	State      string         `json:"state,omitempty" orm:"column(state_);size(10);description(online,offline,unknow,noActive)"`
 	DeviceType string         `json:"deviceType,omitempty" orm:"column(device_type_);size(32);null;description(设备类型device,gateway,subdevice)"`
 	Metaconfig string         `json:"metaconfig,omitempty" orm:"column(meta_config_);null;description(配置属性)"`
+	Secret     string         `json:"secret,omitempty" orm:"column(secret_);size(64);null;description(设备密钥)"`
 	Tag        map[string]any `json:"tag,omitempty" orm:"column(tag_);null;description(标签)"`
 	Desc       string         `json:"desc,omitempty" orm:"column(desc_);description(产品说明)"`
 	CreateId   int64          `json:"createId,omitempty" orm:"column(create_id_);null"`
@@ -122,6 +159,7 @@ func (dev Device) ToDeviceOper() *core.Device {
 	devopr.ParentId = dev.ParentId
 	devopr.DeviceType = dev.DeviceType
 	devopr.Name = dev.Name
+	devopr.Secret = dev.Secret
 	return devopr
 }
 
@@ -136,6 +174,8 @@ type Network struct {
 	State         string   `json:"state" orm:"column(state_);size(10);description(运行状态runing,stop)"`    //运行状态runing,stop
 	CertBase64    string   `json:"certBase64" orm:"column(cert_base64_);null;description(crt文件base64)"` // crt文件base64
 	KeyBase64     string   `json:"keyBase64" orm:"column(key_base64_);null;description(key文件base64)"`   // key文件base64
+	CaBase64      string   `json:"caBase64" orm:"column(ca_base64_);null;description(客户端CA证书base64)"`   // 客户端CA证书base64
+	CrlBase64     string   `json:"crlBase64" orm:"column(crl_base64_);null;description(证书吊销列表base64)"`  // 证书吊销列表base64
 	CreateId      int64    `json:"createId" orm:"column(create_id_);null"`
 	CreateTime    DateTime `json:"createTime" orm:"column(create_time_)"`
 }
@@ -57,13 +57,10 @@ func AddNetWork(ob *models.Network) error {
 		if ob.Port <= 1024 || ob.Port > 65535 {
 			return errors.New("invalid port number")
 		}
-		rs, err := GetNetworkByPort(ob.Port)
+		err := CheckPort(ob)
 		if err != nil {
 			return err
 		}
-		if rs != nil && rs.Id > 0 {
-			return fmt.Errorf("端口[%d]已被使用", ob.Port)
-		}
 	}
 	if len(ob.ProductId) > 0 {
 		nw, err := GetByProductId(ob.ProductId)
@@ -115,6 +112,12 @@ func UpdateNetwork(ob *models.Network) error {
 	if len(ob.KeyBase64) > 0 {
 		cols = append(cols, "KeyBase64")
 	}
+	if len(ob.CaBase64) > 0 {
+		cols = append(cols, "CaBase64")
+	}
+	if len(ob.CrlBase64) > 0 {
+		cols = append(cols, "CrlBase64")
+	}
 	if len(cols) == 0 {
 		return nil
 	}
@@ -178,6 +181,21 @@ func GetNetworkByPort(port int32) (*models.Network, error) {
 	}
 }
 
+// 检查端口是否可以使用, 相同类型的服务可以共用端口, 按路由规则区分产品
+func CheckPort(ob *models.Network) error {
+	rs, err := GetNetworkByPort(ob.Port)
+	if err != nil {
+		return err
+	}
+	if rs == nil || rs.Id == 0 || rs.Id == ob.Id {
+		return nil
+	}
+	if rs.Type == ob.Type && network.IsSharedType(ob.Type) {
+		return nil
+	}
+	return fmt.Errorf("端口[%d]已被使用", ob.Port)
+}
+
 func GetUnuseNetwork() (*models.Network, error) {
 	o := orm.NewOrm()
 	qs := o.QueryTable(&models.Network{})
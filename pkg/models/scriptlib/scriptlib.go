@@ -0,0 +1,104 @@
+package scriptlib
+
+import (
+	"errors"
+	"go-iot/pkg/models"
+
+	"go-iot/pkg/es/orm"
+)
+
+// 查询时不包含脚本内容的列
+var listCols = []string{"Id", "Name", "Version", "Desc", "CreateId", "CreateTime"}
+
+// 保存脚本库的新版本, 版本号自增
+func AddScriptLib(ob *models.ScriptLib) error {
+	if len(ob.Name) == 0 {
+		return errors.New("name must be present")
+	}
+	latest, err := GetScriptLib(ob.Name, 0)
+	if err != nil {
+		return err
+	}
+	ob.Version = 1
+	if latest != nil {
+		ob.Version = latest.Version + 1
+	}
+	ob.CreateTime = models.NewDateTime()
+	o := orm.NewOrm()
+	_, err = o.Insert(ob)
+	return err
+}
+
+// 查询所有脚本库的最新版本, 不包含脚本内容
+func ListScriptLib() ([]models.ScriptLib, error) {
+	o := orm.NewOrm()
+	qs := o.QueryTable(models.ScriptLib{})
+	var list []models.ScriptLib
+	_, err := qs.Limit(1000, 0).OrderBy("-Version").All(&list, listCols...)
+	if err != nil {
+		return nil, err
+	}
+	result := []models.ScriptLib{}
+	exist := map[string]bool{}
+	for _, v := range list {
+		if !exist[v.Name] {
+			exist[v.Name] = true
+			result = append(result, v)
+		}
+	}
+	return result, nil
+}
+
+// 查询脚本库的版本列表, 不包含脚本内容
+func ListScriptLibVersions(name string) ([]models.ScriptLib, error) {
+	o := orm.NewOrm()
+	qs := o.QueryTable(models.ScriptLib{})
+	qs = qs.Filter("name", name)
+	var result []models.ScriptLib
+	_, err := qs.Limit(100, 0).OrderBy("-Version").All(&result, listCols...)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// 查询所有脚本库的所有版本, 启动时加载
+func ListAllScriptLib() ([]models.ScriptLib, error) {
+	o := orm.NewOrm()
+	qs := o.QueryTable(models.ScriptLib{})
+	var result []models.ScriptLib
+	_, err := qs.Limit(10000, 0).OrderBy("Version").All(&result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// 获取脚本库的指定版本, version为0时获取最新版本, 不存在时返回nil
+func GetScriptLib(name string, version int) (*models.ScriptLib, error) {
+	o := orm.NewOrm()
+	qs := o.QueryTable(models.ScriptLib{})
+	qs = qs.Filter("name", name)
+	if version > 0 {
+		qs = qs.Filter("version", version)
+	}
+	var result []models.ScriptLib
+	_, err := qs.Limit(1, 0).OrderBy("-Version").All(&result)
+	if err != nil {
+		return nil, err
+	}
+	if len(result) == 0 {
+		return nil, nil
+	}
+	return &result[0], nil
+}
+
+// 删除脚本库的所有版本
+func DeleteScriptLib(name string) error {
+	if len(name) == 0 {
+		return errors.New("name must be present")
+	}
+	o := orm.NewOrm()
+	_, err := o.Delete(&models.ScriptLib{Name: name}, "Name")
+	return err
+}
@@ -0,0 +1,150 @@
+package clients_test
+
+import (
+	"fmt"
+	_ "go-iot/pkg/codec"
+	"go-iot/pkg/core"
+	"go-iot/pkg/logger"
+	"go-iot/pkg/network"
+	"go-iot/pkg/network/clients"
+	_ "go-iot/pkg/network/clients/tcp"
+	"go-iot/pkg/store"
+	_ "go-iot/pkg/timeseries"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	logger.InitNop()
+	core.RegDeviceStore(store.NewMockDeviceStore())
+	core.PutProduct(&core.Product{Id: "client-product", Config: map[string]string{}, StorePolicy: "mock"})
+}
+
+func TestBackoff(t *testing.T) {
+	r := clients.ReconnectConf{MinInterval: 100, MaxInterval: 1000, Multiplier: 2, Jitter: 0.2}
+	for i, want := range []int{100, 200, 400, 800, 1000, 1000} {
+		d := r.Backoff(i)
+		assert.GreaterOrEqual(t, d, time.Duration(float64(want)*0.8)*time.Millisecond)
+		assert.LessOrEqual(t, d, time.Duration(float64(want)*1.2)*time.Millisecond)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	assert.Nil(t, err)
+	defer l.Close()
+	conns := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+		}
+	}()
+
+	device := core.NewDevice("client-1", "client-product", 0)
+	device.Config["host"] = "localhost"
+	device.Config["port"] = fmt.Sprint(l.Addr().(*net.TCPAddr).Port)
+	core.PutDevice(device)
+	conf := network.NetworkConf{
+		ProductId: "client-product",
+		Type:      string(network.TCP_CLIENT),
+		CodecId:   core.Script_Codec,
+		Script:    "function OnMessage(context) {}",
+		Configuration: `{"delimeter": {"type":"Delimited", "delimited":"\n"},
+		"reconnect": {"enable": true, "minInterval": 50, "maxInterval": 200}}`,
+	}
+	assert.Nil(t, clients.Connect(device.Id, conf))
+	conn := <-conns
+	assert.NotNil(t, core.GetSession(device.Id))
+	assert.Equal(t, clients.StateConnected, clients.GetStatus(device.Id)["state"])
+
+	// 远端断开后离线并自动重连
+	conn.Close()
+	assert.Eventually(t, func() bool {
+		return clients.GetStatus(device.Id)["state"] == clients.StateReconnecting
+	}, time.Second, 5*time.Millisecond)
+	select {
+	case conn = <-conns:
+	case <-time.After(2 * time.Second):
+		t.Fatal("not reconnected")
+	}
+	assert.Eventually(t, func() bool {
+		return core.GetSession(device.Id) != nil && clients.GetStatus(device.Id)["state"] == clients.StateConnected
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, 0, clients.GetStatus(device.Id)["retries"])
+
+	// 主动断开时不重连
+	clients.Stop(device.Id)
+	core.GetSession(device.Id).Disconnect()
+	select {
+	case <-conns:
+		t.Fatal("should not reconnect")
+	case <-time.After(300 * time.Millisecond):
+	}
+	assert.Nil(t, core.GetSession(device.Id))
+	assert.Equal(t, clients.StateDisconnected, clients.GetStatus(device.Id)["state"])
+}
+
+func TestReload(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	assert.Nil(t, err)
+	defer l.Close()
+	conns := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+		}
+	}()
+
+	device := core.NewDevice("client-2", "client-product", 0)
+	device.Config["host"] = "localhost"
+	device.Config["port"] = fmt.Sprint(l.Addr().(*net.TCPAddr).Port)
+	core.PutDevice(device)
+	conf := network.NetworkConf{
+		ProductId:     "client-product",
+		Type:          string(network.TCP_CLIENT),
+		CodecId:       core.Script_Codec,
+		Script:        "function OnMessage(context) {}",
+		Configuration: `{"delimeter": {"type":"Delimited", "delimited":"\n"}}`,
+	}
+	assert.Nil(t, clients.Connect(device.Id, conf))
+	defer clients.Stop(device.Id)
+	conn := <-conns
+	defer conn.Close()
+	session := core.GetSession(device.Id)
+	assert.NotNil(t, session)
+
+	// 重连配置在线生效, 不断开连接
+	conf.Configuration = `{"delimeter": {"type":"Delimited", "delimited":"\n"}, "reconnect": {"enable": true}}`
+	result, err := clients.Reload(conf)
+	assert.Nil(t, err)
+	assert.False(t, result.Restart)
+	assert.True(t, session == core.GetSession(device.Id))
+	assert.True(t, clients.ReconnectEnabled(device.Id))
+
+	// 拆包配置变化时重新连接
+	conf.Configuration = `{"delimeter": {"type":"Delimited", "delimited":"\r\n"}, "reconnect": {"enable": true}}`
+	result, err = clients.Reload(conf)
+	assert.Nil(t, err)
+	assert.True(t, result.Restart)
+	assert.Contains(t, result.Reason, "delimeter")
+	select {
+	case conn = <-conns:
+		defer conn.Close()
+	case <-time.After(2 * time.Second):
+		t.Fatal("not reconnected")
+	}
+	assert.NotNil(t, core.GetSession(device.Id))
+	assert.True(t, session != core.GetSession(device.Id))
+	core.GetSession(device.Id).Disconnect()
+}
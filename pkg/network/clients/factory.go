@@ -1,15 +1,19 @@
 package clients
 
 import (
+	"errors"
 	"fmt"
 	"go-iot/pkg/core"
 	"go-iot/pkg/network"
 	"log"
 	"sync"
+
+	logs "go-iot/pkg/logger"
 )
 
 var m sync.Map
 var instances sync.Map
+var supervisors sync.Map
 
 type CreaterFun func() network.NetClient
 
@@ -19,6 +23,7 @@ func RegClient(f CreaterFun) {
 	log.Printf("Register Client [%s]", s.Type())
 }
 
+// 连接设备, 开启重连时连接失败后会在后台继续重连
 func Connect(deviceId string, conf network.NetworkConf) error {
 	t := network.NetType(conf.Type)
 	if f, ok := m.Load(t); ok {
@@ -26,18 +31,80 @@ func Connect(deviceId string, conf network.NetworkConf) error {
 		if err != nil {
 			return err
 		}
-		fun := f.(CreaterFun)
-		s := fun()
-		err = s.Connect(deviceId, conf)
-		if err == nil {
-			instances.Store(deviceId, s)
+		reconnect, err := newReconnectConf(conf)
+		if err != nil {
+			return err
+		}
+		s := &supervisor{
+			deviceId:  deviceId,
+			conf:      conf,
+			reconnect: reconnect,
+			create:    f.(CreaterFun),
 		}
-		return err
+		// 重新连接时关闭之前的连接
+		if old, ok := supervisors.Swap(deviceId, s); ok {
+			old.(*supervisor).stop()
+			if c := GetClient(deviceId); c != nil {
+				c.Close()
+			}
+		}
+		return s.connect()
 	} else {
 		return fmt.Errorf("unknow client type %s", conf.Type)
 	}
 }
 
+// 在线更新产品下客户端设备的网络配置, 编解码脚本与配置立即生效, 已连接的设备不断开
+// 不能在线生效的配置(如地址)会重新连接设备, 未连接的设备在下次重连时使用新的配置
+func Reload(conf network.NetworkConf) (*network.ReloadResult, error) {
+	if _, ok := m.Load(network.NetType(conf.Type)); !ok {
+		return nil, fmt.Errorf("unknow client type %s", conf.Type)
+	}
+	codec, err := core.CreateCodec(conf.CodecId, conf.ProductId, conf.Script)
+	if err != nil {
+		return nil, err
+	}
+	reconnect, err := newReconnectConf(conf)
+	if err != nil {
+		return nil, err
+	}
+	var restart []string
+	var reason error
+	supervisors.Range(func(key, value any) bool {
+		c, err := value.(*supervisor).reload(conf, reconnect)
+		if c != nil && err == nil {
+			err = c.Reload(conf)
+		}
+		if err == nil {
+			return true
+		}
+		if !errors.Is(err, network.ErrRestartRequired) {
+			reason = err
+			return false
+		}
+		if reason == nil {
+			reason = err
+		}
+		restart = append(restart, key.(string))
+		return true
+	})
+	if reason != nil && !errors.Is(reason, network.ErrRestartRequired) {
+		return nil, reason
+	}
+	// 更新成功后才注册新的编解码
+	core.RegisterCodec(conf.ProductId, codec)
+	for _, deviceId := range restart {
+		// 开启重连时连接失败会在后台继续重连
+		if err := Connect(deviceId, conf); err != nil {
+			logs.Warnf("client [%s] reconnect error: %v", deviceId, err)
+		}
+	}
+	if len(restart) == 0 {
+		return &network.ReloadResult{}, nil
+	}
+	return &network.ReloadResult{Restart: true, Reason: reason.Error()}, nil
+}
+
 func GetClient(deviceId string) network.NetClient {
 	s, ok := instances.Load(deviceId)
 	if ok {
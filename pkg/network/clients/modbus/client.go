@@ -13,6 +13,7 @@ func init() {
 }
 
 type Client struct {
+	session *ModbusSession
 }
 
 func NewClient() *Client {
@@ -24,26 +25,37 @@ func (c *Client) Type() network.NetType {
 }
 func (c *Client) Connect(deviceId string, network network.NetworkConf) error {
 	devoper := core.GetDevice(deviceId)
-	tcpInfo, err := createTcpConnectionInfoByConfig(devoper)
+	protocol, info, err := createConnectionInfoByConfig(devoper)
 	if err != nil {
 		return err
 	}
 	session := newSession()
 	session.deviceId = deviceId
 	session.productId = network.ProductId
-	session.tcpInfo = tcpInfo
+	session.protocol = protocol
+	switch info := info.(type) {
+	case *TcpInfo:
+		session.tcpInfo = info
+	case *RtuInfo:
+		session.rtuInfo = info
+	}
 	err = session.connection(func() {})
 	if err != nil {
 		return err
 	}
+	c.session = session
 	core.PutSession(deviceId, session, false)
 	session.readLoop()
 	return nil
 }
 
-func (c *Client) Reload() error {
+// 连接信息来自设备配置, 网络配置中没有需要更新的内容
+func (c *Client) Reload(conf network.NetworkConf) error {
 	return nil
 }
 func (c *Client) Close() error {
+	if c.session != nil {
+		return c.session.Disconnect()
+	}
 	return nil
 }
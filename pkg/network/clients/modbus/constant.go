@@ -3,6 +3,13 @@ package modbus
 const (
 	ProtocolTCP = "modbus-tcp"
 	ProtocolRTU = "modbus-rtu"
+	// rtu帧通过tcp透传, 用于串口服务器
+	ProtocolRTUOverTCP = "modbus-rtu-over-tcp"
+
+	// 连接模式
+	MODE_TCP          = "tcp"
+	MODE_RTU          = "rtu"
+	MODE_RTU_OVER_TCP = "rtuovertcp"
 
 	DISCRETES_INPUT   = "DISCRETES_INPUT"
 	COILS             = "COILS"
@@ -9,6 +9,10 @@ const MODBUS_CODEC = "modbus-script-core"
 
 func init() {
 	core.RegCodecCreator(MODBUS_CODEC, func(productId string, script string) (core.Codec, error) {
+		// 配置了点位表时使用点位表编解码
+		if product := core.GetProduct(productId); product != nil && len(product.GetConfig("points")) > 0 {
+			return NewModbusPointCodec(productId, product.GetConfig("points"))
+		}
 		core, err := NewModbusScriptCodec(productId, script)
 		return core, err
 	})
@@ -26,8 +30,6 @@ func NewModbusScriptCodec(productId string, script string) (core.Codec, error) {
 	sc := &ModbusScriptCodec{
 		ScriptCodec: c.(*codec.ScriptCodec),
 	}
-	core.RegCodec(productId, sc)
-	core.RegDeviceLifeCycle(productId, sc)
 	return sc, nil
 }
 
@@ -54,3 +56,34 @@ func (c *ModbusScriptCodec) OnInvoke(ctx core.FuncInvokeContext) error {
 	})
 	return nil
 }
+
+// 影子差异下发
+func (c *ModbusScriptCodec) OnShadowDelta(ctx core.FuncInvokeContext) error {
+	return c.invoke(codec.On_Shadow_Delta, ctx)
+}
+
+// 读取属性
+func (c *ModbusScriptCodec) OnReadProperty(ctx core.FuncInvokeContext) error {
+	return c.invoke(codec.On_Read_Property, ctx)
+}
+
+// 写入属性
+func (c *ModbusScriptCodec) OnWriteProperty(ctx core.FuncInvokeContext) error {
+	return c.invoke(codec.On_Write_Property, ctx)
+}
+
+func (c *ModbusScriptCodec) invoke(name string, ctx core.FuncInvokeContext) error {
+	sess := ctx.GetSession()
+	s := sess.(*ModbusSession)
+	modbusInvokeContext := &modbusInvokeContext{
+		FuncInvokeContext: ctx,
+	}
+	var err error
+	connErr := s.connection(func() {
+		_, err = c.ScriptCodec.FuncInvoke(name, modbusInvokeContext)
+	})
+	if connErr != nil {
+		return connErr
+	}
+	return err
+}
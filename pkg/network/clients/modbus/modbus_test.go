@@ -0,0 +1,304 @@
+package modbus_test
+
+import (
+	"encoding/binary"
+	"fmt"
+	_ "go-iot/pkg/codec"
+	"go-iot/pkg/core"
+	"go-iot/pkg/logger"
+	"go-iot/pkg/network"
+	"go-iot/pkg/network/clients/modbus"
+	"go-iot/pkg/store"
+	_ "go-iot/pkg/timeseries"
+	"go-iot/pkg/util"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const script = `
+function OnInvoke(context) {
+	var data = context.GetSession().ReadHoldingRegisters(0, 1)
+	context.SaveProperties({"temp": data.MsgToInt16()})
+	context.ReplyOk()
+}
+`
+
+const tslText = `
+{
+  "functions": [{"id": "read", "name": "读取", "async": false}],
+  "properties": [{"id": "temp", "name": "温度", "type": "int"}]
+}
+`
+
+func init() {
+	logger.InitNop()
+	core.RegDeviceStore(store.NewMockDeviceStore())
+}
+
+// 模拟串口服务器后的rtu从站, 保持寄存器初始值为寄存器地址+100
+type slave struct {
+	net.Listener
+	mutex     sync.Mutex
+	requests  int
+	registers [256]uint16
+	coils     [256]bool
+}
+
+func rtuSlave(t *testing.T, slaveId byte) *slave {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	s := &slave{Listener: l}
+	for i := range s.registers {
+		s.registers[i] = uint16(i + 100)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn, slaveId)
+		}
+	}()
+	return s
+}
+
+func (s *slave) port() int {
+	return s.Addr().(*net.TCPAddr).Port
+}
+
+func (s *slave) serve(conn net.Conn, slaveId byte) {
+	defer conn.Close()
+	for {
+		req := make([]byte, 8)
+		_, err := io.ReadFull(conn, req)
+		if err != nil {
+			return
+		}
+		if req[1] == 0x0f || req[1] == 0x10 {
+			// 写多个线圈或寄存器: 地址, 数量, 字节数, 数据, crc
+			more := make([]byte, int(req[6])+1)
+			_, err = io.ReadFull(conn, more)
+			if err != nil {
+				return
+			}
+			req = append(req, more...)
+		}
+		if req[0] != slaveId {
+			continue
+		}
+		s.mutex.Lock()
+		s.requests++
+		start := binary.BigEndian.Uint16(req[2:])
+		count := binary.BigEndian.Uint16(req[4:])
+		var resp []byte
+		switch req[1] {
+		case 0x01:
+			resp = []byte{req[0], req[1], byte((count + 7) / 8)}
+			bits := make([]byte, (count+7)/8)
+			for i := uint16(0); i < count; i++ {
+				if s.coils[start+i] {
+					bits[i/8] |= 1 << (i % 8)
+				}
+			}
+			resp = append(resp, bits...)
+		case 0x03:
+			resp = []byte{req[0], req[1], byte(count * 2)}
+			for i := uint16(0); i < count; i++ {
+				resp = binary.BigEndian.AppendUint16(resp, s.registers[start+i])
+			}
+		case 0x06:
+			s.registers[start] = count
+			resp = req[:6]
+		case 0x0f:
+			s.coils[start] = req[7]&1 > 0
+			resp = req[:6]
+		case 0x10:
+			for i := uint16(0); i < count; i++ {
+				s.registers[start+i] = binary.BigEndian.Uint16(req[7+i*2:])
+			}
+			resp = req[:6]
+		default:
+			// 不支持的功能码
+			resp = []byte{req[0], req[1] | 0x80, 0x01}
+		}
+		s.mutex.Unlock()
+		resp = append(resp, util.CheckSum(resp)...)
+		conn.Write(resp)
+	}
+}
+
+func TestRTUOverTCP(t *testing.T) {
+	l := rtuSlave(t, 1)
+	defer l.Close()
+
+	client, err := modbus.NewDeviceClient(modbus.ProtocolRTUOverTCP, &modbus.TcpInfo{Address: "127.0.0.1", Port: l.port(), UnitID: 1, Timeout: 1})
+	assert.Nil(t, err)
+	err = client.OpenConnection()
+	assert.Nil(t, err)
+	defer client.CloseConnection()
+
+	data, err := client.GetValue(modbus.HOLDING_REGISTERS, 2, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0, 102, 0, 103}, data)
+
+	_, err = client.GetValue(modbus.INPUT_REGISTERS, 0, 1)
+	assert.NotNil(t, err)
+}
+
+func TestRTUOverTCPClient(t *testing.T) {
+	l := rtuSlave(t, 2)
+	defer l.Close()
+
+	product, err := core.NewProduct("modbus-rtu-product", map[string]string{
+		"mode":    modbus.MODE_RTU_OVER_TCP,
+		"address": "127.0.0.1",
+		"port":    fmt.Sprintf("%d", l.port()),
+		"unitID":  "2",
+		"timeout": "1",
+	}, core.TIME_SERISE_MOCK, tslText)
+	assert.Nil(t, err)
+	core.PutProduct(product)
+	_, err = core.NewCodec(modbus.MODBUS_CODEC, product.Id, script)
+	assert.Nil(t, err)
+	device := core.NewDevice("modbus-rtu-1", product.Id, 0)
+	core.PutDevice(device)
+
+	c := modbus.NewClient()
+	err = c.Connect(device.Id, network.NetworkConf{ProductId: product.Id})
+	assert.Nil(t, err)
+	session := core.GetSession(device.Id)
+	assert.NotNil(t, session)
+	defer session.Disconnect()
+
+	resp := core.DoCmdInvoke(core.FuncInvoke{DeviceId: device.Id, FunctionId: "read"})
+	assert.Nil(t, resp)
+	assert.EqualValues(t, 100, core.GetShadow(device.Id).Reported["temp"].Value)
+}
+
+func TestRTUConfig(t *testing.T) {
+	product, err := core.NewProduct("modbus-rtu-config", map[string]string{
+		"mode":    modbus.MODE_RTU,
+		"address": "/dev/not-exist",
+		"unitID":  "1",
+		"parity":  "X",
+	}, core.TIME_SERISE_MOCK, tslText)
+	assert.Nil(t, err)
+	core.PutProduct(product)
+	device := core.NewDevice("modbus-rtu-2", product.Id, 0)
+	core.PutDevice(device)
+
+	c := modbus.NewClient()
+	err = c.Connect(device.Id, network.NetworkConf{ProductId: product.Id})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "parity")
+
+	product.Config["parity"] = "E"
+	err = c.Connect(device.Id, network.NetworkConf{ProductId: product.Id})
+	// 串口不存在
+	assert.NotNil(t, err)
+	assert.Nil(t, core.GetSession(device.Id))
+}
+
+const pointTsl = `
+{
+  "functions": [{"id": "setup", "name": "设置", "async": false, "inputs": [{"id": "target", "name": "目标", "type": "float"}]}],
+  "properties": [
+    {"id": "temp", "name": "温度", "type": "float"},
+    {"id": "energy", "name": "电能", "type": "int"},
+    {"id": "target", "name": "目标", "type": "float", "accessMode": ["read", "write"]},
+    {"id": "name", "name": "名称", "type": "string"},
+    {"id": "switch", "name": "开关", "type": "bool", "accessMode": ["read", "write"]},
+    {"id": "level", "name": "等级", "type": "int", "accessMode": ["read", "write"]}
+  ]
+}
+`
+
+func TestPointCodec(t *testing.T) {
+	l := rtuSlave(t, 3)
+	defer l.Close()
+	// 名称: "ab"
+	l.registers[20] = 0x6162
+	l.registers[21] = 0
+
+	points := `[
+		{"property": "temp", "address": 0, "dataType": "int16", "scale": 0.1, "interval": 1},
+		{"property": "energy", "address": 1, "dataType": "uint32", "wordSwap": true, "interval": 1, "report": "always"},
+		{"property": "target", "address": 3, "dataType": "float32", "interval": 1},
+		{"property": "name", "address": 20, "dataType": "string", "quantity": 2, "interval": -1},
+		{"property": "switch", "table": "coils", "address": 0, "dataType": "bool", "interval": -1},
+		{"property": "level", "address": 30, "dataType": "uint16", "byteSwap": true, "interval": -1}
+	]`
+	product, err := core.NewProduct("modbus-point-product", map[string]string{
+		"mode":    modbus.MODE_RTU_OVER_TCP,
+		"address": "127.0.0.1",
+		"port":    fmt.Sprintf("%d", l.port()),
+		"unitID":  "3",
+		"timeout": "1",
+		"points":  points,
+	}, core.TIME_SERISE_MOCK, pointTsl)
+	assert.Nil(t, err)
+	core.PutProduct(product)
+	c, err := core.NewCodec(modbus.MODBUS_CODEC, product.Id, "")
+	assert.Nil(t, err)
+	assert.IsType(t, &modbus.ModbusPointCodec{}, c)
+	device := core.NewDevice("modbus-point-1", product.Id, 0)
+	core.PutDevice(device)
+
+	err = modbus.NewClient().Connect(device.Id, network.NetworkConf{ProductId: product.Id})
+	assert.Nil(t, err)
+	session := core.GetSession(device.Id)
+	assert.NotNil(t, session)
+	defer session.Disconnect()
+
+	// 相邻的点位一次读取
+	time.Sleep(200 * time.Millisecond)
+	l.mutex.Lock()
+	assert.Equal(t, 1, l.requests)
+	l.mutex.Unlock()
+	reported := core.GetShadow(device.Id).Reported
+	assert.InDelta(t, 10.0, reported["temp"].Value, 0.001)
+	// 字交换: 寄存器1=101, 寄存器2=102
+	assert.EqualValues(t, 102<<16|101, reported["energy"].Value)
+	assert.NotContains(t, reported, "name")
+
+	resp := core.DoWriteProperty(core.FuncInvoke{DeviceId: device.Id, Data: map[string]any{"target": 25.5, "switch": true}})
+	assert.Nil(t, resp)
+	assert.True(t, l.coils[0])
+	resp = core.DoReadProperty(core.FuncInvoke{DeviceId: device.Id, Data: map[string]any{"properties": []string{"target", "name", "switch"}}})
+	assert.Nil(t, resp)
+	reported = core.GetShadow(device.Id).Reported
+	assert.InDelta(t, 25.5, reported["target"].Value, 0.001)
+	assert.Equal(t, "ab", reported["name"].Value)
+	assert.Equal(t, true, reported["switch"].Value)
+
+	// 16位的值同样交换字节
+	resp = core.DoWriteProperty(core.FuncInvoke{DeviceId: device.Id, Data: map[string]any{"level": 0x0102}})
+	assert.Nil(t, resp)
+	l.mutex.Lock()
+	assert.Equal(t, uint16(0x0201), l.registers[30])
+	l.registers[30] = 0x0304
+	l.mutex.Unlock()
+	resp = core.DoReadProperty(core.FuncInvoke{DeviceId: device.Id, Data: map[string]any{"properties": []string{"level"}}})
+	assert.Nil(t, resp)
+	assert.EqualValues(t, 0x0403, core.GetShadow(device.Id).Reported["level"].Value)
+
+	// 功能调用写入同名的点位
+	resp = core.DoCmdInvoke(core.FuncInvoke{DeviceId: device.Id, FunctionId: "setup", Data: map[string]any{"target": 30}})
+	assert.Nil(t, resp)
+	resp = core.DoReadProperty(core.FuncInvoke{DeviceId: device.Id, Data: map[string]any{"properties": []string{"target"}}})
+	assert.Nil(t, resp)
+	assert.InDelta(t, 30, core.GetShadow(device.Id).Reported["target"].Value, 0.001)
+
+	// 点位表错误
+	_, err = core.NewCodec(modbus.MODBUS_POINT_CODEC, product.Id, "")
+	assert.Nil(t, err)
+	product.Config["points"] = `[{"property": "temp", "table": "INPUT_REGISTERS", "dataType": "double"}]`
+	_, err = core.NewCodec(modbus.MODBUS_POINT_CODEC, product.Id, "")
+	assert.NotNil(t, err)
+}
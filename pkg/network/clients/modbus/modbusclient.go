@@ -23,6 +23,8 @@ type ModbusClient struct {
 	TCPClientHandler MODBUS.TCPClientHandler
 	// TCPClientHandler is ued for holding device RTU connection
 	RTUClientHandler MODBUS.RTUClientHandler
+	// RTUOverTCPClientHandler is used for holding RTU frame over TCP connection
+	RTUOverTCPClientHandler *RTUOverTCPClientHandler
 
 	client MODBUS.Client
 }
@@ -34,6 +36,10 @@ func (c *ModbusClient) OpenConnection() error {
 		err = c.TCPClientHandler.Connect()
 		newClient = MODBUS.NewClient(&c.TCPClientHandler)
 		logs.Infof("Modbus client create TCP connection.")
+	} else if c.RTUOverTCPClientHandler != nil {
+		err = c.RTUOverTCPClientHandler.Connect()
+		newClient = MODBUS.NewClient(c.RTUOverTCPClientHandler)
+		logs.Infof("Modbus client create RTU over TCP connection.")
 	} else {
 		err = c.RTUClientHandler.Connect()
 		newClient = MODBUS.NewClient(&c.RTUClientHandler)
@@ -48,6 +54,8 @@ func (c *ModbusClient) CloseConnection() error {
 	if c.IsModbusTcp {
 		err = c.TCPClientHandler.Close()
 
+	} else if c.RTUOverTCPClientHandler != nil {
+		err = c.RTUOverTCPClientHandler.Close()
 	} else {
 		err = c.RTUClientHandler.Close()
 	}
@@ -124,21 +132,23 @@ func (c *ModbusClient) SetValue(parimaryTable string, startingAddress uint16, le
 func NewDeviceClient(protocol string, connectionInfo interface{}) (*ModbusClient, error) {
 	client := new(ModbusClient)
 	var err error
-	var tcpInfo1 *TcpInfo
-	var rtuInfo1 *RtuInfo
-	if protocol == ProtocolTCP {
+	switch protocol {
+	case ProtocolTCP:
+		tcpInfo1 := connectionInfo.(*TcpInfo)
 		client.IsModbusTcp = true
-		tcpInfo1 = connectionInfo.(*TcpInfo)
-	} else {
-		rtuInfo1 = connectionInfo.(*RtuInfo)
-	}
-	if client.IsModbusTcp {
 		client.TCPClientHandler.Address = fmt.Sprintf("%s:%d", tcpInfo1.Address, tcpInfo1.Port)
 		client.TCPClientHandler.SlaveId = byte(tcpInfo1.UnitID)
 		client.TCPClientHandler.Timeout = time.Duration(tcpInfo1.Timeout) * time.Second
 		client.TCPClientHandler.IdleTimeout = time.Duration(tcpInfo1.IdleTimeout) * time.Second
 		client.TCPClientHandler.Logger = log.New(os.Stdout, "", log.LstdFlags)
-	} else {
+	case ProtocolRTUOverTCP:
+		tcpInfo1 := connectionInfo.(*TcpInfo)
+		handler := NewRTUOverTCPClientHandler(fmt.Sprintf("%s:%d", tcpInfo1.Address, tcpInfo1.Port), byte(tcpInfo1.UnitID))
+		handler.Timeout = time.Duration(tcpInfo1.Timeout) * time.Second
+		handler.Logger = log.New(os.Stdout, "", log.LstdFlags)
+		client.RTUOverTCPClientHandler = handler
+	case ProtocolRTU:
+		rtuInfo1 := connectionInfo.(*RtuInfo)
 		serialParams := strings.Split(rtuInfo1.Address, ",")
 		client.RTUClientHandler.Address = serialParams[0]
 		client.RTUClientHandler.SlaveId = byte(rtuInfo1.UnitID)
@@ -149,6 +159,8 @@ func NewDeviceClient(protocol string, connectionInfo interface{}) (*ModbusClient
 		client.RTUClientHandler.StopBits = rtuInfo1.StopBits
 		client.RTUClientHandler.Parity = rtuInfo1.Parity
 		client.RTUClientHandler.Logger = log.New(os.Stdout, "", log.LstdFlags)
+	default:
+		err = fmt.Errorf("modbus protocol [%s] not supported", protocol)
 	}
 	return client, err
 }
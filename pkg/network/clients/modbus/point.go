@@ -0,0 +1,308 @@
+package modbus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cast"
+)
+
+const (
+	// 点位数据类型
+	POINT_BOOL    = "bool"
+	POINT_INT16   = "int16"
+	POINT_UINT16  = "uint16"
+	POINT_INT32   = "int32"
+	POINT_UINT32  = "uint32"
+	POINT_INT64   = "int64"
+	POINT_UINT64  = "uint64"
+	POINT_FLOAT32 = "float32"
+	POINT_FLOAT64 = "float64"
+	POINT_STRING  = "string"
+
+	// 点位上报方式
+	REPORT_CHANGE = "change" // 值变化时上报
+	REPORT_ALWAYS = "always" // 每次轮询都上报
+
+	// 单次请求最多读取的寄存器与线圈数量
+	maxRegisterQuantity = 125
+	maxBitQuantity      = 2000
+)
+
+// 点位, 映射到物模型的属性
+type Point struct {
+	Property string  `json:"property"` // 物模型属性id
+	Table    string  `json:"table"`    // HOLDING_REGISTERS, INPUT_REGISTERS, COILS, DISCRETES_INPUT
+	Address  uint16  `json:"address"`
+	Quantity uint16  `json:"quantity"` // 寄存器数量, 字符串类型必填, 其它类型根据数据类型计算
+	DataType string  `json:"dataType"`
+	ByteSwap bool    `json:"byteSwap"` // 字内字节交换
+	WordSwap bool    `json:"wordSwap"` // 字交换
+	Scale    float64 `json:"scale"`    // 值 = 原始值 * scale + offset, 默认为1
+	Offset   float64 `json:"offset"`
+	Interval int     `json:"interval"` // 轮询间隔(秒), 默认为5, 小于0时不轮询
+	Report   string  `json:"report"`   // 上报方式change, always, 默认为change
+}
+
+// 连续的点位合并为一次读取
+type pointBatch struct {
+	Table    string
+	Address  uint16
+	Quantity uint16
+	Points   []Point
+}
+
+// 解析点位表
+func parsePoints(text string) ([]Point, error) {
+	var points []Point
+	err := json.Unmarshal([]byte(text), &points)
+	if err != nil {
+		return nil, fmt.Errorf("points parse error: %v", err)
+	}
+	exists := map[string]bool{}
+	for idx := range points {
+		p := &points[idx]
+		if len(p.Property) == 0 {
+			return nil, fmt.Errorf("points[%d] property must be present", idx)
+		}
+		if exists[p.Property] {
+			return nil, fmt.Errorf("point [%s] is repeated", p.Property)
+		}
+		exists[p.Property] = true
+		p.Table = strings.ToUpper(p.Table)
+		if len(p.Table) == 0 {
+			p.Table = HOLDING_REGISTERS
+		}
+		if len(p.DataType) == 0 {
+			p.DataType = POINT_UINT16
+		}
+		p.DataType = strings.ToLower(p.DataType)
+		switch p.Table {
+		case COILS, DISCRETES_INPUT:
+			if p.DataType != POINT_BOOL {
+				return nil, fmt.Errorf("point [%s] dataType of %s must be bool", p.Property, p.Table)
+			}
+			p.Quantity = 1
+		case HOLDING_REGISTERS, INPUT_REGISTERS:
+			quantity, err := registerQuantity(p.DataType)
+			if err != nil {
+				return nil, fmt.Errorf("point [%s] %v", p.Property, err)
+			}
+			if quantity > 0 {
+				p.Quantity = quantity
+			} else if p.Quantity == 0 {
+				return nil, fmt.Errorf("point [%s] quantity must be present", p.Property)
+			}
+		default:
+			return nil, fmt.Errorf("point [%s] table [%s] not supported", p.Property, p.Table)
+		}
+		if p.Scale == 0 {
+			p.Scale = 1
+		}
+		if p.Interval == 0 {
+			p.Interval = 5
+		}
+		if len(p.Report) == 0 {
+			p.Report = REPORT_CHANGE
+		}
+		if p.Report != REPORT_CHANGE && p.Report != REPORT_ALWAYS {
+			return nil, fmt.Errorf("point [%s] report must be change or always", p.Property)
+		}
+	}
+	return points, nil
+}
+
+// 数据类型占用的寄存器数量, 字符串返回0
+func registerQuantity(dataType string) (uint16, error) {
+	switch dataType {
+	case POINT_BOOL, POINT_INT16, POINT_UINT16:
+		return 1, nil
+	case POINT_INT32, POINT_UINT32, POINT_FLOAT32:
+		return 2, nil
+	case POINT_INT64, POINT_UINT64, POINT_FLOAT64:
+		return 4, nil
+	case POINT_STRING:
+		return 0, nil
+	}
+	return 0, fmt.Errorf("dataType [%s] not supported", dataType)
+}
+
+// 按寄存器类型与地址排序后合并相邻的点位
+func batchPoints(points []Point) []pointBatch {
+	list := make([]Point, len(points))
+	copy(list, points)
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].Table != list[j].Table {
+			return list[i].Table < list[j].Table
+		}
+		return list[i].Address < list[j].Address
+	})
+	var batches []pointBatch
+	for _, p := range list {
+		max := uint16(maxRegisterQuantity)
+		if p.Table == COILS || p.Table == DISCRETES_INPUT {
+			max = maxBitQuantity
+		}
+		if len(batches) > 0 {
+			last := &batches[len(batches)-1]
+			end := uint32(last.Address) + uint32(last.Quantity)
+			pointEnd := uint32(p.Address) + uint32(p.Quantity)
+			if last.Table == p.Table && uint32(p.Address) <= end && pointEnd-uint32(last.Address) <= uint32(max) {
+				if pointEnd > end {
+					last.Quantity = uint16(pointEnd - uint32(last.Address))
+				}
+				last.Points = append(last.Points, p)
+				continue
+			}
+		}
+		batches = append(batches, pointBatch{Table: p.Table, Address: p.Address, Quantity: p.Quantity, Points: []Point{p}})
+	}
+	return batches
+}
+
+// 从批量读取的数据中解析点位的值
+func (b *pointBatch) decode(p Point, data []byte) (any, error) {
+	offset := int(p.Address - b.Address)
+	if p.Table == COILS || p.Table == DISCRETES_INPUT {
+		if offset/8 >= len(data) {
+			return nil, fmt.Errorf("point [%s] data out of range", p.Property)
+		}
+		return data[offset/8]&(1<<(offset%8)) > 0, nil
+	}
+	start, end := offset*2, (offset+int(p.Quantity))*2
+	if end > len(data) {
+		return nil, fmt.Errorf("point [%s] data out of range", p.Property)
+	}
+	return p.decode(data[start:end])
+}
+
+// 解析寄存器的值
+func (p *Point) decode(data []byte) (any, error) {
+	raw := make([]byte, len(data))
+	copy(raw, data)
+	raw = p.swap(raw)
+	var val float64
+	switch p.DataType {
+	case POINT_STRING:
+		return string(bytes.TrimRight(raw, "\x00 ")), nil
+	case POINT_BOOL:
+		return binary.BigEndian.Uint16(raw) != 0, nil
+	case POINT_INT16:
+		val = float64(int16(binary.BigEndian.Uint16(raw)))
+	case POINT_UINT16:
+		val = float64(binary.BigEndian.Uint16(raw))
+	case POINT_INT32:
+		val = float64(int32(binary.BigEndian.Uint32(raw)))
+	case POINT_UINT32:
+		val = float64(binary.BigEndian.Uint32(raw))
+	case POINT_INT64:
+		val = float64(int64(binary.BigEndian.Uint64(raw)))
+	case POINT_UINT64:
+		val = float64(binary.BigEndian.Uint64(raw))
+	case POINT_FLOAT32:
+		val = float64(math.Float32frombits(binary.BigEndian.Uint32(raw)))
+	case POINT_FLOAT64:
+		val = math.Float64frombits(binary.BigEndian.Uint64(raw))
+	default:
+		return nil, fmt.Errorf("point [%s] dataType [%s] not supported", p.Property, p.DataType)
+	}
+	val = val*p.Scale + p.Offset
+	if p.isInteger() && val == math.Trunc(val) {
+		return int64(val), nil
+	}
+	return val, nil
+}
+
+func (p *Point) isInteger() bool {
+	switch p.DataType {
+	case POINT_INT16, POINT_UINT16, POINT_INT32, POINT_UINT32, POINT_INT64, POINT_UINT64:
+		return true
+	}
+	return false
+}
+
+// 将值转换为写入的数据(hex)
+func (p *Point) encode(value any) (string, error) {
+	if p.Table == COILS {
+		b, err := cast.ToBoolE(value)
+		if err != nil {
+			return "", fmt.Errorf("point [%s] value must be bool", p.Property)
+		}
+		if b {
+			return "01", nil
+		}
+		return "00", nil
+	}
+	buf := new(bytes.Buffer)
+	var err error
+	if p.DataType == POINT_STRING {
+		str := cast.ToString(value)
+		raw := make([]byte, int(p.Quantity)*2)
+		if len(str) > len(raw) {
+			return "", fmt.Errorf("point [%s] value length must less than %d", p.Property, len(raw))
+		}
+		copy(raw, str)
+		return hex.EncodeToString(raw), nil
+	}
+	if p.DataType == POINT_BOOL {
+		b, err := cast.ToBoolE(value)
+		if err != nil {
+			return "", fmt.Errorf("point [%s] value must be bool", p.Property)
+		}
+		if b {
+			return "0001", nil
+		}
+		return "0000", nil
+	}
+	f, err := cast.ToFloat64E(value)
+	if err != nil {
+		return "", fmt.Errorf("point [%s] value must be number", p.Property)
+	}
+	f = (f - p.Offset) / p.Scale
+	if p.isInteger() {
+		f = math.Round(f)
+	}
+	switch p.DataType {
+	case POINT_INT16:
+		err = binary.Write(buf, binary.BigEndian, int16(f))
+	case POINT_UINT16:
+		err = binary.Write(buf, binary.BigEndian, uint16(f))
+	case POINT_INT32:
+		err = binary.Write(buf, binary.BigEndian, int32(f))
+	case POINT_UINT32:
+		err = binary.Write(buf, binary.BigEndian, uint32(f))
+	case POINT_INT64:
+		err = binary.Write(buf, binary.BigEndian, int64(f))
+	case POINT_UINT64:
+		err = binary.Write(buf, binary.BigEndian, uint64(f))
+	case POINT_FLOAT32:
+		err = binary.Write(buf, binary.BigEndian, float32(f))
+	case POINT_FLOAT64:
+		err = binary.Write(buf, binary.BigEndian, f)
+	default:
+		return "", fmt.Errorf("point [%s] dataType [%s] not supported", p.Property, p.DataType)
+	}
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(p.swap(buf.Bytes())), nil
+}
+
+// 按点位配置交换字节与字的顺序, 16位的值只交换字节
+func (p *Point) swap(raw []byte) []byte {
+	switch len(raw) {
+	case 2:
+		return swap16BitDataBytes(raw, p.ByteSwap)
+	case 4:
+		return swap32BitDataBytes(raw, p.ByteSwap, p.WordSwap)
+	case 8:
+		return swap64BitDataBytes(raw, p.ByteSwap, p.WordSwap)
+	}
+	return raw
+}
@@ -0,0 +1,238 @@
+package modbus
+
+import (
+	"errors"
+	"fmt"
+	"go-iot/pkg/core"
+	"sort"
+	"sync"
+	"time"
+
+	logs "go-iot/pkg/logger"
+)
+
+// 点位表编解码, 根据产品配置的点位表轮询与写入, 不需要编写脚本
+const MODBUS_POINT_CODEC = "modbus-point-core"
+
+func init() {
+	core.RegCodecCreator(MODBUS_POINT_CODEC, func(productId string, script string) (core.Codec, error) {
+		product := core.GetProduct(productId)
+		if product == nil {
+			return nil, fmt.Errorf("product [%s] not found", productId)
+		}
+		return NewModbusPointCodec(productId, product.GetConfig("points"))
+	})
+}
+
+type ModbusPointCodec struct {
+	productId string
+	points    map[string]Point
+	// 按轮询间隔分组后合并的点位
+	polls map[int][]pointBatch
+}
+
+func NewModbusPointCodec(productId string, pointsText string) (core.Codec, error) {
+	points, err := parsePoints(pointsText)
+	if err != nil {
+		return nil, err
+	}
+	if len(points) == 0 {
+		return nil, errors.New("points must be present")
+	}
+	c := &ModbusPointCodec{
+		productId: productId,
+		points:    map[string]Point{},
+		polls:     map[int][]pointBatch{},
+	}
+	group := map[int][]Point{}
+	for _, p := range points {
+		c.points[p.Property] = p
+		if p.Interval > 0 {
+			group[p.Interval] = append(group[p.Interval], p)
+		}
+	}
+	for interval, list := range group {
+		c.polls[interval] = batchPoints(list)
+	}
+	return c, nil
+}
+
+func (c *ModbusPointCodec) OnConnect(ctx core.MessageContext) error {
+	return nil
+}
+
+func (c *ModbusPointCodec) OnMessage(ctx core.MessageContext) error {
+	return nil
+}
+
+// 命令调用, 功能的输入参数写入同名属性的点位
+func (c *ModbusPointCodec) OnInvoke(ctx core.FuncInvokeContext) error {
+	return c.write(ctx)
+}
+
+func (c *ModbusPointCodec) OnClose(ctx core.MessageContext) error {
+	return nil
+}
+
+// 读取属性
+func (c *ModbusPointCodec) OnReadProperty(ctx core.FuncInvokeContext) error {
+	var points []Point
+	for _, id := range ctx.GetReadProperties() {
+		p, ok := c.points[id]
+		if !ok {
+			return fmt.Errorf("point [%s] not found", id)
+		}
+		points = append(points, p)
+	}
+	s := ctx.GetSession().(*ModbusSession)
+	var data map[string]any
+	var err error
+	connErr := s.connection(func() {
+		data, err = c.read(s, batchPoints(points))
+	})
+	if connErr != nil {
+		return connErr
+	}
+	if err != nil {
+		return err
+	}
+	ctx.SaveProperties(data)
+	ctx.ReplyOk()
+	return nil
+}
+
+// 写入属性
+func (c *ModbusPointCodec) OnWriteProperty(ctx core.FuncInvokeContext) error {
+	return c.write(ctx)
+}
+
+func (c *ModbusPointCodec) write(ctx core.FuncInvokeContext) error {
+	message := ctx.GetMessage().(core.FuncInvoke)
+	var keys []string
+	for key := range message.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var points []Point
+	var values []string
+	for _, key := range keys {
+		p, ok := c.points[key]
+		if !ok {
+			return fmt.Errorf("point [%s] not found", key)
+		}
+		if p.Table != HOLDING_REGISTERS && p.Table != COILS {
+			return fmt.Errorf("point [%s] %s is read-only", key, p.Table)
+		}
+		val, err := p.encode(message.Data[key])
+		if err != nil {
+			return err
+		}
+		points = append(points, p)
+		values = append(values, val)
+	}
+	s := ctx.GetSession().(*ModbusSession)
+	var err error
+	connErr := s.connection(func() {
+		for idx, p := range points {
+			err = s.client.SetValue(p.Table, p.Address, p.Quantity, values[idx])
+			if err != nil {
+				return
+			}
+		}
+	})
+	if connErr != nil {
+		return connErr
+	}
+	if err != nil {
+		return err
+	}
+	ctx.ReplyOk()
+	return nil
+}
+
+// 读取点位的值, 需要在连接中调用
+func (c *ModbusPointCodec) read(s *ModbusSession, batches []pointBatch) (map[string]any, error) {
+	data := map[string]any{}
+	for idx := range batches {
+		b := &batches[idx]
+		resp, err := s.client.GetValue(b.Table, b.Address, b.Quantity)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range b.Points {
+			val, err := b.decode(p, resp)
+			if err != nil {
+				return nil, err
+			}
+			data[p.Property] = val
+		}
+	}
+	return data, nil
+}
+
+// 按点位的轮询间隔读取并上报属性
+func (c *ModbusPointCodec) poll(s *ModbusSession) {
+	poller := &pointPoller{codec: c, session: s, last: map[string]any{}}
+	for interval, batches := range c.polls {
+		go poller.loop(interval, batches)
+	}
+}
+
+type pointPoller struct {
+	codec   *ModbusPointCodec
+	session *ModbusSession
+	mutex   sync.Mutex
+	last    map[string]any
+}
+
+func (p *pointPoller) loop(interval int, batches []pointBatch) {
+	ticker := time.NewTicker(time.Second * time.Duration(interval))
+	defer ticker.Stop()
+	p.once(batches)
+	for {
+		select {
+		case <-ticker.C:
+			p.once(batches)
+		case <-p.session.done:
+			return
+		}
+	}
+}
+
+func (p *pointPoller) once(batches []pointBatch) {
+	s := p.session
+	var data map[string]any
+	var err error
+	connErr := s.connection(func() {
+		data, err = p.codec.read(s, batches)
+	})
+	if connErr != nil {
+		err = connErr
+	}
+	if err != nil {
+		logs.Warnf("modbus device [%s] poll error: %v", s.deviceId, err)
+		core.DebugLog(s.deviceId, s.productId, "poll error: "+err.Error())
+		return
+	}
+	// 只上报变化的值
+	p.mutex.Lock()
+	for key, val := range data {
+		if p.codec.points[key].Report == REPORT_CHANGE {
+			if last, ok := p.last[key]; ok && last == val {
+				delete(data, key)
+				continue
+			}
+		}
+		p.last[key] = val
+	}
+	p.mutex.Unlock()
+	if len(data) == 0 {
+		return
+	}
+	ctx := &core.BaseContext{
+		DeviceId:  s.deviceId,
+		ProductId: s.productId,
+		Session:   s,
+	}
+	ctx.SaveProperties(data)
+}
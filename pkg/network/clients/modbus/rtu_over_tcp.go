@@ -0,0 +1,133 @@
+package modbus
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	MODBUS "github.com/goburrow/modbus"
+)
+
+const (
+	rtuMinSize       = 4
+	rtuMaxSize       = 256
+	rtuExceptionSize = 5
+)
+
+// RTUOverTCPClientHandler rtu帧通过tcp透传, 用于串口服务器(串口转以太网)
+type RTUOverTCPClientHandler struct {
+	// rtu的编解码与crc校验
+	*MODBUS.RTUClientHandler
+	Address string
+	Timeout time.Duration
+	Logger  *log.Logger
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func NewRTUOverTCPClientHandler(address string, slaveId byte) *RTUOverTCPClientHandler {
+	rtu := MODBUS.NewRTUClientHandler("")
+	rtu.SlaveId = slaveId
+	return &RTUOverTCPClientHandler{
+		RTUClientHandler: rtu,
+		Address:          address,
+		Timeout:          5 * time.Second,
+	}
+}
+
+func (mb *RTUOverTCPClientHandler) Connect() error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	return mb.connect()
+}
+
+func (mb *RTUOverTCPClientHandler) connect() error {
+	if mb.conn == nil {
+		conn, err := net.DialTimeout("tcp", mb.Address, mb.Timeout)
+		if err != nil {
+			return err
+		}
+		mb.conn = conn
+	}
+	return nil
+}
+
+func (mb *RTUOverTCPClientHandler) Close() error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if mb.conn != nil {
+		err := mb.conn.Close()
+		mb.conn = nil
+		return err
+	}
+	return nil
+}
+
+// Send 发送rtu帧并按功能码读取完整的响应帧
+func (mb *RTUOverTCPClientHandler) Send(aduRequest []byte) ([]byte, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if err := mb.connect(); err != nil {
+		return nil, err
+	}
+	if mb.Timeout > 0 {
+		if err := mb.conn.SetDeadline(time.Now().Add(mb.Timeout)); err != nil {
+			return nil, err
+		}
+	}
+	mb.logf("modbus: sending % x\n", aduRequest)
+	if _, err := mb.conn.Write(aduRequest); err != nil {
+		return nil, err
+	}
+	var data [rtuMaxSize]byte
+	n, err := io.ReadAtLeast(mb.conn, data[:], 3)
+	if err != nil {
+		return nil, err
+	}
+	length := rtuResponseLength(aduRequest[1], data[:n])
+	if length > rtuMaxSize {
+		return nil, fmt.Errorf("modbus: response length '%v' must not be bigger than '%v'", length, rtuMaxSize)
+	}
+	if n < length {
+		_, err = io.ReadFull(mb.conn, data[n:length])
+		if err != nil {
+			return nil, err
+		}
+		n = length
+	}
+	mb.logf("modbus: received % x\n", data[:n])
+	return data[:n], nil
+}
+
+func (mb *RTUOverTCPClientHandler) logf(format string, v ...any) {
+	if mb.Logger != nil {
+		mb.Logger.Printf(format, v...)
+	}
+}
+
+// 根据响应头计算rtu响应帧长度: 从站地址 + 功能码 + 数据 + crc
+func rtuResponseLength(function byte, head []byte) int {
+	if head[1] == function|0x80 {
+		return rtuExceptionSize
+	}
+	switch function {
+	case MODBUS.FuncCodeReadDiscreteInputs,
+		MODBUS.FuncCodeReadCoils,
+		MODBUS.FuncCodeReadInputRegisters,
+		MODBUS.FuncCodeReadHoldingRegisters,
+		MODBUS.FuncCodeReadWriteMultipleRegisters:
+		return 3 + int(head[2]) + 2
+	case MODBUS.FuncCodeWriteSingleCoil,
+		MODBUS.FuncCodeWriteMultipleCoils,
+		MODBUS.FuncCodeWriteSingleRegister,
+		MODBUS.FuncCodeWriteMultipleRegisters:
+		return 8
+	case MODBUS.FuncCodeMaskWriteRegister:
+		return 10
+	}
+	return rtuMinSize
+}
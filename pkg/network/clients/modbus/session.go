@@ -3,6 +3,7 @@ package modbus
 import (
 	"fmt"
 	"go-iot/pkg/core"
+	"go-iot/pkg/network/clients"
 	"go-iot/pkg/tsl"
 	"strconv"
 	"sync"
@@ -13,15 +14,23 @@ import (
 
 var concurrentCommandLimit = 100
 
+// 相同地址(同一串口或同一串口服务器)同时只能处理一个请求
+var addressLocks sync.Map
+
+func getAddressLock(address string) chan bool {
+	lock, _ := addressLocks.LoadOrStore(address, make(chan bool, 1))
+	return lock.(chan bool)
+}
+
 // modbus协议Session
 type ModbusSession struct {
 	deviceId     string
 	productId    string
 	mutex        sync.Mutex
-	lock         chan bool
 	workingCount int
 	stopped      bool
 	client       *ModbusClient
+	protocol     string
 	tcpInfo      *TcpInfo
 	rtuInfo      *RtuInfo
 	done         chan struct{}
@@ -29,8 +38,8 @@ type ModbusSession struct {
 
 func newSession() *ModbusSession {
 	return &ModbusSession{
-		lock: make(chan bool, 1),
-		done: make(chan struct{}),
+		protocol: ProtocolTCP,
+		done:     make(chan struct{}),
 	}
 }
 
@@ -39,7 +48,6 @@ func (s *ModbusSession) Disconnect() error {
 		core.DelSession(s.deviceId)
 		s.stopped = true
 		close(s.done)
-		close(s.lock)
 	}
 	return nil
 }
@@ -56,7 +64,10 @@ func (s *ModbusSession) GetDeviceId() string {
 }
 
 func (s *ModbusSession) GetInfo() map[string]any {
-	return map[string]any{}
+	return map[string]any{
+		"protocol": s.protocol,
+		"address":  s.lockableAddress(nil),
+	}
 }
 
 func (s *ModbusSession) ReadDiscreteInputs(startingAddress uint16, length uint16) *context {
@@ -122,7 +133,7 @@ func (s *ModbusSession) lockAddress(address string) error {
 	}
 
 	s.mutex.Unlock()
-	s.lock <- true
+	getAddressLock(address) <- true
 
 	return nil
 }
@@ -132,7 +143,7 @@ func (s *ModbusSession) unlockAddress(address string) {
 	s.mutex.Lock()
 	s.workingCount = s.workingCount - 1
 	s.mutex.Unlock()
-	<-s.lock
+	<-getAddressLock(address)
 }
 
 // lockableAddress return the lockable address according to the protocol
@@ -160,11 +171,7 @@ func (s *ModbusSession) connection(callback func()) error {
 	defer s.unlockAddress(s.lockableAddress(connectionInfo))
 
 	// create device client and open connection
-	var protocol string = ProtocolTCP
-	if s.tcpInfo != nil {
-		protocol = ProtocolTCP
-	}
-	deviceClient, err := NewDeviceClient(protocol, connectionInfo)
+	deviceClient, err := NewDeviceClient(s.protocol, connectionInfo)
 	if err != nil {
 		logs.Errorf("Read command NewDeviceClient failed. err:%v \n", err)
 		return err
@@ -173,6 +180,7 @@ func (s *ModbusSession) connection(callback func()) error {
 	err = deviceClient.OpenConnection()
 	if err != nil {
 		logs.Errorf("Read command OpenConnection failed. err:%v \n", err)
+		s.lost(err)
 		return err
 	}
 
@@ -185,7 +193,21 @@ func (s *ModbusSession) connection(callback func()) error {
 	return nil
 }
 
+// 开启重连时, 已连接的设备无法打开连接则下线并重连
+func (s *ModbusSession) lost(err error) {
+	if s.stopped || !clients.ReconnectEnabled(s.deviceId) || core.GetSession(s.deviceId) != core.Session(s) {
+		return
+	}
+	s.Disconnect()
+	clients.Disconnected(s.deviceId, err)
+}
+
 func (s *ModbusSession) readLoop() {
+	// 点位表编解码按点位轮询
+	if c, ok := core.GetCodec(s.productId).(*ModbusPointCodec); ok {
+		c.poll(s)
+		return
+	}
 	product := core.GetProduct(s.productId)
 	if product != nil {
 		for _, f := range product.GetTsl().Functions {
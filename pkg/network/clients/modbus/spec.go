@@ -6,22 +6,26 @@ import (
 	"go-iot/pkg/core"
 	"go-iot/pkg/network"
 	"strconv"
+	"strings"
 )
 
 func init() {
 	network.RegNetworkMetaConfigCreator(string(network.MODBUS), func() core.CodecMetaConfig {
 
 		list := []core.MetaConfig{
-			{Property: "address", Type: "string", Buildin: true, Value: "127.0.0.1", Desc: "The host of remote [127.0.0.1]"},
+			{Property: "mode", Type: "string", Buildin: true, Value: MODE_TCP, Desc: "Connection mode: tcp, rtu(serial port), rtuovertcp(rtu frame over tcp serial server)"},
+			{Property: "address", Type: "string", Buildin: true, Value: "127.0.0.1", Desc: "The host of remote [127.0.0.1], or the serial port [/dev/ttyUSB0, COM1] in rtu mode"},
 			{Property: "port", Type: "number", Buildin: true, Value: "502", Desc: "The port of remote"},
 			{Property: "unitID", Type: "number", Buildin: true, Desc: ""},
 			{Property: "timeout", Type: "number", Buildin: true, Value: "5", Desc: "Connect & Read timeout(seconds)"},
 			{Property: "idleTimeout", Type: "number", Buildin: true, Value: "5", Desc: "Idle timeout(seconds) to close the connection"},
 
-			// {Property: "baudRate", Type: "number", Buildin: true, Desc: ""},
-			// {Property: "dataBits", Type: "number", Buildin: true, Desc: ""},
-			// {Property: "stopBits", Type: "number", Buildin: true, Desc: ""},
-			// {Property: "parity", Type: "number", Buildin: true, Desc: ""},
+			{Property: "baudRate", Type: "number", Buildin: true, Value: "9600", Desc: "Baud rate of serial port in rtu mode"},
+			{Property: "dataBits", Type: "number", Buildin: true, Value: "8", Desc: "Data bits of serial port in rtu mode [5, 6, 7, 8]"},
+			{Property: "stopBits", Type: "number", Buildin: true, Value: "1", Desc: "Stop bits of serial port in rtu mode [1, 2]"},
+			{Property: "parity", Type: "string", Buildin: true, Value: "N", Desc: "Parity of serial port in rtu mode, N(None) or O(Odd) or E(Even)"},
+
+			{Property: "points", Type: "string", Buildin: true, Desc: "Point table(json) mapped to tsl properties, use the built-in point codec instead of script when present"},
 		}
 		return core.CodecMetaConfig{
 			MetaConfigs: list,
@@ -31,8 +35,12 @@ func init() {
 }
 
 func parseIntValue(str string, key string) (int, error) {
+	return parseIntDefault(str, key, 5)
+}
+
+func parseIntDefault(str string, key string, def int) (int, error) {
 	if len(str) == 0 {
-		return 5, nil
+		return def, nil
 	}
 	val, err := strconv.Atoi(str)
 	if err != nil {
@@ -128,3 +136,69 @@ func createTcpConnectionInfoByConfig(devoper *core.Device) (*TcpInfo, error) {
 	info.IdleTimeout = idleTimeout
 	return &info, nil
 }
+
+func createRTUConnectionInfoByConfig(devoper *core.Device) (*RtuInfo, error) {
+	errorMessage := "unable to create RTU connection info, protocol config '%s' not exist"
+	address := devoper.GetConfig("address")
+	if len(address) == 0 {
+		return nil, fmt.Errorf(errorMessage, "address")
+	}
+	info := RtuInfo{
+		Address: address,
+		Parity:  "N",
+	}
+	if len(devoper.GetConfig("unitID")) == 0 {
+		return nil, fmt.Errorf(errorMessage, "unitID")
+	}
+	unitID, err := strconv.ParseUint(devoper.GetConfig("unitID"), 0, 8)
+	if err != nil {
+		return nil, fmt.Errorf("uintID value out of range(0–255). Error: %v", err)
+	}
+	info.UnitID = byte(unitID)
+	if info.BaudRate, err = parseIntDefault(devoper.GetConfig("baudRate"), "baudRate", 9600); err != nil {
+		return nil, err
+	}
+	if info.DataBits, err = parseIntDefault(devoper.GetConfig("dataBits"), "dataBits", 8); err != nil {
+		return nil, err
+	}
+	if info.DataBits < 5 || info.DataBits > 8 {
+		return nil, fmt.Errorf("invalid dataBits value, it should be 5, 6, 7 or 8")
+	}
+	if info.StopBits, err = parseIntDefault(devoper.GetConfig("stopBits"), "stopBits", 1); err != nil {
+		return nil, err
+	}
+	if info.StopBits != 1 && info.StopBits != 2 {
+		return nil, fmt.Errorf("invalid stopBits value, it should be 1 or 2")
+	}
+	if parity := devoper.GetConfig("parity"); len(parity) > 0 {
+		info.Parity = strings.ToUpper(parity)
+	}
+	if info.Parity != "N" && info.Parity != "O" && info.Parity != "E" {
+		return nil, fmt.Errorf("invalid parity value, it should be N(None) or O(Odd) or E(Even)")
+	}
+	if info.Timeout, err = parseIntValue(devoper.GetConfig("timeout"), "timeout"); err != nil {
+		return nil, err
+	}
+	if info.IdleTimeout, err = parseIntValue(devoper.GetConfig("idleTimeout"), "idleTimeout"); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// 根据连接模式创建连接信息, 返回协议与连接信息
+func createConnectionInfoByConfig(devoper *core.Device) (string, any, error) {
+	mode := strings.ToLower(devoper.GetConfig("mode"))
+	switch mode {
+	case "", MODE_TCP:
+		info, err := createTcpConnectionInfoByConfig(devoper)
+		return ProtocolTCP, info, err
+	case MODE_RTU:
+		info, err := createRTUConnectionInfoByConfig(devoper)
+		return ProtocolRTU, info, err
+	case MODE_RTU_OVER_TCP:
+		info, err := createTcpConnectionInfoByConfig(devoper)
+		return ProtocolRTUOverTCP, info, err
+	default:
+		return "", nil, fmt.Errorf("invalid mode value [%s], it should be tcp, rtu or rtuovertcp", mode)
+	}
+}
@@ -1,5 +1,12 @@
 package modbus
 
+func swap16BitDataBytes(dataBytes []byte, isByteSwap bool) []byte {
+	if !isByteSwap || len(dataBytes) < 2 {
+		return dataBytes
+	}
+	return []byte{dataBytes[1], dataBytes[0]}
+}
+
 func swap32BitDataBytes(dataBytes []byte, isByteSwap bool, isWordSwap bool) []byte {
 
 	if !isByteSwap && !isWordSwap {
@@ -29,3 +36,33 @@ func swap32BitDataBytes(dataBytes []byte, isByteSwap bool, isWordSwap bool) []by
 
 	return newDataBytes
 }
+
+func swap64BitDataBytes(dataBytes []byte, isByteSwap bool, isWordSwap bool) []byte {
+
+	if !isByteSwap && !isWordSwap {
+		return dataBytes
+	}
+
+	if len(dataBytes) < 8 {
+		return dataBytes
+	}
+
+	var newDataBytes = make([]byte, 8)
+	copy(newDataBytes, dataBytes)
+
+	if isByteSwap {
+		for i := 0; i < 8; i += 2 {
+			newDataBytes[i], newDataBytes[i+1] = newDataBytes[i+1], newDataBytes[i]
+		}
+	}
+	if isWordSwap {
+		// 字顺序反转: w0 w1 w2 w3 -> w3 w2 w1 w0
+		for i := 0; i < 4; i += 2 {
+			j := 6 - i
+			newDataBytes[i], newDataBytes[j] = newDataBytes[j], newDataBytes[i]
+			newDataBytes[i+1], newDataBytes[j+1] = newDataBytes[j+1], newDataBytes[i+1]
+		}
+	}
+
+	return newDataBytes
+}
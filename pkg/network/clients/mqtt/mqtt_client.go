@@ -5,6 +5,7 @@ import (
 	"go-iot/pkg/core"
 	"go-iot/pkg/network"
 	"go-iot/pkg/network/clients"
+	"sync"
 )
 
 func init() {
@@ -14,6 +15,7 @@ func init() {
 }
 
 type MqttClient struct {
+	sync.Mutex
 	deviceId  string
 	productId string
 	spec      *MQTTClientSpec
@@ -55,7 +57,9 @@ func (c *MqttClient) Connect(deviceId string, network network.NetworkConf) error
 
 	c.deviceId = deviceId
 	c.productId = network.ProductId
+	c.Lock()
 	c.spec = &spec
+	c.Unlock()
 	c.session = session
 
 	go session.readLoop()
@@ -63,7 +67,27 @@ func (c *MqttClient) Connect(deviceId string, network network.NetworkConf) error
 	return nil
 }
 
-func (c *MqttClient) Reload() error {
+// 连接相关的配置变化时需要重新连接
+func (c *MqttClient) Reload(conf network.NetworkConf) error {
+	spec := &MQTTClientSpec{}
+	err := spec.FromNetwork(conf)
+	if err != nil {
+		return err
+	}
+	devoper := core.GetDevice(c.deviceId)
+	if devoper == nil {
+		return errors.New("devoper is nil")
+	}
+	err = spec.SetByConfig(devoper)
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	defer c.Unlock()
+	if fields := c.spec.restartFields(spec); len(fields) > 0 {
+		return network.RestartRequired(fields...)
+	}
+	c.spec = spec
 	return nil
 }
 
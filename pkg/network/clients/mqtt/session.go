@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"go-iot/pkg/core"
 	"go-iot/pkg/network"
+	"go-iot/pkg/network/clients"
 	"strings"
+	"sync/atomic"
 
 	logs "go-iot/pkg/logger"
 
@@ -36,7 +38,8 @@ type MqttClientSession struct {
 	CleanFlag bool
 	choke     chan MQTT.Message
 	done      chan struct{}
-	isClose   bool
+	lostErr   error
+	isClose   atomic.Bool
 	core      core.Codec
 }
 
@@ -47,6 +50,8 @@ func newClientSession(deviceId string, network network.NetworkConf, spec *MQTTCl
 	opts.SetUsername(spec.Username)
 	opts.SetPassword(spec.Password)
 	opts.SetCleanSession(spec.CleanSession)
+	// 断线重连由clients统一处理
+	opts.SetAutoReconnect(false)
 
 	session := &MqttClientSession{
 		ClientID:  spec.ClientId,
@@ -65,6 +70,7 @@ func newClientSession(deviceId string, network network.NetworkConf, spec *MQTTCl
 	}
 	opts.SetConnectionLostHandler(func(c MQTT.Client, err error) {
 		logs.Infof("connection lost clientId:%s, err:%s ", opts.ClientID, err.Error())
+		session.lostErr = err
 		close(session.done)
 	})
 
@@ -116,10 +122,9 @@ func (s *MqttClientSession) PublishQos1(topic string, msg interface{}) error {
 }
 
 func (s *MqttClientSession) Disconnect() error {
-	if s.isClose {
+	if !s.isClose.CompareAndSwap(false, true) {
 		return nil
 	}
-	s.isClose = true
 	s.client.Disconnect(250)
 	core.DelSession(s.deviceId)
 	return nil
@@ -148,7 +153,6 @@ func (s *MqttClientSession) deviceOnline(deviceId string) {
 }
 
 func (s *MqttClientSession) readLoop() {
-	defer s.Disconnect()
 	for {
 		select {
 		case msg := <-s.choke:
@@ -161,6 +165,12 @@ func (s *MqttClientSession) readLoop() {
 				Data: msg,
 			})
 		case <-s.done:
+			// 连接断开, 非主动断开时重连
+			lost := !s.isClose.Load()
+			s.Disconnect()
+			if lost {
+				clients.Disconnected(s.deviceId, s.lostErr)
+			}
 			return
 		}
 
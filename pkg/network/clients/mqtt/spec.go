@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"go-iot/pkg/core"
 	"go-iot/pkg/network"
+	"reflect"
 	"strconv"
 )
 
@@ -58,6 +59,27 @@ func (spec *MQTTClientSpec) FromNetwork(network network.NetworkConf) error {
 	return nil
 }
 
+// 需要重新连接才能生效的配置项
+func (spec *MQTTClientSpec) restartFields(n *MQTTClientSpec) []string {
+	var fields []string
+	if spec.Host != n.Host {
+		fields = append(fields, "host")
+	}
+	if spec.Port != n.Port {
+		fields = append(fields, "port")
+	}
+	if spec.ClientId != n.ClientId || spec.Username != n.Username || spec.Password != n.Password {
+		fields = append(fields, "auth")
+	}
+	if !reflect.DeepEqual(spec.Topics, n.Topics) || spec.CleanSession != n.CleanSession {
+		fields = append(fields, "topics")
+	}
+	if spec.UseTLS != n.UseTLS || !reflect.DeepEqual(spec.Certificate, n.Certificate) {
+		fields = append(fields, "useTLS")
+	}
+	return fields
+}
+
 func (spec *MQTTClientSpec) TlsConfig() (*tls.Config, error) {
 	var certificates []tls.Certificate
 
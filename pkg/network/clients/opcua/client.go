@@ -0,0 +1,158 @@
+package opcua
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"go-iot/pkg/core"
+	"go-iot/pkg/network"
+	"go-iot/pkg/network/clients"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/ua"
+)
+
+func init() {
+	clients.RegClient(func() network.NetClient {
+		return NewClient()
+	})
+}
+
+type Client struct {
+	session *OpcUaSession
+}
+
+func NewClient() *Client {
+	return &Client{}
+}
+
+func (c *Client) Type() network.NetType {
+	return network.OPCUA_CLIENT
+}
+
+func (c *Client) Connect(deviceId string, conf network.NetworkConf) error {
+	devoper := core.GetDevice(deviceId)
+	if devoper == nil {
+		return errors.New("devoper is nil")
+	}
+	spec := &OpcUaSpec{}
+	if err := spec.SetByConfig(devoper); err != nil {
+		return err
+	}
+	if err := spec.SetCertificate(conf); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), spec.RequestTimeout)
+	defer cancel()
+	client, err := dial(ctx, spec)
+	if err != nil {
+		return err
+	}
+	session := &OpcUaSession{
+		deviceId:  deviceId,
+		productId: conf.ProductId,
+		spec:      spec,
+		client:    client,
+		done:      make(chan struct{}),
+	}
+	if err := session.subscribe(ctx); err != nil {
+		client.Close(context.Background())
+		return err
+	}
+	c.session = session
+	core.PutSession(deviceId, session, false)
+	go session.watch()
+	if codec := core.GetCodec(conf.ProductId); codec != nil {
+		codec.OnConnect(&opcuaContext{
+			BaseContext: core.BaseContext{
+				DeviceId:  deviceId,
+				ProductId: conf.ProductId,
+				Session:   session,
+			},
+		})
+	}
+	return nil
+}
+
+// 连接信息来自设备配置, 证书或信任列表变化时需要重新连接
+func (c *Client) Reload(conf network.NetworkConf) error {
+	if c.session == nil {
+		return nil
+	}
+	spec := *c.session.spec
+	if err := spec.SetCertificate(conf); err != nil {
+		return err
+	}
+	if string(spec.Certificate) != string(c.session.spec.Certificate) {
+		return network.RestartRequired("certificate")
+	}
+	if !sameCerts(spec.TrustedCerts, c.session.spec.TrustedCerts) {
+		return network.RestartRequired("caBase64")
+	}
+	return nil
+}
+
+func (c *Client) Close() error {
+	if c.session != nil {
+		return c.session.Disconnect()
+	}
+	return nil
+}
+
+// 连接服务端, 先获取端点并校验服务端证书, 再使用端点的证书建立安全通道
+func dial(ctx context.Context, spec *OpcUaSpec) (*opcua.Client, error) {
+	endpoints, err := opcua.GetEndpoints(ctx, spec.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	ep, err := opcua.SelectEndpoint(endpoints, spec.SecurityPolicy, spec.SecurityMode)
+	if err != nil {
+		return nil, err
+	}
+	// GetEndpoints没有经过认证, 服务端证书必须在信任列表中, 防止中间人攻击
+	if spec.SecurityPolicy != ua.SecurityPolicyURINone || len(spec.TrustedCerts) > 0 {
+		if err := spec.VerifyServerCertificate(ep.ServerCertificate); err != nil {
+			return nil, err
+		}
+	}
+	opts := []opcua.Option{
+		opcua.SecurityPolicy(spec.SecurityPolicy),
+		opcua.SecurityMode(spec.SecurityMode),
+		opcua.AutoReconnect(false),
+		opcua.DialTimeout(spec.RequestTimeout),
+		opcua.RequestTimeout(spec.RequestTimeout),
+	}
+	if len(spec.Certificate) > 0 {
+		opts = append(opts, opcua.Certificate(spec.Certificate), opcua.PrivateKey(spec.PrivateKey))
+	}
+	switch spec.AuthType {
+	case ua.UserTokenTypeUserName:
+		opts = append(opts, opcua.AuthUsername(spec.Username, spec.Password))
+	case ua.UserTokenTypeCertificate:
+		opts = append(opts, opcua.AuthCertificate(spec.Certificate), opcua.AuthPrivateKey(spec.PrivateKey))
+	default:
+		opts = append(opts, opcua.AuthAnonymous())
+	}
+	opts = append(opts, opcua.SecurityFromEndpoint(ep, spec.AuthType))
+	client, err := opcua.NewClient(spec.Endpoint, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.Connect(ctx); err != nil {
+		return nil, fmt.Errorf("opcua connect error: %v", err)
+	}
+	return client, nil
+}
+
+func sameCerts(a, b []*x509.Certificate) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,176 @@
+package opcua
+
+import (
+	"fmt"
+	"go-iot/pkg/codec"
+	"go-iot/pkg/core"
+	"go-iot/pkg/tsl"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cast"
+)
+
+// 内置编解码, 按物模型expands中的节点读写属性与调用方法, 不需要编写脚本
+const OPCUA_CODEC = "opcua-core"
+
+func init() {
+	core.RegCodecCreator(OPCUA_CODEC, func(productId string, script string) (core.Codec, error) {
+		// 有脚本时使用脚本编解码, 脚本中通过session的Read、Write、Call访问节点
+		if len(strings.TrimSpace(script)) > 0 {
+			return codec.NewScriptCodec(productId, script)
+		}
+		return NewOpcUaCodec(productId)
+	})
+}
+
+type opcuaContext struct {
+	core.BaseContext
+	Data map[string]any
+}
+
+func (ctx *opcuaContext) GetMessage() interface{} {
+	return ctx.Data
+}
+
+type OpcUaCodec struct {
+	productId string
+}
+
+func NewOpcUaCodec(productId string) (core.Codec, error) {
+	if core.GetProduct(productId) == nil {
+		return nil, fmt.Errorf("product [%s] not found", productId)
+	}
+	c := &OpcUaCodec{productId: productId}
+	return c, nil
+}
+
+func (c *OpcUaCodec) OnConnect(ctx core.MessageContext) error {
+	return nil
+}
+
+func (c *OpcUaCodec) OnMessage(ctx core.MessageContext) error {
+	return nil
+}
+
+// 命令调用, 配置了objectId与methodId时调用方法, 否则输入参数写入同名属性的节点
+func (c *OpcUaCodec) OnInvoke(ctx core.FuncInvokeContext) error {
+	message := ctx.GetMessage().(core.FuncInvoke)
+	product := core.GetProduct(c.productId)
+	if product == nil {
+		return fmt.Errorf("product [%s] not found", c.productId)
+	}
+	function, ok := product.GetTsl().FunctionsMap()[message.FunctionId]
+	if !ok {
+		return fmt.Errorf("function [%s] not found", message.FunctionId)
+	}
+	objectId, methodId := function.Expands[EXPAND_OBJECT_ID], function.Expands[EXPAND_METHOD_ID]
+	if len(objectId) == 0 || len(methodId) == 0 {
+		return c.write(ctx)
+	}
+	var args []any
+	for _, p := range function.Inputs {
+		val, err := inputValue(p, message.Data[p.GetId()])
+		if err != nil {
+			return fmt.Errorf("input [%s] error: %v", p.GetId(), err)
+		}
+		args = append(args, val)
+	}
+	s := ctx.GetSession().(*OpcUaSession)
+	if _, err := s.call(objectId, methodId, args); err != nil {
+		return err
+	}
+	ctx.ReplyOk()
+	return nil
+}
+
+func (c *OpcUaCodec) OnClose(ctx core.MessageContext) error {
+	return nil
+}
+
+// 读取属性
+func (c *OpcUaCodec) OnReadProperty(ctx core.FuncInvokeContext) error {
+	nodes, err := c.propertyNodes(ctx.GetReadProperties())
+	if err != nil {
+		return err
+	}
+	s := ctx.GetSession().(*OpcUaSession)
+	data := map[string]any{}
+	for _, id := range ctx.GetReadProperties() {
+		val, err := s.read(nodes[id])
+		if err != nil {
+			return err
+		}
+		data[id] = val
+	}
+	ctx.SaveProperties(data)
+	ctx.ReplyOk()
+	return nil
+}
+
+// 写入属性
+func (c *OpcUaCodec) OnWriteProperty(ctx core.FuncInvokeContext) error {
+	return c.write(ctx)
+}
+
+func (c *OpcUaCodec) write(ctx core.FuncInvokeContext) error {
+	message := ctx.GetMessage().(core.FuncInvoke)
+	var keys []string
+	for key := range message.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	nodes, err := c.propertyNodes(keys)
+	if err != nil {
+		return err
+	}
+	s := ctx.GetSession().(*OpcUaSession)
+	for _, key := range keys {
+		if err := s.write(nodes[key], message.Data[key]); err != nil {
+			return err
+		}
+	}
+	ctx.ReplyOk()
+	return nil
+}
+
+// 属性对应的节点
+func (c *OpcUaCodec) propertyNodes(ids []string) (map[string]string, error) {
+	product := core.GetProduct(c.productId)
+	if product == nil {
+		return nil, fmt.Errorf("product [%s] not found", c.productId)
+	}
+	properties := product.GetTsl().PropertiesMap()
+	nodes := map[string]string{}
+	for _, id := range ids {
+		p, ok := properties[id]
+		if !ok {
+			return nil, fmt.Errorf("property [%s] not found", id)
+		}
+		nodeId := p.GetExpands()[EXPAND_NODE_ID]
+		if len(nodeId) == 0 {
+			return nil, fmt.Errorf("property [%s] nodeId must be present", id)
+		}
+		nodes[id] = nodeId
+	}
+	return nodes, nil
+}
+
+// 方法的输入参数按物模型类型转换
+func inputValue(p tsl.Property, v any) (any, error) {
+	switch p.GetType() {
+	case tsl.TypeInt, tsl.TypeEnum:
+		return cast.ToInt32E(v)
+	case tsl.TypeLong, tsl.TypeDate:
+		return cast.ToInt64E(v)
+	case tsl.TypeFloat:
+		return cast.ToFloat32E(v)
+	case tsl.TypeDouble:
+		return cast.ToFloat64E(v)
+	case tsl.TypeBool:
+		return cast.ToBoolE(v)
+	case tsl.TypeString, tsl.TypePassword:
+		return cast.ToStringE(v)
+	}
+	return v, nil
+}
@@ -0,0 +1,274 @@
+package opcua_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	_ "go-iot/pkg/codec"
+	"go-iot/pkg/core"
+	"go-iot/pkg/logger"
+	"go-iot/pkg/network"
+	"go-iot/pkg/network/clients/opcua"
+	"go-iot/pkg/store"
+	_ "go-iot/pkg/timeseries"
+	"math/big"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/server"
+	"github.com/gopcua/opcua/ua"
+	"github.com/gopcua/opcua/uasc"
+	"github.com/spf13/cast"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const tslText = `
+{
+  "functions": [
+    {"id": "add", "name": "加", "async": false, "expands": {"objectId": "ns=1;s=device", "methodId": "ns=1;s=add"},
+     "inputs": [{"id": "a", "name": "a", "type": "int"}, {"id": "b", "name": "b", "type": "int"}]},
+    {"id": "setup", "name": "设置", "async": false, "inputs": [{"id": "target", "name": "目标", "type": "float"}]}
+  ],
+  "properties": [
+    {"id": "temp", "name": "温度", "type": "double", "expands": {"nodeId": "ns=1;s=temperature"}},
+    {"id": "target", "name": "目标", "type": "float", "accessMode": ["read", "write", "report"], "expands": {"nodeId": "ns=1;s=target"}},
+    {"id": "sum", "name": "和", "type": "int", "expands": {"nodeId": "ns=1;s=sum"}}
+  ]
+}
+`
+
+func init() {
+	logger.InitNop()
+	core.RegDeviceStore(store.NewMockDeviceStore())
+}
+
+// 测试用的服务端, 变量保存在ns=1的map中, 方法ns=1;s=add返回两个参数的和并写入sum
+type testServer struct {
+	*server.Server
+	ns       *server.MapNamespace
+	endpoint string
+}
+
+func newServer(t *testing.T, opts ...server.Option) *testServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	opts = append(opts, server.EndPoint("127.0.0.1", port))
+	s := &testServer{Server: server.New(opts...), endpoint: fmt.Sprintf("opc.tcp://127.0.0.1:%d", port)}
+	s.ns = server.NewMapNamespace(s.Server, "go-iot")
+	s.ns.Data["temperature"] = float64(20.5)
+	s.ns.Data["target"] = float32(0)
+	s.ns.Data["sum"] = int32(0)
+	// 服务端没有实现方法调用, 在Start之前注册
+	s.RegisterHandler(id.CallRequest_Encoding_DefaultBinary, s.call)
+	require.Nil(t, s.Start(context.Background()))
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func anonymousServer(t *testing.T) *testServer {
+	return newServer(t,
+		server.EnableSecurity("None", ua.MessageSecurityModeNone),
+		server.EnableAuthMode(ua.UserTokenTypeAnonymous),
+	)
+}
+
+func (s *testServer) call(sc *uasc.SecureChannel, r ua.Request, reqID uint32) (ua.Response, error) {
+	req, ok := r.(*ua.CallRequest)
+	if !ok {
+		return nil, errors.New("not call request")
+	}
+	results := make([]*ua.CallMethodResult, len(req.MethodsToCall))
+	for i, m := range req.MethodsToCall {
+		results[i] = &ua.CallMethodResult{StatusCode: ua.StatusBadMethodInvalid}
+		if m.MethodID.String() != "ns=1;s=add" || len(m.InputArguments) != 2 {
+			continue
+		}
+		// 脚本中的整数为int64
+		sum := cast.ToInt32(m.InputArguments[0].Value()) + cast.ToInt32(m.InputArguments[1].Value())
+		s.ns.SetValue("sum", sum)
+		results[i] = &ua.CallMethodResult{StatusCode: ua.StatusOK, OutputArguments: []*ua.Variant{ua.MustVariant(sum)}}
+	}
+	return &ua.CallResponse{
+		ResponseHeader: &ua.ResponseHeader{
+			Timestamp:          time.Now(),
+			RequestHandle:      req.RequestHeader.RequestHandle,
+			ServiceResult:      ua.StatusOK,
+			ServiceDiagnostics: &ua.DiagnosticInfo{},
+			StringTable:        []string{},
+			AdditionalHeader:   ua.NewExtensionObject(nil),
+		},
+		Results: results,
+	}, nil
+}
+
+// 自签名的应用证书
+func certificate(t *testing.T, uri string) ([]byte, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	appUri, err := url.Parse(uri)
+	require.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: uri},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageDataEncipherment | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		URIs:                  []*url.URL{appUri},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(t, err)
+	return cert, key
+}
+
+func certBase64(cert []byte) string {
+	return base64.StdEncoding.EncodeToString(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}))
+}
+
+func newDevice(t *testing.T, id string, config map[string]string, script string) *core.Device {
+	product, err := core.NewProduct(id+"-product", config, core.TIME_SERISE_MOCK, tslText)
+	require.Nil(t, err)
+	core.PutProduct(product)
+	_, err = core.NewCodec(opcua.OPCUA_CODEC, product.Id, script)
+	require.Nil(t, err)
+	device := core.NewDevice(id, product.Id, 0)
+	core.PutDevice(device)
+	return device
+}
+
+func reported(deviceId string, key string) any {
+	if v, ok := core.GetShadow(deviceId).Reported[key]; ok {
+		return v.Value
+	}
+	return nil
+}
+
+func TestOpcUaClient(t *testing.T) {
+	s := anonymousServer(t)
+	device := newDevice(t, "opcua-1", map[string]string{"endpoint": s.endpoint, "publishInterval": "20"}, "")
+
+	c := opcua.NewClient()
+	require.Nil(t, c.Connect(device.Id, network.NetworkConf{ProductId: device.ProductId}))
+	defer c.Close()
+	assert.NotNil(t, core.GetSession(device.Id))
+
+	// 订阅的节点上报属性
+	assert.Eventually(t, func() bool { return reported(device.Id, "temp") == 20.5 }, 5*time.Second, 20*time.Millisecond)
+	s.ns.SetValue("temperature", float64(21))
+	assert.Eventually(t, func() bool { return reported(device.Id, "temp") == float64(21) }, 5*time.Second, 20*time.Millisecond)
+
+	resp := core.DoWriteProperty(core.FuncInvoke{DeviceId: device.Id, Data: map[string]any{"target": 25.5}})
+	assert.Nil(t, resp)
+	assert.Equal(t, float32(25.5), s.ns.GetValue("target"))
+	resp = core.DoReadProperty(core.FuncInvoke{DeviceId: device.Id, Data: map[string]any{"properties": []string{"target"}}})
+	assert.Nil(t, resp)
+	assert.InDelta(t, 25.5, reported(device.Id, "target"), 0.001)
+
+	// 调用方法
+	resp = core.DoCmdInvoke(core.FuncInvoke{DeviceId: device.Id, FunctionId: "add", Data: map[string]any{"a": 1, "b": 2}})
+	assert.Nil(t, resp)
+	assert.Eventually(t, func() bool { return cast.ToInt(reported(device.Id, "sum")) == 3 }, 5*time.Second, 20*time.Millisecond)
+	assert.EqualValues(t, 3, s.ns.GetValue("sum"))
+	// 没有配置方法时写入同名属性的节点
+	resp = core.DoCmdInvoke(core.FuncInvoke{DeviceId: device.Id, FunctionId: "setup", Data: map[string]any{"target": 30}})
+	assert.Nil(t, resp)
+	assert.Equal(t, float32(30), s.ns.GetValue("target"))
+
+	// 服务端关闭后下线
+	s.Close()
+	assert.Eventually(t, func() bool { return core.GetSession(device.Id) == nil }, 10*time.Second, 20*time.Millisecond)
+}
+
+func TestOpcUaSecurity(t *testing.T) {
+	serverCert, serverKey := certificate(t, "urn:go-iot:test:server")
+	s := newServer(t,
+		server.Certificate(serverCert),
+		server.PrivateKey(serverKey),
+		server.EnableSecurity("None", ua.MessageSecurityModeNone),
+		server.EnableSecurity("Basic256Sha256", ua.MessageSecurityModeSignAndEncrypt),
+		server.EnableAuthMode(ua.UserTokenTypeAnonymous),
+		server.EnableAuthMode(ua.UserTokenTypeUserName),
+	)
+	clientCert, clientKey := certificate(t, "urn:go-iot:test:client")
+	conf := network.NetworkConf{}
+	conf.CertBase64 = certBase64(clientCert)
+	conf.KeyBase64 = base64.StdEncoding.EncodeToString(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(clientKey)}))
+	conf.CaBase64 = certBase64(serverCert)
+
+	config := map[string]string{
+		"endpoint":       s.endpoint,
+		"securityPolicy": "Basic256Sha256",
+		"securityMode":   "SignAndEncrypt",
+		"authType":       "username",
+		"username":       "admin",
+		"password":       "123456",
+	}
+	device := newDevice(t, "opcua-2", config, "")
+	conf.ProductId = device.ProductId
+	c := opcua.NewClient()
+	require.Nil(t, c.Connect(device.Id, conf))
+	assert.Eventually(t, func() bool { return reported(device.Id, "temp") == 20.5 }, 5*time.Second, 20*time.Millisecond)
+	assert.Nil(t, c.Reload(conf))
+	// 信任列表变化需要重新连接
+	otherCert, _ := certificate(t, "urn:go-iot:test:other")
+	other := conf
+	other.CaBase64 = certBase64(otherCert)
+	assert.ErrorIs(t, c.Reload(other), network.ErrRestartRequired)
+	c.Close()
+	assert.Nil(t, core.GetSession(device.Id))
+
+	// 服务端证书不在信任列表中
+	assert.NotNil(t, c.Connect(device.Id, other))
+	assert.Nil(t, core.GetSession(device.Id))
+	// 缺少信任列表
+	noTrust := conf
+	noTrust.CaBase64 = ""
+	assert.NotNil(t, c.Connect(device.Id, noTrust))
+	// 缺少证书
+	assert.NotNil(t, c.Connect(device.Id, network.NetworkConf{ProductId: device.ProductId, CaBase64: conf.CaBase64}))
+}
+
+const script = `
+function OnMessage(context) {
+	var data = context.GetMessage()
+	if (data.property == "temp") {
+		context.SaveProperties({"temp": data.value * 10})
+	}
+}
+function OnInvoke(context) {
+	var session = context.GetSession()
+	var out = session.Call("ns=1;s=device", "ns=1;s=add", 20, 22)
+	session.Write("ns=1;s=target", out[0])
+	context.SaveProperties({"target": session.Read("ns=1;s=target")})
+	context.ReplyOk()
+}
+`
+
+func TestOpcUaScript(t *testing.T) {
+	s := anonymousServer(t)
+	device := newDevice(t, "opcua-3", map[string]string{"endpoint": s.endpoint, "publishInterval": "20"}, script)
+
+	c := opcua.NewClient()
+	require.Nil(t, c.Connect(device.Id, network.NetworkConf{ProductId: device.ProductId}))
+	defer c.Close()
+	assert.Eventually(t, func() bool { return cast.ToFloat64(reported(device.Id, "temp")) == 205 }, 5*time.Second, 20*time.Millisecond)
+
+	resp := core.DoCmdInvoke(core.FuncInvoke{DeviceId: device.Id, FunctionId: "setup", Data: map[string]any{"target": 1}})
+	assert.Nil(t, resp)
+	assert.Equal(t, float32(42), s.ns.GetValue("target"))
+	assert.InDelta(t, 42, reported(device.Id, "target"), 0.001)
+}
@@ -0,0 +1,400 @@
+package opcua
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"go-iot/pkg/core"
+	"go-iot/pkg/network/clients"
+	"sync/atomic"
+	"time"
+
+	logs "go-iot/pkg/logger"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/ua"
+	"github.com/spf13/cast"
+)
+
+// 检查连接状态的间隔
+const watchInterval = 500 * time.Millisecond
+
+// opc ua协议Session, 一个设备对应一个OPC UA会话
+type OpcUaSession struct {
+	deviceId  string
+	productId string
+	spec      *OpcUaSpec
+	client    *opcua.Client
+	// 订阅的监控项与属性的对应关系
+	nodes   map[uint32]monitoredNode
+	done    chan struct{}
+	isClose atomic.Bool
+}
+
+type monitoredNode struct {
+	nodeId   string
+	property string
+}
+
+func (s *OpcUaSession) Disconnect() error {
+	if !s.isClose.CompareAndSwap(false, true) {
+		return nil
+	}
+	close(s.done)
+	ctx, cancel := s.context()
+	defer cancel()
+	s.client.Close(ctx)
+	core.DelSession(s.deviceId)
+	return nil
+}
+
+func (s *OpcUaSession) Close() error {
+	return s.Disconnect()
+}
+
+func (s *OpcUaSession) SetDeviceId(deviceId string) {
+	s.deviceId = deviceId
+}
+
+func (s *OpcUaSession) GetDeviceId() string {
+	return s.deviceId
+}
+
+func (s *OpcUaSession) GetInfo() map[string]any {
+	return map[string]any{
+		"endpoint":       s.spec.Endpoint,
+		"securityPolicy": s.spec.SecurityPolicy,
+		"securityMode":   s.spec.SecurityMode.String(),
+	}
+}
+
+// 读取节点的值, 用于脚本
+func (s *OpcUaSession) Read(nodeId string) any {
+	val, err := s.read(nodeId)
+	if err != nil {
+		panic(err)
+	}
+	return val
+}
+
+// 写入节点的值, 值按节点当前的类型转换, 用于脚本
+func (s *OpcUaSession) Write(nodeId string, value any) {
+	if err := s.write(nodeId, value); err != nil {
+		panic(err)
+	}
+}
+
+// 调用对象的方法, 返回输出参数, 用于脚本
+func (s *OpcUaSession) Call(objectId string, methodId string, args ...any) []any {
+	out, err := s.call(objectId, methodId, args)
+	if err != nil {
+		panic(err)
+	}
+	return out
+}
+
+func (s *OpcUaSession) read(nodeId string) (any, error) {
+	dv, err := s.readValue(nodeId)
+	if err != nil {
+		return nil, err
+	}
+	return toValue(dv.Value.Value()), nil
+}
+
+// 读取节点的Value属性
+func (s *OpcUaSession) readValue(nodeId string) (*ua.DataValue, error) {
+	node, err := ua.ParseNodeID(nodeId)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := s.context()
+	defer cancel()
+	resp, err := s.client.Read(ctx, &ua.ReadRequest{
+		NodesToRead:        []*ua.ReadValueID{{NodeID: node, AttributeID: ua.AttributeIDValue}},
+		TimestampsToReturn: ua.TimestampsToReturnBoth,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Results) == 0 {
+		return nil, fmt.Errorf("read node [%s] error: empty result", nodeId)
+	}
+	dv := resp.Results[0]
+	if isBad(dv.Status) {
+		return nil, fmt.Errorf("read node [%s] error: %v", nodeId, dv.Status)
+	}
+	if dv.Value == nil {
+		return nil, fmt.Errorf("read node [%s] error: value is empty", nodeId)
+	}
+	return dv, nil
+}
+
+func (s *OpcUaSession) write(nodeId string, value any) error {
+	node, err := ua.ParseNodeID(nodeId)
+	if err != nil {
+		return err
+	}
+	// 先读取节点的值得到数据类型
+	dv, err := s.readValue(nodeId)
+	if err != nil {
+		return err
+	}
+	val, err := convert(value, dv.Value.Value())
+	if err != nil {
+		return fmt.Errorf("write node [%s] error: %v", nodeId, err)
+	}
+	variant, err := ua.NewVariant(val)
+	if err != nil {
+		return fmt.Errorf("write node [%s] error: %v", nodeId, err)
+	}
+	ctx, cancel := s.context()
+	defer cancel()
+	resp, err := s.client.Write(ctx, &ua.WriteRequest{
+		NodesToWrite: []*ua.WriteValue{{
+			NodeID:      node,
+			AttributeID: ua.AttributeIDValue,
+			Value:       &ua.DataValue{EncodingMask: ua.DataValueValue, Value: variant},
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("write node [%s] error: %v", nodeId, err)
+	}
+	if len(resp.Results) > 0 && isBad(resp.Results[0]) {
+		return fmt.Errorf("write node [%s] error: %v", nodeId, resp.Results[0])
+	}
+	return nil
+}
+
+func (s *OpcUaSession) call(objectId string, methodId string, args []any) ([]any, error) {
+	object, err := ua.ParseNodeID(objectId)
+	if err != nil {
+		return nil, err
+	}
+	method, err := ua.ParseNodeID(methodId)
+	if err != nil {
+		return nil, err
+	}
+	var inputs []*ua.Variant
+	for _, arg := range args {
+		v, err := ua.NewVariant(arg)
+		if err != nil {
+			return nil, fmt.Errorf("call method [%s] error: %v", methodId, err)
+		}
+		inputs = append(inputs, v)
+	}
+	ctx, cancel := s.context()
+	defer cancel()
+	resp, err := s.client.Call(ctx, &ua.CallMethodRequest{
+		ObjectID:       object,
+		MethodID:       method,
+		InputArguments: inputs,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("call method [%s] error: %v", methodId, err)
+	}
+	if isBad(resp.StatusCode) {
+		return nil, fmt.Errorf("call method [%s] error: %v", methodId, resp.StatusCode)
+	}
+	out := make([]any, 0, len(resp.OutputArguments))
+	for _, v := range resp.OutputArguments {
+		out = append(out, toValue(v.Value()))
+	}
+	return out, nil
+}
+
+func (s *OpcUaSession) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), s.spec.RequestTimeout)
+}
+
+// 订阅物模型中配置了nodeId的属性
+func (s *OpcUaSession) subscribe(ctx context.Context) error {
+	product := core.GetProduct(s.productId)
+	if product == nil {
+		return fmt.Errorf("product [%s] not found", s.productId)
+	}
+	s.nodes = map[uint32]monitoredNode{}
+	var items []*ua.MonitoredItemCreateRequest
+	for _, p := range product.GetTsl().Properties {
+		nodeId := p.GetExpands()[EXPAND_NODE_ID]
+		if len(nodeId) == 0 {
+			continue
+		}
+		node, err := ua.ParseNodeID(nodeId)
+		if err != nil {
+			return fmt.Errorf("property [%s] nodeId error: %v", p.GetId(), err)
+		}
+		handle := uint32(len(items) + 1)
+		s.nodes[handle] = monitoredNode{nodeId: node.String(), property: p.GetId()}
+		items = append(items, opcua.NewMonitoredItemCreateRequestWithDefaults(node, ua.AttributeIDValue, handle))
+	}
+	if len(items) == 0 {
+		return nil
+	}
+	notify := make(chan *opcua.PublishNotificationData, 16)
+	sub, err := s.client.Subscribe(ctx, &opcua.SubscriptionParameters{Interval: s.spec.PublishInterval}, notify)
+	if err != nil {
+		return err
+	}
+	resp, err := sub.Monitor(ctx, ua.TimestampsToReturnBoth, items...)
+	if err != nil {
+		return err
+	}
+	for i, result := range resp.Results {
+		if isBad(result.StatusCode) {
+			return fmt.Errorf("monitor node [%s] error: %v", items[i].ItemToMonitor.NodeID, result.StatusCode)
+		}
+	}
+	go s.receive(notify)
+	return nil
+}
+
+// 接收订阅的通知
+func (s *OpcUaSession) receive(notify chan *opcua.PublishNotificationData) {
+	for {
+		select {
+		case <-s.done:
+			return
+		case data := <-notify:
+			if data == nil {
+				continue
+			}
+			if data.Error != nil {
+				logs.Warnf("opcua device [%s] subscription error: %v", s.deviceId, data.Error)
+				continue
+			}
+			change, ok := data.Value.(*ua.DataChangeNotification)
+			if !ok {
+				continue
+			}
+			for _, item := range change.MonitoredItems {
+				if node, ok := s.nodes[item.ClientHandle]; ok && item.Value != nil {
+					s.onDataChange(node, item.Value)
+				}
+			}
+		}
+	}
+}
+
+// 节点值变化, 内置编解码直接保存属性, 脚本编解码交给OnMessage处理
+func (s *OpcUaSession) onDataChange(node monitoredNode, value *ua.DataValue) {
+	var val any
+	if value.Value != nil {
+		val = toValue(value.Value.Value())
+	}
+	ctx := &opcuaContext{
+		BaseContext: core.BaseContext{
+			DeviceId:  s.deviceId,
+			ProductId: s.productId,
+			Session:   s,
+		},
+		Data: map[string]any{
+			"nodeId":    node.nodeId,
+			"property":  node.property,
+			"value":     val,
+			"status":    uint32(value.Status),
+			"timestamp": value.SourceTimestamp.UnixMilli(),
+		},
+	}
+	codec := core.GetCodec(s.productId)
+	if codec == nil {
+		return
+	}
+	if _, ok := codec.(*OpcUaCodec); ok {
+		if isBad(value.Status) {
+			logs.Warnf("opcua device [%s] node [%s] status: %v", s.deviceId, node.nodeId, value.Status)
+			return
+		}
+		ctx.SaveProperties(map[string]any{node.property: val})
+		return
+	}
+	codec.OnMessage(ctx)
+}
+
+// 连接断开, 非主动断开时重连
+func (s *OpcUaSession) watch() {
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			state := s.client.State()
+			if state != opcua.Closed && state != opcua.Disconnected {
+				continue
+			}
+			lost := !s.isClose.Load()
+			s.Disconnect()
+			if lost {
+				clients.Disconnected(s.deviceId, fmt.Errorf("opcua connection %s", state))
+			}
+			return
+		}
+	}
+}
+
+// 状态码的严重程度为Bad
+func isBad(code ua.StatusCode) bool {
+	return uint32(code)&0x80000000 != 0
+}
+
+// opc ua的值转换为物模型的值
+func toValue(v any) any {
+	switch v := v.(type) {
+	case float32:
+		return float64(v)
+	case time.Time:
+		return v.UnixMilli()
+	case []byte:
+		return hex.EncodeToString(v)
+	case *ua.LocalizedText:
+		return v.Text
+	case *ua.QualifiedName:
+		return v.Name
+	case *ua.NodeID:
+		return v.String()
+	case *ua.ExpandedNodeID:
+		return v.String()
+	case ua.StatusCode:
+		return uint32(v)
+	}
+	return v
+}
+
+// 按节点当前值的类型转换写入的值
+func convert(v any, sample any) (any, error) {
+	switch sample.(type) {
+	case bool:
+		return cast.ToBoolE(v)
+	case int8:
+		return cast.ToInt8E(v)
+	case uint8:
+		return cast.ToUint8E(v)
+	case int16:
+		return cast.ToInt16E(v)
+	case uint16:
+		return cast.ToUint16E(v)
+	case int32:
+		return cast.ToInt32E(v)
+	case uint32:
+		return cast.ToUint32E(v)
+	case int64:
+		return cast.ToInt64E(v)
+	case uint64:
+		return cast.ToUint64E(v)
+	case float32:
+		return cast.ToFloat32E(v)
+	case float64:
+		return cast.ToFloat64E(v)
+	case string:
+		return cast.ToStringE(v)
+	case time.Time:
+		if ms, err := cast.ToInt64E(v); err == nil {
+			return time.UnixMilli(ms), nil
+		}
+		return cast.ToTimeE(v)
+	case []byte:
+		return hex.DecodeString(cast.ToString(v))
+	}
+	return nil, fmt.Errorf("unsupported node data type %T", sample)
+}
@@ -0,0 +1,252 @@
+package opcua
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"go-iot/pkg/core"
+	"go-iot/pkg/network"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gopcua/opcua/ua"
+	"github.com/gopcua/opcua/uapolicy"
+)
+
+const (
+	AUTH_ANONYMOUS   = "anonymous"
+	AUTH_USERNAME    = "username"
+	AUTH_CERTIFICATE = "certificate"
+
+	// 物模型expands中的节点配置
+	EXPAND_NODE_ID   = "nodeId"
+	EXPAND_OBJECT_ID = "objectId"
+	EXPAND_METHOD_ID = "methodId"
+)
+
+func init() {
+	network.RegNetworkMetaConfigCreator(string(network.OPCUA_CLIENT), func() core.CodecMetaConfig {
+		list := []core.MetaConfig{
+			{Property: "endpoint", Type: "string", Buildin: true, Value: "opc.tcp://127.0.0.1:4840", Desc: "The endpoint url of opc ua server"},
+			{Property: "securityPolicy", Type: "string", Buildin: true, Value: "None", Desc: "Security policy: None, Basic128Rsa15, Basic256, Basic256Sha256, Aes128_Sha256_RsaOaep, Aes256_Sha256_RsaPss"},
+			{Property: "securityMode", Type: "string", Buildin: true, Value: "None", Desc: "Security mode: None, Sign, SignAndEncrypt"},
+			{Property: "authType", Type: "string", Buildin: true, Value: AUTH_ANONYMOUS, Desc: "User authentication: anonymous, username, certificate(use the network certificate)"},
+			{Property: "username", Type: "string", Buildin: true, Desc: "Username when authType is username"},
+			{Property: "password", Type: "password", Buildin: true, Desc: "Password when authType is username"},
+			{Property: "publishInterval", Type: "number", Buildin: true, Value: "1000", Desc: "Publishing interval(milliseconds) of the subscription to tsl properties with expands.nodeId"},
+			{Property: "timeout", Type: "number", Buildin: true, Value: "10", Desc: "Connect & Request timeout(seconds)"},
+		}
+		return core.CodecMetaConfig{
+			MetaConfigs: list,
+			CodecId:     OPCUA_CODEC,
+		}
+	})
+}
+
+// 客户端配置, 连接参数来自设备配置, 证书来自网络配置
+type OpcUaSpec struct {
+	Endpoint       string
+	SecurityPolicy string // 安全策略uri
+	SecurityMode   ua.MessageSecurityMode
+	AuthType       ua.UserTokenType
+	Username       string
+	Password       string
+	// 客户端应用证书(der)与私钥
+	Certificate []byte
+	PrivateKey  *rsa.PrivateKey
+	// 信任的服务端证书或CA证书, 安全策略不为None时必填
+	TrustedCerts    []*x509.Certificate
+	RequestTimeout  time.Duration
+	PublishInterval time.Duration
+}
+
+func (spec *OpcUaSpec) SetByConfig(devoper *core.Device) error {
+	spec.Endpoint = devoper.GetConfig("endpoint")
+	if len(spec.Endpoint) == 0 {
+		return errors.New("endpoint must be present")
+	}
+	var err error
+	if spec.SecurityPolicy, err = securityPolicyUri(devoper.GetConfig("securityPolicy")); err != nil {
+		return err
+	}
+	if spec.SecurityMode, err = securityMode(devoper.GetConfig("securityMode")); err != nil {
+		return err
+	}
+	if (spec.SecurityPolicy == ua.SecurityPolicyURINone) != (spec.SecurityMode == ua.MessageSecurityModeNone) {
+		return errors.New("securityMode must be None if and only if securityPolicy is None")
+	}
+	switch strings.ToLower(devoper.GetConfig("authType")) {
+	case "", AUTH_ANONYMOUS:
+		spec.AuthType = ua.UserTokenTypeAnonymous
+	case AUTH_USERNAME:
+		spec.AuthType = ua.UserTokenTypeUserName
+		spec.Username = devoper.GetConfig("username")
+		spec.Password = devoper.GetConfig("password")
+		if len(spec.Username) == 0 {
+			return errors.New("username must be present")
+		}
+	case AUTH_CERTIFICATE:
+		spec.AuthType = ua.UserTokenTypeCertificate
+	default:
+		return fmt.Errorf("invalid authType [%s], it should be anonymous, username or certificate", devoper.GetConfig("authType"))
+	}
+	interval, err := parseIntDefault(devoper.GetConfig("publishInterval"), "publishInterval", 1000)
+	if err != nil {
+		return err
+	}
+	spec.PublishInterval = time.Duration(interval) * time.Millisecond
+	timeout, err := parseIntDefault(devoper.GetConfig("timeout"), "timeout", 10)
+	if err != nil {
+		return err
+	}
+	spec.RequestTimeout = time.Duration(timeout) * time.Second
+	return nil
+}
+
+// 应用证书与服务端证书信任列表, 安全策略不为None或证书认证时必填应用证书, 安全策略不为None时必填信任列表
+func (spec *OpcUaSpec) SetCertificate(conf network.NetworkConf) error {
+	if err := spec.setTrustedCerts(conf.CaBase64); err != nil {
+		return err
+	}
+	if spec.SecurityPolicy != ua.SecurityPolicyURINone && len(spec.TrustedCerts) == 0 {
+		return errors.New("opcua server trust list(caBase64) must be present when securityPolicy is not None")
+	}
+	if len(conf.CertBase64) == 0 || len(conf.KeyBase64) == 0 {
+		if spec.SecurityPolicy != ua.SecurityPolicyURINone || spec.AuthType == ua.UserTokenTypeCertificate {
+			return errors.New("opcua client certificate and key must be present")
+		}
+		return nil
+	}
+	certPem, err := base64.StdEncoding.DecodeString(conf.CertBase64)
+	if err != nil {
+		return fmt.Errorf("opcua client cert error: %v", err)
+	}
+	keyPem, err := base64.StdEncoding.DecodeString(conf.KeyBase64)
+	if err != nil {
+		return fmt.Errorf("opcua client key error: %v", err)
+	}
+	block, _ := pem.Decode(certPem)
+	if block == nil {
+		return errors.New("opcua client cert is not pem")
+	}
+	spec.Certificate = block.Bytes
+	block, _ = pem.Decode(keyPem)
+	if block == nil {
+		return errors.New("opcua client key is not pem")
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		k, err8 := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err8 != nil {
+			return fmt.Errorf("opcua client key error: %v", err)
+		}
+		var ok bool
+		if key, ok = k.(*rsa.PrivateKey); !ok {
+			return errors.New("opcua client key must be rsa")
+		}
+	}
+	spec.PrivateKey = key
+	return nil
+}
+
+// 信任列表, 可以是服务端的自签名证书, 也可以是签发服务端证书的CA证书
+func (spec *OpcUaSpec) setTrustedCerts(caBase64 string) error {
+	spec.TrustedCerts = nil
+	if len(caBase64) == 0 {
+		return nil
+	}
+	data, err := base64.StdEncoding.DecodeString(caBase64)
+	if err != nil {
+		return fmt.Errorf("opcua server trust list error: %v", err)
+	}
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("opcua server trust list error: %v", err)
+		}
+		spec.TrustedCerts = append(spec.TrustedCerts, cert)
+	}
+	if len(spec.TrustedCerts) == 0 {
+		return errors.New("opcua server trust list error: none valid certs")
+	}
+	return nil
+}
+
+// 校验端点返回的服务端证书, 证书在信任列表中或由信任列表中的CA签发
+func (spec *OpcUaSpec) VerifyServerCertificate(der []byte) error {
+	if len(spec.TrustedCerts) == 0 {
+		if spec.SecurityPolicy == ua.SecurityPolicyURINone {
+			return nil
+		}
+		return errors.New("opcua server trust list is empty")
+	}
+	if len(der) == 0 {
+		return errors.New("opcua server certificate is empty")
+	}
+	// 证书链时第一个为服务端证书
+	certs, err := x509.ParseCertificates(der)
+	if err != nil {
+		return fmt.Errorf("opcua server certificate error: %v", err)
+	}
+	roots := x509.NewCertPool()
+	for _, trusted := range spec.TrustedCerts {
+		if bytes.Equal(trusted.Raw, certs[0].Raw) {
+			return nil
+		}
+		roots.AddCert(trusted)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err = certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return fmt.Errorf("opcua server certificate is not trusted: %v", err)
+	}
+	return nil
+}
+
+// 安全策略名称转换为uri, 如 Basic256Sha256
+func securityPolicyUri(name string) (string, error) {
+	if len(name) == 0 {
+		return ua.SecurityPolicyURINone, nil
+	}
+	uri := ua.FormatSecurityPolicyURI(name)
+	for _, p := range uapolicy.SupportedPolicies() {
+		if p == uri {
+			return uri, nil
+		}
+	}
+	return "", fmt.Errorf("invalid securityPolicy [%s]", name)
+}
+
+func securityMode(name string) (ua.MessageSecurityMode, error) {
+	if len(name) == 0 {
+		return ua.MessageSecurityModeNone, nil
+	}
+	mode := ua.MessageSecurityModeFromString(name)
+	if mode == ua.MessageSecurityModeInvalid {
+		return mode, fmt.Errorf("invalid securityMode [%s], it should be None, Sign or SignAndEncrypt", name)
+	}
+	return mode, nil
+}
+
+func parseIntDefault(str string, key string, def int) (int, error) {
+	if len(str) == 0 {
+		return def, nil
+	}
+	val, err := strconv.Atoi(str)
+	if err != nil {
+		return 0, fmt.Errorf("fail to parse protocol config '%s', %v", key, err)
+	}
+	return val, nil
+}
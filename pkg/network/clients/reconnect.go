@@ -0,0 +1,247 @@
+package clients
+
+import (
+	"encoding/json"
+	"fmt"
+	"go-iot/pkg/core"
+	"go-iot/pkg/network"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	logs "go-iot/pkg/logger"
+)
+
+const (
+	StateConnected    = "connected"
+	StateReconnecting = "reconnecting"
+	StateDisconnected = "disconnected"
+)
+
+// 断线重连配置, 配置在网络配置的reconnect中
+type ReconnectConf struct {
+	Enable      bool    `json:"enable"`
+	MinInterval int     `json:"minInterval"` // 首次重连间隔(毫秒), 默认1000
+	MaxInterval int     `json:"maxInterval"` // 最大重连间隔(毫秒), 默认60000
+	Multiplier  float64 `json:"multiplier"`  // 重连间隔的倍数, 默认2
+	Jitter      float64 `json:"jitter"`      // 随机抖动的比例(0-1), 默认0.2
+	MaxRetries  int     `json:"maxRetries"`  // 最大重连次数, 0不限制
+}
+
+func newReconnectConf(conf network.NetworkConf) (ReconnectConf, error) {
+	var config struct {
+		Reconnect ReconnectConf `json:"reconnect"`
+	}
+	if len(conf.Configuration) > 0 {
+		err := json.Unmarshal([]byte(conf.Configuration), &config)
+		if err != nil {
+			return ReconnectConf{}, fmt.Errorf("network reconnect error: %v", err)
+		}
+	}
+	r := config.Reconnect
+	if r.MinInterval <= 0 {
+		r.MinInterval = 1000
+	}
+	if r.MaxInterval <= 0 {
+		r.MaxInterval = 60000
+	}
+	if r.MaxInterval < r.MinInterval {
+		r.MaxInterval = r.MinInterval
+	}
+	if r.Multiplier < 1 {
+		r.Multiplier = 2
+	}
+	if r.Jitter <= 0 || r.Jitter > 1 {
+		r.Jitter = 0.2
+	}
+	return r, nil
+}
+
+// 第retries次重连前的等待时间, 按倍数递增到最大间隔, 并加上随机抖动
+func (r ReconnectConf) Backoff(retries int) time.Duration {
+	interval := float64(r.MinInterval) * math.Pow(r.Multiplier, float64(retries))
+	interval = math.Min(interval, float64(r.MaxInterval))
+	interval += interval * r.Jitter * (rand.Float64()*2 - 1)
+	return time.Duration(interval) * time.Millisecond
+}
+
+// 客户端设备的连接状态, 负责断线后的重连
+type supervisor struct {
+	sync.Mutex
+	deviceId   string
+	conf       network.NetworkConf
+	reconnect  ReconnectConf
+	create     CreaterFun
+	client     network.NetClient
+	state      string
+	retries    int
+	lastError  string
+	nextRetry  time.Time
+	timer      *time.Timer
+	connecting bool
+	lostErr    error
+	stopped    bool
+}
+
+func (s *supervisor) connect() error {
+	s.Lock()
+	if s.stopped {
+		s.Unlock()
+		return nil
+	}
+	s.connecting, s.lostErr = true, nil
+	s.Unlock()
+
+	var err error
+	var c network.NetClient
+	if core.GetDevice(s.deviceId) == nil {
+		err = fmt.Errorf("device [%s] not found", s.deviceId)
+	} else {
+		c = s.create()
+		err = c.Connect(s.deviceId, s.conf)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.connecting = false
+	if s.stopped {
+		if err == nil {
+			c.Close()
+		}
+		return err
+	}
+	if err == nil {
+		s.client = c
+		instances.Store(s.deviceId, c)
+		// 连接过程中已经断开
+		if s.lostErr != nil {
+			s.lost(s.lostErr)
+			return nil
+		}
+		s.state, s.retries, s.lastError = StateConnected, 0, ""
+		return nil
+	}
+	if c == nil {
+		// 设备已删除, 不再重连
+		s.state, s.lastError = StateDisconnected, err.Error()
+		return err
+	}
+	s.lost(err)
+	return err
+}
+
+// 连接失败或断开后按退避间隔重连
+func (s *supervisor) lost(err error) {
+	if err != nil {
+		s.lastError = err.Error()
+	}
+	if !s.reconnect.Enable || (s.reconnect.MaxRetries > 0 && s.retries >= s.reconnect.MaxRetries) {
+		s.state = StateDisconnected
+		return
+	}
+	delay := s.reconnect.Backoff(s.retries)
+	s.retries++
+	s.state = StateReconnecting
+	s.nextRetry = time.Now().Add(delay)
+	logs.Infof("client [%s] reconnect after %v, retries: %d", s.deviceId, delay, s.retries)
+	s.timer = time.AfterFunc(delay, func() {
+		s.connect()
+	})
+}
+
+func (s *supervisor) disconnected(err error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.stopped {
+		return
+	}
+	if s.connecting {
+		if err == nil {
+			err = fmt.Errorf("connection lost")
+		}
+		s.lostErr = err
+		return
+	}
+	if s.state != StateConnected {
+		return
+	}
+	s.lost(err)
+}
+
+func (s *supervisor) stop() bool {
+	s.Lock()
+	defer s.Unlock()
+	reconnecting := s.state == StateReconnecting
+	s.stopped = true
+	s.state = StateDisconnected
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	return reconnecting
+}
+
+// 更新产品的网络配置, 返回已连接的客户端, 类型变化时需要重新连接
+func (s *supervisor) reload(conf network.NetworkConf, reconnect ReconnectConf) (network.NetClient, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.stopped || s.conf.ProductId != conf.ProductId {
+		return nil, nil
+	}
+	typeChanged := s.conf.Type != conf.Type
+	s.conf, s.reconnect = conf, reconnect
+	if typeChanged {
+		return nil, network.RestartRequired("type")
+	}
+	if s.state != StateConnected {
+		return nil, nil
+	}
+	return s.client, nil
+}
+
+func (s *supervisor) status() map[string]any {
+	s.Lock()
+	defer s.Unlock()
+	status := map[string]any{
+		"reconnect": s.reconnect.Enable,
+		"state":     s.state,
+		"retries":   s.retries,
+		"lastError": s.lastError,
+	}
+	if s.state == StateReconnecting {
+		status["nextRetry"] = s.nextRetry.Format(time.DateTime)
+	}
+	return status
+}
+
+// 连接异常断开时由客户端调用(主动断开时不调用), 开启重连时按退避间隔重新连接
+// 调用前客户端需要先删除设备会话, 以发送离线事件
+func Disconnected(deviceId string, err error) {
+	if val, ok := supervisors.Load(deviceId); ok {
+		val.(*supervisor).disconnected(err)
+	}
+}
+
+// 设备是否开启了断线重连
+func ReconnectEnabled(deviceId string) bool {
+	if val, ok := supervisors.Load(deviceId); ok {
+		return val.(*supervisor).reconnect.Enable
+	}
+	return false
+}
+
+// 停止重连, 设备正在等待重连时返回true
+func Stop(deviceId string) bool {
+	if val, ok := supervisors.Load(deviceId); ok {
+		return val.(*supervisor).stop()
+	}
+	return false
+}
+
+// 客户端设备的连接状态, 没有连接过时返回nil
+func GetStatus(deviceId string) map[string]any {
+	if val, ok := supervisors.Load(deviceId); ok {
+		return val.(*supervisor).status()
+	}
+	return nil
+}
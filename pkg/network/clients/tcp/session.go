@@ -4,8 +4,10 @@ import (
 	"encoding/hex"
 	"go-iot/pkg/core"
 	tcpserver "go-iot/pkg/network/servers/tcp"
+	"go-iot/pkg/util"
 	"net"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	logs "go-iot/pkg/logger"
@@ -31,11 +33,17 @@ type TcpSession struct {
 	keepalive uint16
 	delimeter tcpserver.Delimeter
 	done      chan struct{}
-	isClose   bool
+	isClose   atomic.Bool
 }
 
-func (s *TcpSession) Send(msg string) error {
-	_, err := s.conn.Write([]byte(msg))
+// msg为字符串或字节数组
+func (s *TcpSession) Send(msg any) error {
+	b, err := util.ToBytes(msg)
+	if err != nil {
+		logs.Errorf("tcpclient Send error: %v", err)
+		return err
+	}
+	_, err = s.conn.Write(b)
 	if err != nil {
 		logs.Errorf("tcpclient Send error: %v", err)
 	}
@@ -56,11 +64,10 @@ func (s *TcpSession) SendHex(msgHex string) error {
 }
 
 func (s *TcpSession) Disconnect() error {
-	if s.isClose {
+	if !s.isClose.CompareAndSwap(false, true) {
 		return nil
 	}
 	close(s.done)
-	s.isClose = true
 	err := s.conn.Close()
 	core.DelSession(s.deviceId)
 	return err
@@ -101,13 +108,13 @@ func (s *TcpSession) deviceOnline(deviceId string) {
 	}
 }
 
-func (s *TcpSession) readLoop() {
+func (s *TcpSession) readLoop() error {
 	keepAlive := time.Duration(s.keepalive) * time.Second
 	timeOut := keepAlive + keepAlive/2
 	for {
 		select {
 		case <-s.done:
-			return
+			return nil
 		default:
 		}
 
@@ -122,7 +129,7 @@ func (s *TcpSession) readLoop() {
 		//3.2 数据读尽、读取错误 关闭 socket 连接
 		if err != nil {
 			logs.Debugf("tcpclient read error: %v", err)
-			break
+			return err
 		}
 		sc := core.GetCodec(s.productId)
 		sc.OnMessage(&tcpContext{
@@ -9,6 +9,7 @@ import (
 	"go-iot/pkg/core"
 	"go-iot/pkg/network"
 	tcpserver "go-iot/pkg/network/servers/tcp"
+	"reflect"
 	"strconv"
 )
 
@@ -41,7 +42,7 @@ func (spec *TcpClientSpec) FromJson(str string) error {
 	if err != nil {
 		return fmt.Errorf("tcpclient spec error:%v", err)
 	}
-	return nil
+	return spec.Delimeter.Validate()
 }
 
 func (spec *TcpClientSpec) FromNetwork(network network.NetworkConf) error {
@@ -58,6 +59,24 @@ func (spec *TcpClientSpec) FromNetwork(network network.NetworkConf) error {
 	return nil
 }
 
+// 需要重新连接才能生效的配置项
+func (spec *TcpClientSpec) restartFields(n *TcpClientSpec) []string {
+	var fields []string
+	if spec.Host != n.Host {
+		fields = append(fields, "host")
+	}
+	if spec.Port != n.Port {
+		fields = append(fields, "port")
+	}
+	if spec.UseTLS != n.UseTLS || !reflect.DeepEqual(spec.Certificate, n.Certificate) {
+		fields = append(fields, "useTLS")
+	}
+	if !reflect.DeepEqual(spec.Delimeter, n.Delimeter) {
+		fields = append(fields, "delimeter")
+	}
+	return fields
+}
+
 func (spec *TcpClientSpec) TlsConfig() (*tls.Config, error) {
 	var certificates []tls.Certificate
 
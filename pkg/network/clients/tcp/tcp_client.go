@@ -7,6 +7,7 @@ import (
 	"go-iot/pkg/network"
 	"go-iot/pkg/network/clients"
 	"net"
+	"sync"
 )
 
 func init() {
@@ -16,6 +17,7 @@ func init() {
 }
 
 type TcpClient struct {
+	sync.Mutex
 	conn      net.Conn
 	deviceId  string
 	productId string
@@ -53,20 +55,20 @@ func (c *TcpClient) Connect(deviceId string, network network.NetworkConf) error
 	}
 	c.conn = conn
 	c.deviceId = deviceId
+	c.Lock()
 	c.spec = spec
+	c.Unlock()
 
 	c.productId = network.ProductId
+	session := newTcpSession(c.deviceId, c.spec, c.productId, c.conn)
+	c.session = session
 
-	go c.readLoop()
+	go c.readLoop(session)
 
 	return nil
 }
 
-func (c *TcpClient) readLoop() {
-	session := newTcpSession(c.deviceId, c.spec, c.productId, c.conn)
-	defer session.Disconnect()
-	c.session = session
-
+func (c *TcpClient) readLoop(session *TcpSession) {
 	sc := core.GetCodec(c.productId)
 
 	context := &tcpContext{
@@ -77,10 +79,36 @@ func (c *TcpClient) readLoop() {
 	}
 
 	sc.OnConnect(context)
-	session.readLoop()
+	err := session.readLoop()
+	// 非主动断开时重连
+	lost := !session.isClose.Load()
+	session.Disconnect()
+	if lost {
+		clients.Disconnected(c.deviceId, err)
+	}
 }
 
-func (c *TcpClient) Reload() error {
+// 连接相关的配置变化时需要重新连接
+func (c *TcpClient) Reload(conf network.NetworkConf) error {
+	spec := &TcpClientSpec{}
+	err := spec.FromNetwork(conf)
+	if err != nil {
+		return err
+	}
+	devoper := core.GetDevice(c.deviceId)
+	if devoper == nil {
+		return errors.New("devoper is nil")
+	}
+	err = spec.SetByConfig(devoper)
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	defer c.Unlock()
+	if fields := c.spec.restartFields(spec); len(fields) > 0 {
+		return network.RestartRequired(fields...)
+	}
+	c.spec = spec
 	return nil
 }
 
@@ -1,7 +1,10 @@
 package network
 
 import (
+	"errors"
+	"fmt"
 	"go-iot/pkg/core"
+	"strings"
 	"sync"
 )
 
@@ -19,6 +22,10 @@ const (
 	WEBSOCKET_SERVER NetType = "WEBSOCKET_SERVER"
 	// CoAP服务端
 	COAP_SERVER NetType = "COAP_SERVER"
+	// MODBUS从站服务端, 设备作为主站写入
+	MODBUS_SERVER NetType = "MODBUS_SERVER"
+	// UDP服务端, 按设备地址区分会话
+	UDP_SERVER NetType = "UDP_SERVER"
 
 	// MQTT客户端
 	MQTT_CLIENT NetType = "MQTT_CLIENT"
@@ -26,10 +33,33 @@ const (
 	TCP_CLIENT NetType = "TCP_CLIENT"
 	// MODBUS
 	MODBUS NetType = "MODBUS"
+	// OPC UA客户端
+	OPCUA_CLIENT NetType = "OPCUA_CLIENT"
 )
 
+// 配置变更需要重启才能生效
+var ErrRestartRequired = errors.New("restart required")
+
+// 需要重启的配置项
+func RestartRequired(fields ...string) error {
+	return fmt.Errorf("%w: %s", ErrRestartRequired, strings.Join(fields, ", "))
+}
+
 func IsNetClientType(str string) bool {
-	return TCP_CLIENT == NetType(str) || MQTT_CLIENT == NetType(str) || MODBUS == NetType(str)
+	switch NetType(str) {
+	case TCP_CLIENT, MQTT_CLIENT, MODBUS, OPCUA_CLIENT:
+		return true
+	}
+	return false
+}
+
+// 是否可以多个产品共用一个监听
+func IsSharedType(str string) bool {
+	switch NetType(str) {
+	case MQTT_BROKER, TCP_SERVER, HTTP_SERVER, WEBSOCKET_SERVER, COAP_SERVER:
+		return true
+	}
+	return false
 }
 
 // 是否为无状态协议, HTTP协议为无状态
@@ -56,22 +86,41 @@ type (
 		CodecId       string `json:"codecId"`
 		CertBase64    string `json:"certBase64"` // crt文件base64
 		KeyBase64     string `json:"keyBase64"`  // key文件base64
+		CaBase64      string `json:"caBase64"`   // 客户端CA证书base64, 配置后启用双向认证; OPC UA客户端为信任的服务端证书
+		CrlBase64     string `json:"crlBase64"`  // 证书吊销列表base64
 	}
 
 	NetServer interface {
 		Type() NetType
 		Start(n NetworkConf) error
-		Reload() error
+		// 在线更新配置, 不能在线生效时返回ErrRestartRequired
+		Reload(n NetworkConf) error
 		Stop() error
 		TotalConnection() int32
 	}
 
+	// 可以被多个产品共用监听的网络服务, 按路由规则把连接分配给产品
+	SharedServer interface {
+		NetServer
+		// 添加共用监听的产品, 产品已存在时更新路由规则
+		AddProduct(n NetworkConf) error
+		RemoveProduct(productId string)
+		Products() []string
+	}
+
 	NetClient interface {
 		Type() NetType
 		Connect(deviceId string, n NetworkConf) error
-		Reload() error
+		// 在线更新配置, 不能在线生效时返回ErrRestartRequired
+		Reload(n NetworkConf) error
 		Close() error
 	}
+
+	// 重新加载的结果
+	ReloadResult struct {
+		Restart bool   `json:"restart"`          // 是否重启了服务, 重启时连接会断开
+		Reason  string `json:"reason,omitempty"` // 需要重启的配置项
+	}
 	// network meta config
 	networkMetaConfig struct {
 		sync.Mutex
@@ -0,0 +1,251 @@
+package network
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	logs "go-iot/pkg/logger"
+
+	"github.com/dop251/goja"
+)
+
+const (
+	routeScriptFunc = "route"
+	// 路由脚本在接入连接时执行, 超时后中断, 不阻塞其它设备接入
+	routeScriptTimeout = 100 * time.Millisecond
+)
+
+var errRouteTimeout = errors.New("network route script timeout")
+
+type (
+	// 多个产品共用一个监听时产品的路由规则, 配置在网络配置的route中
+	ProductRoute struct {
+		// mqtt匹配clientId或username前缀, http, websocket, coap匹配url路径前缀, tcp匹配首包内容前缀
+		Prefix string `json:"prefix"`
+		// 首包路由脚本, 函数route(data)返回产品id, 返回空时继续匹配其它规则
+		Script string `json:"script"`
+	}
+
+	// 共用监听的产品路由, 没有匹配的规则时使用第一个启动的产品
+	// 监听的配置(端口, 证书, 分隔符等)使用第一个启动的产品, 主题权限按产品区分
+	ProductRouter struct {
+		mu         sync.RWMutex
+		productIds []string
+		routes     map[string]*productRoute
+		// 产品的主题权限, 移除产品后已连接的设备仍使用原来的权限
+		acls map[string]TopicAcl
+	}
+
+	productRoute struct {
+		ProductRoute
+		sync.Mutex
+		acl   TopicAcl
+		vm    *goja.Runtime
+		route goja.Callable
+	}
+)
+
+func NewProductRouter(conf NetworkConf) (*ProductRouter, error) {
+	r := &ProductRouter{routes: map[string]*productRoute{}, acls: map[string]TopicAcl{}}
+	err := r.AddProduct(conf)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// 添加共用监听的产品, 产品已存在时更新路由规则
+func (r *ProductRouter) AddProduct(conf NetworkConf) error {
+	route, err := newProductRoute(conf)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.routes[conf.ProductId]; !ok {
+		r.productIds = append(r.productIds, conf.ProductId)
+	}
+	r.routes[conf.ProductId] = route
+	r.acls[conf.ProductId] = route.acl
+	return nil
+}
+
+// 移除产品, 已连接的设备不受影响
+func (r *ProductRouter) RemoveProduct(productId string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.routes[productId]; !ok {
+		return
+	}
+	delete(r.routes, productId)
+	for i, id := range r.productIds {
+		if id == productId {
+			r.productIds = append(r.productIds[:i:i], r.productIds[i+1:]...)
+			break
+		}
+	}
+}
+
+// 共用监听的产品, 第一个为默认产品
+func (r *ProductRouter) Products() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]string{}, r.productIds...)
+}
+
+// 是否有多个产品共用监听
+func (r *ProductRouter) Shared() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.productIds) > 1
+}
+
+// 默认产品
+func (r *ProductRouter) Default() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.productIds) == 0 {
+		return ""
+	}
+	return r.productIds[0]
+}
+
+// 产品的主题权限
+func (r *ProductRouter) Acl(productId string) TopicAcl {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.acls[productId]
+}
+
+// 按前缀匹配产品, 多个产品匹配时取最长的前缀
+func (r *ProductRouter) Match(keys ...string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.productIds) == 0 {
+		return ""
+	}
+	productId, length := r.productIds[0], 0
+	for _, id := range r.productIds {
+		prefix := r.routes[id].Prefix
+		if len(prefix) <= length {
+			continue
+		}
+		for _, key := range keys {
+			if strings.HasPrefix(key, prefix) {
+				productId, length = id, len(prefix)
+				break
+			}
+		}
+	}
+	return productId
+}
+
+// 按首包路由, 先执行路由脚本, 脚本没有返回产品时按首包内容前缀匹配
+func (r *ProductRouter) Route(data []byte) string {
+	r.mu.RLock()
+	routes := make([]*productRoute, 0, len(r.productIds))
+	for _, id := range r.productIds {
+		routes = append(routes, r.routes[id])
+	}
+	r.mu.RUnlock()
+	for _, route := range routes {
+		productId := route.call(data)
+		if len(productId) == 0 {
+			continue
+		}
+		r.mu.RLock()
+		_, ok := r.routes[productId]
+		r.mu.RUnlock()
+		if ok {
+			return productId
+		}
+		logs.Debugf("route script return unknown product [%s]", productId)
+	}
+	return r.Match(string(data))
+}
+
+// 客户端证书对应的产品与设备, 证书不属于任何产品时返回默认产品
+func (r *ProductRouter) MatchCert(cert *x509.Certificate) (string, string) {
+	for _, productId := range r.Products() {
+		if deviceId := CertDeviceId(productId, cert); len(deviceId) > 0 {
+			return productId, deviceId
+		}
+	}
+	return r.Default(), ""
+}
+
+func newProductRoute(conf NetworkConf) (*productRoute, error) {
+	var config struct {
+		Route ProductRoute `json:"route"`
+		// mqtt的主题权限
+		Acl TopicAcl `json:"acl"`
+	}
+	if len(conf.Configuration) > 0 {
+		err := json.Unmarshal([]byte(conf.Configuration), &config)
+		if err != nil {
+			return nil, fmt.Errorf("network route error: %v", err)
+		}
+	}
+	route := &productRoute{ProductRoute: config.Route, acl: config.Acl}
+	if len(route.Script) == 0 {
+		return route, nil
+	}
+	route.vm = goja.New()
+	_, err := runRouteScript(route.vm, func() (goja.Value, error) {
+		return route.vm.RunString(route.Script)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("network route script error: %v", err)
+	}
+	fn, ok := goja.AssertFunction(route.vm.Get(routeScriptFunc))
+	if !ok {
+		return nil, fmt.Errorf("network route script error: function %s not found", routeScriptFunc)
+	}
+	route.route = fn
+	return route, nil
+}
+
+// 执行路由脚本, data为首包的字符串
+func (r *productRoute) call(data []byte) string {
+	if r.route == nil {
+		return ""
+	}
+	r.Lock()
+	defer r.Unlock()
+	val, err := runRouteScript(r.vm, func() (goja.Value, error) {
+		return r.route(goja.Undefined(), r.vm.ToValue(string(data)))
+	})
+	if err != nil {
+		logs.Warnf("network route script error: %v", err)
+		return ""
+	}
+	if goja.IsUndefined(val) || goja.IsNull(val) {
+		return ""
+	}
+	return val.String()
+}
+
+// 执行路由脚本, 超过routeScriptTimeout时中断
+func runRouteScript(vm *goja.Runtime, fn func() (goja.Value, error)) (goja.Value, error) {
+	interrupted := make(chan struct{})
+	timer := time.AfterFunc(routeScriptTimeout, func() {
+		vm.Interrupt(errRouteTimeout)
+		close(interrupted)
+	})
+	val, err := fn()
+	if !timer.Stop() {
+		// 等待中断完成后清除, 引擎可以继续使用
+		<-interrupted
+		vm.ClearInterrupt()
+	}
+	var e *goja.InterruptedError
+	if errors.As(err, &e) {
+		err = errRouteTimeout
+	}
+	return val, err
+}
@@ -0,0 +1,34 @@
+package network_test
+
+import (
+	logs "go-iot/pkg/logger"
+	"go-iot/pkg/network"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouteScriptTimeout(t *testing.T) {
+	logs.InitNop()
+	router, err := network.NewProductRouter(network.NetworkConf{ProductId: "route-product1"})
+	assert.Nil(t, err)
+	err = router.AddProduct(network.NetworkConf{
+		ProductId:     "route-product2",
+		Configuration: `{"route": {"script": "function route(data) { while (data == 'loop') {} if (data == '#2') return 'route-product2' }"}}`,
+	})
+	assert.Nil(t, err)
+
+	// 死循环的脚本超时后中断, 使用默认产品
+	start := time.Now()
+	assert.Equal(t, "route-product1", router.Route([]byte("loop")))
+	assert.Less(t, time.Since(start), time.Second)
+	// 中断后脚本可以继续执行
+	assert.Equal(t, "route-product2", router.Route([]byte("#2")))
+
+	err = router.AddProduct(network.NetworkConf{
+		ProductId:     "route-product3",
+		Configuration: `{"route": {"script": "while (true) {}"}}`,
+	})
+	assert.NotNil(t, err)
+}
@@ -12,6 +12,7 @@ import (
 
 type coapContext struct {
 	core.BaseContext
+	session   *CoapSession
 	Data      []byte
 	r         *mux.Message
 	url       string
@@ -28,7 +29,9 @@ func (ctx *coapContext) DeviceOnline(deviceId string) {
 		if device.GetProductId() != ctx.ProductId {
 			panic(fmt.Errorf("device [%s] product error: %s != %s", deviceId, ctx.ProductId, device.GetProductId()))
 		}
-		core.DeviceOnlineEvent(deviceId, ctx.ProductId)
+		ctx.DeviceId = deviceId
+		ctx.session.SetDeviceId(deviceId)
+		ctx.session.server.deviceOnline(deviceId, ctx.ProductId, ctx.session.w.Conn())
 	}
 }
 
@@ -42,7 +45,9 @@ func (ctx *coapContext) DeviceOffline(deviceId string) {
 		if device.GetProductId() != ctx.ProductId {
 			panic(fmt.Errorf("device [%s] product error: %s != %s", deviceId, ctx.ProductId, device.GetProductId()))
 		}
-		core.DeviceOfflineEvent(deviceId, ctx.ProductId)
+		if session := ctx.session.server.getSession(deviceId); session != nil {
+			session.Disconnect()
+		}
 	}
 }
 
@@ -61,7 +66,12 @@ func (ctx *coapContext) GetUrl() string {
 func (ctx *coapContext) GetQuery(key string) string {
 	var v = ""
 	if ctx.parsedURL == nil {
-		parsedURL, err := url.Parse(ctx.url)
+		// 查询参数在uri-query选项中, 不在路径中
+		u := ctx.url
+		if queries, err := ctx.r.Queries(); err == nil && len(queries) > 0 {
+			u += "?" + strings.Join(queries, "&")
+		}
+		parsedURL, err := url.Parse(u)
 		ctx.parsedURL = parsedURL
 		if err != nil {
 			logger.Errorf("%v", err)
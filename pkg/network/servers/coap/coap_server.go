@@ -2,19 +2,25 @@ package coapserver
 
 import (
 	"bytes"
+	"crypto/tls"
 	"fmt"
+	"go-iot/pkg/core"
 	"go-iot/pkg/eventbus"
 	logs "go-iot/pkg/logger"
 	"go-iot/pkg/network"
 	"go-iot/pkg/network/servers"
+	"sync"
+	"sync/atomic"
 
+	piondtls "github.com/pion/dtls/v3"
+	"github.com/plgd-dev/go-coap/v3/dtls"
 	"github.com/plgd-dev/go-coap/v3/message"
 	"github.com/plgd-dev/go-coap/v3/message/codes"
 	"github.com/plgd-dev/go-coap/v3/mux"
 	"github.com/plgd-dev/go-coap/v3/net"
 	"github.com/plgd-dev/go-coap/v3/options"
 	"github.com/plgd-dev/go-coap/v3/udp"
-	udpServer "github.com/plgd-dev/go-coap/v3/udp/server"
+	udpserver "github.com/plgd-dev/go-coap/v3/udp/server"
 )
 
 func init() {
@@ -25,16 +31,21 @@ func init() {
 
 type (
 	CoapServer struct {
-		productId   string
+		sync.RWMutex
+		*network.ProductRouter
 		spec        *CoapServerSpec
-		server      *udpServer.Server
+		server      interface{ Stop() }
+		cert        atomic.Pointer[tls.Certificate] // dtls当前使用的证书, 可在线更新
 		pathmatcher eventbus.AntPathMatcher
+		// 已上线设备的会话
+		sessions map[string]*DeviceSession
 	}
 )
 
 func NewServer() *CoapServer {
 	return &CoapServer{
 		pathmatcher: *eventbus.NewAntPathMatcher(),
+		sessions:    map[string]*DeviceSession{},
 	}
 }
 
@@ -42,44 +53,99 @@ func (s *CoapServer) Type() network.NetType {
 	return network.COAP_SERVER
 }
 
-func (s *CoapServer) Start(network network.NetworkConf) error {
+func (s *CoapServer) Start(conf network.NetworkConf) error {
 	spec := &CoapServerSpec{}
-	err := spec.FromNetwork(network)
+	err := spec.FromNetwork(conf)
 	if err != nil {
 		return err
 	}
-	spec.Port = network.Port
+	spec.Port = conf.Port
 
 	if len(spec.Routers) == 0 {
 		spec.Routers = append(spec.Routers, Router{Url: "/**"})
 	}
 
-	s.productId = network.ProductId
+	s.ProductRouter, err = network.NewProductRouter(conf)
+	if err != nil {
+		return err
+	}
 	s.spec = spec
 	addr := fmt.Sprintf("%s:%d", spec.Host, spec.Port)
+	if spec.UseTLS {
+		err = s.serveDTLS(addr)
+	} else {
+		err = s.serveUDP(addr)
+	}
+	if err != nil {
+		return err
+	}
+	logs.Infof("coap server start: %s %s", conf.ProductId, addr)
+	return nil
+}
+
+func (s *CoapServer) serveUDP(addr string) error {
 	l, err := net.NewListenUDP("udp", addr)
 	if err != nil {
 		return err
 	}
+	server := udp.NewServer(options.WithMux(s))
+	s.server = server
 	go func() {
-		server := udp.NewServer(options.WithMux(s))
 		err := server.Serve(l)
 		if err != nil {
 			logs.Errorf("start coap server error: %v", err)
 		}
-		s.server = server
 	}()
-	logs.Infof("coap server start: %s %s", s.productId, addr)
 	return nil
 }
 
+// coaps, 使用dtls加密
+func (s *CoapServer) serveDTLS(addr string) error {
+	cfg, err := s.spec.DtlsConfig()
+	if err != nil {
+		return fmt.Errorf("invalid dtls config for coap server: %v", err)
+	}
+	s.cert.Store(&cfg.Certificates[0])
+	l, err := net.NewDTLSListener("udp", addr, s.dtlsConfig())
+	if err != nil {
+		return err
+	}
+	server := dtls.NewServer(options.WithMux(s))
+	s.server = server
+	go func() {
+		err := server.Serve(l)
+		if err != nil {
+			logs.Errorf("start coap dtls server error: %v", err)
+		}
+	}()
+	return nil
+}
+
+// 监听使用的dtls配置, 握手时读取当前的证书与客户端CA, 在线更新后对新的连接生效
+func (s *CoapServer) dtlsConfig() *piondtls.Config {
+	return &piondtls.Config{
+		ExtendedMasterSecret: piondtls.RequireExtendedMasterSecret,
+		ClientAuth:           piondtls.RequestClientCert,
+		GetCertificate: func(*piondtls.ClientHelloInfo) (*tls.Certificate, error) {
+			return s.cert.Load(), nil
+		},
+		VerifyConnection: func(state *piondtls.State) error {
+			auth := s.getSpec().ClientAuth
+			if auth == nil {
+				return nil
+			}
+			return auth.VerifyRawCertificates(state.PeerCertificates)
+		},
+	}
+}
+
 func (s *CoapServer) ServeCOAP(w mux.ResponseWriter, r *mux.Message) {
 	allow := false
 	path, err := r.Path()
 	if err != nil {
 		logs.Errorf("cannot set response: %v", err)
 	}
-	for _, route := range s.spec.Routers {
+	for _, route := range s.getSpec().Routers {
 		if s.pathmatcher.Match(route.Url, path) {
 			allow = true
 			break
@@ -93,22 +159,106 @@ func (s *CoapServer) ServeCOAP(w mux.ResponseWriter, r *mux.Message) {
 		return
 	}
 
-	session := newSession(w, r, s.productId)
+	// 多个产品共用监听时按url路径前缀确定产品
+	session := newSession(s, w, r, s.Match(path))
 
 	session.readData()
 }
 
-func (s *CoapServer) Reload() error {
+// 在线更新配置, 路由与证书立即生效
+func (s *CoapServer) Reload(conf network.NetworkConf) error {
+	spec := &CoapServerSpec{}
+	err := spec.FromNetwork(conf)
+	if err != nil {
+		return err
+	}
+	spec.Port = conf.Port
+	if len(spec.Routers) == 0 {
+		spec.Routers = append(spec.Routers, Router{Url: "/**"})
+	}
+	if fields := s.getSpec().restartFields(spec); len(fields) > 0 {
+		return network.RestartRequired(fields...)
+	}
+	if spec.UseTLS {
+		cfg, err := spec.DtlsConfig()
+		if err != nil {
+			return fmt.Errorf("invalid dtls config for coap server: %v", err)
+		}
+		s.cert.Store(&cfg.Certificates[0])
+	}
+	s.Lock()
+	s.spec = spec
+	s.Unlock()
 	return nil
 }
 
+func (s *CoapServer) getSpec() *CoapServerSpec {
+	s.RLock()
+	defer s.RUnlock()
+	return s.spec
+}
+
 func (s *CoapServer) Stop() error {
 	s.server.Stop()
+	s.RLock()
+	var sessions []*DeviceSession
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	s.RUnlock()
+	for _, session := range sessions {
+		session.Disconnect()
+	}
 	return nil
 }
 
+// udp监听, 用于按设备地址重新创建连接, dtls时返回nil
+func (s *CoapServer) getUdpServer() *udpserver.Server {
+	s.RLock()
+	defer s.RUnlock()
+	server, _ := s.server.(*udpserver.Server)
+	return server
+}
+
+// 设备上线, 创建或更新设备会话
+func (s *CoapServer) deviceOnline(deviceId, productId string, conn mux.Conn) {
+	s.Lock()
+	session, ok := s.sessions[deviceId]
+	if !ok {
+		session = newDeviceSession(s, deviceId, productId)
+		s.sessions[deviceId] = session
+	}
+	s.Unlock()
+	session.touch(conn)
+	old := core.GetSession(deviceId)
+	if old == core.Session(session) {
+		return
+	}
+	if old != nil {
+		logs.Infof("device [%s] a new connection come in, close old session", deviceId)
+		old.Close()
+	}
+	core.PutSession(deviceId, session, old != nil)
+}
+
+func (s *CoapServer) getSession(deviceId string) *DeviceSession {
+	s.RLock()
+	defer s.RUnlock()
+	return s.sessions[deviceId]
+}
+
+func (s *CoapServer) removeSession(session *DeviceSession) {
+	s.Lock()
+	defer s.Unlock()
+	if s.sessions[session.deviceId] == session {
+		delete(s.sessions, session.deviceId)
+	}
+}
+
 func (s *CoapServer) TotalConnection() int32 {
-	return 0
+	s.RLock()
+	defer s.RUnlock()
+	return int32(len(s.sessions))
 }
 
 func sendResponse(w mux.ResponseWriter, code codes.Code, contentFormat message.MediaType, msg string) error {
@@ -1,10 +1,12 @@
 package coapserver_test
 
 import (
+	"bytes"
 	"context"
 	_ "go-iot/pkg/codec"
 	"go-iot/pkg/core"
 	"go-iot/pkg/network"
+	"go-iot/pkg/network/servers"
 	coapserver "go-iot/pkg/network/servers/coap"
 	"go-iot/pkg/store"
 	_ "go-iot/pkg/timeseries"
@@ -15,7 +17,12 @@ import (
 	"time"
 
 	"github.com/plgd-dev/go-coap/v3/message"
+	"github.com/plgd-dev/go-coap/v3/message/codes"
+	"github.com/plgd-dev/go-coap/v3/message/pool"
+	"github.com/plgd-dev/go-coap/v3/mux"
+	"github.com/plgd-dev/go-coap/v3/options"
 	"github.com/plgd-dev/go-coap/v3/udp"
+	"github.com/stretchr/testify/assert"
 
 	logs "go-iot/pkg/logger"
 )
@@ -87,3 +94,82 @@ func initClient() {
 	log.Printf("client Received: %s %s \n", res.Code().String(), res.String())
 	// time.Sleep(time.Second * 11)
 }
+
+const downlinkScript = `
+function OnMessage(context) {
+	context.DeviceOnline(context.GetQuery("id"))
+}
+function OnInvoke(context) {
+	var session = context.GetSession()
+	if (context.GetMessage().FunctionId == "reboot") {
+		session.Notify("/cmd", "reboot")
+		context.ReplyOk()
+		return
+	}
+	var resp = session.Post("/led", "on")
+	if (resp.IsSuccess()) {
+		context.ReplyOk()
+	} else {
+		context.ReplyFail(resp.GetCode() + " " + resp.MsgToString())
+	}
+}
+`
+
+func TestServerDownlink(t *testing.T) {
+	product, err := core.NewProduct("coap-product", map[string]string{}, core.TIME_SERISE_MOCK,
+		`{"functions":[{"id":"led", "async": false},{"id":"reboot", "async": false}]}`)
+	assert.Nil(t, err)
+	core.PutProduct(product)
+	core.PutDevice(core.NewDevice("coap-1", product.Id, 0))
+	conf := network.NetworkConf{
+		ProductId:     product.Id,
+		CodecId:       core.Script_Codec,
+		Type:          string(network.COAP_SERVER),
+		Port:          5689,
+		Configuration: `{"host": "localhost"}`,
+		Script:        downlinkScript,
+	}
+	assert.Nil(t, servers.StartServer(conf))
+	defer servers.StopServer(conf.ProductId)
+
+	// 设备未上线
+	assert.NotNil(t, core.DoCmdInvoke(core.FuncInvoke{DeviceId: "coap-1", FunctionId: "led"}))
+
+	router := mux.NewRouter()
+	router.Handle("/led", mux.HandlerFunc(func(w mux.ResponseWriter, r *mux.Message) {
+		body, _ := r.ReadBody()
+		w.SetResponse(codes.Changed, message.TextPlain, bytes.NewReader(body))
+	}))
+	co, err := udp.Dial("localhost:5689", options.WithMux(router))
+	assert.Nil(t, err)
+	defer co.Close()
+
+	// 设备observe命令资源后上线
+	notifications := make(chan string, 10)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	obs, err := co.Observe(ctx, "/cmd?id=coap-1", func(m *pool.Message) {
+		body, _ := m.ReadBody()
+		notifications <- string(body)
+	})
+	assert.Nil(t, err)
+	defer obs.Cancel(ctx)
+	assert.Equal(t, "", <-notifications)
+	assert.NotNil(t, core.GetSession("coap-1"))
+	assert.Equal(t, []string{"/cmd"}, core.GetSession("coap-1").GetInfo()["observes"])
+
+	// 服务端请求, 设备的捎带响应作为命令回复
+	assert.Nil(t, core.DoCmdInvoke(core.FuncInvoke{DeviceId: "coap-1", FunctionId: "led"}))
+	// observe通知
+	assert.Nil(t, core.DoCmdInvoke(core.FuncInvoke{DeviceId: "coap-1", FunctionId: "reboot"}))
+	select {
+	case n := <-notifications:
+		assert.Equal(t, "reboot", n)
+	case <-time.After(5 * time.Second):
+		t.Fatal("notification not received")
+	}
+
+	// 停止服务后设备离线
+	assert.Nil(t, servers.StopServer(conf.ProductId))
+	assert.Nil(t, core.GetSession("coap-1"))
+}
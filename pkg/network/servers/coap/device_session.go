@@ -0,0 +1,282 @@
+package coapserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"go-iot/pkg/core"
+	"net"
+	"sync"
+	"time"
+
+	logs "go-iot/pkg/logger"
+
+	"github.com/plgd-dev/go-coap/v3/message"
+	"github.com/plgd-dev/go-coap/v3/message/codes"
+	"github.com/plgd-dev/go-coap/v3/message/pool"
+	"github.com/plgd-dev/go-coap/v3/mux"
+)
+
+const (
+	// 默认设备会话超时(秒)
+	defaultSessionTimeout = 300
+	// 服务端请求等待设备响应的时间, 包括重传
+	requestTimeout = 30 * time.Second
+	// observe序号为24位
+	maxObserveSeq = 1 << 24
+)
+
+func newDeviceSession(server *CoapServer, deviceId, productId string) *DeviceSession {
+	return &DeviceSession{
+		server:       server,
+		deviceId:     deviceId,
+		productId:    productId,
+		observations: map[string]*observation{},
+	}
+}
+
+// 设备会话, 保存设备最后的地址与observe注册, 用于服务端主动下发
+type DeviceSession struct {
+	sync.Mutex
+	server       *CoapServer
+	deviceId     string
+	productId    string
+	conn         mux.Conn
+	timer        *time.Timer
+	observations map[string]*observation
+	isClose      bool
+}
+
+// 设备对资源的observe注册
+type observation struct {
+	token message.Token
+	seq   uint32
+}
+
+// 服务端请求的响应, 设备通过ack捎带或单独响应返回
+type coapResponse struct {
+	Code string // 响应码, 如2.04
+	Data []byte
+}
+
+func (r *coapResponse) GetCode() string {
+	return r.Code
+}
+
+// 2.xx响应
+func (r *coapResponse) IsSuccess() bool {
+	return len(r.Code) > 0 && r.Code[0] == '2'
+}
+
+func (r *coapResponse) MsgToString() string {
+	return string(r.Data)
+}
+
+func (r *coapResponse) MsgToHexStr() string {
+	return hex.EncodeToString(r.Data)
+}
+
+func (s *DeviceSession) SetDeviceId(deviceId string) {
+	s.deviceId = deviceId
+}
+
+func (s *DeviceSession) GetDeviceId() string {
+	return s.deviceId
+}
+
+func (s *DeviceSession) GetInfo() map[string]any {
+	s.Lock()
+	defer s.Unlock()
+	var observes []string
+	for path := range s.observations {
+		observes = append(observes, path)
+	}
+	info := map[string]any{"observes": observes}
+	if s.conn != nil {
+		info["localAddr"] = s.conn.NetConn().LocalAddr().String()
+		info["remoteAddr"] = s.conn.RemoteAddr().String()
+	}
+	return info
+}
+
+func (s *DeviceSession) Disconnect() error {
+	if s.close() && core.GetSession(s.deviceId) == core.Session(s) {
+		core.DelSession(s.deviceId)
+	}
+	return nil
+}
+
+func (s *DeviceSession) Close() error {
+	s.close()
+	return nil
+}
+
+func (s *DeviceSession) close() bool {
+	s.Lock()
+	if s.isClose {
+		s.Unlock()
+		return false
+	}
+	s.isClose = true
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.Unlock()
+	s.server.removeSession(s)
+	return true
+}
+
+// 收到设备请求时更新设备的地址, 并重新计算会话超时
+func (s *DeviceSession) touch(conn mux.Conn) {
+	timeout := s.server.getSpec().sessionTimeout()
+	s.Lock()
+	defer s.Unlock()
+	s.conn = conn
+	if s.timer == nil {
+		s.timer = time.AfterFunc(timeout, func() {
+			logs.Debugf("coap device %s session timeout", s.deviceId)
+			s.Disconnect()
+		})
+	} else {
+		s.timer.Reset(timeout)
+	}
+}
+
+// 设备最后的连接, udp连接因空闲关闭后按设备最后的地址重新创建
+func (s *DeviceSession) getConn() (mux.Conn, error) {
+	s.Lock()
+	conn := s.conn
+	s.Unlock()
+	if conn == nil {
+		return nil, errors.New("coap device has no endpoint")
+	}
+	if conn.Context().Err() == nil {
+		return conn, nil
+	}
+	if udp := s.server.getUdpServer(); udp != nil {
+		if addr, ok := conn.RemoteAddr().(*net.UDPAddr); ok {
+			return udp.NewConn(addr)
+		}
+	}
+	return nil, errors.New("coap device connection is closed")
+}
+
+// 注册observe, 返回响应中的observe序号
+func (s *DeviceSession) observe(path string, token message.Token) uint32 {
+	s.Lock()
+	defer s.Unlock()
+	obs := &observation{token: append(message.Token{}, token...), seq: 2}
+	s.observations[path] = obs
+	return obs.seq
+}
+
+func (s *DeviceSession) cancelObserve(path string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.observations, path)
+}
+
+// 向设备发送GET请求(可确认消息), 返回设备的响应
+func (s *DeviceSession) Get(path string) (*coapResponse, error) {
+	return s.request(codes.GET, path, nil)
+}
+
+// 向设备发送POST请求(可确认消息), 返回设备的响应
+func (s *DeviceSession) Post(path string, payload string) (*coapResponse, error) {
+	return s.request(codes.POST, path, []byte(payload))
+}
+
+// 向设备发送PUT请求(可确认消息), 返回设备的响应
+func (s *DeviceSession) Put(path string, payload string) (*coapResponse, error) {
+	return s.request(codes.PUT, path, []byte(payload))
+}
+
+func (s *DeviceSession) PostHex(path string, payloadHex string) (*coapResponse, error) {
+	b, err := hex.DecodeString(payloadHex)
+	if err != nil {
+		return nil, err
+	}
+	return s.request(codes.POST, path, b)
+}
+
+func (s *DeviceSession) request(code codes.Code, path string, payload []byte) (*coapResponse, error) {
+	conn, err := s.getConn()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	var resp *pool.Message
+	switch code {
+	case codes.GET:
+		resp, err = conn.Get(ctx, path)
+	case codes.PUT:
+		resp, err = conn.Put(ctx, path, message.TextPlain, bytes.NewReader(payload))
+	default:
+		resp, err = conn.Post(ctx, path, message.TextPlain, bytes.NewReader(payload))
+	}
+	if err != nil {
+		logs.Warnf("coap request %s %s to device %s error: %v", code, path, s.deviceId, err)
+		return nil, err
+	}
+	defer conn.ReleaseMessage(resp)
+	data, err := resp.ReadBody()
+	if err != nil {
+		return nil, err
+	}
+	return &coapResponse{Code: codeString(resp.Code()), Data: data}, nil
+}
+
+// 向observe了资源的设备发送通知(可确认消息), 等待设备确认
+func (s *DeviceSession) Notify(path string, payload string) error {
+	return s.notify(path, []byte(payload))
+}
+
+func (s *DeviceSession) NotifyHex(path string, payloadHex string) error {
+	b, err := hex.DecodeString(payloadHex)
+	if err != nil {
+		return err
+	}
+	return s.notify(path, b)
+}
+
+func (s *DeviceSession) notify(path string, payload []byte) error {
+	s.Lock()
+	obs, ok := s.observations[path]
+	var token message.Token
+	var seq uint32
+	if ok {
+		obs.seq = (obs.seq + 1) % maxObserveSeq
+		token, seq = obs.token, obs.seq
+	}
+	s.Unlock()
+	if !ok {
+		return fmt.Errorf("device %s not observe %s", s.deviceId, path)
+	}
+	conn, err := s.getConn()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	m := conn.AcquireMessage(ctx)
+	defer conn.ReleaseMessage(m)
+	m.SetCode(codes.Content)
+	m.SetToken(token)
+	m.SetType(message.Confirmable)
+	m.SetContentFormat(message.TextPlain)
+	m.SetObserve(seq)
+	m.SetBody(bytes.NewReader(payload))
+	err = conn.WriteMessage(m)
+	if err != nil {
+		logs.Warnf("coap notify %s to device %s error: %v", path, s.deviceId, err)
+	}
+	return err
+}
+
+// 响应码的点分格式, 如2.05
+func codeString(c codes.Code) string {
+	return fmt.Sprintf("%d.%02d", c>>5, c&0x1f)
+}
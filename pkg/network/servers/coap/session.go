@@ -1,18 +1,23 @@
 package coapserver
 
 import (
+	"crypto/x509"
 	"go-iot/pkg/core"
+	"go-iot/pkg/network"
 	"io"
+	"strings"
 
 	logs "go-iot/pkg/logger"
 
+	piondtls "github.com/pion/dtls/v3"
 	"github.com/plgd-dev/go-coap/v3/message"
 	"github.com/plgd-dev/go-coap/v3/message/codes"
 	"github.com/plgd-dev/go-coap/v3/mux"
 )
 
-func newSession(w mux.ResponseWriter, r *mux.Message, productId string) *CoapSession {
+func newSession(server *CoapServer, w mux.ResponseWriter, r *mux.Message, productId string) *CoapSession {
 	session := &CoapSession{
+		server:    server,
 		w:         w,
 		r:         r,
 		productId: productId,
@@ -20,7 +25,9 @@ func newSession(w mux.ResponseWriter, r *mux.Message, productId string) *CoapSes
 	return session
 }
 
+// 一次请求的会话, 设备上线后下发使用设备会话DeviceSession
 type CoapSession struct {
+	server    *CoapServer
 	w         mux.ResponseWriter
 	r         *mux.Message
 	productId string
@@ -36,11 +43,30 @@ func (s *CoapSession) GetDeviceId() string {
 }
 
 func (s *CoapSession) GetInfo() map[string]any {
-	return map[string]any{}
+	return network.AddCertInfo(map[string]any{}, s.peerCertificate())
+}
+
+// dtls客户端证书, 双向认证时有值
+func (s *CoapSession) peerCertificate() *x509.Certificate {
+	conn, ok := s.w.Conn().NetConn().(*piondtls.Conn)
+	if !ok {
+		return nil
+	}
+	state, ok := conn.ConnectionState()
+	if !ok || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	cert, err := x509.ParseCertificate(state.PeerCertificates[0])
+	if err != nil {
+		return nil
+	}
+	return cert
 }
 
 func (s *CoapSession) Disconnect() error {
-	core.DelSession(s.deviceId)
+	if session := s.server.getSession(s.deviceId); session != nil {
+		return session.Disconnect()
+	}
 	return nil
 }
 
@@ -70,21 +96,60 @@ func (s *CoapSession) readData() error {
 	sc := core.GetCodec(s.productId)
 	message := s.getBody(s.r) // 10 MB is a lot of text.
 	path, _ := s.r.Path()
-	sc.OnMessage(&coapContext{
+	ctx := &coapContext{
 		BaseContext: core.BaseContext{
 			DeviceId:  s.GetDeviceId(),
 			ProductId: s.productId,
 			Session:   s,
 		},
-		Data: message,
-		r:    s.r,
-		url:  path,
-	})
+		session: s,
+		Data:    message,
+		r:       s.r,
+		url:     path,
+	}
+	// 双向认证时证书对应的设备自动上线
+	if deviceId := network.CertDeviceId(s.productId, s.peerCertificate()); len(deviceId) > 0 {
+		s.SetDeviceId(deviceId)
+		ctx.DeviceId = deviceId
+		ctx.DeviceOnline(deviceId)
+	}
+	sc.OnMessage(ctx)
+	s.handleObserve(path)
 	return nil
 }
 
+// 已上线设备的observe注册(GET observe=0)与取消(observe=1), 通知在命令下发时发送
+func (s *CoapSession) handleObserve(path string) {
+	obs, err := s.r.Options().Observe()
+	if err != nil || s.r.Code() != codes.GET {
+		return
+	}
+	session := s.server.getSession(s.deviceId)
+	if session == nil {
+		return
+	}
+	// 部分客户端把查询参数写在路径中
+	path, _, _ = strings.Cut(path, "?")
+	if obs == 1 {
+		session.cancelObserve(path)
+		return
+	}
+	seq := session.observe(path, s.r.Token())
+	if !s.w.Message().IsModified() {
+		err = sendResponse(s.w, codes.Content, message.TextPlain, "")
+		if err != nil {
+			logs.Warnf("coap observe response error: %v", err)
+			return
+		}
+	}
+	s.w.Message().SetObserve(seq)
+}
+
 func (s *CoapSession) getBody(r *mux.Message) []byte {
 	var requestbody []byte
+	if r.Body() == nil {
+		return requestbody
+	}
 	requestbody, _ = io.ReadAll(r.Body())
 
 	return requestbody
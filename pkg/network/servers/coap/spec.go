@@ -7,6 +7,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"go-iot/pkg/network"
+	"time"
+
+	piondtls "github.com/pion/dtls/v3"
 )
 
 type (
@@ -17,7 +20,10 @@ type (
 		Port        int32                 `json:"port"`
 		UseTLS      bool                  `json:"useTLS"`
 		Certificate []network.Certificate `json:"certificate"`
+		ClientAuth  *network.ClientAuth   `json:"-"` // 客户端证书认证
 		Routers     []Router              `json:"routers"`
+		// 设备会话超时(秒), 超时没有收到设备的请求时设备离线, 默认300
+		SessionTimeout int `json:"sessionTimeout"`
 	}
 	Router struct {
 		Url string `json:"url"`
@@ -38,9 +44,19 @@ func (spec *CoapServerSpec) FromJson(str string) error {
 		}
 	}
 	spec.Routers = routers
+	if spec.SessionTimeout < 0 {
+		return fmt.Errorf("coap server spec error: invalid sessionTimeout %d", spec.SessionTimeout)
+	}
 	return nil
 }
 
+func (spec *CoapServerSpec) sessionTimeout() time.Duration {
+	if spec.SessionTimeout == 0 {
+		return defaultSessionTimeout * time.Second
+	}
+	return time.Duration(spec.SessionTimeout) * time.Second
+}
+
 func (spec *CoapServerSpec) FromNetwork(network network.NetworkConf) error {
 	err := spec.FromJson(network.Configuration)
 	if err != nil {
@@ -55,6 +71,21 @@ func (spec *CoapServerSpec) FromNetwork(network network.NetworkConf) error {
 	return nil
 }
 
+// 需要重启才能生效的配置项
+func (spec *CoapServerSpec) restartFields(n *CoapServerSpec) []string {
+	var fields []string
+	if spec.Host != n.Host {
+		fields = append(fields, "host")
+	}
+	if spec.Port != n.Port {
+		fields = append(fields, "port")
+	}
+	if spec.UseTLS != n.UseTLS {
+		fields = append(fields, "useTLS")
+	}
+	return fields
+}
+
 func (spec *CoapServerSpec) TlsConfig() (*tls.Config, error) {
 	var certificates []tls.Certificate
 
@@ -68,11 +99,37 @@ func (spec *CoapServerSpec) TlsConfig() (*tls.Config, error) {
 	if len(certificates) == 0 {
 		return nil, fmt.Errorf("none valid certs and secret")
 	}
+	cfg := &tls.Config{Certificates: certificates}
+	if spec.ClientAuth != nil {
+		spec.ClientAuth.Apply(cfg)
+	}
+	return cfg, nil
+}
 
-	return &tls.Config{Certificates: certificates}, nil
+// dtls配置, 配置了客户端CA证书时要求客户端提供证书
+func (spec *CoapServerSpec) DtlsConfig() (*piondtls.Config, error) {
+	cfg, err := spec.TlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	dtlsCfg := &piondtls.Config{
+		Certificates:         cfg.Certificates,
+		ExtendedMasterSecret: piondtls.RequireExtendedMasterSecret,
+	}
+	if spec.ClientAuth != nil {
+		dtlsCfg.ClientCAs = spec.ClientAuth.CertPool()
+		dtlsCfg.ClientAuth = piondtls.RequireAndVerifyClientCert
+		dtlsCfg.VerifyPeerCertificate = spec.ClientAuth.VerifyPeerCertificate
+	}
+	return dtlsCfg, nil
 }
 
 func (spec *CoapServerSpec) SetCertificate(conf network.NetworkConf) error {
+	clientAuth, err := network.NewClientAuth(conf)
+	if err != nil {
+		return err
+	}
+	spec.ClientAuth = clientAuth
 	if len(conf.CertBase64) == 0 || len(conf.KeyBase64) == 0 {
 		return nil
 	}
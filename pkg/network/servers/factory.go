@@ -1,12 +1,16 @@
 package servers
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"go-iot/pkg/core"
 	"go-iot/pkg/network"
 	"log"
+	"reflect"
 	"sync"
+
+	logs "go-iot/pkg/logger"
 )
 
 type CreateFun func() network.NetServer
@@ -14,6 +18,9 @@ type CreateFun func() network.NetServer
 var m sync.Map
 var instances sync.Map
 
+// 运行中的产品网络配置
+var confs sync.Map
+
 func RegServer(f CreateFun) {
 	s := f()
 	m.Store(s.Type(), f)
@@ -28,36 +35,229 @@ func GetServer(productId string) network.NetServer {
 	return nil
 }
 
-// 启动网络服务
+// 启动网络服务, 其它产品已使用相同类型与端口的监听时共用该监听
 func StartServer(conf network.NetworkConf) error {
 	if _, ok := instances.Load(conf.ProductId); ok {
 		return errors.New("network is runing")
 	}
 	t := network.NetType(conf.Type)
-	if f, ok := m.Load(t); ok {
-		_, err := core.NewCodec(conf.CodecId, conf.ProductId, conf.Script)
-		if err != nil {
-			return err
+	f, ok := m.Load(t)
+	if !ok {
+		return fmt.Errorf("unknow type %s", conf.Type)
+	}
+	_, err := core.NewCodec(conf.CodecId, conf.ProductId, conf.Script)
+	if err != nil {
+		return err
+	}
+	return startServer(f.(CreateFun), conf)
+}
+
+// 启动网络服务, 不创建编解码
+func startServer(create CreateFun, conf network.NetworkConf) error {
+	if s := getListener(conf); s != nil {
+		shared, ok := s.(network.SharedServer)
+		if !ok {
+			return fmt.Errorf("端口[%d]已被使用", conf.Port)
 		}
-		s := f.(CreateFun)()
-		err = s.Start(conf)
+		err := shared.AddProduct(conf)
 		if err != nil {
 			return err
 		}
 		instances.Store(conf.ProductId, s)
+		confs.Store(conf.ProductId, conf)
 		return nil
-	} else {
-		return fmt.Errorf("unknow type %s", conf.Type)
 	}
+	s := create()
+	err := s.Start(conf)
+	if err != nil {
+		return err
+	}
+	instances.Store(conf.ProductId, s)
+	confs.Store(conf.ProductId, conf)
+	return nil
 }
 
-// 关闭网络服务
+// 关闭网络服务, 共用监听时只移除产品
+// 移除的是监听配置所属的第一个产品时, 监听改用下一个产品的配置
 func StopServer(productId string) error {
 	server := GetServer(productId)
 	if server == nil {
 		return errors.New("network is not runing")
 	}
-	server.Stop()
 	instances.Delete(productId)
+	confs.Delete(productId)
+	if shared, ok := server.(network.SharedServer); ok && len(shared.Products()) > 1 {
+		owner := shared.Products()[0] == productId
+		shared.RemoveProduct(productId)
+		if owner {
+			err := rehomeListener(server, shared.Products()[0])
+			if err != nil {
+				logs.Errorf("network listener of product %s rehome failed: %v", productId, err)
+			}
+		}
+		return nil
+	}
+	server.Stop()
 	return nil
 }
+
+// 在线更新网络服务, 编解码脚本与配置立即生效, 已建立的会话不断开
+// 不能在线生效的配置(如端口)会重启网络服务, 重启失败时恢复原来的服务
+// 共用监听时监听的配置(证书, 分隔符等)使用第一个产品的, 其它产品只能更新路由规则与主题权限
+// 更新成功后才注册新的编解码
+func ReloadServer(conf network.NetworkConf) (*network.ReloadResult, error) {
+	server := GetServer(conf.ProductId)
+	if server == nil {
+		return nil, errors.New("network is not runing")
+	}
+	codec, err := core.CreateCodec(conf.CodecId, conf.ProductId, conf.Script)
+	if err != nil {
+		return nil, err
+	}
+	value, _ := confs.Load(conf.ProductId)
+	old := value.(network.NetworkConf)
+	shared, isShared := server.(network.SharedServer)
+	if old.Type != conf.Type {
+		err = network.RestartRequired("type")
+	} else if old.Port != conf.Port {
+		err = network.RestartRequired("port")
+	} else if isShared && len(shared.Products()) > 1 {
+		owner := shared.Products()[0]
+		if owner != conf.ProductId {
+			if listenerChanged(old, conf) {
+				return nil, fmt.Errorf("端口[%d]与其它产品共用, 监听的配置需要在产品[%s]中修改", conf.Port, owner)
+			}
+			err = shared.AddProduct(conf)
+		} else if err = server.Reload(conf); err == nil {
+			err = shared.AddProduct(conf)
+		} else if errors.Is(err, network.ErrRestartRequired) {
+			// 重启共用的监听, 其它产品一起重新加入
+			startErr := restartListener(server, conf, &old)
+			if startErr != nil {
+				return nil, startErr
+			}
+			confs.Store(conf.ProductId, conf)
+			core.RegisterCodec(conf.ProductId, codec)
+			return &network.ReloadResult{Restart: true, Reason: err.Error()}, nil
+		}
+	} else if err = server.Reload(conf); err == nil && isShared {
+		err = shared.AddProduct(conf)
+	}
+	if err == nil {
+		confs.Store(conf.ProductId, conf)
+		core.RegisterCodec(conf.ProductId, codec)
+		return &network.ReloadResult{}, nil
+	}
+	if !errors.Is(err, network.ErrRestartRequired) {
+		return nil, err
+	}
+	f, ok := m.Load(network.NetType(conf.Type))
+	if !ok {
+		return nil, fmt.Errorf("unknow type %s", conf.Type)
+	}
+	StopServer(conf.ProductId)
+	startErr := startServer(f.(CreateFun), conf)
+	if startErr != nil {
+		f, _ := m.Load(network.NetType(old.Type))
+		if restoreErr := startServer(f.(CreateFun), old); restoreErr != nil {
+			logs.Errorf("network of product %s restore failed: %v", conf.ProductId, restoreErr)
+		}
+		return nil, startErr
+	}
+	core.RegisterCodec(conf.ProductId, codec)
+	return &network.ReloadResult{Restart: true, Reason: err.Error()}, nil
+}
+
+// 共用的监听改用产品的配置, 不能在线生效时重启监听
+func rehomeListener(server network.NetServer, productId string) error {
+	value, ok := confs.Load(productId)
+	if !ok {
+		return fmt.Errorf("network of product %s is not runing", productId)
+	}
+	conf := value.(network.NetworkConf)
+	err := server.Reload(conf)
+	if errors.Is(err, network.ErrRestartRequired) {
+		return restartListener(server, conf, nil)
+	}
+	return err
+}
+
+// 使用conf重启共用的监听, 产品按原来的顺序重新加入
+// 启动失败时使用fallback恢复原来的监听, 没有fallback或恢复失败时这些产品的网络服务都停止
+func restartListener(server network.NetServer, conf network.NetworkConf, fallback *network.NetworkConf) error {
+	productIds := server.(network.SharedServer).Products()
+	server.Stop()
+	f, _ := m.Load(server.Type())
+	s := f.(CreateFun)()
+	err := s.Start(conf)
+	if err == nil {
+		rejoinListener(s, conf, productIds)
+		return nil
+	}
+	if fallback != nil {
+		s = f.(CreateFun)()
+		restoreErr := s.Start(*fallback)
+		if restoreErr == nil {
+			rejoinListener(s, *fallback, productIds)
+			return err
+		}
+		logs.Errorf("network listener of product %s restore failed: %v", fallback.ProductId, restoreErr)
+	}
+	for _, id := range productIds {
+		instances.Delete(id)
+		confs.Delete(id)
+	}
+	return err
+}
+
+// 产品按原来的顺序加入重启后的监听, conf为启动监听的产品配置
+func rejoinListener(s network.NetServer, conf network.NetworkConf, productIds []string) {
+	shared := s.(network.SharedServer)
+	shared.RemoveProduct(conf.ProductId)
+	for _, id := range productIds {
+		c := conf
+		if id != conf.ProductId {
+			value, _ := confs.Load(id)
+			c = value.(network.NetworkConf)
+		}
+		err := shared.AddProduct(c)
+		if err != nil {
+			logs.Errorf("network of product %s restart failed: %v", id, err)
+			instances.Delete(id)
+			confs.Delete(id)
+			continue
+		}
+		instances.Store(id, s)
+	}
+}
+
+// 监听的配置是否变化, 不比较路由规则与主题权限
+func listenerChanged(old network.NetworkConf, conf network.NetworkConf) bool {
+	if old.CertBase64 != conf.CertBase64 || old.KeyBase64 != conf.KeyBase64 ||
+		old.CaBase64 != conf.CaBase64 || old.CrlBase64 != conf.CrlBase64 {
+		return true
+	}
+	return !reflect.DeepEqual(listenerConfiguration(old), listenerConfiguration(conf))
+}
+
+func listenerConfiguration(conf network.NetworkConf) map[string]any {
+	config := map[string]any{}
+	json.Unmarshal([]byte(conf.Configuration), &config)
+	delete(config, "route")
+	delete(config, "acl")
+	return config
+}
+
+// 其它产品已启动的相同类型与端口的监听
+func getListener(conf network.NetworkConf) network.NetServer {
+	var server network.NetServer
+	confs.Range(func(key, value any) bool {
+		c := value.(network.NetworkConf)
+		if c.Port == conf.Port && c.Type == conf.Type {
+			server = GetServer(c.ProductId)
+			return false
+		}
+		return true
+	})
+	return server
+}
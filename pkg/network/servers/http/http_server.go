@@ -1,13 +1,13 @@
 package httpserver
 
 import (
-	"crypto/tls"
 	"fmt"
 	"go-iot/pkg/eventbus"
 	"go-iot/pkg/network"
 	"go-iot/pkg/network/servers"
 	"net"
 	"net/http"
+	"sync"
 
 	logs "go-iot/pkg/logger"
 )
@@ -20,9 +20,11 @@ func init() {
 
 type (
 	HttpServer struct {
-		productId   string
+		sync.RWMutex
+		*network.ProductRouter
 		spec        *HttpServerSpec
 		server      *http.Server
+		tls         *network.TlsReloader
 		pathmatcher eventbus.AntPathMatcher
 	}
 )
@@ -37,19 +39,22 @@ func (s *HttpServer) Type() network.NetType {
 	return network.HTTP_SERVER
 }
 
-func (s *HttpServer) Start(network network.NetworkConf) error {
+func (s *HttpServer) Start(conf network.NetworkConf) error {
 	spec := &HttpServerSpec{}
-	err := spec.FromNetwork(network)
+	err := spec.FromNetwork(conf)
 	if err != nil {
 		return err
 	}
-	spec.Port = network.Port
+	spec.Port = conf.Port
 
 	if len(spec.Routers) == 0 {
 		spec.Routers = append(spec.Routers, Router{Url: "/**"})
 	}
 
-	s.productId = network.ProductId
+	s.ProductRouter, err = network.NewProductRouter(conf)
+	if err != nil {
+		return err
+	}
 	s.spec = spec
 	addr := fmt.Sprintf("%s:%d", spec.Host, spec.Port)
 
@@ -63,9 +68,8 @@ func (s *HttpServer) Start(network network.NetworkConf) error {
 		return err
 	}
 
-	var tlsConfig *tls.Config
 	if spec.UseTLS {
-		tlsConfig, err = spec.TlsConfig()
+		err = s.setTls(spec)
 		if err != nil {
 			return err
 		}
@@ -74,7 +78,7 @@ func (s *HttpServer) Start(network network.NetworkConf) error {
 	go func() {
 		var err error
 		if spec.UseTLS {
-			s.server.TLSConfig = tlsConfig
+			s.server.TLSConfig = s.tls.Config()
 			err = s.server.ServeTLS(listener, "", "")
 		} else {
 			err = s.server.Serve(listener)
@@ -88,7 +92,7 @@ func (s *HttpServer) Start(network network.NetworkConf) error {
 
 func (s *HttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	allow := false
-	for _, route := range s.spec.Routers {
+	for _, route := range s.getSpec().Routers {
 		if s.pathmatcher.Match(route.Url, r.RequestURI) {
 			allow = true
 			break
@@ -100,15 +104,54 @@ func (s *HttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	r.ParseForm()
-	session := newSession(w, r, s.productId)
+	// 多个产品共用监听时按url路径前缀确定产品
+	session := newSession(w, r, s.Match(r.URL.Path))
 
 	session.readData()
 }
 
-func (s *HttpServer) Reload() error {
+// 在线更新配置, 路由与证书立即生效
+func (s *HttpServer) Reload(conf network.NetworkConf) error {
+	spec := &HttpServerSpec{}
+	err := spec.FromNetwork(conf)
+	if err != nil {
+		return err
+	}
+	spec.Port = conf.Port
+	if len(spec.Routers) == 0 {
+		spec.Routers = append(spec.Routers, Router{Url: "/**"})
+	}
+	if fields := s.getSpec().restartFields(spec); len(fields) > 0 {
+		return network.RestartRequired(fields...)
+	}
+	if spec.UseTLS {
+		cfg, err := spec.TlsConfig()
+		if err != nil {
+			return err
+		}
+		s.tls.Store(cfg)
+	}
+	s.Lock()
+	s.spec = spec
+	s.Unlock()
+	return nil
+}
+
+func (s *HttpServer) setTls(spec *HttpServerSpec) error {
+	cfg, err := spec.TlsConfig()
+	if err != nil {
+		return err
+	}
+	s.tls = network.NewTlsReloader(cfg)
 	return nil
 }
 
+func (s *HttpServer) getSpec() *HttpServerSpec {
+	s.RLock()
+	defer s.RUnlock()
+	return s.spec
+}
+
 func (s *HttpServer) Stop() error {
 	return s.server.Close()
 }
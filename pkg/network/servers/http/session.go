@@ -2,7 +2,9 @@ package httpserver
 
 import (
 	"compress/gzip"
+	"crypto/x509"
 	"go-iot/pkg/core"
+	"go-iot/pkg/network"
 	"io"
 	"net/http"
 
@@ -34,7 +36,15 @@ func (s *HttpSession) GetDeviceId() string {
 }
 
 func (s *HttpSession) GetInfo() map[string]any {
-	return map[string]any{}
+	return network.AddCertInfo(map[string]any{}, s.peerCertificate())
+}
+
+// 客户端证书, 双向认证时有值
+func (s *HttpSession) peerCertificate() *x509.Certificate {
+	if s.r.TLS == nil || len(s.r.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	return s.r.TLS.PeerCertificates[0]
 }
 
 func (s *HttpSession) Disconnect() error {
@@ -78,7 +88,7 @@ func (s *HttpSession) SetStatesCode(code int) {
 func (s *HttpSession) readData() error {
 	sc := core.GetCodec(s.productId)
 	message := s.getBody(s.r, int64(10<<20)) // 10 MB is a lot of text.
-	sc.OnMessage(&httpContext{
+	ctx := &httpContext{
 		BaseContext: core.BaseContext{
 			DeviceId:  s.GetDeviceId(),
 			ProductId: s.productId,
@@ -86,7 +96,14 @@ func (s *HttpSession) readData() error {
 		},
 		Data: message,
 		r:    s.r,
-	})
+	}
+	// 双向认证时证书对应的设备自动上线
+	if deviceId := network.CertDeviceId(s.productId, s.peerCertificate()); len(deviceId) > 0 {
+		s.SetDeviceId(deviceId)
+		ctx.DeviceId = deviceId
+		ctx.DeviceOnline(deviceId)
+	}
+	sc.OnMessage(ctx)
 	return nil
 }
 
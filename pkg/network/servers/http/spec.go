@@ -17,6 +17,7 @@ type (
 		Port        int32                 `json:"port"`
 		UseTLS      bool                  `json:"useTLS"`
 		Certificate []network.Certificate `json:"certificate"`
+		ClientAuth  *network.ClientAuth   `json:"-"` // 客户端证书认证
 		Routers     []Router              `json:"routers"`
 	}
 	Router struct {
@@ -55,6 +56,21 @@ func (spec *HttpServerSpec) FromNetwork(network network.NetworkConf) error {
 	return nil
 }
 
+// 需要重启才能生效的配置项
+func (spec *HttpServerSpec) restartFields(n *HttpServerSpec) []string {
+	var fields []string
+	if spec.Host != n.Host {
+		fields = append(fields, "host")
+	}
+	if spec.Port != n.Port {
+		fields = append(fields, "port")
+	}
+	if spec.UseTLS != n.UseTLS {
+		fields = append(fields, "useTLS")
+	}
+	return fields
+}
+
 func (spec *HttpServerSpec) TlsConfig() (*tls.Config, error) {
 	var certificates []tls.Certificate
 
@@ -68,11 +84,19 @@ func (spec *HttpServerSpec) TlsConfig() (*tls.Config, error) {
 	if len(certificates) == 0 {
 		return nil, fmt.Errorf("none valid certs and secret")
 	}
-
-	return &tls.Config{Certificates: certificates}, nil
+	cfg := &tls.Config{Certificates: certificates}
+	if spec.ClientAuth != nil {
+		spec.ClientAuth.Apply(cfg)
+	}
+	return cfg, nil
 }
 
 func (spec *HttpServerSpec) SetCertificate(conf network.NetworkConf) error {
+	clientAuth, err := network.NewClientAuth(conf)
+	if err != nil {
+		return err
+	}
+	spec.ClientAuth = clientAuth
 	if len(conf.CertBase64) == 0 || len(conf.KeyBase64) == 0 {
 		return nil
 	}
@@ -0,0 +1,86 @@
+package modbusserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"go-iot/pkg/core"
+)
+
+// 主站写入的消息, 寄存器为大端字节, 线圈按位打包
+type modbusContext struct {
+	core.BaseContext
+	UnitId   byte
+	Table    string
+	Address  uint16
+	Quantity uint16
+	Data     []byte
+}
+
+func (ctx *modbusContext) GetMessage() interface{} {
+	return ctx.Data
+}
+
+func (ctx *modbusContext) GetUnitId() byte {
+	return ctx.UnitId
+}
+
+func (ctx *modbusContext) GetTable() string {
+	return ctx.Table
+}
+
+func (ctx *modbusContext) GetAddress() uint16 {
+	return ctx.Address
+}
+
+func (ctx *modbusContext) GetQuantity() uint16 {
+	return ctx.Quantity
+}
+
+func (ctx *modbusContext) MsgToString() string {
+	return string(bytes.Trim(ctx.Data, string(rune(0))))
+}
+
+func (ctx *modbusContext) MsgToHexStr() string {
+	return hex.EncodeToString(ctx.Data)
+}
+
+// 数据不足一个寄存器时返回0
+func (ctx *modbusContext) MsgToUint16() uint16 {
+	if len(ctx.Data) < 2 {
+		return 0
+	}
+	return binary.BigEndian.Uint16(ctx.Data)
+}
+
+// 数据不足两个寄存器时返回0
+func (ctx *modbusContext) MsgToUint32() uint32 {
+	if len(ctx.Data) < 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(ctx.Data)
+}
+
+func (ctx *modbusContext) MsgToInt16() int16 {
+	return int16(ctx.MsgToUint16())
+}
+
+func (ctx *modbusContext) MsgToInt32() int32 {
+	return int32(ctx.MsgToUint32())
+}
+
+func (ctx *modbusContext) MsgToBool() bool {
+	if len(ctx.Data) == 0 {
+		return false
+	}
+	return (ctx.Data[0] & 1) > 0
+}
+
+// 按寄存器读取, 每个寄存器一个值
+func (ctx *modbusContext) MsgToUint16Array() []uint16 {
+	var result []uint16
+	for i := 0; i+1 < len(ctx.Data); i += 2 {
+		result = append(result, binary.BigEndian.Uint16(ctx.Data[i:]))
+	}
+	return result
+}
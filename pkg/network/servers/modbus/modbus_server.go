@@ -0,0 +1,360 @@
+package modbusserver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"go-iot/pkg/core"
+	"go-iot/pkg/network"
+	"go-iot/pkg/network/servers"
+	"io"
+	"net"
+	"sync"
+
+	logs "go-iot/pkg/logger"
+)
+
+func init() {
+	servers.RegServer(func() network.NetServer {
+		return NewServer()
+	})
+}
+
+const (
+	// mbap头: 事务id, 协议id, 长度, 单元id
+	mbapHeaderSize = 7
+	maxPduSize     = 253
+
+	funcReadCoils              = 0x01
+	funcReadDiscreteInputs     = 0x02
+	funcReadHoldingRegisters   = 0x03
+	funcReadInputRegisters     = 0x04
+	funcWriteSingleCoil        = 0x05
+	funcWriteSingleRegister    = 0x06
+	funcWriteMultipleCoils     = 0x0F
+	funcWriteMultipleRegisters = 0x10
+
+	exceptionIllegalFunction    = 0x01
+	exceptionIllegalDataAddress = 0x02
+	exceptionIllegalDataValue   = 0x03
+)
+
+type ModbusServer struct {
+	sync.RWMutex
+	productId string
+	spec      *ModbusServerSpec
+	listener  net.Listener
+
+	// done is the channel for shutdowning this server.
+	done  chan struct{}
+	conns map[*modbusConn]struct{}
+	// 每个设备一份寄存器表, 连接断开后保留
+	devices map[string]*registers
+}
+
+func NewServer() *ModbusServer {
+	return &ModbusServer{
+		conns:   make(map[*modbusConn]struct{}),
+		devices: make(map[string]*registers),
+	}
+}
+
+func (s *ModbusServer) Type() network.NetType {
+	return network.MODBUS_SERVER
+}
+
+func (s *ModbusServer) Start(network network.NetworkConf) error {
+	spec := &ModbusServerSpec{}
+	err := spec.FromJson(network.Configuration)
+	if err != nil {
+		return err
+	}
+	spec.Port = network.Port
+
+	s.productId = network.ProductId
+	s.spec = spec
+	s.done = make(chan struct{})
+
+	addr := fmt.Sprintf("%s:%d", s.spec.Host, s.spec.Port)
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		logs.Errorf("modbus server listen failed: %v", err)
+		return fmt.Errorf("gen modbus listener with addr %s failed: %v", addr, err)
+	}
+	s.listener = l
+
+	go s.run()
+	return nil
+}
+
+func (s *ModbusServer) run() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+		} else {
+			go s.handleConn(conn)
+		}
+	}
+}
+
+func (s *ModbusServer) handleConn(c net.Conn) {
+	conn := &modbusConn{
+		server:   s,
+		conn:     c,
+		sessions: map[byte]*ModbusServerSession{},
+	}
+	s.Lock()
+	s.conns[conn] = struct{}{}
+	s.Unlock()
+	defer func() {
+		conn.close()
+		s.Lock()
+		delete(s.conns, conn)
+		s.Unlock()
+	}()
+
+	header := make([]byte, mbapHeaderSize)
+	for {
+		_, err := io.ReadFull(c, header)
+		if err != nil {
+			logs.Debugf("modbus server read error: %v", err)
+			return
+		}
+		length := int(binary.BigEndian.Uint16(header[4:]))
+		if length < 2 || length-1 > maxPduSize {
+			logs.Debugf("modbus server invalid length: %d", length)
+			return
+		}
+		pdu := make([]byte, length-1)
+		_, err = io.ReadFull(c, pdu)
+		if err != nil {
+			logs.Debugf("modbus server read error: %v", err)
+			return
+		}
+		unitId := header[6]
+		resp, msg := conn.handle(unitId, pdu)
+		adu := make([]byte, mbapHeaderSize, mbapHeaderSize+len(resp))
+		copy(adu, header[:4])
+		binary.BigEndian.PutUint16(adu[4:], uint16(len(resp)+1))
+		adu[6] = unitId
+		adu = append(adu, resp...)
+		_, err = c.Write(adu)
+		if err != nil {
+			logs.Debugf("modbus server write error: %v", err)
+			return
+		}
+		// 应答后再交给编解码处理, 避免脚本阻塞主站
+		if msg != nil {
+			sc := core.GetCodec(s.productId)
+			sc.OnMessage(msg)
+		}
+	}
+}
+
+// 获取设备的寄存器表, 不存在时创建
+func (s *ModbusServer) registers(deviceId string) *registers {
+	s.Lock()
+	defer s.Unlock()
+	r, ok := s.devices[deviceId]
+	if !ok {
+		r = newRegisters()
+		s.devices[deviceId] = r
+	}
+	return r
+}
+
+// 在线更新配置, 监听地址变化时需要重启
+func (s *ModbusServer) Reload(conf network.NetworkConf) error {
+	spec := &ModbusServerSpec{}
+	err := spec.FromJson(conf.Configuration)
+	if err != nil {
+		return err
+	}
+	spec.Port = conf.Port
+	s.Lock()
+	defer s.Unlock()
+	if fields := s.spec.restartFields(spec); len(fields) > 0 {
+		return network.RestartRequired(fields...)
+	}
+	s.spec = spec
+	return nil
+}
+
+func (s *ModbusServer) Stop() error {
+	close(s.done)
+	s.listener.Close()
+	s.RLock()
+	var conns []*modbusConn
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.RUnlock()
+	for _, c := range conns {
+		c.close()
+	}
+	return nil
+}
+
+func (s *ModbusServer) TotalConnection() int32 {
+	s.RLock()
+	defer s.RUnlock()
+	return int32(len(s.conns))
+}
+
+// 主站的一个tcp连接, 连接内每个单元id对应一个会话
+type modbusConn struct {
+	sync.Mutex
+	server   *ModbusServer
+	conn     net.Conn
+	sessions map[byte]*ModbusServerSession
+}
+
+func (c *modbusConn) session(unitId byte) *ModbusServerSession {
+	c.Lock()
+	session, ok := c.sessions[unitId]
+	if ok {
+		c.Unlock()
+		return session
+	}
+	session = newSession(c, unitId)
+	c.sessions[unitId] = session
+	c.Unlock()
+
+	// 处理OnConnect步骤, 脚本中调用DeviceOnline绑定设备
+	sc := core.GetCodec(c.server.productId)
+	sc.OnConnect(&modbusContext{
+		BaseContext: core.BaseContext{
+			ProductId: c.server.productId,
+			Session:   session,
+		},
+		UnitId: unitId,
+	})
+	return session
+}
+
+func (c *modbusConn) removeSession(session *ModbusServerSession) (empty bool) {
+	c.Lock()
+	defer c.Unlock()
+	if c.sessions[session.unitId] == session {
+		delete(c.sessions, session.unitId)
+	}
+	return len(c.sessions) == 0
+}
+
+func (c *modbusConn) close() {
+	c.Lock()
+	var sessions []*ModbusServerSession
+	for _, session := range c.sessions {
+		sessions = append(sessions, session)
+	}
+	c.Unlock()
+	for _, session := range sessions {
+		session.Disconnect()
+	}
+	c.conn.Close()
+}
+
+// 处理请求pdu, 返回应答pdu与需要交给编解码的写入消息
+func (c *modbusConn) handle(unitId byte, pdu []byte) ([]byte, *modbusContext) {
+	function := pdu[0]
+	exception := func(code byte) []byte {
+		return []byte{function | 0x80, code}
+	}
+	switch function {
+	case funcReadCoils, funcReadDiscreteInputs, funcReadHoldingRegisters, funcReadInputRegisters,
+		funcWriteSingleCoil, funcWriteSingleRegister, funcWriteMultipleCoils, funcWriteMultipleRegisters:
+	default:
+		return exception(exceptionIllegalFunction), nil
+	}
+	if len(pdu) < 5 {
+		return exception(exceptionIllegalDataValue), nil
+	}
+	address := binary.BigEndian.Uint16(pdu[1:])
+	quantity := binary.BigEndian.Uint16(pdu[3:])
+	outOfRange := func(quantity uint16) bool {
+		return uint32(address)+uint32(quantity) > 0x10000
+	}
+
+	session := c.session(unitId)
+	regs := session.registers()
+	var table string
+	var data []byte
+	var resp []byte
+	switch function {
+	case funcReadCoils, funcReadDiscreteInputs:
+		if quantity < 1 || quantity > 2000 {
+			return exception(exceptionIllegalDataValue), nil
+		}
+		if outOfRange(quantity) {
+			return exception(exceptionIllegalDataAddress), nil
+		}
+		table = COILS
+		if function == funcReadDiscreteInputs {
+			table = DISCRETES_INPUT
+		}
+		bits := regs.readBits(table, address, quantity)
+		return append([]byte{function, byte(len(bits))}, bits...), nil
+	case funcReadHoldingRegisters, funcReadInputRegisters:
+		if quantity < 1 || quantity > 125 {
+			return exception(exceptionIllegalDataValue), nil
+		}
+		if outOfRange(quantity) {
+			return exception(exceptionIllegalDataAddress), nil
+		}
+		table = HOLDING_REGISTERS
+		if function == funcReadInputRegisters {
+			table = INPUT_REGISTERS
+		}
+		words := regs.readWords(table, address, quantity)
+		return append([]byte{function, byte(len(words))}, words...), nil
+	case funcWriteSingleCoil:
+		// 值为0xFF00或0x0000
+		if quantity != 0xFF00 && quantity != 0 {
+			return exception(exceptionIllegalDataValue), nil
+		}
+		table, data = COILS, []byte{byte(quantity >> 8 & 1)}
+		regs.writeBits(table, address, 1, data)
+		resp, quantity = pdu[:5], 1
+	case funcWriteSingleRegister:
+		table, data = HOLDING_REGISTERS, pdu[3:5]
+		regs.writeWords(table, address, data)
+		resp, quantity = pdu[:5], 1
+	case funcWriteMultipleCoils:
+		if quantity < 1 || quantity > 1968 || len(pdu) < 6 || int(pdu[5]) != (int(quantity)+7)/8 || len(pdu) < 6+int(pdu[5]) {
+			return exception(exceptionIllegalDataValue), nil
+		}
+		if outOfRange(quantity) {
+			return exception(exceptionIllegalDataAddress), nil
+		}
+		table, data = COILS, pdu[6:6+int(pdu[5])]
+		regs.writeBits(table, address, quantity, data)
+		resp = pdu[:5]
+	case funcWriteMultipleRegisters:
+		if quantity < 1 || quantity > 123 || len(pdu) < 6 || int(pdu[5]) != int(quantity)*2 || len(pdu) < 6+int(pdu[5]) {
+			return exception(exceptionIllegalDataValue), nil
+		}
+		if outOfRange(quantity) {
+			return exception(exceptionIllegalDataAddress), nil
+		}
+		table, data = HOLDING_REGISTERS, pdu[6:6+int(pdu[5])]
+		regs.writeWords(table, address, data)
+		resp = pdu[:5]
+	}
+	msg := &modbusContext{
+		BaseContext: core.BaseContext{
+			DeviceId:  session.GetDeviceId(),
+			ProductId: c.server.productId,
+			Session:   session,
+		},
+		UnitId:   unitId,
+		Table:    table,
+		Address:  address,
+		Quantity: quantity,
+		Data:     append([]byte{}, data...),
+	}
+	return resp, msg
+}
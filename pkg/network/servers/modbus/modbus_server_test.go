@@ -0,0 +1,153 @@
+package modbusserver_test
+
+import (
+	_ "go-iot/pkg/codec"
+	"go-iot/pkg/core"
+	"go-iot/pkg/logger"
+	"go-iot/pkg/network"
+	modbusserver "go-iot/pkg/network/servers/modbus"
+	"go-iot/pkg/store"
+	_ "go-iot/pkg/timeseries"
+	"testing"
+	"time"
+
+	MODBUS "github.com/goburrow/modbus"
+	"github.com/stretchr/testify/assert"
+)
+
+const script = `
+function OnConnect(context) {
+	// 单元id小于10的绑定设备
+	if (context.GetUnitId() < 10) {
+		context.DeviceOnline("modbus-slave-" + context.GetUnitId())
+	}
+}
+function OnMessage(context) {
+	if (context.GetTable() == "HOLDING_REGISTERS" && context.GetAddress() == 0) {
+		context.SaveProperties({"temp": context.MsgToInt16()})
+	}
+	if (context.GetTable() == "COILS") {
+		// 线圈只有1个字节, 按寄存器读取时为0
+		context.SaveProperties({"switch": context.MsgToBool(), "level": context.MsgToUint32() + context.MsgToUint16()})
+	}
+}
+function OnInvoke(context) {
+	var session = context.GetSession()
+	session.WriteInputRegisters(10, 2, "00070008")
+	session.WriteDiscreteInputs(0, 1, "01")
+	context.ReplyOk()
+}
+`
+
+const tslText = `
+{
+  "functions": [{"id": "stage", "name": "暂存", "async": false}],
+  "properties": [
+    {"id": "temp", "name": "温度", "type": "int"},
+    {"id": "switch", "name": "开关", "type": "bool"},
+    {"id": "level", "name": "等级", "type": "int"}
+  ]
+}
+`
+
+func init() {
+	logger.InitNop()
+	core.RegDeviceStore(store.NewMockDeviceStore())
+}
+
+func TestModbusServer(t *testing.T) {
+	product, err := core.NewProduct("modbus-server-product", map[string]string{}, core.TIME_SERISE_MOCK, tslText)
+	assert.Nil(t, err)
+	core.PutProduct(product)
+	core.PutDevice(core.NewDevice("modbus-slave-1", product.Id, 0))
+	core.PutDevice(core.NewDevice("modbus-slave-2", product.Id, 0))
+
+	conf := network.NetworkConf{
+		Name:          "modbus server",
+		ProductId:     product.Id,
+		CodecId:       core.Script_Codec,
+		Port:          15502,
+		Configuration: `{"host": "127.0.0.1"}`,
+		Script:        script,
+	}
+	_, err = core.NewCodec(conf.CodecId, conf.ProductId, conf.Script)
+	assert.Nil(t, err)
+	s := modbusserver.NewServer()
+	err = s.Start(conf)
+	assert.Nil(t, err)
+	defer s.Stop()
+
+	handler := MODBUS.NewTCPClientHandler("127.0.0.1:15502")
+	handler.SlaveId = 1
+	handler.Timeout = time.Second
+	err = handler.Connect()
+	assert.Nil(t, err)
+	defer handler.Close()
+	client := MODBUS.NewClient(handler)
+
+	// 主站写入
+	_, err = client.WriteMultipleRegisters(0, 2, []byte{0xff, 0xfe, 0, 1})
+	assert.Nil(t, err)
+	_, err = client.WriteSingleCoil(3, 0xFF00)
+	assert.Nil(t, err)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(1), s.TotalConnection())
+	assert.NotNil(t, core.GetSession("modbus-slave-1"))
+	reported := core.GetShadow("modbus-slave-1").Reported
+	assert.EqualValues(t, -2, reported["temp"].Value)
+	assert.Equal(t, true, reported["switch"].Value)
+	assert.EqualValues(t, 0, reported["level"].Value)
+
+	data, err := client.ReadHoldingRegisters(0, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0xff, 0xfe, 0, 1, 0, 0}, data)
+	data, err = client.ReadCoils(0, 4)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x08}, data)
+
+	// 命令调用暂存值, 主站读取
+	resp := core.DoCmdInvoke(core.FuncInvoke{DeviceId: "modbus-slave-1", FunctionId: "stage"})
+	assert.Nil(t, resp)
+	data, err = client.ReadInputRegisters(10, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0, 7, 0, 8}, data)
+	data, err = client.ReadDiscreteInputs(0, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{1}, data)
+
+	// 其它单元id的寄存器表独立
+	handler.SlaveId = 2
+	data, err = client.ReadInputRegisters(10, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0, 0, 0, 0}, data)
+
+	// 未绑定设备的单元id, 寄存器表只属于当前连接
+	handler.SlaveId = 20
+	_, err = client.WriteSingleRegister(5, 9)
+	assert.Nil(t, err)
+	other := MODBUS.NewTCPClientHandler("127.0.0.1:15502")
+	other.SlaveId = 20
+	other.Timeout = time.Second
+	assert.Nil(t, other.Connect())
+	otherClient := MODBUS.NewClient(other)
+	data, err = otherClient.ReadHoldingRegisters(5, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0, 0}, data)
+
+	// 设备重连后寄存器表保留
+	handler.Close()
+	assert.Eventually(t, func() bool { return core.GetSession("modbus-slave-1") == nil }, time.Second, 10*time.Millisecond)
+	other.SlaveId = 1
+	data, err = otherClient.ReadInputRegisters(10, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0, 7, 0, 8}, data)
+	other.Close()
+	handler.SlaveId = 2
+	assert.Nil(t, handler.Connect())
+
+	// 不支持的功能码
+	_, err = client.ReadFIFOQueue(0)
+	assert.NotNil(t, err)
+	_, err = client.ReadHoldingRegisters(0, 200)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,73 @@
+package modbusserver
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+const (
+	DISCRETES_INPUT   = "DISCRETES_INPUT"
+	COILS             = "COILS"
+	INPUT_REGISTERS   = "INPUT_REGISTERS"
+	HOLDING_REGISTERS = "HOLDING_REGISTERS"
+)
+
+// 单元的寄存器表, 未写入过的地址值为0
+type registers struct {
+	sync.RWMutex
+	words map[string]map[uint16]uint16
+	bits  map[string]map[uint16]bool
+}
+
+func newRegisters() *registers {
+	return &registers{
+		words: map[string]map[uint16]uint16{
+			HOLDING_REGISTERS: {},
+			INPUT_REGISTERS:   {},
+		},
+		bits: map[string]map[uint16]bool{
+			COILS:           {},
+			DISCRETES_INPUT: {},
+		},
+	}
+}
+
+// 读取寄存器, 每个寄存器2个字节(大端)
+func (r *registers) readWords(table string, address uint16, quantity uint16) []byte {
+	r.RLock()
+	defer r.RUnlock()
+	data := make([]byte, 0, int(quantity)*2)
+	for i := uint16(0); i < quantity; i++ {
+		data = binary.BigEndian.AppendUint16(data, r.words[table][address+i])
+	}
+	return data
+}
+
+func (r *registers) writeWords(table string, address uint16, data []byte) {
+	r.Lock()
+	defer r.Unlock()
+	for i := 0; i+1 < len(data); i += 2 {
+		r.words[table][address+uint16(i/2)] = binary.BigEndian.Uint16(data[i:])
+	}
+}
+
+// 读取线圈, 按位打包, 低位在前
+func (r *registers) readBits(table string, address uint16, quantity uint16) []byte {
+	r.RLock()
+	defer r.RUnlock()
+	data := make([]byte, (int(quantity)+7)/8)
+	for i := uint16(0); i < quantity; i++ {
+		if r.bits[table][address+i] {
+			data[i/8] |= 1 << (i % 8)
+		}
+	}
+	return data
+}
+
+func (r *registers) writeBits(table string, address uint16, quantity uint16, data []byte) {
+	r.Lock()
+	defer r.Unlock()
+	for i := uint16(0); i < quantity; i++ {
+		r.bits[table][address+i] = data[i/8]&(1<<(i%8)) > 0
+	}
+}
@@ -0,0 +1,167 @@
+package modbusserver
+
+import (
+	"encoding/hex"
+	"fmt"
+	"go-iot/pkg/core"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	Connected    = 1
+	Disconnected = 2
+)
+
+func newSession(conn *modbusConn, unitId byte) *ModbusServerSession {
+	return &ModbusServerSession{
+		id:         fmt.Sprintf("modbus%d", time.Now().UnixNano()),
+		conn:       conn,
+		unitId:     unitId,
+		productId:  conn.server.productId,
+		statusFlag: Connected,
+		regs:       newRegisters(),
+	}
+}
+
+// 主站连接中的一个单元id, 绑定一个设备
+type ModbusServerSession struct {
+	id         string
+	conn       *modbusConn
+	unitId     byte
+	productId  string
+	deviceId   string
+	statusFlag int32
+	// 未绑定设备时使用的寄存器表
+	regs *registers
+}
+
+func (s *ModbusServerSession) SetDeviceId(deviceId string) {
+	s.deviceId = deviceId
+}
+
+func (s *ModbusServerSession) GetDeviceId() string {
+	return s.deviceId
+}
+
+func (s *ModbusServerSession) GetInfo() map[string]any {
+	return map[string]any{
+		"localAddr":  s.conn.conn.LocalAddr().String(),
+		"remoteAddr": s.conn.conn.RemoteAddr().String(),
+		"unitId":     s.unitId,
+	}
+}
+
+func (s *ModbusServerSession) Disconnect() error {
+	if s.disconnected() {
+		return nil
+	}
+	core.DelSession(s.deviceId)
+	return s.Close()
+}
+
+// 关闭会话, 连接中没有其它会话时关闭连接
+func (s *ModbusServerSession) Close() error {
+	if !atomic.CompareAndSwapInt32(&s.statusFlag, Connected, Disconnected) {
+		return nil
+	}
+	if s.conn.removeSession(s) {
+		return s.conn.conn.Close()
+	}
+	return nil
+}
+
+// 寄存器表, 绑定设备后按设备保存, 重连后保留, 未绑定时只属于当前连接的单元id
+func (s *ModbusServerSession) registers() *registers {
+	if len(s.deviceId) > 0 {
+		return s.conn.server.registers(s.deviceId)
+	}
+	return s.regs
+}
+
+func (s *ModbusServerSession) disconnected() bool {
+	return atomic.LoadInt32(&s.statusFlag) == Disconnected
+}
+
+func (s *ModbusServerSession) GetUnitId() byte {
+	return s.unitId
+}
+
+func (s *ModbusServerSession) ReadDiscreteInputs(startingAddress uint16, length uint16) *modbusContext {
+	return s.getValue(DISCRETES_INPUT, startingAddress, length)
+}
+
+func (s *ModbusServerSession) ReadCoils(startingAddress uint16, length uint16) *modbusContext {
+	return s.getValue(COILS, startingAddress, length)
+}
+
+func (s *ModbusServerSession) ReadInputRegisters(startingAddress uint16, length uint16) *modbusContext {
+	return s.getValue(INPUT_REGISTERS, startingAddress, length)
+}
+
+func (s *ModbusServerSession) ReadHoldingRegisters(startingAddress uint16, length uint16) *modbusContext {
+	return s.getValue(HOLDING_REGISTERS, startingAddress, length)
+}
+
+// 读取寄存器表中的值, 包括主站写入与暂存的值
+func (s *ModbusServerSession) getValue(table string, startingAddress uint16, length uint16) *modbusContext {
+	regs := s.registers()
+	var data []byte
+	if table == COILS || table == DISCRETES_INPUT {
+		data = regs.readBits(table, startingAddress, length)
+	} else {
+		data = regs.readWords(table, startingAddress, length)
+	}
+	return &modbusContext{
+		BaseContext: core.BaseContext{
+			DeviceId:  s.deviceId,
+			ProductId: s.productId,
+			Session:   s,
+		},
+		UnitId:   s.unitId,
+		Table:    table,
+		Address:  startingAddress,
+		Quantity: length,
+		Data:     data,
+	}
+}
+
+// 暂存值, 供主站读取
+func (s *ModbusServerSession) WriteDiscreteInputs(startingAddress uint16, length uint16, hexStr string) error {
+	return s.setValue(DISCRETES_INPUT, startingAddress, length, hexStr)
+}
+
+func (s *ModbusServerSession) WriteCoils(startingAddress uint16, length uint16, hexStr string) error {
+	return s.setValue(COILS, startingAddress, length, hexStr)
+}
+
+func (s *ModbusServerSession) WriteInputRegisters(startingAddress uint16, length uint16, hexStr string) error {
+	return s.setValue(INPUT_REGISTERS, startingAddress, length, hexStr)
+}
+
+func (s *ModbusServerSession) WriteHoldingRegisters(startingAddress uint16, length uint16, hexStr string) error {
+	return s.setValue(HOLDING_REGISTERS, startingAddress, length, hexStr)
+}
+
+func (s *ModbusServerSession) setValue(table string, startingAddress uint16, length uint16, hexStr string) error {
+	data, err := hex.DecodeString(hexStr)
+	if err != nil {
+		return fmt.Errorf("modbus hex decode error: %v", err)
+	}
+	if uint32(startingAddress)+uint32(length) > 0x10000 {
+		return fmt.Errorf("modbus address %d with length %d out of range", startingAddress, length)
+	}
+	regs := s.registers()
+	if table == COILS || table == DISCRETES_INPUT {
+		if len(data) != (int(length)+7)/8 {
+			return fmt.Errorf("modbus %s data must be %d bytes", table, (int(length)+7)/8)
+		}
+		regs.writeBits(table, startingAddress, length, data)
+		return nil
+	}
+	if len(data) != int(length)*2 {
+		return fmt.Errorf("modbus %s data must be %d bytes", table, int(length)*2)
+	}
+	regs.writeWords(table, startingAddress, data)
+	return nil
+}
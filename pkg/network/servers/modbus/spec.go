@@ -0,0 +1,38 @@
+// modbus tcp从站服务
+package modbusserver
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+type (
+	// Spec describes the ModbusServer
+	ModbusServerSpec struct {
+		Name string `json:"name"`
+		Host string `json:"host"`
+		Port int32  `json:"port"`
+	}
+)
+
+func (spec *ModbusServerSpec) FromJson(str string) error {
+	if len(str) > 0 {
+		err := json.Unmarshal([]byte(str), spec)
+		if err != nil {
+			return fmt.Errorf("modbus server spec error: %v", err)
+		}
+	}
+	return nil
+}
+
+// 需要重启才能生效的配置项
+func (spec *ModbusServerSpec) restartFields(n *ModbusServerSpec) []string {
+	var fields []string
+	if spec.Host != n.Host {
+		fields = append(fields, "host")
+	}
+	if spec.Port != n.Port {
+		fields = append(fields, "port")
+	}
+	return fields
+}
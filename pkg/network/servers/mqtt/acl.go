@@ -0,0 +1,72 @@
+package mqttserver
+
+import (
+	"fmt"
+	"go-iot/pkg/core"
+	"go-iot/pkg/network"
+
+	logs "go-iot/pkg/logger"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+func (c *Client) aclVars() network.TopicAclVars {
+	return network.TopicAclVars{
+		ProductId: c.info.productId,
+		DeviceId:  c.session.GetDeviceId(),
+		ClientId:  c.info.cid,
+		Username:  c.info.username,
+	}
+}
+
+func (c *Client) canPublish(topic string) bool {
+	if c.broker.Acl(c.info.productId).CanPublish(c.aclVars(), topic) {
+		return true
+	}
+	c.denied("publish", topic)
+	return false
+}
+
+func (c *Client) canSubscribe(filter string) bool {
+	if c.broker.Acl(c.info.productId).CanSubscribe(c.aclVars(), filter) {
+		return true
+	}
+	c.denied("subscribe", filter)
+	return false
+}
+
+// 拒绝的操作记录到设备调试日志
+func (c *Client) denied(op string, topic string) {
+	logs.Debugf("client %s %s [%s] denied", c.info.cid, op, topic)
+	core.DebugLog(c.session.GetDeviceId(), c.info.productId, fmt.Sprintf("%s [%s] denied by acl", op, topic))
+}
+
+// 转发给订阅了该主题的其它会话, qos取发布与订阅中较小的
+func (b *Broker) fanout(from *MqttSession, publish *packets.PublishPacket) {
+	if !b.getSpec().Fanout {
+		return
+	}
+	b.RLock()
+	targets := map[*MqttSession]bool{}
+	for _, c := range b.clients {
+		if c.session != nil {
+			targets[c.session] = true
+		}
+	}
+	// 离线的持久会话
+	for _, s := range b.sessions {
+		targets[s] = true
+	}
+	b.RUnlock()
+	delete(targets, from)
+	for s := range targets {
+		qos, ok := s.subscribedQos(publish.TopicName)
+		if !ok {
+			continue
+		}
+		if publish.Qos < qos {
+			qos = publish.Qos
+		}
+		s.publish(publish.TopicName, publish.Payload, qos, false)
+	}
+}
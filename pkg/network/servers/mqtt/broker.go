@@ -26,13 +26,17 @@ type (
 	// Broker is MQTT server, will manage client, topic, session, etc.
 	Broker struct {
 		sync.RWMutex
-		productId string
-		name      string
-		spec      *MQTTServerSpec
+		*network.ProductRouter
+		name string
+		spec *MQTTServerSpec
 
 		listener net.Listener
 		clients  map[string]*Client
-		tlsCfg   *tls.Config
+		tls      *network.TlsReloader
+		// CleanSession为false的会话, 断开后保留
+		sessions map[string]*MqttSession
+		// 主题的保留消息
+		retained map[string]*packets.PublishPacket
 
 		// done is the channel for shutdowning this proxy.
 		done chan struct{}
@@ -47,18 +51,26 @@ func (s *Broker) Type() network.NetType {
 	return network.MQTT_BROKER
 }
 
-func (s *Broker) Start(network network.NetworkConf) error {
+func (s *Broker) Start(conf network.NetworkConf) error {
 	spec := &MQTTServerSpec{}
-	err := spec.FromNetwork(network)
+	err := spec.FromNetwork(conf)
 	if err != nil {
 		return err
 	}
-	spec.Port = network.Port
+	spec.Port = conf.Port
+	if spec.MaxQueuedMessages == 0 {
+		spec.MaxQueuedMessages = defaultMaxQueuedMessages
+	}
 
-	s.productId = network.ProductId
+	s.ProductRouter, err = network.NewProductRouter(conf)
+	if err != nil {
+		return err
+	}
 	s.name = spec.Name
 	s.spec = spec
 	s.clients = make(map[string]*Client)
+	s.sessions = make(map[string]*MqttSession)
+	s.retained = make(map[string]*packets.PublishPacket)
 	s.done = make(chan struct{})
 
 	err = s.setListener()
@@ -76,14 +88,14 @@ func (s *Broker) Start(network network.NetworkConf) error {
 func (b *Broker) setListener() error {
 	var l net.Listener
 	var err error
-	var cfg *tls.Config
 	addr := fmt.Sprintf(":%d", b.spec.Port)
 	if b.spec.UseTLS {
-		cfg, err = b.spec.TlsConfig()
+		cfg, err := b.spec.TlsConfig()
 		if err != nil {
 			return fmt.Errorf("invalid tls config for mqtt proxy: %v", err)
 		}
-		l, err = tls.Listen("tcp", addr, cfg)
+		b.tls = network.NewTlsReloader(cfg)
+		l, err = tls.Listen("tcp", addr, b.tls.Config())
 		if err != nil {
 			return fmt.Errorf("gen mqtt tls tcp listener with addr %v and cfg %v failed: %v", addr, cfg, err)
 		}
@@ -93,38 +105,65 @@ func (b *Broker) setListener() error {
 			return fmt.Errorf("gen mqtt tcp listener with addr %s failed: %v", addr, err)
 		}
 	}
-	b.tlsCfg = cfg
 	b.listener = l
 	return err
 }
 
-func (b *Broker) Reload() error {
+// 在线更新配置, 证书, 主题权限, 转发等配置立即生效, 已连接的客户端不会断开
+func (b *Broker) Reload(conf network.NetworkConf) error {
+	spec := &MQTTServerSpec{}
+	err := spec.FromNetwork(conf)
+	if err != nil {
+		return err
+	}
+	spec.Port = conf.Port
+	if spec.MaxQueuedMessages == 0 {
+		spec.MaxQueuedMessages = defaultMaxQueuedMessages
+	}
+	if fields := b.getSpec().restartFields(spec); len(fields) > 0 {
+		return network.RestartRequired(fields...)
+	}
+	if spec.UseTLS {
+		cfg, err := spec.TlsConfig()
+		if err != nil {
+			return fmt.Errorf("invalid tls config for mqtt proxy: %v", err)
+		}
+		b.tls.Store(cfg)
+	}
+	b.Lock()
+	b.spec = spec
+	b.Unlock()
 	return nil
 }
 
+func (b *Broker) getSpec() *MQTTServerSpec {
+	b.RLock()
+	defer b.RUnlock()
+	return b.spec
+}
+
 func (b *Broker) Stop() error {
 	close(b.done)
 	b.listener.Close()
 
 	b.Lock()
-	defer b.Unlock()
-	for _, v := range b.clients {
-		go v.close()
+	clients := b.clients
+	sessions := b.sessions
+	b.clients = map[string]*Client{}
+	b.sessions = map[string]*MqttSession{}
+	b.Unlock()
+	// 先断开连接, 断开时设置的过期定时器在下面停止
+	for _, v := range clients {
+		v.close()
 	}
-	b.clients = nil
-	return nil
-}
-
-func (b *Broker) deleteSession(clientID string) {
-	b.Lock()
-	defer b.Unlock()
-	if c, ok := b.clients[clientID]; ok {
-		if !c.disconnected() {
-			logs.Debugf("broker watch and delete client %v", c.info.cid)
-			c.close()
-		}
+	// 保留的会话一起删除, 设备下线
+	for _, sess := range sessions {
+		sess.Lock()
+		sess.stopExpiry()
+		sess.Unlock()
+		sess.offline()
 	}
-	delete(b.clients, clientID)
+	return nil
 }
 
 func (b *Broker) run() {
@@ -145,11 +184,11 @@ func (b *Broker) run() {
 func (b *Broker) checkConnectPermission(connect *packets.ConnectPacket) bool {
 	// check here to do early stop for connection. Later we will check it again to make sure
 	// not exceed MaxAllowedConnection
-	if b.spec.MaxAllowedConnection > 0 {
+	if max := b.getSpec().MaxAllowedConnection; max > 0 {
 		b.Lock()
 		connNum := len(b.clients)
 		b.Unlock()
-		if connNum >= b.spec.MaxAllowedConnection {
+		if connNum >= max {
 			return false
 		}
 	}
@@ -158,7 +197,7 @@ func (b *Broker) checkConnectPermission(connect *packets.ConnectPacket) bool {
 
 func (b *Broker) connectionValidation(connect *packets.ConnectPacket, conn net.Conn) (*Client, *packets.ConnackPacket, bool) {
 	connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
-	connack.SessionPresent = connect.CleanSession
+	connack.SessionPresent = false
 	connack.ReturnCode = connect.Validate()
 	if connack.ReturnCode != packets.Accepted {
 		err := connack.Write(conn)
@@ -177,11 +216,16 @@ func (b *Broker) connectionValidation(connect *packets.ConnectPacket, conn net.C
 	}
 
 	client := newClient(connect, b, conn)
+	cert := network.PeerCertificate(conn)
+	// 多个产品共用监听时证书对应设备的产品优先
+	if cert != nil && b.Shared() {
+		client.info.productId, _ = b.MatchCert(cert)
+	}
 
 	// check auth
 	ctx := &authContext{
 		BaseContext: core.BaseContext{
-			ProductId: b.productId,
+			ProductId: client.info.productId,
 			Session:   nil,
 			DeviceId:  client.ClientID(),
 		},
@@ -189,7 +233,12 @@ func (b *Broker) connectionValidation(connect *packets.ConnectPacket, conn net.C
 		connack: connack,
 		conn:    conn,
 	}
-	err := core.GetCodec(b.productId).OnConnect(ctx)
+	// 双向认证时证书对应的设备自动上线, 不再校验密码
+	certDeviceId := network.CertDeviceId(client.info.productId, cert)
+	if len(certDeviceId) > 0 {
+		ctx.DeviceOnline(certDeviceId)
+	}
+	err := core.GetCodec(client.info.productId).OnConnect(ctx)
 
 	if ctx.authFail {
 		return nil, nil, false
@@ -199,7 +248,7 @@ func (b *Broker) connectionValidation(connect *packets.ConnectPacket, conn net.C
 			logs.Errorf(err.Error())
 			return nil, nil, false
 		}
-		if !ctx.checkAuth() {
+		if len(certDeviceId) == 0 && !ctx.checkAuth() {
 			return nil, nil, false
 		}
 		ctx.DeviceOnline(ctx.DeviceId)
@@ -237,7 +286,7 @@ func (b *Broker) handleConn(conn net.Conn) {
 	b.clients[client.info.cid] = client
 	b.Unlock()
 
-	b.setSession(client, connect)
+	b.setSession(client, connect, connack)
 
 	err = connack.Write(conn)
 	if err != nil {
@@ -247,33 +296,43 @@ func (b *Broker) handleConn(conn net.Conn) {
 	}
 
 	go client.writeLoop()
+	client.session.resend(client)
 	client.readLoop()
 }
 
-func (b *Broker) setSession(client *Client, connect *packets.ConnectPacket) {
-	// when clean session is false, previous session exist and previous session not clean session,
-	// then we use previous session, otherwise use new session
-	prevS := core.GetSession(client.info.deviceId)
-	var prevSess *MqttSession = nil
-	if prevS != nil {
-		prevSess = prevS.(*MqttSession)
-	}
-	if !connect.CleanSession && (prevSess != nil) && !prevSess.cleanSession() {
-		client.session = prevSess
-	} else {
-		if prevSess != nil {
-			prevSess.Close()
+func (b *Broker) setSession(client *Client, connect *packets.ConnectPacket, connack *packets.ConnackPacket) {
+	// when clean session is false and previous session exist, then we use previous session,
+	// otherwise use new session
+	cid := client.info.cid
+	b.Lock()
+	sess, ok := b.sessions[cid]
+	if connect.CleanSession || !ok {
+		if ok {
+			sess.Lock()
+			sess.stopExpiry()
+			sess.Unlock()
 		}
-		sess := &MqttSession{}
+		sess = &MqttSession{}
 		sess.init(b, connect)
-		// here connect is valid, make device online
-		baseContext := &core.BaseContext{
-			ProductId: b.productId,
-			Session:   sess,
+		if connect.CleanSession {
+			delete(b.sessions, cid)
+		} else {
+			b.sessions[cid] = sess
 		}
-		baseContext.DeviceOnline(client.info.deviceId)
-		client.session = sess
+	} else {
+		connack.SessionPresent = true
+		sess.info.Username = connect.Username
 	}
+	client.session = sess
+	// 持有broker锁绑定, 避免会话同时过期
+	sess.attach(client)
+	b.Unlock()
+	// here connect is valid, make device online
+	baseContext := &core.BaseContext{
+		ProductId: client.info.productId,
+		Session:   sess,
+	}
+	baseContext.DeviceOnline(client.info.deviceId)
 }
 
 func (b *Broker) getClient(clientID string) *Client {
@@ -285,17 +344,67 @@ func (b *Broker) getClient(clientID string) *Client {
 	return nil
 }
 
-func (b *Broker) removeClient(clientID string) {
+func (b *Broker) removeClient(c *Client) {
 	b.Lock()
-	if val, ok := b.clients[clientID]; ok {
-		if val.disconnected() {
-			delete(b.clients, clientID)
-		}
+	if val, ok := b.clients[c.info.cid]; ok && val == c {
+		delete(b.clients, c.info.cid)
 	}
 	b.Unlock()
 }
 
+func (b *Broker) removeSession(s *MqttSession) {
+	b.Lock()
+	if val, ok := b.sessions[s.info.ClientID]; ok && val == s {
+		delete(b.sessions, s.info.ClientID)
+	}
+	s.Lock()
+	s.stopExpiry()
+	s.Unlock()
+	b.Unlock()
+}
+
+// 会话过期, 断开后未在sessionExpiry内重连时删除会话, 设备下线
+func (b *Broker) expireSession(s *MqttSession) {
+	b.Lock()
+	if val, ok := b.sessions[s.info.ClientID]; !ok || val != s || !s.detached() {
+		b.Unlock()
+		return
+	}
+	delete(b.sessions, s.info.ClientID)
+	b.Unlock()
+	logs.Debugf("session %s expired", s.info.ClientID)
+	s.offline()
+}
+
+// 遗嘱消息, 保存为保留消息并触发设备的遗嘱事件
+func (b *Broker) publishWill(c *Client) {
+	will := c.info.will
+	if will.Retain {
+		b.retain(will)
+	}
+	deviceId := c.session.GetDeviceId()
+	product := core.GetProduct(c.info.productId)
+	if len(deviceId) == 0 || product == nil {
+		return
+	}
+	if _, ok := product.GetTsl().EventsMap()[WillEventId]; !ok {
+		logs.Debugf("client %s will message of %s ignored, event [%s] not defined", c.info.cid, will.TopicName, WillEventId)
+		return
+	}
+	ctx := &core.BaseContext{
+		DeviceId:  deviceId,
+		ProductId: c.info.productId,
+		Session:   c.session,
+	}
+	ctx.SaveEvents(WillEventId, map[string]any{
+		"topic":   will.TopicName,
+		"payload": string(will.Payload),
+	})
+}
+
 func (b *Broker) TotalConnection() int32 {
+	b.RLock()
+	defer b.RUnlock()
 	l := len(b.clients)
 	return int32(l)
 }
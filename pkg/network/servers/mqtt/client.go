@@ -35,9 +35,9 @@ type processFnWithErr func(*Client, packets.ControlPacket) error
 var processPacketMap = map[string]processFnWithErr{
 	"*packets.ConnectPacket":     errorWrapper("double connect"),
 	"*packets.ConnackPacket":     errorWrapper("client should not send connack"),
-	"*packets.PubrecPacket":      errorWrapper("qos2 not support now"),
-	"*packets.PubrelPacket":      errorWrapper("qos2 not support now"),
-	"*packets.PubcompPacket":     errorWrapper("qos2 not support now"),
+	"*packets.PubrecPacket":      nilErrWrapper(processPubrec),
+	"*packets.PubrelPacket":      nilErrWrapper(processPubrel),
+	"*packets.PubcompPacket":     nilErrWrapper(processPubcomp),
 	"*packets.SubackPacket":      errorWrapper("broker not subscribe"),
 	"*packets.UnsubackPacket":    errorWrapper("broker not unsubscribe"),
 	"*packets.PingrespPacket":    errorWrapper("broker not ping"),
@@ -55,6 +55,7 @@ type (
 		username  string
 		password  string
 		deviceId  string
+		productId string // 多个产品共用监听时按clientId或username前缀确定
 		keepalive uint16
 		will      *packets.PublishPacket
 	}
@@ -99,6 +100,7 @@ func newClient(connect *packets.ConnectPacket, broker *Broker, conn net.Conn) *C
 		cid:       connect.ClientIdentifier,
 		username:  connect.Username,
 		password:  string(connect.Password),
+		productId: broker.Match(connect.ClientIdentifier, connect.Username),
 		keepalive: connect.Keepalive,
 		will:      will,
 	}
@@ -163,7 +165,10 @@ func (c *Client) processPacket(packet packets.ControlPacket) error {
 }
 
 func (c *Client) writePacket(packet packets.ControlPacket) {
-	c.writeCh <- packet
+	select {
+	case c.writeCh <- packet:
+	case <-c.done:
+	}
 }
 
 func (c *Client) writeLoop() {
@@ -190,12 +195,15 @@ func (c *Client) close() {
 	logs.Debugf("client %v connection close", c.info.cid)
 	atomic.StoreInt32(&c.statusFlag, Disconnected)
 	close(c.done) // 删除
-	c.broker.deleteSession(c.info.cid)
-	c.broker.removeClient(c.info.cid)
+	c.broker.removeClient(c)
 	c.conn.Close()
 	c.Unlock()
 	if c.session != nil {
-		c.session.Disconnect()
+		// 非正常断开时发送遗嘱消息
+		if c.info.will != nil {
+			c.broker.publishWill(c)
+		}
+		c.session.detach(c)
 	}
 }
 
@@ -238,14 +246,29 @@ func processPublish(c *Client, packet packets.ControlPacket) {
 		puback.MessageID = publish.MessageID
 		c.writePacket(puback) // 返回客户端ack
 	case QoS2:
-		// not support yet
+		pubrec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+		pubrec.MessageID = publish.MessageID
+		// 重复的消息只回复PUBREC, 不再处理
+		first := c.session.receive(publish.MessageID)
+		c.writePacket(pubrec)
+		if !first {
+			return
+		}
+	}
+	// 没有权限的消息确认后丢弃
+	if !c.canPublish(publish.TopicName) {
+		return
+	}
+	if publish.Retain {
+		c.broker.retain(publish)
 	}
+	c.broker.fanout(c.session, publish)
 	// 调用wasm host处理
-	sc := core.GetCodec(c.broker.productId)
+	sc := core.GetCodec(c.info.productId)
 	sc.OnMessage(&mqttContext{
 		BaseContext: core.BaseContext{
 			DeviceId:  c.session.GetDeviceId(),
-			ProductId: c.broker.productId,
+			ProductId: c.info.productId,
 			Session:   c.session,
 		},
 		Data:      publish.Payload,
@@ -259,19 +282,53 @@ func processPuback(c *Client, packet packets.ControlPacket) {
 	c.session.puback(puback)
 }
 
+func processPubrec(c *Client, packet packets.ControlPacket) {
+	pubrec := packet.(*packets.PubrecPacket)
+	c.writePacket(c.session.pubrec(pubrec))
+}
+
+func processPubrel(c *Client, packet packets.ControlPacket) {
+	pubrel := packet.(*packets.PubrelPacket)
+	c.session.release(pubrel.MessageID)
+	pubcomp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+	pubcomp.MessageID = pubrel.MessageID
+	c.writePacket(pubcomp)
+}
+
+func processPubcomp(c *Client, packet packets.ControlPacket) {
+	pubcomp := packet.(*packets.PubcompPacket)
+	c.session.pubcomp(pubcomp)
+}
+
 func processSubscribe(c *Client, p packets.ControlPacket) {
 	packet := p.(*packets.SubscribePacket)
 	logs.Debugf("client %s subscribe %v with qos %v", c.info.cid, packet.Topics, packet.Qoss)
 
-	c.session.subscribe(packet.Topics, packet.Qoss)
-
 	suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
 	suback.MessageID = packet.MessageID
 	suback.ReturnCodes = make([]byte, len(packet.Topics))
-	for i := range packet.Topics {
-		suback.ReturnCodes[i] = packet.Qos
+	for i, filter := range packet.Topics {
+		suback.ReturnCodes[i] = packet.Qoss[i]
+		if packet.Qoss[i] > QoS2 || !c.canSubscribe(filter) {
+			suback.ReturnCodes[i] = 0x80
+		}
 	}
+	c.session.subscribe(packet.Topics, suback.ReturnCodes)
 	c.writePacket(suback)
+
+	// 发送匹配的保留消息
+	for i, filter := range packet.Topics {
+		if suback.ReturnCodes[i] > QoS2 {
+			continue
+		}
+		for _, retained := range c.broker.retainedFor(filter) {
+			qos := retained.Qos
+			if packet.Qoss[i] < qos {
+				qos = packet.Qoss[i]
+			}
+			c.session.publish(retained.TopicName, retained.Payload, qos, true)
+		}
+	}
 }
 
 func processUnsubscribe(c *Client, p packets.ControlPacket) {
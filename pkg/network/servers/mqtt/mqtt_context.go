@@ -69,6 +69,16 @@ func (ctx *authContext) _authFail(code int) {
 }
 
 func (ctx *authContext) checkAuth() bool {
+	// 设备设置了密钥时使用签名密码认证
+	device := core.GetDevice(ctx.DeviceId)
+	if device != nil && len(device.Secret) > 0 {
+		if err := device.VerifySign(ctx.GetClientId(), ctx.GetPassword()); err != nil {
+			core.DebugLog(device.Id, device.ProductId, "auth fail: "+err.Error())
+			ctx.AuthFail()
+			return false
+		}
+		return true
+	}
 	username := ctx.GetConfig("username")
 	password := ctx.GetConfig("password")
 	username1 := ctx.GetUserName()
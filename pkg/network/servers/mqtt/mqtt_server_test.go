@@ -7,15 +7,19 @@ import (
 	"go-iot/pkg/network"
 	mqttserver "go-iot/pkg/network/servers/mqtt"
 	"go-iot/pkg/store"
-	_ "go-iot/pkg/timeseries"
+	"go-iot/pkg/timeseries"
 	"go-iot/pkg/tsl"
+	"net"
 	"os"
+	"sync"
 	"testing"
 	"time"
 
 	logs "go-iot/pkg/logger"
 
 	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/stretchr/testify/assert"
 )
 
 const script = `
@@ -135,3 +139,406 @@ func newClient(network network.NetworkConf, deviceId string) {
 	client.Disconnect(250)
 	fmt.Println("Sample Publisher Disconnected")
 }
+
+const sessionScript = `
+function OnConnect(context) {
+	context.DeviceOnline(context.GetClientId())
+}
+function OnMessage(context) {
+	context.SaveProperties(JSON.parse(context.MsgToString()))
+}
+function OnInvoke(context) {
+	context.GetSession().Publish("down", JSON.stringify(context.GetMessage().Data))
+	context.ReplyOk()
+}
+`
+
+const sessionTsl = `
+{
+  "properties": [{"id": "temperature", "name": "温度", "type": "float"}],
+  "events": [{"id": "will", "name": "遗嘱", "type": "object", "properties": [
+    {"id": "topic", "name": "主题", "type": "string"},
+    {"id": "payload", "name": "内容", "type": "string"}
+  ]}],
+  "functions": [{"id": "func1", "name": "下发", "async": false, "inputs": [{"id": "name", "name": "名称", "type": "string"}]}]
+}
+`
+
+// 记录保存的属性与事件
+type recordTimeSeries struct {
+	timeseries.MockTimeSeries
+	sync.Mutex
+	properties []map[string]any
+	events     []map[string]any
+}
+
+func (t *recordTimeSeries) Id() string {
+	return "mqtt-record"
+}
+
+func (t *recordTimeSeries) SaveProperties(product *core.Product, data map[string]any) error {
+	t.Lock()
+	defer t.Unlock()
+	t.properties = append(t.properties, data)
+	return nil
+}
+
+func (t *recordTimeSeries) SaveEvents(product *core.Product, eventId string, data map[string]any) error {
+	t.Lock()
+	defer t.Unlock()
+	t.events = append(t.events, data)
+	return nil
+}
+
+func (t *recordTimeSeries) count() (int, int) {
+	t.Lock()
+	defer t.Unlock()
+	return len(t.properties), len(t.events)
+}
+
+type rawClient struct {
+	net.Conn
+	t *testing.T
+}
+
+func dial(t *testing.T, port int32, clientId string, clean bool, will *packets.PublishPacket) (*rawClient, *packets.ConnackPacket) {
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	assert.Nil(t, err)
+	c := &rawClient{Conn: conn, t: t}
+	connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	connect.ProtocolName = "MQTT"
+	connect.ProtocolVersion = 4
+	connect.ClientIdentifier = clientId
+	connect.CleanSession = clean
+	if will != nil {
+		connect.WillFlag = true
+		connect.WillTopic = will.TopicName
+		connect.WillMessage = will.Payload
+		connect.WillRetain = will.Retain
+	}
+	c.send(connect)
+	return c, c.read().(*packets.ConnackPacket)
+}
+
+func (c *rawClient) send(p packets.ControlPacket) {
+	assert.Nil(c.t, p.Write(c.Conn))
+}
+
+func (c *rawClient) read() packets.ControlPacket {
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	p, err := packets.ReadPacket(c.Conn)
+	assert.Nil(c.t, err)
+	return p
+}
+
+func (c *rawClient) subscribe(topic string, qos byte) {
+	sub := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	sub.MessageID = 1
+	sub.Topics = []string{topic}
+	sub.Qoss = []byte{qos}
+	c.send(sub)
+	suback := c.read().(*packets.SubackPacket)
+	assert.Equal(c.t, []byte{qos}, suback.ReturnCodes)
+}
+
+func TestSession(t *testing.T) {
+	ts := &recordTimeSeries{}
+	core.RegisterTimeSeries(ts)
+	product, err := core.NewProduct("session-product", map[string]string{}, ts.Id(), sessionTsl)
+	assert.Nil(t, err)
+	core.PutProduct(product)
+	core.PutDevice(core.NewDevice("session-1", product.Id, 0))
+	core.PutDevice(core.NewDevice("session-2", product.Id, 0))
+
+	conf := network.NetworkConf{
+		Name:      "session server",
+		ProductId: product.Id,
+		CodecId:   core.Script_Codec,
+		Port:      1884,
+		Script:    sessionScript,
+		// 断开1秒后会话过期
+		Configuration: `{"sessionExpiry": 1}`,
+	}
+	_, err = core.NewCodec(conf.CodecId, conf.ProductId, conf.Script)
+	assert.Nil(t, err)
+	b := mqttserver.NewServer()
+	err = b.Start(conf)
+	assert.Nil(t, err)
+
+	c, connack := dial(t, conf.Port, "session-1", false, nil)
+	assert.False(t, connack.SessionPresent)
+	c.subscribe("down", 1)
+
+	// 未确认的QoS1消息在重连后重发
+	resp := core.DoCmdInvoke(core.FuncInvoke{DeviceId: "session-1", FunctionId: "func1", Data: map[string]any{"name": "a"}})
+	assert.Nil(t, resp)
+	publish := c.read().(*packets.PublishPacket)
+	assert.Equal(t, byte(1), publish.Qos)
+	assert.False(t, publish.Dup)
+	c.Close()
+	// 断开后会话保留, 离线时下发的消息排队
+	session := core.GetSession("session-1")
+	assert.NotNil(t, session)
+	assert.Eventually(t, func() bool { return session.GetInfo()["connected"] == false }, time.Second, 10*time.Millisecond)
+	resp = core.DoCmdInvoke(core.FuncInvoke{DeviceId: "session-1", FunctionId: "func1", Data: map[string]any{"name": "offline"}})
+	assert.Nil(t, resp)
+	assert.Equal(t, 2, session.GetInfo()["pending"])
+
+	c, connack = dial(t, conf.Port, "session-1", false, nil)
+	defer c.Close()
+	assert.True(t, connack.SessionPresent)
+	assert.Equal(t, session, core.GetSession("session-1"))
+	resent := c.read().(*packets.PublishPacket)
+	assert.True(t, resent.Dup)
+	assert.Equal(t, publish.MessageID, resent.MessageID)
+	assert.Equal(t, `{"name":"a"}`, string(resent.Payload))
+	queued := c.read().(*packets.PublishPacket)
+	assert.False(t, queued.Dup)
+	assert.Equal(t, `{"name":"offline"}`, string(queued.Payload))
+	for _, p := range []*packets.PublishPacket{resent, queued} {
+		puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+		puback.MessageID = p.MessageID
+		c.send(puback)
+	}
+	assert.Eventually(t, func() bool { return session.GetInfo()["pending"] == 0 }, time.Second, 10*time.Millisecond)
+
+	// QoS2上行, 重复的消息只处理一次
+	up := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	up.TopicName = "up"
+	up.Qos = 2
+	up.MessageID = 7
+	up.Payload = []byte(`{"temperature": 1.5}`)
+	c.send(up)
+	assert.Equal(t, uint16(7), c.read().(*packets.PubrecPacket).MessageID)
+	up.Dup = true
+	c.send(up)
+	assert.Equal(t, uint16(7), c.read().(*packets.PubrecPacket).MessageID)
+	pubrel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+	pubrel.MessageID = 7
+	c.send(pubrel)
+	assert.Equal(t, uint16(7), c.read().(*packets.PubcompPacket).MessageID)
+	properties, _ := ts.count()
+	assert.Equal(t, 1, properties)
+
+	// QoS2下行
+	c.subscribe("down", 2)
+	resp = core.DoCmdInvoke(core.FuncInvoke{DeviceId: "session-1", FunctionId: "func1", Data: map[string]any{"name": "b"}})
+	assert.Nil(t, resp)
+	publish = c.read().(*packets.PublishPacket)
+	assert.Equal(t, byte(2), publish.Qos)
+	pubrec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+	pubrec.MessageID = publish.MessageID
+	c.send(pubrec)
+	assert.Equal(t, publish.MessageID, c.read().(*packets.PubrelPacket).MessageID)
+	pubcomp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+	pubcomp.MessageID = publish.MessageID
+	c.send(pubcomp)
+	assert.Eventually(t, func() bool { return session.GetInfo()["pending"] == 0 }, time.Second, 10*time.Millisecond)
+
+	// 保留消息
+	retained := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	retained.TopicName = "status/session-1"
+	retained.Retain = true
+	retained.Payload = []byte(`{"temperature": 2}`)
+	c.send(retained)
+	c.subscribe("status/+", 0)
+	publish = c.read().(*packets.PublishPacket)
+	assert.True(t, publish.Retain)
+	assert.Equal(t, "status/session-1", publish.TopicName)
+
+	// 非正常断开发送遗嘱消息
+	will := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	will.TopicName = "will/session-2"
+	will.Payload = []byte("gone")
+	will.Retain = true
+	c2, _ := dial(t, conf.Port, "session-2", true, will)
+	c2.Close()
+	assert.Eventually(t, func() bool {
+		_, events := ts.count()
+		return events == 1
+	}, time.Second, 10*time.Millisecond)
+	c.subscribe("will/#", 0)
+	publish = c.read().(*packets.PublishPacket)
+	assert.Equal(t, "gone", string(publish.Payload))
+
+	// 正常断开不发送遗嘱
+	c2, _ = dial(t, conf.Port, "session-2", true, will)
+	c2.send(packets.NewControlPacket(packets.Disconnect))
+	c2.Close()
+	time.Sleep(100 * time.Millisecond)
+	_, events := ts.count()
+	assert.Equal(t, 1, events)
+
+	// 超过sessionExpiry未重连时删除会话
+	c.Close()
+	assert.Eventually(t, func() bool { return core.GetSession("session-1") == nil }, 3*time.Second, 10*time.Millisecond)
+	c, connack = dial(t, conf.Port, "session-1", false, nil)
+	defer c.Close()
+	assert.False(t, connack.SessionPresent)
+
+	// CleanSession为true时丢弃之前的会话
+	c.Close()
+	c, connack = dial(t, conf.Port, "session-1", true, nil)
+	defer c.Close()
+	assert.False(t, connack.SessionPresent)
+
+	// 会话被关闭(如被新连接替换)时, CleanSession为true的设备下线
+	assert.Eventually(t, func() bool { return core.GetSession("session-1") != nil }, time.Second, 10*time.Millisecond)
+	core.GetSession("session-1").Close()
+	assert.Nil(t, core.GetSession("session-1"))
+	// CleanSession为false的会话保留到过期
+	c, _ = dial(t, conf.Port, "session-1", false, nil)
+	defer c.Close()
+	assert.Eventually(t, func() bool { return core.GetSession("session-1") != nil }, time.Second, 10*time.Millisecond)
+	core.GetSession("session-1").Close()
+	assert.NotNil(t, core.GetSession("session-1"))
+	assert.Eventually(t, func() bool { return core.GetSession("session-1") == nil }, 3*time.Second, 10*time.Millisecond)
+	c, connack = dial(t, conf.Port, "session-1", false, nil)
+	defer c.Close()
+	assert.False(t, connack.SessionPresent)
+
+	// 停止服务时保留会话的设备立即下线
+	assert.Eventually(t, func() bool { return core.GetSession("session-1") != nil }, time.Second, 10*time.Millisecond)
+	b.Stop()
+	assert.Nil(t, core.GetSession("session-1"))
+}
+
+func TestSignAuth(t *testing.T) {
+	product, err := core.NewProduct("sign-product", map[string]string{}, core.TIME_SERISE_MOCK, sessionTsl)
+	assert.Nil(t, err)
+	core.PutProduct(product)
+	device := core.NewDevice("sign-1", product.Id, 0)
+	device.Secret = "secret-1"
+	core.PutDevice(device)
+
+	// 未实现OnConnect时使用默认认证
+	conf := network.NetworkConf{
+		Name:      "sign server",
+		ProductId: product.Id,
+		CodecId:   core.Script_Codec,
+		Port:      1885,
+		Script:    `function OnMessage(context) {}`,
+	}
+	_, err = core.NewCodec(conf.CodecId, conf.ProductId, conf.Script)
+	assert.Nil(t, err)
+	b := mqttserver.NewServer()
+	err = b.Start(conf)
+	assert.Nil(t, err)
+	defer b.Stop()
+
+	connect := func(password string) *packets.ConnackPacket {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", conf.Port))
+		assert.Nil(t, err)
+		c := &rawClient{Conn: conn, t: t}
+		defer c.Close()
+		p := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+		p.ProtocolName = "MQTT"
+		p.ProtocolVersion = 4
+		p.ClientIdentifier = "sign-1"
+		p.CleanSession = true
+		p.UsernameFlag = true
+		p.Username = "sign-1"
+		p.PasswordFlag = true
+		p.Password = []byte(password)
+		c.send(p)
+		return c.read().(*packets.ConnackPacket)
+	}
+	connack := connect("123456")
+	assert.Equal(t, byte(packets.ErrRefusedNotAuthorised), connack.ReturnCode)
+	password, err := core.SignPassword("secret-2", "sign-1", "sha256", time.Now().UnixMilli())
+	assert.Nil(t, err)
+	connack = connect(password)
+	assert.Equal(t, byte(packets.ErrRefusedNotAuthorised), connack.ReturnCode)
+	password, err = core.SignPassword("secret-1", "sign-1", "sha256", time.Now().UnixMilli())
+	assert.Nil(t, err)
+	connack = connect(password)
+	assert.Equal(t, byte(packets.Accepted), connack.ReturnCode)
+}
+
+func TestAcl(t *testing.T) {
+	ts := &recordTimeSeries{}
+	core.RegisterTimeSeries(ts)
+	product, err := core.NewProduct("acl-product", map[string]string{}, ts.Id(), sessionTsl)
+	assert.Nil(t, err)
+	core.PutProduct(product)
+	core.PutDevice(core.NewDevice("acl-1", product.Id, 0))
+	core.PutDevice(core.NewDevice("acl-2", product.Id, 0))
+
+	conf := network.NetworkConf{
+		Name:      "acl server",
+		ProductId: product.Id,
+		CodecId:   core.Script_Codec,
+		Port:      1886,
+		Script:    sessionScript,
+		Configuration: `{"fanout": true, "acl": {
+			"publish": ["{productId}/{deviceId}/up"],
+			"subscribe": ["{productId}/+/up", "{productId}/{deviceId}/down"]
+		}}`,
+	}
+	_, err = core.NewCodec(conf.CodecId, conf.ProductId, conf.Script)
+	assert.Nil(t, err)
+	b := mqttserver.NewServer()
+	err = b.Start(conf)
+	assert.Nil(t, err)
+	defer b.Stop()
+
+	c1, _ := dial(t, conf.Port, "acl-1", true, nil)
+	defer c1.Close()
+	c2, _ := dial(t, conf.Port, "acl-2", true, nil)
+	defer c2.Close()
+
+	// 没有权限的订阅返回0x80
+	sub := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	sub.MessageID = 1
+	sub.Topics = []string{"acl-product/+/up", "acl-product/acl-1/down", "#", "acl-product/acl-2/down"}
+	sub.Qoss = []byte{1, 1, 0, 0}
+	c2.send(sub)
+	suback := c2.read().(*packets.SubackPacket)
+	assert.Equal(t, []byte{1, 0x80, 0x80, 0}, suback.ReturnCodes)
+
+	// 有权限的消息转发给订阅的设备, 并交给编解码处理
+	up := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	up.TopicName = "acl-product/acl-1/up"
+	up.Payload = []byte(`{"temperature": 1}`)
+	c1.send(up)
+	publish := c2.read().(*packets.PublishPacket)
+	assert.Equal(t, up.TopicName, publish.TopicName)
+	assert.Equal(t, byte(0), publish.Qos)
+	assert.Eventually(t, func() bool {
+		properties, _ := ts.count()
+		return properties == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// 没有权限的消息确认后丢弃
+	denied := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	denied.TopicName = "acl-product/acl-2/up"
+	denied.Qos = 1
+	denied.MessageID = 2
+	denied.Payload = []byte(`{"temperature": 2}`)
+	c1.send(denied)
+	assert.Equal(t, uint16(2), c1.read().(*packets.PubackPacket).MessageID)
+	c2.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err = packets.ReadPacket(c2.Conn)
+	assert.NotNil(t, err)
+	properties, _ := ts.count()
+	assert.Equal(t, 1, properties)
+
+	// 共用监听的产品使用各自的主题权限
+	product2, err := core.NewProduct("acl-product2", map[string]string{}, ts.Id(), sessionTsl)
+	assert.Nil(t, err)
+	core.PutProduct(product2)
+	core.PutDevice(core.NewDevice("acl2-1", product2.Id, 0))
+	conf2 := conf
+	conf2.ProductId = product2.Id
+	conf2.Configuration = `{"route": {"prefix": "acl2-"}, "acl": {"subscribe": ["{productId}/a/#"]}}`
+	_, err = core.NewCodec(conf2.CodecId, conf2.ProductId, conf2.Script)
+	assert.Nil(t, err)
+	assert.Nil(t, b.AddProduct(conf2))
+	c3, _ := dial(t, conf.Port, "acl2-1", true, nil)
+	defer c3.Close()
+	sub.Topics = []string{"acl-product2/a/b", "acl-product2/x/up"}
+	sub.Qoss = []byte{0, 0}
+	c3.send(sub)
+	suback = c3.read().(*packets.SubackPacket)
+	assert.Equal(t, []byte{0, 0x80}, suback.ReturnCodes)
+}
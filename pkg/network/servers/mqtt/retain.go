@@ -0,0 +1,36 @@
+package mqttserver
+
+import (
+	"go-iot/pkg/network"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// 保存主题的保留消息, payload为空时删除
+func (b *Broker) retain(p *packets.PublishPacket) {
+	b.Lock()
+	defer b.Unlock()
+	if len(p.Payload) == 0 {
+		delete(b.retained, p.TopicName)
+		return
+	}
+	msg := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	msg.TopicName = p.TopicName
+	msg.Qos = p.Qos
+	msg.Retain = true
+	msg.Payload = append([]byte{}, p.Payload...)
+	b.retained[p.TopicName] = msg
+}
+
+// 匹配订阅的保留消息
+func (b *Broker) retainedFor(filter string) []*packets.PublishPacket {
+	b.RLock()
+	defer b.RUnlock()
+	var result []*packets.PublishPacket
+	for topic, p := range b.retained {
+		if network.TopicMatch(filter, topic) {
+			result = append(result, p)
+		}
+	}
+	return result
+}
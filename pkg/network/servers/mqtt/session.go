@@ -5,7 +5,9 @@ import (
 	"encoding/hex"
 	"fmt"
 	"go-iot/pkg/core"
+	"go-iot/pkg/network"
 	"sync"
+	"time"
 
 	logs "go-iot/pkg/logger"
 
@@ -26,15 +28,22 @@ type (
 
 	// MqttSession includes the information about the connect between client and broker,
 	// such as topic subscribe, not-send messages, etc.
+	// CleanSession为false时, 断开连接后会话保留在broker中, 重连后继续使用,
+	// 保留期间设备会话不删除, 下发的QoS1/2消息排队, 重连后重发, 超过sessionExpiry未重连时删除
 	MqttSession struct {
 		sync.Mutex
-		broker       *Broker
-		info         *SessionInfo
-		done         chan struct{}
+		broker *Broker
+		info   *SessionInfo
+		// 当前连接, 断开时为nil
+		client *Client
+		// 等待确认的QoS1/2消息, 包括离线时排队的消息
 		pending      map[uint16]*Message
 		pendingQueue []uint16
-		nextID       uint16
-		isClose      bool
+		// 已收到但未释放(PUBREL)的QoS2消息
+		received map[uint16]bool
+		nextID   uint16
+		// 断开后的过期定时器
+		expiry *time.Timer
 	}
 
 	// Message is the message send from broker to client
@@ -42,6 +51,11 @@ type (
 		Topic      string `yaml:"topic"`
 		B64Payload string `yaml:"b64Payload"`
 		QoS        int    `yaml:"qos"`
+		Retain     bool   `yaml:"retain"`
+		// 已发送过, 重发时设置dup
+		sent bool
+		// QoS2已收到PUBREC, 重发时发送PUBREL
+		released bool
 	}
 )
 
@@ -56,26 +70,77 @@ func newMsg(topic string, payload []byte, qos byte) *Message {
 
 func (s *MqttSession) init(b *Broker, connect *packets.ConnectPacket) error {
 	s.broker = b
-	s.done = make(chan struct{})
 	s.pending = make(map[uint16]*Message)
 	s.pendingQueue = []uint16{}
+	s.received = make(map[uint16]bool)
 
 	s.info = &SessionInfo{}
 	s.info.Username = connect.Username
 	s.info.ClientID = connect.ClientIdentifier
-	s.info.CleanFlag = true //connect.CleanSession not supported currently
+	s.info.CleanFlag = connect.CleanSession
 	s.info.ProtocolInfo = fmt.Sprintf("%s %v", connect.ProtocolName, connect.ProtocolVersion)
 	s.info.Topics = make(map[string]int)
 
-	go s.backgroundResendPending()
-
 	return nil
 }
 
+// 绑定新的连接
+func (s *MqttSession) attach(c *Client) {
+	s.Lock()
+	s.client = c
+	s.stopExpiry()
+	s.Unlock()
+}
+
+// 连接断开, 只处理当前绑定的连接, CleanSession为false时保留会话直到过期
+func (s *MqttSession) detach(c *Client) {
+	expiry := s.broker.getSpec().sessionExpiry()
+	s.Lock()
+	if s.client != c {
+		s.Unlock()
+		return
+	}
+	s.client = nil
+	if !s.info.CleanFlag {
+		s.stopExpiry()
+		s.expiry = time.AfterFunc(expiry, func() {
+			s.broker.expireSession(s)
+		})
+		s.Unlock()
+		return
+	}
+	s.Unlock()
+	s.offline()
+}
+
+func (s *MqttSession) stopExpiry() {
+	if s.expiry != nil {
+		s.expiry.Stop()
+		s.expiry = nil
+	}
+}
+
+// 未连接时返回true
+func (s *MqttSession) detached() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.client == nil
+}
+
+// 设备下线
+func (s *MqttSession) offline() {
+	if core.GetSession(s.info.deviceId) == s {
+		core.DelSession(s.info.deviceId)
+	}
+}
+
 func (s *MqttSession) subscribe(topics []string, qoss []byte) error {
 	logs.Debugf("session %s sub %v", s.info.ClientID, topics)
 	s.Lock()
 	for i, t := range topics {
+		if qoss[i] > QoS2 {
+			continue
+		}
 		s.info.Topics[t] = int(qoss[i])
 	}
 	s.Unlock()
@@ -92,59 +157,125 @@ func (s *MqttSession) unsubscribe(topics []string) error {
 	return nil
 }
 
+// 匹配订阅的最大qos
+func (s *MqttSession) subscribedQos(topic string) (byte, bool) {
+	s.Lock()
+	defer s.Unlock()
+	qos, found := 0, false
+	for filter, q := range s.info.Topics {
+		if network.TopicMatch(filter, topic) && (!found || q > qos) {
+			qos, found = q, true
+		}
+	}
+	return byte(qos), found
+}
+
 func (s *MqttSession) getPacketFromMsg(topic string, payload []byte, qos byte) *packets.PublishPacket {
 	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
 	p.Qos = qos
 	p.TopicName = topic
 	p.Payload = payload
-	p.MessageID = s.nextID
-	// the overflow is okay here
-	// the session will give unique id from 0 to 65535 and do this again and again
-	s.nextID++
 	return p
 }
 
-func (s *MqttSession) publish(topic string, payload []byte, qos byte) {
-	client := s.broker.getClient(s.info.ClientID)
-	if client == nil {
-		logs.Errorf("client %s is offline in eg %v", s.info.ClientID, s.broker.productId)
-		return
+// 消息id, 跳过0与未确认的id
+func (s *MqttSession) nextMessageID() uint16 {
+	for {
+		// the overflow is okay here
+		s.nextID++
+		if s.nextID == 0 {
+			continue
+		}
+		if _, ok := s.pending[s.nextID]; !ok {
+			return s.nextID
+		}
 	}
+}
 
+// 发送消息, 连接断开时QoS1/2的消息排队等待重连, QoS0的消息丢弃
+// 写入连接时不持有锁, 避免阻塞确认等其它处理
+func (s *MqttSession) publish(topic string, payload []byte, qos byte, retain bool) {
+	max := s.broker.getSpec().MaxQueuedMessages
 	s.Lock()
-	defer s.Unlock()
-
 	logs.Debugf("session %v publish %v", s.info.ClientID, topic)
-	p := s.getPacketFromMsg(topic, payload, qos)
+	client := s.client
 	if qos == QoS0 {
+		s.Unlock()
+		if client == nil {
+			logs.Debugf("client %s is offline, drop qos0 message of %s", s.info.ClientID, topic)
+			return
+		}
+		p := s.getPacketFromMsg(topic, payload, qos)
+		p.Retain = retain
 		select {
 		case client.writeCh <- p:
 		default:
 		}
-	} else if qos == QoS1 {
-		msg := newMsg(topic, payload, qos)
-		s.pending[p.MessageID] = msg
-		s.pendingQueue = append(s.pendingQueue, p.MessageID)
+		return
+	}
+	msg := newMsg(topic, payload, qos)
+	msg.Retain = retain
+	id := s.nextMessageID()
+	s.enqueue(id, msg, max)
+	var p *packets.PublishPacket
+	if client != nil {
+		msg.sent = true
+		p = msg.packet(id)
+	}
+	s.Unlock()
+	if p != nil {
 		client.writePacket(p)
-	} else {
-		logs.Errorf("publish message with qos=2 is not supported currently")
 	}
 }
 
+// QoS1收到PUBACK
 func (s *MqttSession) puback(p *packets.PubackPacket) {
 	s.Lock()
-	delete(s.pending, p.MessageID)
+	s.ack(p.MessageID)
+	s.Unlock()
+}
+
+// QoS2收到PUBREC, 回复PUBREL
+func (s *MqttSession) pubrec(p *packets.PubrecPacket) *packets.PubrelPacket {
+	s.Lock()
+	if msg, ok := s.pending[p.MessageID]; ok {
+		msg.released = true
+	}
+	s.Unlock()
+	pubrel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+	pubrel.MessageID = p.MessageID
+	return pubrel
+}
+
+// QoS2收到PUBCOMP, 流程结束
+func (s *MqttSession) pubcomp(p *packets.PubcompPacket) {
+	s.Lock()
+	s.ack(p.MessageID)
+	s.Unlock()
+}
+
+// 收到QoS2消息, 重复的消息返回false
+func (s *MqttSession) receive(messageID uint16) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.received[messageID] {
+		return false
+	}
+	s.received[messageID] = true
+	return true
+}
+
+// 收到PUBREL, 释放QoS2消息id
+func (s *MqttSession) release(messageID uint16) {
+	s.Lock()
+	delete(s.received, messageID)
 	s.Unlock()
 }
 
 // device session functions
 func (s *MqttSession) Publish(topic string, payload string) {
-	var qos int
-	qos, ok := s.info.Topics[topic]
-	if !ok {
-		qos = int(QoS0)
-	}
-	s.publish(topic, []byte(payload), byte(qos))
+	qos, _ := s.subscribedQos(topic)
+	s.publish(topic, []byte(payload), qos, false)
 }
 
 func (s *MqttSession) PublishHex(topic string, payload string) {
@@ -153,37 +284,38 @@ func (s *MqttSession) PublishHex(topic string, payload string) {
 		logs.Errorf("mqtt hex decode error: %v", err)
 		return
 	}
-	var qos int
-	qos, ok := s.info.Topics[topic]
-	if !ok {
-		qos = int(QoS0)
+	qos, _ := s.subscribedQos(topic)
+	s.publish(topic, b, qos, false)
+}
+
+// 发送保留消息, 之后订阅该主题的客户端会收到最后一条保留消息, payload为空时删除
+func (s *MqttSession) PublishRetained(topic string, payload string) {
+	qos, subscribed := s.subscribedQos(topic)
+	p := s.getPacketFromMsg(topic, []byte(payload), qos)
+	p.Retain = true
+	s.broker.retain(p)
+	if subscribed {
+		s.publish(topic, []byte(payload), qos, true)
 	}
-	s.publish(topic, b, byte(qos))
 }
 
+// 平台主动断开, 同时删除保留的会话
 func (s *MqttSession) Disconnect() error {
-	if s.cleanSession() {
-		if s.isClose {
-			return nil
-		}
-		s.Close()
-		core.DelSession(s.info.deviceId)
-	}
-	return nil
+	s.broker.removeSession(s)
+	s.offline()
+	return s.Close()
 }
 
+// 关闭当前连接, 由detach解除绑定, CleanSession为false时会话保留直到过期, 否则设备下线
 func (s *MqttSession) Close() error {
-	if s.cleanSession() {
-		if s.isClose {
-			return nil
-		}
-		close(s.done)
-		s.isClose = true
-		logs.Debugf("session close %s", s.info.deviceId)
-		client := s.broker.getClient(s.info.ClientID)
-		if client != nil {
-			client.close()
-		}
+	s.Lock()
+	client := s.client
+	s.Unlock()
+	logs.Debugf("session close %s", s.info.deviceId)
+	if client != nil {
+		client.close()
+		// 连接已经关闭时close不会再次detach
+		s.detach(client)
 	}
 	return nil
 }
@@ -195,10 +327,18 @@ func (s *MqttSession) GetDeviceId() string {
 	return s.info.deviceId
 }
 func (s *MqttSession) GetInfo() map[string]any {
-	return map[string]any{
+	s.Lock()
+	defer s.Unlock()
+	info := map[string]any{
 		"username":     s.info.Username,
 		"clientID":     s.info.ClientID,
 		"cleanSession": s.info.CleanFlag,
 		"protocol":     s.info.ProtocolInfo,
+		"pending":      len(s.pending),
+		"connected":    s.client != nil,
+	}
+	if s.client != nil {
+		network.AddCertInfo(info, network.PeerCertificate(s.client.conn))
 	}
+	return info
 }
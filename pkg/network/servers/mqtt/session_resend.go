@@ -2,73 +2,83 @@ package mqttserver
 
 import (
 	"encoding/base64"
-	"time"
 
 	logs "go-iot/pkg/logger"
 
 	"github.com/eclipse/paho.mqtt.golang/packets"
 )
 
-var suppertMqttQOS2 bool = false
+func (m *Message) packet(id uint16) *packets.PublishPacket {
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.Qos = byte(m.QoS)
+	p.TopicName = m.Topic
+	p.Retain = m.Retain
+	payload, err := base64.StdEncoding.DecodeString(m.B64Payload)
+	if err != nil {
+		logs.Errorf("base64 decode error for Message B64Payload %v", err)
+	}
+	p.Payload = payload
+	p.MessageID = id
+	return p
+}
 
-func (s *MqttSession) cleanSession() bool {
-	if !suppertMqttQOS2 {
-		return true
+// 加入待确认队列, 超过最大数量时丢弃最早的消息
+func (s *MqttSession) enqueue(id uint16, msg *Message, max int) {
+	for max > 0 && len(s.pending) >= max && len(s.pendingQueue) > 0 {
+		oldest := s.pendingQueue[0]
+		s.pendingQueue = s.pendingQueue[1:]
+		if _, ok := s.pending[oldest]; ok {
+			logs.Warnf("session %v queue is full, drop message %d", s.info.ClientID, oldest)
+			delete(s.pending, oldest)
+		}
 	}
-	return s.info.CleanFlag
+	s.pending[id] = msg
+	s.pendingQueue = append(s.pendingQueue, id)
 }
 
-func (s *MqttSession) backgroundResendPending() {
-	if !suppertMqttQOS2 {
+// 消息已确认, 从待确认队列中删除
+func (s *MqttSession) ack(id uint16) {
+	if _, ok := s.pending[id]; !ok {
 		return
 	}
-	debugLogTime := time.Now().Add(time.Minute)
-	ticker := time.NewTicker(200 * time.Millisecond)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-s.done:
-			return
-		case <-ticker.C:
-			s.doResend()
-		}
-		if time.Now().After(debugLogTime) {
-			logs.Debugf("session %v resend", s.info.ClientID)
-			debugLogTime = time.Now().Add(time.Minute)
+	delete(s.pending, id)
+	for i, v := range s.pendingQueue {
+		if v == id {
+			s.pendingQueue = append(s.pendingQueue[:i], s.pendingQueue[i+1:]...)
+			break
 		}
 	}
 }
 
-func (s *MqttSession) doResend() {
-	client := s.broker.getClient(s.info.ClientID)
+// 重连后按顺序重发未确认与离线时排队的消息, 已收到PUBREC的QoS2消息重发PUBREL
+func (s *MqttSession) resend(client *Client) {
 	s.Lock()
-	defer s.Unlock()
+	queue := []uint16{}
+	resend := []packets.ControlPacket{}
+	for _, id := range s.pendingQueue {
+		msg, ok := s.pending[id]
+		if !ok {
+			continue
+		}
+		queue = append(queue, id)
+		if msg.released {
+			pubrel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+			pubrel.MessageID = id
+			resend = append(resend, pubrel)
+			continue
+		}
+		p := msg.packet(id)
+		p.Dup = msg.sent
+		msg.sent = true
+		resend = append(resend, p)
+	}
+	s.pendingQueue = queue
+	s.Unlock()
 
-	if len(s.pending) == 0 {
-		s.pendingQueue = []uint16{}
-		return
+	if len(resend) > 0 {
+		logs.Debugf("session %v resend %d messages", s.info.ClientID, len(resend))
 	}
-	for i, idx := range s.pendingQueue {
-		if val, ok := s.pending[idx]; ok {
-			// find first msg need to resend
-			s.pendingQueue = s.pendingQueue[i:]
-			p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
-			p.Qos = byte(val.QoS)
-			p.TopicName = val.Topic
-			payload, err := base64.StdEncoding.DecodeString(val.B64Payload)
-			if err != nil {
-				logs.Errorf("base64 decode error for Message B64Payload %v", err)
-				return
-			}
-			p.Payload = payload
-			p.MessageID = idx
-			if client != nil {
-				client.writePacket(p)
-			} else {
-				logs.Debugf("session %v do resend but client is nil", s.info.ClientID)
-			}
-			return
-		}
+	for _, p := range resend {
+		client.writePacket(p)
 	}
 }
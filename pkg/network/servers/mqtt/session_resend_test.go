@@ -0,0 +1,32 @@
+package mqttserver
+
+import (
+	"testing"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPendingQueue(t *testing.T) {
+	s := &MqttSession{info: &SessionInfo{ClientID: "queue-1"}, pending: map[uint16]*Message{}}
+	// 确认后的消息从队列中删除, 长连接的队列不会增长
+	for i := 0; i < 70000; i++ {
+		id := s.nextMessageID()
+		s.enqueue(id, newMsg("down", []byte("a"), QoS1), 10)
+		puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+		puback.MessageID = id
+		s.puback(puback)
+	}
+	assert.Empty(t, s.pending)
+	assert.Empty(t, s.pendingQueue)
+
+	for i := 0; i < 3; i++ {
+		s.enqueue(s.nextMessageID(), newMsg("down", []byte("b"), QoS2), 10)
+	}
+	ids := append([]uint16{}, s.pendingQueue...)
+	pubcomp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+	pubcomp.MessageID = ids[1]
+	s.pubcomp(pubcomp)
+	assert.Equal(t, []uint16{ids[0], ids[2]}, s.pendingQueue)
+	assert.Len(t, s.pending, 2)
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"go-iot/pkg/core"
 	"go-iot/pkg/network"
+	"time"
 )
 
 func init() {
@@ -20,6 +21,15 @@ func init() {
 	})
 }
 
+const (
+	// 遗嘱消息触发的事件id, 物模型中定义后保存
+	WillEventId = "will"
+
+	defaultMaxQueuedMessages = 1000
+	// 断开后保留会话的时间(秒)
+	defaultSessionExpiry = 7200
+)
+
 // PacketType is mqtt packet type
 type PacketType string
 
@@ -48,7 +58,11 @@ type (
 		Port                 int32                 `json:"port"`
 		UseTLS               bool                  `json:"useTLS"`
 		Certificate          []network.Certificate `json:"certificate"`
+		ClientAuth           *network.ClientAuth   `json:"-"` // 客户端证书认证
 		MaxAllowedConnection int                   `json:"maxAllowedConnection"`
+		MaxQueuedMessages    int                   `json:"maxQueuedMessages"` // 每个会话最多排队的QoS1/2消息, 默认1000
+		SessionExpiry        int                   `json:"sessionExpiry"`     // CleanSession为false的会话断开后保留的秒数, 默认7200
+		Fanout               bool                  `json:"fanout"`            // 转发设备发布的消息给订阅的其它设备
 	}
 )
 
@@ -77,6 +91,28 @@ func (spec *MQTTServerSpec) FromNetwork(network network.NetworkConf) error {
 	return nil
 }
 
+func (spec *MQTTServerSpec) sessionExpiry() time.Duration {
+	if spec.SessionExpiry <= 0 {
+		return defaultSessionExpiry * time.Second
+	}
+	return time.Duration(spec.SessionExpiry) * time.Second
+}
+
+// 需要重启才能生效的配置项
+func (spec *MQTTServerSpec) restartFields(n *MQTTServerSpec) []string {
+	var fields []string
+	if spec.Name != n.Name {
+		fields = append(fields, "name")
+	}
+	if spec.Port != n.Port {
+		fields = append(fields, "port")
+	}
+	if spec.UseTLS != n.UseTLS {
+		fields = append(fields, "useTLS")
+	}
+	return fields
+}
+
 func (spec *MQTTServerSpec) TlsConfig() (*tls.Config, error) {
 	var certificates []tls.Certificate
 
@@ -92,11 +128,19 @@ func (spec *MQTTServerSpec) TlsConfig() (*tls.Config, error) {
 	if len(certificates) == 0 {
 		return nil, fmt.Errorf("none valid certs and secret")
 	}
-
-	return &tls.Config{Certificates: certificates}, nil
+	cfg := &tls.Config{Certificates: certificates}
+	if spec.ClientAuth != nil {
+		spec.ClientAuth.Apply(cfg)
+	}
+	return cfg, nil
 }
 
 func (spec *MQTTServerSpec) SetCertificate(conf network.NetworkConf) error {
+	clientAuth, err := network.NewClientAuth(conf)
+	if err != nil {
+		return err
+	}
+	spec.ClientAuth = clientAuth
 	if len(conf.CertBase64) == 0 || len(conf.KeyBase64) == 0 {
 		return nil
 	}
@@ -2,7 +2,6 @@ package mqtt5
 
 import (
 	"bytes"
-	"crypto/tls"
 	"fmt"
 	"go-iot/pkg/core"
 	"go-iot/pkg/network"
@@ -30,12 +29,12 @@ type (
 	// Broker is MQTT5 server, manages clients, topics, sessions, etc.
 	Broker struct {
 		sync.RWMutex
-		productId string
-		name      string
-		spec      *MQTTServerSpec
-		server    *mqtt.Server
-		tlsCfg    *tls.Config
-		clients   map[string]*ClientAndSession
+		*network.ProductRouter
+		name    string
+		spec    *MQTTServerSpec
+		server  *mqtt.Server
+		tls     *network.TlsReloader
+		clients map[string]*ClientAndSession
 
 		done chan struct{}
 	}
@@ -59,15 +58,18 @@ func (s *Broker) Type() network.NetType {
 	return network.MQTT_BROKER
 }
 
-func (s *Broker) Start(network network.NetworkConf) error {
+func (s *Broker) Start(conf network.NetworkConf) error {
 	spec := &MQTTServerSpec{}
-	err := spec.FromNetwork(network)
+	err := spec.FromNetwork(conf)
 	if err != nil {
 		return err
 	}
-	spec.Port = network.Port
+	spec.Port = conf.Port
 
-	s.productId = network.ProductId
+	s.ProductRouter, err = network.NewProductRouter(conf)
+	if err != nil {
+		return err
+	}
 	s.name = spec.Name
 	s.spec = spec
 	s.clients = make(map[string]*ClientAndSession)
@@ -80,17 +82,16 @@ func (s *Broker) Start(network network.NetworkConf) error {
 
 	// Configure TLS if enabled
 	if s.spec.UseTLS {
-		cfg, err := s.spec.TlsConfig()
+		err = s.setTls(spec)
 		if err != nil {
-			return fmt.Errorf("invalid tls config for mqtt proxy: %v", err)
+			return err
 		}
-		s.tlsCfg = cfg
 	}
 
 	// Create a TCP listener on a standard port.
-	config := listeners.Config{ID: "mqtt-" + s.productId, Address: fmt.Sprintf(":%d", spec.Port)}
+	config := listeners.Config{ID: "mqtt-" + conf.ProductId, Address: fmt.Sprintf(":%d", spec.Port)}
 	if s.spec.UseTLS {
-		config.TLSConfig = s.tlsCfg
+		config.TLSConfig = s.tls.Config()
 	}
 	tcp := listeners.NewTCP(config)
 	err = server.AddListener(tcp)
@@ -98,7 +99,7 @@ func (s *Broker) Start(network network.NetworkConf) error {
 		return err
 	}
 	// 给broker增加Hook
-	err = server.AddHook(&BrokerHook{productId: s.productId}, &BrokerHookOptions{broker: s})
+	err = server.AddHook(&BrokerHook{productId: conf.ProductId}, &BrokerHookOptions{broker: s})
 	if err != nil {
 		return err
 	}
@@ -121,13 +122,13 @@ func (s *Broker) Start(network network.NetworkConf) error {
 }
 
 func (b *Broker) Stop() error {
-
 	close(b.done)
-	b.Lock()
-	defer b.Unlock()
+	// 关闭时会回调OnDisconnect, 不能持有锁
 	if b.server != nil {
 		b.server.Close()
 	}
+	b.Lock()
+	defer b.Unlock()
 	for _, v := range b.clients {
 		go v.Close()
 	}
@@ -135,10 +136,45 @@ func (b *Broker) Stop() error {
 	return nil
 }
 
-func (b *Broker) Reload() error {
+// 在线更新配置, 证书, 主题权限与转发立即生效, 已连接的客户端不会断开
+func (b *Broker) Reload(conf network.NetworkConf) error {
+	spec := &MQTTServerSpec{}
+	err := spec.FromNetwork(conf)
+	if err != nil {
+		return err
+	}
+	spec.Port = conf.Port
+	if fields := b.getSpec().restartFields(spec); len(fields) > 0 {
+		return network.RestartRequired(fields...)
+	}
+	if spec.UseTLS {
+		cfg, err := spec.TlsConfig()
+		if err != nil {
+			return fmt.Errorf("invalid tls config for mqtt proxy: %v", err)
+		}
+		b.tls.Store(cfg)
+	}
+	b.Lock()
+	b.spec = spec
+	b.Unlock()
 	return nil
 }
 
+func (b *Broker) setTls(spec *MQTTServerSpec) error {
+	cfg, err := spec.TlsConfig()
+	if err != nil {
+		return fmt.Errorf("invalid tls config for mqtt proxy: %v", err)
+	}
+	b.tls = network.NewTlsReloader(cfg)
+	return nil
+}
+
+func (b *Broker) getSpec() *MQTTServerSpec {
+	b.RLock()
+	defer b.RUnlock()
+	return b.spec
+}
+
 func (b *Broker) TotalConnection() int32 {
 	b.RLock()
 	defer b.RUnlock()
@@ -157,7 +193,7 @@ func (h *BrokerHook) Provides(b byte) bool {
 		mqtt.OnSubscribed,
 		mqtt.OnUnsubscribed,
 		mqtt.OnPublished,
-		// mqtt.OnPublish,
+		mqtt.OnPublish,
 	}, []byte{b})
 }
 
@@ -165,7 +201,7 @@ func (h *BrokerHook) Init(config any) error {
 	logs.Debugf("initialised")
 	opt := config.(*BrokerHookOptions)
 	h.broker = opt.broker
-	h.productId = opt.broker.productId
+	h.productId = opt.broker.Default()
 	return nil
 }
 
@@ -181,13 +217,13 @@ func (h *BrokerHook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) b
 	// check auth
 	ctx := &authContext{
 		BaseContext: core.BaseContext{
-			ProductId: h.productId,
+			ProductId: client.info.productId,
 			Session:   nil,
 			DeviceId:  client.ClientID(),
 		},
 		client: client,
 	}
-	err := core.GetCodec(h.productId).OnConnect(ctx)
+	err := core.GetCodec(client.info.productId).OnConnect(ctx)
 	if ctx.authFailCode != 0 {
 		return false
 	}
@@ -206,10 +242,49 @@ func (h *BrokerHook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) b
 }
 
 // 当用户尝试发布或订阅主题时调用，用来检测ACL规则。
+// 向订阅者转发消息时也会调用(write为false), 订阅时已经检查过, 转发时的主题一定被订阅包含
 func (h *BrokerHook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	vars := network.TopicAclVars{
+		ProductId: h.productId,
+		ClientId:  cl.ID,
+		Username:  string(cl.Properties.Username),
+	}
+	h.broker.RLock()
+	if c := h.broker.clients[cl.ID]; c != nil {
+		vars.ProductId = c.info.productId
+		vars.DeviceId = c.GetDeviceId()
+	}
+	h.broker.RUnlock()
+	// 共用监听时按客户端所属的产品取主题权限
+	acl := h.broker.Acl(vars.ProductId)
+	if write && !acl.CanPublish(vars, topic) {
+		h.denied(vars, "publish", topic)
+		return false
+	}
+	if !write && !acl.CanSubscribe(vars, topic) {
+		h.denied(vars, "subscribe", topic)
+		return false
+	}
 	return true
 }
 
+// 拒绝的操作记录到设备调试日志
+func (h *BrokerHook) denied(vars network.TopicAclVars, op string, topic string) {
+	logs.Debugf("client %s %s [%s] denied", vars.ClientId, op, topic)
+	core.DebugLog(vars.DeviceId, vars.ProductId, fmt.Sprintf("%s [%s] denied by acl", op, topic))
+}
+
+// 收到客户端发布的消息时调用, 关闭转发时消息只交给编解码处理, 保留消息仍然保存
+func (h *BrokerHook) OnPublish(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	if !h.broker.getSpec().fanout() {
+		if pk.FixedHeader.Retain {
+			h.broker.server.Topics.RetainMessage(pk.Copy(false))
+		}
+		pk.Ignore = true
+	}
+	return pk, nil
+}
+
 // 当客户端因任何原因断开连接时调用。
 func (h *BrokerHook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
 	if err != nil {
@@ -242,11 +317,11 @@ func (h *BrokerHook) OnPublished(cl *mqtt.Client, pk packets.Packet) {
 
 	c := h.broker.clients[cl.ID]
 	// 调用编解码脚本处理
-	sc := core.GetCodec(h.productId)
+	sc := core.GetCodec(c.info.productId)
 	sc.OnMessage(&mqttContext{
 		BaseContext: core.BaseContext{
 			DeviceId:  c.GetDeviceId(),
-			ProductId: c.broker.productId,
+			ProductId: c.info.productId,
 			Session:   c,
 		},
 		Data:      pk.Payload,
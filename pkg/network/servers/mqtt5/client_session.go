@@ -26,7 +26,9 @@ type (
 		username string
 		password string
 		deviceId string
-		Topics   map[string]byte
+		// 多个产品共用监听时按clientId或username前缀确定
+		productId string
+		Topics    map[string]byte
 	}
 
 	// ClientAndSession represents a MQTT5 client connection
@@ -50,8 +52,9 @@ type (
 
 func NewClient(cl *mqtt.Client, broker *Broker) *ClientAndSession {
 	info := ClientInfo{
-		cid:      cl.ID,
-		username: string(cl.Properties.Username),
+		cid:       cl.ID,
+		username:  string(cl.Properties.Username),
+		productId: broker.Match(cl.ID, string(cl.Properties.Username)),
 	}
 
 	client := &ClientAndSession{
@@ -10,6 +10,7 @@ import (
 	"go-iot/pkg/store"
 	_ "go-iot/pkg/timeseries"
 	"go-iot/pkg/tsl"
+	"net"
 	"net/url"
 	"strconv"
 	"testing"
@@ -19,6 +20,8 @@ import (
 
 	"github.com/eclipse/paho.golang/autopaho"
 	"github.com/eclipse/paho.golang/paho"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/stretchr/testify/assert"
 )
 
 const script = `
@@ -179,3 +182,101 @@ func newClient(network network.NetworkConf, deviceId string) {
 	}
 	fmt.Println("signal caught - exiting")
 }
+
+func dial(t *testing.T, port int32, clientId string) net.Conn {
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	assert.Nil(t, err)
+	connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	connect.ProtocolName = "MQTT"
+	connect.ProtocolVersion = 4
+	connect.ClientIdentifier = clientId
+	connect.CleanSession = true
+	assert.Nil(t, connect.Write(conn))
+	assert.EqualValues(t, packets.Accepted, read(t, conn).(*packets.ConnackPacket).ReturnCode)
+	return conn
+}
+
+func read(t *testing.T, conn net.Conn) packets.ControlPacket {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	p, err := packets.ReadPacket(conn)
+	if err != nil {
+		return nil
+	}
+	return p
+}
+
+// 订阅主题, 返回订阅时收到的保留消息
+func subscribe(t *testing.T, conn net.Conn, topic string) []*packets.PublishPacket {
+	sub := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	sub.MessageID = 1
+	sub.Topics = []string{topic}
+	sub.Qoss = []byte{0}
+	assert.Nil(t, sub.Write(conn))
+	var retained []*packets.PublishPacket
+	for suback := false; !suback; {
+		switch p := read(t, conn).(type) {
+		case *packets.SubackPacket:
+			suback = true
+		case *packets.PublishPacket:
+			retained = append(retained, p)
+		default:
+			t.Fatalf("unexpected packet %v", p)
+		}
+	}
+	// 保留消息可能在SUBACK之后发送
+	if p, ok := read(t, conn).(*packets.PublishPacket); ok {
+		retained = append(retained, p)
+	}
+	return retained
+}
+
+func publish(t *testing.T, conn net.Conn, topic string, payload string, retain bool) {
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName = topic
+	p.Retain = retain
+	p.Payload = []byte(payload)
+	assert.Nil(t, p.Write(conn))
+}
+
+func TestFanout(t *testing.T) {
+	core.PutDevice(core.NewDevice("fanout-sub", network1.ProductId, 0))
+	core.NewCodec(network1.CodecId, network1.ProductId, network1.Script)
+
+	// 默认转发给订阅的设备
+	conf := network1
+	conf.Port = 1893
+	conf.Configuration = `{"host": "127.0.0.1"}`
+	b := mqttserver.NewServer()
+	assert.Nil(t, b.Start(conf))
+	defer b.Stop()
+	sub := dial(t, conf.Port, "fanout-sub")
+	defer sub.Close()
+	subscribe(t, sub, "fanout/#")
+	pub := dial(t, conf.Port, "1234")
+	defer pub.Close()
+	publish(t, pub, "fanout/a", `{"temperature": 1}`, false)
+	p, ok := read(t, sub).(*packets.PublishPacket)
+	assert.True(t, ok)
+	if ok {
+		assert.Equal(t, "fanout/a", p.TopicName)
+	}
+
+	// 关闭转发时不转发, 保留消息仍然保存
+	conf.Port = 1894
+	conf.Configuration = `{"host": "127.0.0.1", "fanout": false}`
+	b2 := mqttserver.NewServer()
+	assert.Nil(t, b2.Start(conf))
+	defer b2.Stop()
+	sub2 := dial(t, conf.Port, "fanout-sub")
+	defer sub2.Close()
+	subscribe(t, sub2, "fanout/#")
+	pub2 := dial(t, conf.Port, "1234")
+	defer pub2.Close()
+	publish(t, pub2, "fanout/b", `{"temperature": 2}`, true)
+	assert.Nil(t, read(t, sub2))
+	retained := subscribe(t, pub2, "fanout/#")
+	if assert.Len(t, retained, 1) {
+		assert.True(t, retained[0].Retain)
+		assert.Equal(t, "fanout/b", retained[0].TopicName)
+	}
+}
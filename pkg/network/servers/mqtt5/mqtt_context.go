@@ -48,7 +48,7 @@ func (ctx *authContext) DeviceOnline(deviceId string) {
 		ctx.authFailCode = 0
 		// 认证成功、让设备上线
 		baseContext := &core.BaseContext{
-			ProductId: ctx.client.broker.productId,
+			ProductId: ctx.client.info.productId,
 			Session:   ctx.client,
 		}
 		baseContext.DeviceOnline(deviceId)
@@ -60,6 +60,16 @@ func (ctx *authContext) AuthFail() {
 }
 
 func (ctx *authContext) checkAuth() bool {
+	// 设备设置了密钥时使用签名密码认证
+	device := core.GetDevice(ctx.DeviceId)
+	if device != nil && len(device.Secret) > 0 {
+		if err := device.VerifySign(ctx.GetClientId(), ctx.GetPassword()); err != nil {
+			core.DebugLog(device.Id, device.ProductId, "auth fail: "+err.Error())
+			ctx.AuthFail()
+			return false
+		}
+		return true
+	}
 	username := ctx.GetConfig("username")
 	password := ctx.GetConfig("password")
 	username1 := ctx.GetUserName()
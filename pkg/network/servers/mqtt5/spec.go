@@ -27,6 +27,12 @@ type MQTTServerSpec struct {
 	UseTLS               bool                  `json:"useTLS"`
 	Certificate          []network.Certificate `json:"certificate"`
 	MaxAllowedConnection int                   `json:"maxAllowedConnection"`
+	Fanout               *bool                 `json:"fanout"` // 转发设备发布的消息给订阅的其它设备, 默认转发
+}
+
+// 是否转发消息, 未配置时转发, 关闭后消息只交给编解码处理, 保留消息仍然保存
+func (spec *MQTTServerSpec) fanout() bool {
+	return spec.Fanout == nil || *spec.Fanout
 }
 
 func (spec *MQTTServerSpec) FromJson(str string) error {
@@ -54,6 +60,21 @@ func (spec *MQTTServerSpec) FromNetwork(network network.NetworkConf) error {
 	return nil
 }
 
+// 需要重启才能生效的配置项
+func (spec *MQTTServerSpec) restartFields(n *MQTTServerSpec) []string {
+	var fields []string
+	if spec.Name != n.Name {
+		fields = append(fields, "name")
+	}
+	if spec.Port != n.Port {
+		fields = append(fields, "port")
+	}
+	if spec.UseTLS != n.UseTLS {
+		fields = append(fields, "useTLS")
+	}
+	return fields
+}
+
 func (spec *MQTTServerSpec) TlsConfig() (*tls.Config, error) {
 	var certificates []tls.Certificate
 
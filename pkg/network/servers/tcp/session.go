@@ -1,9 +1,13 @@
 package tcpserver
 
 import (
+	"crypto/x509"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"go-iot/pkg/core"
+	"go-iot/pkg/network"
+	"go-iot/pkg/util"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -21,10 +25,12 @@ const (
 
 func newTcpSession(server *TcpServer, conn net.Conn, productId string) *TcpSession {
 	//2.网络数据流分隔器
-	delimeter := NewDelimeter(server.spec.Delimeter, conn)
+	spec := server.getSpec()
+	delimeter := NewDelimeter(spec.Delimeter, conn)
 	session := &TcpSession{
 		id:         fmt.Sprintf("tcp%d", time.Now().UnixNano()),
 		tcpServer:  server,
+		spec:       spec,
 		conn:       conn,
 		productId:  productId,
 		delimeter:  delimeter,
@@ -38,6 +44,7 @@ type TcpSession struct {
 	sync.Mutex
 	id        string
 	tcpServer *TcpServer
+	spec      *TcpServerSpec
 	conn      net.Conn
 	productId string
 	deviceId  string
@@ -46,6 +53,8 @@ type TcpSession struct {
 	// Buffered channel of outbound messages.
 	send       chan []byte
 	statusFlag int32
+	// 客户端证书, 双向认证时有值
+	cert *x509.Certificate
 }
 
 func (s *TcpSession) SetDeviceId(deviceId string) {
@@ -56,7 +65,7 @@ func (s *TcpSession) GetDeviceId() string {
 	return s.deviceId
 }
 func (s *TcpSession) GetInfo() map[string]any {
-	return map[string]any{
+	return network.AddCertInfo(map[string]any{
 		"localAddr": func() string {
 			if s.conn != nil {
 				return s.conn.LocalAddr().String()
@@ -69,7 +78,7 @@ func (s *TcpSession) GetInfo() map[string]any {
 			}
 			return "unknown" // 或者返回其他适当的默认值
 		}(),
-	}
+	}, s.cert)
 }
 
 func (s *TcpSession) Disconnect() error {
@@ -95,9 +104,14 @@ func (s *TcpSession) Close() error {
 	return err
 }
 
-func (s *TcpSession) Send(msg string) error {
-	s.send <- []byte(msg)
-	return nil
+// msg为字符串或字节数组
+func (s *TcpSession) Send(msg any) error {
+	b, err := util.ToBytes(msg)
+	if err != nil {
+		logs.Errorf("tcp Send error: %v", err)
+		return err
+	}
+	return s.write(b)
 }
 
 func (s *TcpSession) SendHex(msgHex string) error {
@@ -106,8 +120,22 @@ func (s *TcpSession) SendHex(msgHex string) error {
 		logs.Errorf("tcp hex decode error: %v", err)
 		return err
 	}
-	s.send <- b
-	return nil
+	return s.write(b)
+}
+
+// 放入发送队列, 会话关闭后返回错误; 队列满时不等待, 避免持有锁时阻塞关闭会话
+func (s *TcpSession) write(b []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.disconnected() {
+		return errors.New("tcp session is closed")
+	}
+	select {
+	case s.send <- b:
+		return nil
+	default:
+		return errors.New("tcp send queue is full")
+	}
 }
 
 func (c *TcpSession) disconnected() bool {
@@ -117,17 +145,50 @@ func (c *TcpSession) disconnected() bool {
 func (s *TcpSession) readLoop() {
 	defer s.Disconnect()
 
-	// 处理OnConnect步骤
-	sc := core.GetCodec(s.productId)
-	sc.OnConnect(&tcpContext{
+	// 双向认证时握手失败直接断开, 证书对应的设备自动上线
+	s.cert = network.PeerCertificate(s.conn)
+	if s.spec.ClientAuth != nil && s.cert == nil {
+		logs.Debugf("tcp client %s handshake failed", s.conn.RemoteAddr())
+		return
+	}
+	// 多个产品共用监听时按证书或首包确定产品
+	var first []byte
+	if s.tcpServer.Shared() {
+		if s.cert != nil {
+			s.productId, _ = s.tcpServer.MatchCert(s.cert)
+		} else {
+			// 限制等待首包的时间, 避免不发数据的连接一直占用
+			if err := s.conn.SetReadDeadline(time.Now().Add(s.tcpServer.getSpec().routeTimeout())); err != nil {
+				logs.Errorf("set route read timeout failed: %v", err)
+			}
+			data, err := s.delimeter.Read()
+			if err != nil {
+				logs.Debugf("tcp server read error: %v", err)
+				return
+			}
+			s.conn.SetReadDeadline(time.Time{})
+			s.productId = s.tcpServer.Route(data)
+			first = data
+		}
+	}
+	ctx := &tcpContext{
 		BaseContext: core.BaseContext{
 			ProductId: s.productId,
 			Session:   s,
 		},
-	})
+	}
+	if deviceId := network.CertDeviceId(s.productId, s.cert); len(deviceId) > 0 {
+		ctx.DeviceOnline(deviceId)
+	}
+	// 处理OnConnect步骤
+	sc := core.GetCodec(s.productId)
+	sc.OnConnect(ctx)
 	if s.disconnected() {
 		return
 	}
+	if first != nil {
+		s.onMessage(first)
+	}
 
 	keepAlive := time.Duration(s.keepalive) * time.Second
 	timeOut := keepAlive + keepAlive/2
@@ -145,18 +206,22 @@ func (s *TcpSession) readLoop() {
 			logs.Debugf("tcp server read error: %v", err)
 			break
 		}
-		sc := core.GetCodec(s.productId)
-		sc.OnMessage(&tcpContext{
-			BaseContext: core.BaseContext{
-				DeviceId:  s.GetDeviceId(),
-				ProductId: s.productId,
-				Session:   s,
-			},
-			Data: data,
-		})
+		s.onMessage(data)
 	}
 }
 
+func (s *TcpSession) onMessage(data []byte) {
+	sc := core.GetCodec(s.productId)
+	sc.OnMessage(&tcpContext{
+		BaseContext: core.BaseContext{
+			DeviceId:  s.GetDeviceId(),
+			ProductId: s.productId,
+			Session:   s,
+		},
+		Data: data,
+	})
+}
+
 func (c *TcpSession) writeLoop() {
 	defer func() {
 		c.Disconnect()
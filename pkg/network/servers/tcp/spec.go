@@ -5,10 +5,14 @@ import (
 	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"go-iot/pkg/network"
+	"time"
 )
 
+const defaultRouteTimeout = 30 * time.Second
+
 type (
 
 	// Spec describes the TcpServer
@@ -18,14 +22,19 @@ type (
 		Port                 int32                 `json:"port"`
 		UseTLS               bool                  `json:"useTLS"`
 		Certificate          []network.Certificate `json:"certificate"`
+		ClientAuth           *network.ClientAuth   `json:"-"` // 客户端证书认证
 		MaxAllowedConnection int                   `json:"maxAllowedConnection"`
 		Delimeter            TcpDelimeter          `json:"delimeter"`
+		RouteTimeout         int                   `json:"routeTimeout"` // 共用监听时等待首包的超时(秒), 默认30
 	}
 	TcpDelimeter struct {
-		Type      DelimType `json:"type"`      // Delimited(分隔符) FixLength(固定长度)
-		Delimited string    `json:"delimited"` // 分隔符
-		Length    int32     `json:"length"`    // 长度
-		SplitFunc string    `json:"splitFunc"`
+		Type        DelimType   `json:"type"`      // Delimited(分隔符) FixLength(固定长度) LengthField(长度字段) SplitFunc(脚本)
+		Delimited   string      `json:"delimited"` // 分隔符, 支持多字节
+		MaxLength   int         `json:"maxLength"` // 分隔符拆包的最大帧长度, 默认64K
+		Length      int32       `json:"length"`    // 长度
+		SplitFunc   string      `json:"splitFunc"`
+		LengthField LengthField `json:"lengthField"` // 长度字段
+		Check       FrameCheck  `json:"check"`       // 帧校验
 	}
 )
 
@@ -34,7 +43,10 @@ func (spec *TcpServerSpec) FromJson(str string) error {
 	if err != nil {
 		return fmt.Errorf("tcp server spec error: %v", err)
 	}
-	return nil
+	if spec.RouteTimeout < 0 {
+		return errors.New("routeTimeout must not be negative")
+	}
+	return spec.Delimeter.Validate()
 }
 
 func (spec *TcpServerSpec) FromNetwork(network network.NetworkConf) error {
@@ -51,6 +63,29 @@ func (spec *TcpServerSpec) FromNetwork(network network.NetworkConf) error {
 	return nil
 }
 
+// 等待首包路由的超时
+func (spec *TcpServerSpec) routeTimeout() time.Duration {
+	if spec.RouteTimeout == 0 {
+		return defaultRouteTimeout
+	}
+	return time.Duration(spec.RouteTimeout) * time.Second
+}
+
+// 需要重启才能生效的配置项
+func (spec *TcpServerSpec) restartFields(n *TcpServerSpec) []string {
+	var fields []string
+	if spec.Host != n.Host {
+		fields = append(fields, "host")
+	}
+	if spec.Port != n.Port {
+		fields = append(fields, "port")
+	}
+	if spec.UseTLS != n.UseTLS {
+		fields = append(fields, "useTLS")
+	}
+	return fields
+}
+
 func (spec *TcpServerSpec) TlsConfig() (*tls.Config, error) {
 	var certificates []tls.Certificate
 
@@ -64,11 +99,19 @@ func (spec *TcpServerSpec) TlsConfig() (*tls.Config, error) {
 	if len(certificates) == 0 {
 		return nil, fmt.Errorf("none valid certs and secret")
 	}
-
-	return &tls.Config{Certificates: certificates}, nil
+	cfg := &tls.Config{Certificates: certificates}
+	if spec.ClientAuth != nil {
+		spec.ClientAuth.Apply(cfg)
+	}
+	return cfg, nil
 }
 
 func (spec *TcpServerSpec) SetCertificate(conf network.NetworkConf) error {
+	clientAuth, err := network.NewClientAuth(conf)
+	if err != nil {
+		return err
+	}
+	spec.ClientAuth = clientAuth
 	if len(conf.CertBase64) == 0 || len(conf.KeyBase64) == 0 {
 		return nil
 	}
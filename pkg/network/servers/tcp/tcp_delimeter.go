@@ -2,6 +2,9 @@ package tcpserver
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
 	"go-iot/pkg/logger"
 	"log"
 	"math"
@@ -22,12 +25,37 @@ const DelimType_FixLength DelimType = "FixLength"
 // 自定义拆分函数
 const DelimType_SplitFunc DelimType = "SplitFunc"
 
+// 长度字段
+const DelimType_LengthField DelimType = "LengthField"
+
+// 拆包配置校验
+func (d TcpDelimeter) Validate() error {
+	if d.Type == DelimType_Delimited && len(d.Delimited) == 0 {
+		return errors.New("delimited must be present")
+	}
+	if d.MaxLength < 0 {
+		return errors.New("invalid max length")
+	}
+	if d.Type == DelimType_LengthField {
+		err := d.LengthField.validate()
+		if err != nil {
+			return err
+		}
+	}
+	return d.Check.validate()
+}
+
 func NewDelimeter(delimeter TcpDelimeter, c net.Conn) Delimeter {
 	var d Delimeter
+	tail := delimeter.Check.Tail
+	strip := 0
 	switch delimeter.Type {
 	case DelimType_Delimited:
-		b := []byte(delimeter.Delimited)
-		d = &DelimeterDelimited{delim: b[len(b)-1], conn: c}
+		d = &DelimeterDelimited{delim: []byte(delimeter.Delimited), max: delimeter.MaxLength, conn: c}
+		tail += len(delimeter.Delimited)
+	case DelimType_LengthField:
+		d = &DelimeterLengthField{field: delimeter.LengthField, conn: c}
+		strip = delimeter.LengthField.Strip
 	case DelimType_FixLength:
 		d = &DelimeterFixLength{buf: make([]byte, delimeter.Length), conn: c}
 	case DelimType_SplitFunc:
@@ -37,6 +65,9 @@ func NewDelimeter(delimeter TcpDelimeter, c net.Conn) Delimeter {
 		d = &DelimeterFixLength{buf: make([]byte, 128), conn: c}
 	}
 	d.init()
+	if len(delimeter.Check.Type) > 0 || strip > 0 {
+		d = &frameDelimeter{Delimeter: d, check: delimeter.Check, tail: tail, strip: strip}
+	}
 	return d
 }
 
@@ -45,9 +76,10 @@ type Delimeter interface {
 	Read() ([]byte, error)
 }
 
-// 分隔符
+// 分隔符, 支持多字节
 type DelimeterDelimited struct {
-	delim  byte // 分隔符
+	delim  []byte // 分隔符
+	max    int    // 最大帧长度
 	conn   net.Conn
 	reader *bufio.Reader
 }
@@ -57,8 +89,26 @@ func (d *DelimeterDelimited) init() {
 }
 
 func (d *DelimeterDelimited) Read() ([]byte, error) {
-	data, err := d.reader.ReadSlice(d.delim)
-	return data, err
+	last := d.delim[len(d.delim)-1]
+	max := d.max
+	if max == 0 {
+		max = defaultMaxFrameLength
+	}
+	var frame []byte
+	for {
+		data, err := d.reader.ReadSlice(last)
+		frame = append(frame, data...)
+		if len(frame) > max {
+			// 超长时无法找到下一帧的开始位置, 断开连接
+			return nil, fmt.Errorf("frame length exceeds %d", max)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil || bytes.HasSuffix(frame, d.delim) {
+			return frame, err
+		}
+	}
 }
 
 // fix length
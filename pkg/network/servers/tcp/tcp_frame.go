@@ -0,0 +1,184 @@
+package tcpserver
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go-iot/pkg/util"
+	"io"
+	"net"
+
+	logs "go-iot/pkg/logger"
+)
+
+// 默认最大帧长度
+const defaultMaxFrameLength = 64 * 1024
+
+const (
+	// modbus crc16, 低位在前
+	FrameCheck_CRC16 = "CRC16"
+	// 累加和, 1字节
+	FrameCheck_SUM8 = "SUM8"
+	// 异或校验, 1字节
+	FrameCheck_XOR8 = "XOR8"
+)
+
+type (
+	// 长度字段, 帧长度 = offset + size + 长度字段的值 + adjustment
+	LengthField struct {
+		Offset       int  `json:"offset"`       // 长度字段的位置
+		Size         int  `json:"size"`         // 长度字段的字节数, 1, 2, 4, 8
+		LittleEndian bool `json:"littleEndian"` // 小端, 默认大端
+		Adjustment   int  `json:"adjustment"`   // 长度调整值, 长度字段的值不是剩余字节数时使用
+		Strip        int  `json:"strip"`        // 去掉帧头的字节数, 校验之后去掉
+		MaxLength    int  `json:"maxLength"`    // 最大帧长度, 默认64K
+	}
+	// 帧校验, 校验值位于帧尾(tail个字节之前), 校验失败的帧丢弃
+	FrameCheck struct {
+		Type  string `json:"type"`  // CRC16, SUM8, XOR8
+		Start int    `json:"start"` // 参与校验的起始位置
+		Tail  int    `json:"tail"`  // 校验值之后的字节数(如帧尾标识), 分隔符的长度会自动加上
+	}
+)
+
+func (f LengthField) validate() error {
+	switch f.Size {
+	case 1, 2, 4, 8:
+	default:
+		return fmt.Errorf("invalid length field size: %d", f.Size)
+	}
+	if f.Offset < 0 || f.Strip < 0 || f.MaxLength < 0 {
+		return errors.New("invalid length field")
+	}
+	return nil
+}
+
+// 长度字段的值
+func (f LengthField) length(b []byte) uint64 {
+	var order binary.ByteOrder = binary.BigEndian
+	if f.LittleEndian {
+		order = binary.LittleEndian
+	}
+	switch f.Size {
+	case 1:
+		return uint64(b[0])
+	case 2:
+		return uint64(order.Uint16(b))
+	case 4:
+		return uint64(order.Uint32(b))
+	default:
+		return order.Uint64(b)
+	}
+}
+
+func (c FrameCheck) validate() error {
+	switch c.Type {
+	case "", FrameCheck_CRC16, FrameCheck_SUM8, FrameCheck_XOR8:
+	default:
+		return fmt.Errorf("invalid frame check type: %s", c.Type)
+	}
+	if c.Start < 0 || c.Tail < 0 {
+		return errors.New("invalid frame check")
+	}
+	return nil
+}
+
+func (c FrameCheck) size() int {
+	if c.Type == FrameCheck_CRC16 {
+		return 2
+	}
+	return 1
+}
+
+// 校验帧, tail为校验值之后的字节数
+func (c FrameCheck) verify(frame []byte, tail int) bool {
+	end := len(frame) - tail - c.size()
+	if end < c.Start {
+		return false
+	}
+	data, value := frame[c.Start:end], frame[end:end+c.size()]
+	switch c.Type {
+	case FrameCheck_CRC16:
+		crc := util.CheckSum(data)
+		return crc[0] == value[0] && crc[1] == value[1]
+	case FrameCheck_SUM8:
+		var sum byte
+		for _, b := range data {
+			sum += b
+		}
+		return sum == value[0]
+	case FrameCheck_XOR8:
+		var xor byte
+		for _, b := range data {
+			xor ^= b
+		}
+		return xor == value[0]
+	}
+	return true
+}
+
+// 长度字段拆包
+type DelimeterLengthField struct {
+	field  LengthField
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func (d *DelimeterLengthField) init() {
+	d.reader = bufio.NewReader(d.conn)
+}
+
+func (d *DelimeterLengthField) Read() ([]byte, error) {
+	header := d.field.Offset + d.field.Size
+	head := make([]byte, header)
+	_, err := io.ReadFull(d.reader, head)
+	if err != nil {
+		return nil, err
+	}
+	max := d.field.MaxLength
+	if max == 0 {
+		max = defaultMaxFrameLength
+	}
+	length := d.field.length(head[d.field.Offset:])
+	total := int64(header) + int64(d.field.Adjustment) + int64(length)
+	if length > uint64(max) || total < int64(header) || total > int64(max) {
+		// 长度错误时无法找到下一帧的开始位置, 断开连接
+		return nil, fmt.Errorf("invalid frame length: %d", length)
+	}
+	frame := make([]byte, total)
+	copy(frame, head)
+	_, err = io.ReadFull(d.reader, frame[header:])
+	if err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// 校验帧并去掉帧头
+type frameDelimeter struct {
+	Delimeter
+	check FrameCheck
+	tail  int
+	strip int
+}
+
+func (d *frameDelimeter) Read() ([]byte, error) {
+	for {
+		frame, err := d.Delimeter.Read()
+		if err != nil {
+			return frame, err
+		}
+		if len(d.check.Type) > 0 && !d.check.verify(frame, d.tail) {
+			logs.Debugf("tcp frame check [%s] failed: %x", d.check.Type, frame)
+			continue
+		}
+		if d.strip > 0 {
+			if d.strip > len(frame) {
+				continue
+			}
+			frame = frame[d.strip:]
+		}
+		return frame, nil
+	}
+}
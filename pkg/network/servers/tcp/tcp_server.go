@@ -24,10 +24,10 @@ var m = map[string]*TcpServer{}
 type (
 	TcpServer struct {
 		sync.RWMutex
-		productId string
-		spec      *TcpServerSpec
-		listener  net.Listener
-		tlsCfg    *tls.Config
+		*network.ProductRouter
+		spec     *TcpServerSpec
+		listener net.Listener
+		tls      *network.TlsReloader
 
 		// done is the channel for shutdowning this server.
 		done    chan struct{}
@@ -46,16 +46,19 @@ func (s *TcpServer) Type() network.NetType {
 }
 
 // 开启serverSocket
-func (s *TcpServer) Start(network network.NetworkConf) error {
+func (s *TcpServer) Start(conf network.NetworkConf) error {
 
 	spec := &TcpServerSpec{}
-	err := spec.FromNetwork(network)
+	err := spec.FromNetwork(conf)
 	if err != nil {
 		return err
 	}
-	spec.Port = network.Port
+	spec.Port = conf.Port
 
-	s.productId = network.ProductId
+	s.ProductRouter, err = network.NewProductRouter(conf)
+	if err != nil {
+		return err
+	}
 	s.spec = spec
 	s.done = make(chan struct{})
 
@@ -66,21 +69,21 @@ func (s *TcpServer) Start(network network.NetworkConf) error {
 	}
 
 	go s.run()
-	m[network.ProductId] = s
+	m[conf.ProductId] = s
 	return nil
 }
 
 func (s *TcpServer) setListener() error {
 	var l net.Listener
 	var err error
-	var cfg *tls.Config
 	addr := fmt.Sprintf("%s:%d", s.spec.Host, s.spec.Port)
 	if s.spec.UseTLS {
-		cfg, err = s.spec.TlsConfig()
+		cfg, err := s.spec.TlsConfig()
 		if err != nil {
 			return fmt.Errorf("invalid tls config for tcp server: %v", err)
 		}
-		l, err = tls.Listen("tcp", addr, cfg)
+		s.tls = network.NewTlsReloader(cfg)
+		l, err = tls.Listen("tcp", addr, s.tls.Config())
 		if err != nil {
 			return fmt.Errorf("gen tls tcp listener with addr %v and cfg %v failed: %v", addr, cfg, err)
 		}
@@ -90,7 +93,6 @@ func (s *TcpServer) setListener() error {
 			return fmt.Errorf("gen tcp listener with addr %s failed: %v", addr, err)
 		}
 	}
-	s.tlsCfg = cfg
 	s.listener = l
 	return err
 }
@@ -111,7 +113,7 @@ func (s *TcpServer) run() {
 }
 
 func (s *TcpServer) handleConn(c net.Conn) {
-	session := newTcpSession(s, c, s.productId)
+	session := newTcpSession(s, c, s.Default())
 
 	s.Lock()
 	s.clients[session.id] = session
@@ -122,10 +124,36 @@ func (s *TcpServer) handleConn(c net.Conn) {
 	go session.writeLoop()
 }
 
-func (s *TcpServer) Reload() error {
+// 在线更新配置, 证书与分隔符对新的连接生效, 已建立的连接不会断开
+func (s *TcpServer) Reload(conf network.NetworkConf) error {
+	spec := &TcpServerSpec{}
+	err := spec.FromNetwork(conf)
+	if err != nil {
+		return err
+	}
+	spec.Port = conf.Port
+	if fields := s.getSpec().restartFields(spec); len(fields) > 0 {
+		return network.RestartRequired(fields...)
+	}
+	if spec.UseTLS {
+		cfg, err := spec.TlsConfig()
+		if err != nil {
+			return fmt.Errorf("invalid tls config for tcp server: %v", err)
+		}
+		s.tls.Store(cfg)
+	}
+	s.Lock()
+	s.spec = spec
+	s.Unlock()
 	return nil
 }
 
+func (s *TcpServer) getSpec() *TcpServerSpec {
+	s.RLock()
+	defer s.RUnlock()
+	return s.spec
+}
+
 func (s *TcpServer) Stop() error {
 	close(s.done)
 	s.listener.Close()
@@ -2,17 +2,34 @@ package tcpserver_test
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
 	"fmt"
 	_ "go-iot/pkg/codec"
 	"go-iot/pkg/core"
 	"go-iot/pkg/logger"
 	"go-iot/pkg/network"
+	"go-iot/pkg/network/servers"
 	tcpserver "go-iot/pkg/network/servers/tcp"
 	"go-iot/pkg/store"
 	_ "go-iot/pkg/timeseries"
+	"go-iot/pkg/util"
+	"io"
+	"math/big"
 	"net"
 	"testing"
 	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 const script = `
@@ -171,3 +188,374 @@ func newClient1(network network.NetworkConf, call func() string) {
 		time.Sleep(1 * time.Second)
 	}
 }
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCert(t *testing.T, serial int64, cn string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tpl, key
+	if parent == nil {
+		tpl.IsCA = true
+		tpl.BasicConstraintsValid = true
+		tpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, signer, &key.PublicKey, signerKey)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	return &testCert{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+func (c *testCert) keyPem(t *testing.T) []byte {
+	der, err := x509.MarshalECPrivateKey(c.key)
+	assert.Nil(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func (c *testCert) tlsCert(t *testing.T) tls.Certificate {
+	cert, err := tls.X509KeyPair(c.pem, c.keyPem(t))
+	assert.Nil(t, err)
+	return cert
+}
+
+func TestServerClientAuth(t *testing.T) {
+	ca := newTestCert(t, 1, "test-ca", nil)
+	server := newTestCert(t, 2, "localhost", ca)
+	client := newTestCert(t, 3, "1234", ca)
+	revoked := newTestCert(t, 4, "1234", ca)
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(1),
+		ThisUpdate:                time.Now(),
+		NextUpdate:                time.Now().Add(time.Hour),
+		RevokedCertificateEntries: []x509.RevocationListEntry{{SerialNumber: revoked.cert.SerialNumber, RevocationTime: time.Now()}},
+	}, ca.cert, ca.key)
+	assert.Nil(t, err)
+
+	conf := network1
+	conf.Port = 8899
+	conf.Configuration = `{"host": "localhost", "useTLS": true, "delimeter": {"type":"Delimited", "delimited":"\n"}}`
+	conf.CertBase64 = base64.StdEncoding.EncodeToString(server.pem)
+	conf.KeyBase64 = base64.StdEncoding.EncodeToString(server.keyPem(t))
+	conf.CaBase64 = base64.StdEncoding.EncodeToString(ca.pem)
+	conf.CrlBase64 = base64.StdEncoding.EncodeToString(crl)
+	s := tcpserver.NewServer()
+	assert.Nil(t, s.Start(conf))
+	defer s.Stop()
+	_, err = core.NewCodec(conf.CodecId, conf.ProductId, conf.Script)
+	assert.Nil(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	dial := func(certs ...tls.Certificate) error {
+		conn, err := tls.Dial("tcp", "localhost:8899", &tls.Config{RootCAs: pool, Certificates: certs})
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		// tls1.3客户端证书在握手后校验, 读取时才能得到结果
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, err = conn.Read(make([]byte, 1))
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return nil
+		}
+		return err
+	}
+	// 证书对应的设备自动上线
+	go dial(client.tlsCert(t))
+	assert.Eventually(t, func() bool {
+		session := core.GetSession("1234")
+		return session != nil && session.GetInfo()["certFingerprint"] != nil
+	}, time.Second, 10*time.Millisecond)
+	info := core.GetSession("1234").GetInfo()
+	fingerprint := sha256.Sum256(client.cert.Raw)
+	assert.Equal(t, hex.EncodeToString(fingerprint[:]), info["certFingerprint"])
+	assert.Equal(t, client.cert.NotAfter.Format(time.DateTime), info["certNotAfter"])
+	assert.Eventually(t, func() bool { return core.GetSession("1234") == nil }, time.Second, 10*time.Millisecond)
+
+	// 未提供证书与已吊销的证书拒绝连接
+	assert.NotNil(t, dial())
+	assert.NotNil(t, dial(revoked.tlsCert(t)))
+	assert.Nil(t, core.GetSession("1234"))
+
+	// 一直不完成握手的连接在超时后关闭
+	network.SetHandshakeTimeout(200 * time.Millisecond)
+	defer network.SetHandshakeTimeout(0)
+	conn, err := net.Dial("tcp", "localhost:8899")
+	assert.Nil(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestSessionClosed(t *testing.T) {
+	conf := network1
+	conf.Port = 8891
+	conf.Configuration = `{"host": "localhost", "delimeter": {"type":"Delimited", "delimited":"\n"}}`
+	conf.Script = script1
+	s := newServer(conf)
+	defer s.Stop()
+
+	conn, err := net.Dial("tcp", "localhost:8891")
+	assert.Nil(t, err)
+	conn.Write([]byte(`{"deviceId": "1234"}` + "\n"))
+	assert.Eventually(t, func() bool { return core.GetSession("1234") != nil }, time.Second, 10*time.Millisecond)
+	session := core.GetSession("1234").(*tcpserver.TcpSession)
+	assert.Nil(t, session.Send("hello"))
+
+	// 断开后发送返回错误
+	conn.Close()
+	assert.Eventually(t, func() bool { return core.GetSession("1234") == nil }, time.Second, 10*time.Millisecond)
+	assert.NotNil(t, session.Send("hello"))
+	assert.NotNil(t, session.SendHex("0102"))
+}
+
+const echoScript = `
+function OnMessage(context) {
+  context.GetSession().Send("%s\n")
+}
+`
+
+func TestServerReload(t *testing.T) {
+	ca := newTestCert(t, 11, "test-ca", nil)
+	cert1 := newTestCert(t, 12, "localhost", ca)
+	cert2 := newTestCert(t, 13, "localhost", ca)
+
+	conf := network1
+	conf.Type = string(network.TCP_SERVER)
+	conf.Port = 8897
+	conf.Configuration = `{"host": "localhost", "useTLS": true, "delimeter": {"type":"Delimited", "delimited":"\n"}}`
+	conf.CertBase64 = base64.StdEncoding.EncodeToString(cert1.pem)
+	conf.KeyBase64 = base64.StdEncoding.EncodeToString(cert1.keyPem(t))
+	conf.Script = fmt.Sprintf(echoScript, "v1")
+	assert.Nil(t, servers.StartServer(conf))
+	defer servers.StopServer(conf.ProductId)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	dial := func(port int32) (*tls.Conn, *bufio.Reader) {
+		conn, err := tls.Dial("tcp", fmt.Sprintf("localhost:%d", port), &tls.Config{RootCAs: pool})
+		assert.Nil(t, err)
+		return conn, bufio.NewReader(conn)
+	}
+	echo := func(conn net.Conn, r *bufio.Reader) string {
+		conn.Write([]byte("ping\n"))
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		line, _ := r.ReadString('\n')
+		return line
+	}
+	conn, r := dial(8897)
+	defer conn.Close()
+	assert.Equal(t, "v1\n", echo(conn, r))
+
+	// 更新脚本与证书, 已建立的连接不断开, 新连接使用新证书
+	conf.Script = fmt.Sprintf(echoScript, "v2")
+	conf.CertBase64 = base64.StdEncoding.EncodeToString(cert2.pem)
+	conf.KeyBase64 = base64.StdEncoding.EncodeToString(cert2.keyPem(t))
+	result, err := servers.ReloadServer(conf)
+	assert.Nil(t, err)
+	assert.False(t, result.Restart)
+	assert.Equal(t, "v2\n", echo(conn, r))
+	conn2, r2 := dial(8897)
+	defer conn2.Close()
+	assert.Equal(t, cert2.cert.SerialNumber, conn2.ConnectionState().PeerCertificates[0].SerialNumber)
+	assert.Equal(t, "v2\n", echo(conn2, r2))
+
+	// 端口变化时重启服务
+	conf.Port = 8898
+	result, err = servers.ReloadServer(conf)
+	assert.Nil(t, err)
+	assert.True(t, result.Restart)
+	assert.Contains(t, result.Reason, "port")
+	conn3, r3 := dial(8898)
+	defer conn3.Close()
+	assert.Equal(t, "v2\n", echo(conn3, r3))
+
+	// 新端口启动失败时恢复原来的服务与脚本
+	l, err := net.Listen("tcp", "localhost:8899")
+	assert.Nil(t, err)
+	defer l.Close()
+	conf.Port = 8899
+	conf.Script = fmt.Sprintf(echoScript, "v3")
+	_, err = servers.ReloadServer(conf)
+	assert.NotNil(t, err)
+	conn4, r4 := dial(8898)
+	defer conn4.Close()
+	assert.Equal(t, "v2\n", echo(conn4, r4))
+}
+
+func TestServerShared(t *testing.T) {
+	for _, id := range []string{"test-product2", "test-product3"} {
+		core.PutProduct(&core.Product{Id: id, Config: map[string]string{}, StorePolicy: "mock"})
+	}
+	conf1 := network1
+	conf1.Type = string(network.TCP_SERVER)
+	conf1.Port = 8896
+	conf1.Configuration = `{"host": "localhost", "routeTimeout": 1, "delimeter": {"type":"Delimited", "delimited":"\n"}}`
+	conf1.Script = fmt.Sprintf(echoScript, "p1")
+	// 按首包前缀路由
+	conf2 := conf1
+	conf2.ProductId = "test-product2"
+	conf2.Configuration = `{"route": {"prefix": "p2:"}}`
+	conf2.Script = fmt.Sprintf(echoScript, "p2")
+	// 首包路由脚本
+	conf3 := conf1
+	conf3.ProductId = "test-product3"
+	conf3.Configuration = `{"host": "localhost", "delimeter": {"type":"Delimited", "delimited":";"},
+	"route": {"script": "function route(data) { if (data.indexOf('#3') == 0) return 'test-product3' }"}}`
+	conf3.Script = fmt.Sprintf(echoScript, "p3")
+	for _, conf := range []network.NetworkConf{conf1, conf2, conf3} {
+		assert.Nil(t, servers.StartServer(conf))
+		defer servers.StopServer(conf.ProductId)
+	}
+	assert.Equal(t, servers.GetServer(conf1.ProductId), servers.GetServer(conf2.ProductId))
+	assert.Equal(t, servers.GetServer(conf1.ProductId), servers.GetServer(conf3.ProductId))
+
+	echo := func(msg string) string {
+		conn, err := net.Dial("tcp", "localhost:8896")
+		assert.Nil(t, err)
+		defer conn.Close()
+		conn.Write([]byte(msg + "\n"))
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		return line
+	}
+	assert.Equal(t, "p1\n", echo("hello"))
+	assert.Equal(t, "p2\n", echo("p2:hello"))
+	assert.Equal(t, "p3\n", echo("#3hello"))
+
+	// 不发送首包的连接超时后断开
+	conn, err := net.Dial("tcp", "localhost:8896")
+	assert.Nil(t, err)
+	defer conn.Close()
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	assert.Less(t, time.Since(start), 2*time.Second)
+
+	// 移除产品后监听不关闭, 其它产品不受影响
+	assert.Nil(t, servers.StopServer(conf2.ProductId))
+	assert.Equal(t, "p1\n", echo("p2:hello"))
+	assert.Equal(t, "p3\n", echo("#3hello"))
+	assert.Nil(t, servers.StartServer(conf2))
+
+	// 其它产品不能修改监听的配置, 脚本也不更新
+	conf2.Configuration = `{"route": {"prefix": "p2:"}, "delimeter": {"type":"Delimited", "delimited":";"}}`
+	conf2.Script = fmt.Sprintf(echoScript, "p2x")
+	_, err = servers.ReloadServer(conf2)
+	assert.NotNil(t, err)
+	assert.Equal(t, "p2\n", echo("p2:hello"))
+
+	// 移除第一个产品后监听使用下一个产品的配置
+	assert.Nil(t, servers.StopServer(conf1.ProductId))
+	send := func(msg string) string {
+		conn, err := net.Dial("tcp", "localhost:8896")
+		assert.Nil(t, err)
+		defer conn.Close()
+		conn.Write([]byte(msg))
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		return line
+	}
+	assert.Equal(t, "p3\n", send("#3hello;"))
+	assert.Equal(t, "", send("p2:hello\n"))
+	assert.Equal(t, "p2\n", send("p2:hello;"))
+
+	// 第一个产品修改需要重启的配置时重启共用的监听
+	conf3.Configuration = `{"delimeter": {"type":"Delimited", "delimited":"\n"},
+	"route": {"script": "function route(data) { if (data.indexOf('#3') == 0) return 'test-product3' }"}}`
+	result, err := servers.ReloadServer(conf3)
+	assert.Nil(t, err)
+	assert.True(t, result.Restart)
+	assert.Equal(t, servers.GetServer(conf2.ProductId), servers.GetServer(conf3.ProductId))
+	assert.Equal(t, "p3\n", echo("#3hello"))
+	assert.Equal(t, "p2\n", echo("p2:hello"))
+}
+
+func TestServerLengthField(t *testing.T) {
+	xor := func(b []byte) byte {
+		var x byte
+		for _, v := range b {
+			x ^= v
+		}
+		return x
+	}
+	crc := func(b []byte) []byte {
+		return append(b, util.CheckSum(b)...)
+	}
+	conf := network1
+	conf.Type = string(network.TCP_SERVER)
+	conf.Script = `
+function OnMessage(context) {
+  context.GetSession().Send(context.MsgToString().substring(0, 5) + "\n")
+}
+`
+	echo := func(port int32, frames ...[]byte) string {
+		conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+		assert.Nil(t, err)
+		defer conn.Close()
+		for _, frame := range frames {
+			conn.Write(frame)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		return line
+	}
+
+	// 帧头0xAA, 1字节长度, 异或校验, 去掉帧头
+	conf.Port = 8895
+	conf.Configuration = `{"host": "localhost", "delimeter": {"type":"LengthField",
+	"lengthField": {"offset": 1, "size": 1, "strip": 2}, "check": {"type": "XOR8", "start": 2}}}`
+	assert.Nil(t, servers.StartServer(conf))
+	frame := func(payload string) []byte {
+		b := append([]byte{0xAA, byte(len(payload) + 1)}, payload...)
+		return append(b, xor([]byte(payload)))
+	}
+	bad := append([]byte{0xAA, 6}, "hellox"...)
+	assert.Equal(t, "world\n", echo(8895, bad, frame("world")))
+	assert.Equal(t, "hello\n", echo(8895, frame("hello")))
+	assert.Nil(t, servers.StopServer(conf.ProductId))
+
+	// 多字节分隔符, crc16校验
+	conf.Port = 8894
+	conf.Configuration = `{"host": "localhost", "delimeter": {"type":"Delimited", "delimited":"\r\n", "maxLength": 8192,
+	"check": {"type": "CRC16"}}}`
+	assert.Nil(t, servers.StartServer(conf))
+	defer servers.StopServer(conf.ProductId)
+	bad = append([]byte("hello\r\n"), "\r\n"...)
+	assert.Equal(t, "world\n", echo(8894, bad, append(crc([]byte("world")), "\r\n"...)))
+	// 单独的\r不拆包
+	assert.Equal(t, "he\rll\n", echo(8894, append(crc([]byte("he\rllo")), "\r\n"...)))
+	// 超过最大帧长度时断开连接
+	assert.Equal(t, "", echo(8894, bytes.Repeat([]byte("a"), 10000), append(crc([]byte("hello")), "\r\n"...)))
+
+	// 单字节分隔符同样限制最大帧长度
+	conf.ProductId = "test-product2"
+	conf.Port = 8892
+	conf.Configuration = `{"host": "localhost", "delimeter": {"type":"Delimited", "delimited":"\n", "maxLength": 16}}`
+	assert.Nil(t, servers.StartServer(conf))
+	defer servers.StopServer(conf.ProductId)
+	assert.Equal(t, "hello\n", echo(8892, []byte("hello\n")))
+	assert.Equal(t, "", echo(8892, bytes.Repeat([]byte("a"), 100), []byte("hello\n")))
+
+	// 配置错误
+	conf.Configuration = `{"delimeter": {"type":"LengthField", "lengthField": {"size": 3}}}`
+	spec := tcpserver.TcpServerSpec{}
+	assert.NotNil(t, spec.FromJson(conf.Configuration))
+}
@@ -0,0 +1,164 @@
+package udpserver
+
+import (
+	"encoding/hex"
+	"go-iot/pkg/core"
+	"go-iot/pkg/util"
+	"net"
+	"sync"
+	"time"
+
+	logs "go-iot/pkg/logger"
+)
+
+func newUdpSession(server *UdpServer, addr *net.UDPAddr) *UdpSession {
+	return &UdpSession{
+		server:    server,
+		addr:      addr,
+		key:       addr.String(),
+		productId: server.productId,
+		recv:      make(chan []byte, 256),
+		done:      make(chan struct{}),
+	}
+}
+
+// udp会话, 设备地址变化时(如NAT)由新地址的会话替换
+type UdpSession struct {
+	sync.Mutex
+	server    *UdpServer
+	addr      *net.UDPAddr
+	key       string
+	productId string
+	deviceId  string
+	// 收到的数据报, 按顺序交给编解码处理
+	recv    chan []byte
+	done    chan struct{}
+	isClose bool
+}
+
+func (s *UdpSession) SetDeviceId(deviceId string) {
+	s.deviceId = deviceId
+}
+
+func (s *UdpSession) GetDeviceId() string {
+	return s.deviceId
+}
+
+func (s *UdpSession) GetInfo() map[string]any {
+	return map[string]any{
+		"localAddr":  s.server.conn.LocalAddr().String(),
+		"remoteAddr": s.key,
+	}
+}
+
+func (s *UdpSession) Disconnect() error {
+	if s.closed() {
+		return nil
+	}
+	if core.GetSession(s.deviceId) == core.Session(s) {
+		core.DelSession(s.deviceId)
+	}
+	return s.Close()
+}
+
+func (s *UdpSession) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.isClose {
+		return nil
+	}
+	s.isClose = true
+	close(s.done)
+	s.server.removeSession(s)
+	return nil
+}
+
+func (s *UdpSession) closed() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.isClose
+}
+
+// 发送到设备最后的地址, msg为字符串或字节数组
+func (s *UdpSession) Send(msg any) error {
+	b, err := util.ToBytes(msg)
+	if err != nil {
+		logs.Errorf("udp Send error: %v", err)
+		return err
+	}
+	return s.write(b)
+}
+
+func (s *UdpSession) SendHex(msgHex string) error {
+	b, err := hex.DecodeString(msgHex)
+	if err != nil {
+		logs.Errorf("udp hex decode error: %v", err)
+		return err
+	}
+	return s.write(b)
+}
+
+func (s *UdpSession) write(b []byte) error {
+	_, err := s.server.conn.WriteToUDP(b, s.addr)
+	if err != nil {
+		logs.Errorf("udp write error: %v", err)
+	}
+	return err
+}
+
+func (s *UdpSession) receive(data []byte) {
+	select {
+	case <-s.done:
+	case s.recv <- data:
+	default:
+		logs.Debugf("udp session %s is busy, drop datagram", s.key)
+	}
+}
+
+func (s *UdpSession) readLoop() {
+	defer s.Disconnect()
+
+	sc := core.GetCodec(s.productId)
+	sc.OnConnect(&udpContext{
+		BaseContext: core.BaseContext{
+			ProductId: s.productId,
+			Session:   s,
+		},
+	})
+	if s.closed() {
+		return
+	}
+
+	timer := time.NewTimer(s.server.getSpec().idleTimeout())
+	defer timer.Stop()
+	for {
+		select {
+		case data := <-s.recv:
+			s.onMessage(data)
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(s.server.getSpec().idleTimeout())
+		case <-timer.C:
+			logs.Debugf("udp session %s idle timeout", s.key)
+			return
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *UdpSession) onMessage(data []byte) {
+	sc := core.GetCodec(s.productId)
+	sc.OnMessage(&udpContext{
+		BaseContext: core.BaseContext{
+			DeviceId:  s.GetDeviceId(),
+			ProductId: s.productId,
+			Session:   s,
+		},
+		Data: data,
+	})
+}
@@ -0,0 +1,68 @@
+// udp服务
+package udpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	// 默认会话空闲超时(秒)
+	defaultIdleTimeout = 300
+	// 默认最大会话数
+	defaultMaxSessions = 10000
+)
+
+type (
+	// Spec describes the UdpServer
+	UdpServerSpec struct {
+		Name        string `json:"name"`
+		Host        string `json:"host"`
+		Port        int32  `json:"port"`
+		IdleTimeout int    `json:"idleTimeout"` // 会话空闲超时(秒), 超时没有收到数据时设备离线, 默认300
+		MaxSessions int    `json:"maxSessions"` // 最大会话数, 达到后丢弃新地址的数据, 默认10000
+	}
+)
+
+func (spec *UdpServerSpec) FromJson(str string) error {
+	if len(str) > 0 {
+		err := json.Unmarshal([]byte(str), spec)
+		if err != nil {
+			return fmt.Errorf("udp server spec error: %v", err)
+		}
+	}
+	if spec.IdleTimeout < 0 {
+		return fmt.Errorf("udp server spec error: invalid idleTimeout %d", spec.IdleTimeout)
+	}
+	if spec.MaxSessions < 0 {
+		return fmt.Errorf("udp server spec error: invalid maxSessions %d", spec.MaxSessions)
+	}
+	return nil
+}
+
+func (spec *UdpServerSpec) idleTimeout() time.Duration {
+	if spec.IdleTimeout == 0 {
+		return defaultIdleTimeout * time.Second
+	}
+	return time.Duration(spec.IdleTimeout) * time.Second
+}
+
+func (spec *UdpServerSpec) maxSessions() int {
+	if spec.MaxSessions == 0 {
+		return defaultMaxSessions
+	}
+	return spec.MaxSessions
+}
+
+// 需要重启才能生效的配置项
+func (spec *UdpServerSpec) restartFields(n *UdpServerSpec) []string {
+	var fields []string
+	if spec.Host != n.Host {
+		fields = append(fields, "host")
+	}
+	if spec.Port != n.Port {
+		fields = append(fields, "port")
+	}
+	return fields
+}
@@ -0,0 +1,23 @@
+package udpserver
+
+import (
+	"encoding/hex"
+	"go-iot/pkg/core"
+)
+
+type udpContext struct {
+	core.BaseContext
+	Data []byte
+}
+
+func (ctx *udpContext) GetMessage() interface{} {
+	return ctx.Data
+}
+
+func (ctx *udpContext) MsgToString() string {
+	return string(ctx.Data)
+}
+
+func (ctx *udpContext) MsgToHexStr() string {
+	return hex.EncodeToString(ctx.Data)
+}
@@ -0,0 +1,162 @@
+package udpserver
+
+import (
+	"fmt"
+	"go-iot/pkg/network"
+	"go-iot/pkg/network/servers"
+	"net"
+	"sync"
+
+	logs "go-iot/pkg/logger"
+)
+
+func init() {
+	servers.RegServer(func() network.NetServer {
+		return NewServer()
+	})
+}
+
+// udp数据报最大长度
+const maxDatagramSize = 65535
+
+type UdpServer struct {
+	sync.RWMutex
+	productId string
+	spec      *UdpServerSpec
+	conn      *net.UDPConn
+
+	// done is the channel for shutdowning this server.
+	done chan struct{}
+	// 按设备地址区分的会话
+	sessions map[string]*UdpSession
+}
+
+func NewServer() *UdpServer {
+	return &UdpServer{
+		sessions: make(map[string]*UdpSession),
+	}
+}
+
+func (s *UdpServer) Type() network.NetType {
+	return network.UDP_SERVER
+}
+
+func (s *UdpServer) Start(conf network.NetworkConf) error {
+	spec := &UdpServerSpec{}
+	err := spec.FromJson(conf.Configuration)
+	if err != nil {
+		return err
+	}
+	spec.Port = conf.Port
+
+	s.productId = conf.ProductId
+	s.spec = spec
+	s.done = make(chan struct{})
+
+	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", spec.Host, spec.Port))
+	if err != nil {
+		return fmt.Errorf("udp server addr error: %v", err)
+	}
+	c, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		logs.Errorf("udp server listen failed: %v", err)
+		return fmt.Errorf("gen udp listener with addr %s failed: %v", addr, err)
+	}
+	s.conn = c
+
+	go s.run()
+	return nil
+}
+
+func (s *UdpServer) run() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			logs.Debugf("udp server read error: %v", err)
+			continue
+		}
+		session := s.getSession(addr)
+		if session == nil {
+			logs.Debugf("udp server sessions reach max, drop datagram from %s", addr)
+			continue
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		session.receive(data)
+	}
+}
+
+// 地址对应的会话, 不存在时创建, 会话数达到上限时返回nil
+func (s *UdpServer) getSession(addr *net.UDPAddr) *UdpSession {
+	key := addr.String()
+	s.Lock()
+	defer s.Unlock()
+	if session, ok := s.sessions[key]; ok {
+		return session
+	}
+	if len(s.sessions) >= s.spec.maxSessions() {
+		return nil
+	}
+	session := newUdpSession(s, addr)
+	s.sessions[key] = session
+	go session.readLoop()
+	return session
+}
+
+func (s *UdpServer) removeSession(session *UdpSession) {
+	s.Lock()
+	defer s.Unlock()
+	if s.sessions[session.key] == session {
+		delete(s.sessions, session.key)
+	}
+}
+
+// 在线更新配置, 空闲超时对新收到的数据生效
+func (s *UdpServer) Reload(conf network.NetworkConf) error {
+	spec := &UdpServerSpec{}
+	err := spec.FromJson(conf.Configuration)
+	if err != nil {
+		return err
+	}
+	spec.Port = conf.Port
+	s.Lock()
+	defer s.Unlock()
+	if fields := s.spec.restartFields(spec); len(fields) > 0 {
+		return network.RestartRequired(fields...)
+	}
+	s.spec = spec
+	return nil
+}
+
+func (s *UdpServer) getSpec() *UdpServerSpec {
+	s.RLock()
+	defer s.RUnlock()
+	return s.spec
+}
+
+func (s *UdpServer) Stop() error {
+	close(s.done)
+	s.conn.Close()
+	s.RLock()
+	var sessions []*UdpSession
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	s.RUnlock()
+	for _, session := range sessions {
+		session.Disconnect()
+	}
+	return nil
+}
+
+func (s *UdpServer) TotalConnection() int32 {
+	s.RLock()
+	defer s.RUnlock()
+	return int32(len(s.sessions))
+}
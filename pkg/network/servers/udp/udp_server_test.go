@@ -0,0 +1,104 @@
+package udpserver_test
+
+import (
+	_ "go-iot/pkg/codec"
+	"go-iot/pkg/core"
+	"go-iot/pkg/logger"
+	"go-iot/pkg/network"
+	"go-iot/pkg/network/servers"
+	_ "go-iot/pkg/network/servers/udp"
+	"go-iot/pkg/store"
+	_ "go-iot/pkg/timeseries"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const script = `
+function OnMessage(context) {
+  context.DeviceOnline(context.MsgToString().split(":")[0])
+  context.GetSession().Send("ack:" + context.MsgToHexStr())
+}
+function OnInvoke(context) {
+  context.GetSession().Send("invoke:" + context.GetMessage().FunctionId)
+  context.ReplyOk()
+}
+`
+
+const tslText = `
+{
+  "functions": [{"id": "reset", "name": "重置", "async": false}]
+}
+`
+
+func init() {
+	logger.InitNop()
+	core.RegDeviceStore(store.NewMockDeviceStore())
+}
+
+func TestServer(t *testing.T) {
+	product, err := core.NewProduct("udp-product", map[string]string{}, core.TIME_SERISE_MOCK, tslText)
+	assert.Nil(t, err)
+	core.PutProduct(product)
+	core.PutDevice(core.NewDevice("meter-1", product.Id, 0))
+
+	conf := network.NetworkConf{
+		Name:          "udp server",
+		ProductId:     product.Id,
+		CodecId:       core.Script_Codec,
+		Type:          string(network.UDP_SERVER),
+		Port:          8893,
+		Configuration: `{"host": "localhost", "idleTimeout": 2}`,
+		Script:        script,
+	}
+	assert.Nil(t, servers.StartServer(conf))
+	defer servers.StopServer(conf.ProductId)
+
+	read := func(conn net.Conn) string {
+		buf := make([]byte, 1024)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _ := conn.Read(buf)
+		return string(buf[:n])
+	}
+	conn1, err := net.Dial("udp", "localhost:8893")
+	assert.Nil(t, err)
+	defer conn1.Close()
+	conn1.Write([]byte("meter-1:1"))
+	assert.Equal(t, "ack:6d657465722d313a31", read(conn1))
+	assert.Equal(t, conn1.LocalAddr().String(), core.GetSession("meter-1").GetInfo()["remoteAddr"])
+
+	// 设备地址变化后, 命令发送到最后的地址
+	conn2, err := net.Dial("udp", "localhost:8893")
+	assert.Nil(t, err)
+	defer conn2.Close()
+	conn2.Write([]byte("meter-1:2"))
+	assert.Equal(t, "ack:6d657465722d313a32", read(conn2))
+	resp := core.DoCmdInvoke(core.FuncInvoke{DeviceId: "meter-1", FunctionId: "reset"})
+	assert.Nil(t, resp)
+	assert.Equal(t, "invoke:reset", read(conn2))
+	assert.Equal(t, 1, int(servers.GetServer(conf.ProductId).TotalConnection()))
+
+	// 空闲超时后离线
+	assert.Eventually(t, func() bool {
+		return core.GetSession("meter-1") == nil
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.Equal(t, 0, int(servers.GetServer(conf.ProductId).TotalConnection()))
+
+	// 会话数达到上限时丢弃新地址的数据
+	conf.Configuration = `{"host": "localhost", "idleTimeout": 2, "maxSessions": 1}`
+	_, err = servers.ReloadServer(conf)
+	assert.Nil(t, err)
+	conn3, err := net.Dial("udp", "localhost:8893")
+	assert.Nil(t, err)
+	defer conn3.Close()
+	conn3.Write([]byte("meter-1:3"))
+	assert.Equal(t, "ack:6d657465722d313a33", read(conn3))
+	conn4, err := net.Dial("udp", "localhost:8893")
+	assert.Nil(t, err)
+	defer conn4.Close()
+	conn4.Write([]byte("meter-1:4"))
+	assert.Equal(t, "", read(conn4))
+	assert.Equal(t, 1, int(servers.GetServer(conf.ProductId).TotalConnection()))
+}
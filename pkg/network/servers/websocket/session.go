@@ -2,8 +2,10 @@ package websocketserver
 
 import (
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"go-iot/pkg/core"
+	"go-iot/pkg/util"
 	"net/http"
 	"net/url"
 	"sync"
@@ -117,18 +119,38 @@ func (s *WebsocketSession) Close() error {
 }
 
 func (s *WebsocketSession) SendText(msg string) error {
-	s.send <- &wsMsg{messageType: websocket.TextMessage, data: []byte(msg)}
-	return nil
+	return s.write(&wsMsg{messageType: websocket.TextMessage, data: []byte(msg)})
 }
 
-func (s *WebsocketSession) SendBinary(msg string) error {
-	payload, err := hex.DecodeString(msg)
+// msg为16进制字符串或字节数组
+func (s *WebsocketSession) SendBinary(msg any) error {
+	var payload []byte
+	var err error
+	if str, ok := msg.(string); ok {
+		payload, err = hex.DecodeString(str)
+	} else {
+		payload, err = util.ToBytes(msg)
+	}
 	if err != nil {
-		logs.Warnf("Error message, message is not a hex string: %v", err)
+		logs.Warnf("Error message, message is not a hex string or bytes: %v", err)
 		return err
 	}
-	s.send <- &wsMsg{messageType: websocket.BinaryMessage, data: payload}
-	return nil
+	return s.write(&wsMsg{messageType: websocket.BinaryMessage, data: payload})
+}
+
+// 放入发送队列, 会话关闭后返回错误; 队列满时不等待, 避免持有锁时阻塞关闭会话
+func (s *WebsocketSession) write(msg *wsMsg) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.disconnected() {
+		return errors.New("websocket session is closed")
+	}
+	select {
+	case s.send <- msg:
+		return nil
+	default:
+		return errors.New("websocket send queue is full")
+	}
 }
 
 func (c *WebsocketSession) disconnected() bool {
@@ -56,6 +56,21 @@ func (spec *WebsocketServerSpec) FromNetwork(network network.NetworkConf) error
 	return nil
 }
 
+// 需要重启才能生效的配置项
+func (spec *WebsocketServerSpec) restartFields(n *WebsocketServerSpec) []string {
+	var fields []string
+	if spec.Host != n.Host {
+		fields = append(fields, "host")
+	}
+	if spec.Port != n.Port {
+		fields = append(fields, "port")
+	}
+	if spec.UseTLS != n.UseTLS {
+		fields = append(fields, "useTLS")
+	}
+	return fields
+}
+
 func (spec *WebsocketServerSpec) TlsConfig() (*tls.Config, error) {
 	var certificates []tls.Certificate
 
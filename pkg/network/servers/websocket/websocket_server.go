@@ -1,7 +1,6 @@
 package websocketserver
 
 import (
-	"crypto/tls"
 	"fmt"
 	"go-iot/pkg/eventbus"
 	"go-iot/pkg/network"
@@ -28,9 +27,10 @@ var upgrader = websocket.Upgrader{
 type (
 	WebSocketServer struct {
 		sync.RWMutex
-		productId   string
+		*network.ProductRouter
 		spec        *WebsocketServerSpec
 		server      *http.Server
+		tls         *network.TlsReloader
 		pathmatcher eventbus.AntPathMatcher
 		clients     map[string]*WebsocketSession
 	}
@@ -47,19 +47,22 @@ func (s *WebSocketServer) Type() network.NetType {
 	return network.WEBSOCKET_SERVER
 }
 
-func (s *WebSocketServer) Start(network network.NetworkConf) error {
+func (s *WebSocketServer) Start(conf network.NetworkConf) error {
 	spec := &WebsocketServerSpec{}
-	err := spec.FromNetwork(network)
+	err := spec.FromNetwork(conf)
 	if err != nil {
 		return err
 	}
-	spec.Port = network.Port
+	spec.Port = conf.Port
 
 	if len(spec.Routers) == 0 {
 		spec.Routers = append(spec.Routers, Router{Url: "/**"})
 	}
 
-	s.productId = network.ProductId
+	s.ProductRouter, err = network.NewProductRouter(conf)
+	if err != nil {
+		return err
+	}
 	s.spec = spec
 
 	addr := fmt.Sprintf("%s:%d", spec.Host, spec.Port)
@@ -74,9 +77,8 @@ func (s *WebSocketServer) Start(network network.NetworkConf) error {
 		return err
 	}
 
-	var tlsConfig *tls.Config
 	if spec.UseTLS {
-		tlsConfig, err = spec.TlsConfig()
+		err = s.setTls(spec)
 		if err != nil {
 			return err
 		}
@@ -85,7 +87,7 @@ func (s *WebSocketServer) Start(network network.NetworkConf) error {
 	go func() {
 		var err error
 		if spec.UseTLS {
-			s.server.TLSConfig = tlsConfig
+			s.server.TLSConfig = s.tls.Config()
 			err = s.server.ServeTLS(listener, "", "")
 		} else {
 			err = s.server.Serve(listener)
@@ -99,7 +101,7 @@ func (s *WebSocketServer) Start(network network.NetworkConf) error {
 
 func (s *WebSocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	allow := false
-	for _, route := range s.spec.Routers {
+	for _, route := range s.getSpec().Routers {
 		if s.pathmatcher.Match(route.Url, r.RequestURI) {
 			allow = true
 			break
@@ -109,14 +111,16 @@ func (s *WebSocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
+	// 多个产品共用监听时按url路径前缀确定产品
+	productId := s.Match(r.URL.Path)
 	// Upgrade our raw HTTP connection to a websocket based one
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		logs.Errorf("Error during [%s] websocket connection upgradation: %v", s.productId, err)
+		logs.Errorf("Error during [%s] websocket connection upgradation: %v", productId, err)
 		return
 	}
 
-	session := newWebsocketSession(conn, r, s, s.productId)
+	session := newWebsocketSession(conn, r, s, productId)
 
 	s.Lock()
 	s.clients[session.id] = session
@@ -127,10 +131,48 @@ func (s *WebSocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 }
 
-func (s *WebSocketServer) Reload() error {
+// 在线更新配置, 路由与证书对新的连接生效, 已建立的连接不会断开
+func (s *WebSocketServer) Reload(conf network.NetworkConf) error {
+	spec := &WebsocketServerSpec{}
+	err := spec.FromNetwork(conf)
+	if err != nil {
+		return err
+	}
+	spec.Port = conf.Port
+	if len(spec.Routers) == 0 {
+		spec.Routers = append(spec.Routers, Router{Url: "/**"})
+	}
+	if fields := s.getSpec().restartFields(spec); len(fields) > 0 {
+		return network.RestartRequired(fields...)
+	}
+	if spec.UseTLS {
+		cfg, err := spec.TlsConfig()
+		if err != nil {
+			return err
+		}
+		s.tls.Store(cfg)
+	}
+	s.Lock()
+	s.spec = spec
+	s.Unlock()
 	return nil
 }
 
+func (s *WebSocketServer) setTls(spec *WebsocketServerSpec) error {
+	cfg, err := spec.TlsConfig()
+	if err != nil {
+		return err
+	}
+	s.tls = network.NewTlsReloader(cfg)
+	return nil
+}
+
+func (s *WebSocketServer) getSpec() *WebsocketServerSpec {
+	s.RLock()
+	defer s.RUnlock()
+	return s.spec
+}
+
 func (s *WebSocketServer) Stop() error {
 	s.Lock()
 	defer s.Unlock()
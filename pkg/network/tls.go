@@ -0,0 +1,231 @@
+package network
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"go-iot/pkg/core"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// 客户端证书认证(双向TLS), 使用CA证书校验设备证书, 并拒绝已吊销的证书
+type ClientAuth struct {
+	pool *x509.CertPool
+	// 已吊销证书的序列号
+	revoked map[string]bool
+}
+
+// 配置了CA证书时启用客户端证书认证, 否则返回nil
+func NewClientAuth(conf NetworkConf) (*ClientAuth, error) {
+	if len(conf.CaBase64) == 0 {
+		return nil, nil
+	}
+	ca, err := base64.StdEncoding.DecodeString(conf.CaBase64)
+	if err != nil {
+		return nil, fmt.Errorf("client ca error: %v", err)
+	}
+	auth := &ClientAuth{pool: x509.NewCertPool(), revoked: map[string]bool{}}
+	var cas []*x509.Certificate
+	for block, rest := pem.Decode(ca); block != nil; block, rest = pem.Decode(rest) {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("client ca error: %v", err)
+		}
+		auth.pool.AddCert(cert)
+		cas = append(cas, cert)
+	}
+	if len(cas) == 0 {
+		return nil, errors.New("client ca error: none valid certs")
+	}
+	if len(conf.CrlBase64) > 0 {
+		err = auth.setRevocationList(conf.CrlBase64, cas)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return auth, nil
+}
+
+// 证书吊销列表, 支持pem与der格式, 需要由CA证书签发
+func (a *ClientAuth) setRevocationList(crlBase64 string, cas []*x509.Certificate) error {
+	data, err := base64.StdEncoding.DecodeString(crlBase64)
+	if err != nil {
+		return fmt.Errorf("client crl error: %v", err)
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return fmt.Errorf("client crl error: %v", err)
+	}
+	signed := false
+	for _, ca := range cas {
+		if crl.CheckSignatureFrom(ca) == nil {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return errors.New("client crl error: not signed by client ca")
+	}
+	for _, entry := range crl.RevokedCertificateEntries {
+		a.revoked[entry.SerialNumber.String()] = true
+	}
+	return nil
+}
+
+// 设置tls配置, 要求客户端提供由CA签发的证书
+func (a *ClientAuth) Apply(cfg *tls.Config) {
+	cfg.ClientCAs = a.pool
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	cfg.VerifyPeerCertificate = a.VerifyPeerCertificate
+}
+
+func (a *ClientAuth) CertPool() *x509.CertPool {
+	return a.pool
+}
+
+// 在证书链校验通过后检查证书是否已吊销
+func (a *ClientAuth) VerifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	for _, chain := range verifiedChains {
+		for _, cert := range chain {
+			if a.revoked[cert.SerialNumber.String()] {
+				return fmt.Errorf("certificate %s is revoked", cert.Subject)
+			}
+		}
+	}
+	return nil
+}
+
+// 校验客户端证书链与吊销状态, 用于握手时不校验证书的场景(如可在线更新CA的dtls)
+func (a *ClientAuth) VerifyRawCertificates(rawCerts [][]byte) error {
+	if len(rawCerts) == 0 {
+		return errors.New("client certificate required")
+	}
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	chains, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         a.pool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return err
+	}
+	return a.VerifyPeerCertificate(rawCerts, chains)
+}
+
+// 可以在线更新证书的tls配置, 新连接使用最新的证书, 已建立的连接不受影响
+type TlsReloader struct {
+	cfg atomic.Pointer[tls.Config]
+}
+
+func NewTlsReloader(cfg *tls.Config) *TlsReloader {
+	r := &TlsReloader{}
+	r.Store(cfg)
+	return r
+}
+
+func (r *TlsReloader) Store(cfg *tls.Config) {
+	r.cfg.Store(cfg)
+}
+
+// 监听使用的tls配置
+func (r *TlsReloader) Config() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.cfg.Load(), nil
+		},
+	}
+}
+
+const defaultHandshakeTimeout = 10 * time.Second
+
+// TLS握手的超时时间, 未设置时为10秒
+var handshakeTimeout atomic.Int64
+
+func SetHandshakeTimeout(d time.Duration) {
+	handshakeTimeout.Store(int64(d))
+}
+
+func getHandshakeTimeout() time.Duration {
+	if d := handshakeTimeout.Load(); d > 0 {
+		return time.Duration(d)
+	}
+	return defaultHandshakeTimeout
+}
+
+// 连接的客户端证书, 非TLS连接、握手失败或超时、客户端未提供证书时返回nil
+func PeerCertificate(conn net.Conn) *x509.Certificate {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	if !tlsConn.ConnectionState().HandshakeComplete {
+		// 客户端一直不完成握手时不会一直阻塞
+		tlsConn.SetDeadline(time.Now().Add(getHandshakeTimeout()))
+		err := tlsConn.Handshake()
+		tlsConn.SetDeadline(time.Time{})
+		if err != nil {
+			return nil
+		}
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil
+	}
+	return certs[0]
+}
+
+// 证书对应的设备id, 依次匹配证书CN与SAN(DNS, URI, Email), 返回产品下第一个存在的设备
+func CertDeviceId(productId string, cert *x509.Certificate) string {
+	if cert == nil {
+		return ""
+	}
+	names := []string{cert.Subject.CommonName}
+	names = append(names, cert.DNSNames...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	names = append(names, cert.EmailAddresses...)
+	for _, name := range names {
+		if len(name) == 0 {
+			continue
+		}
+		device := core.GetDevice(name)
+		if device != nil && device.ProductId == productId {
+			return name
+		}
+	}
+	return ""
+}
+
+// 添加证书信息到会话信息中
+func AddCertInfo(info map[string]any, cert *x509.Certificate) map[string]any {
+	if cert == nil {
+		return info
+	}
+	fingerprint := sha256.Sum256(cert.Raw)
+	info["certSubject"] = cert.Subject.String()
+	info["certFingerprint"] = hex.EncodeToString(fingerprint[:])
+	info["certNotAfter"] = cert.NotAfter.Format(time.DateTime)
+	return info
+}
@@ -0,0 +1,108 @@
+package network
+
+import (
+	"strings"
+)
+
+// mqtt主题权限规则, 支持占位符{productId}, {deviceId}, {clientId}, {username}与通配符+, #
+// 规则为空时不限制
+type TopicAcl struct {
+	Publish   []string `json:"publish"`   // 允许发布的主题
+	Subscribe []string `json:"subscribe"` // 允许订阅的主题
+}
+
+// 主题权限的占位符取值
+type TopicAclVars struct {
+	ProductId string
+	DeviceId  string
+	ClientId  string
+	Username  string
+}
+
+// 是否允许发布到主题
+func (a TopicAcl) CanPublish(vars TopicAclVars, topic string) bool {
+	if len(a.Publish) == 0 {
+		return true
+	}
+	for _, rule := range a.Publish {
+		if filter, ok := vars.replace(rule); ok && TopicMatch(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// 是否允许订阅, 订阅的主题需要被规则完全包含
+func (a TopicAcl) CanSubscribe(vars TopicAclVars, filter string) bool {
+	if len(a.Subscribe) == 0 {
+		return true
+	}
+	for _, rule := range a.Subscribe {
+		if r, ok := vars.replace(rule); ok && topicCover(r, filter) {
+			return true
+		}
+	}
+	return false
+}
+
+// 替换占位符, 占位符没有取值时规则不生效
+func (v TopicAclVars) replace(rule string) (string, bool) {
+	for key, val := range map[string]string{
+		"{productId}": v.ProductId,
+		"{deviceId}":  v.DeviceId,
+		"{clientId}":  v.ClientId,
+		"{username}":  v.Username,
+	} {
+		if !strings.Contains(rule, key) {
+			continue
+		}
+		// 取值中有通配符时可能越权
+		if len(val) == 0 || strings.ContainsAny(val, "+#/") {
+			return "", false
+		}
+		rule = strings.ReplaceAll(rule, key, val)
+	}
+	return rule, true
+}
+
+// 主题是否匹配订阅, 支持通配符+与#, $开头的主题不匹配首层通配符
+func TopicMatch(filter, topic string) bool {
+	if filter == topic {
+		return true
+	}
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+	fs := strings.Split(filter, "/")
+	ts := strings.Split(topic, "/")
+	for i, f := range fs {
+		if f == "#" {
+			return i == len(fs)-1
+		}
+		if i >= len(ts) {
+			return false
+		}
+		if f != "+" && f != ts[i] {
+			return false
+		}
+	}
+	return len(fs) == len(ts)
+}
+
+// 规则是否包含订阅的所有主题
+func topicCover(rule, filter string) bool {
+	rs := strings.Split(rule, "/")
+	fs := strings.Split(filter, "/")
+	for i, r := range rs {
+		if r == "#" {
+			return i == len(rs)-1
+		}
+		if i >= len(fs) || fs[i] == "#" {
+			return false
+		}
+		if r != "+" && r != fs[i] {
+			return false
+		}
+	}
+	return len(rs) == len(fs)
+}
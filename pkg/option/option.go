@@ -69,6 +69,8 @@ type Options struct {
 	Log Log `yaml:"logs"`
 	// 抖动限制最大秒默认3600
 	MaxShakeLimitTime int `yaml:"max-shake-limit-time"`
+	// 脚本执行时进程堆内存上限(MB), 全局熔断, 超过时中断所有产品执行中的脚本, 0不限制
+	ScriptMaxHeapMemory int `yaml:"script-max-heap-memory"`
 	// 控制台输出的banner
 	Banner string `yaml:"banner"`
 }
@@ -122,6 +124,7 @@ func New() *Options {
 	opt.flags.StringVar(&opt.Cluster.Hosts, "cluster.hosts", "", "集群内主机列表")
 
 	opt.flags.IntVar(&opt.MaxShakeLimitTime, "max-shake-limit-time", 3600, "抖动限制最大秒")
+	opt.flags.IntVar(&opt.ScriptMaxHeapMemory, "script-max-heap-memory", 0, "脚本执行时进程堆内存上限(MB), 超过时中断所有执行中的脚本, 0不限制")
 	opt.flags.StringVar(&opt.Banner, "banner", banner, "")
 	opt.viper.BindPFlags(opt.flags)
 
@@ -13,13 +13,16 @@ import (
 	// servers
 	_ "go-iot/pkg/network/servers/coap"
 	_ "go-iot/pkg/network/servers/http"
+	_ "go-iot/pkg/network/servers/modbus"
 	_ "go-iot/pkg/network/servers/mqtt5"
 	_ "go-iot/pkg/network/servers/tcp"
+	_ "go-iot/pkg/network/servers/udp"
 	_ "go-iot/pkg/network/servers/websocket"
 
 	// clients
 	_ "go-iot/pkg/network/clients/modbus"
 	_ "go-iot/pkg/network/clients/mqtt"
+	_ "go-iot/pkg/network/clients/opcua"
 	_ "go-iot/pkg/network/clients/tcp"
 
 	// notifys
@@ -8,6 +8,7 @@ import (
 	"go-iot/pkg/option"
 	"go-iot/pkg/tsl"
 	"go-iot/pkg/util"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -187,6 +188,16 @@ func (c *ConditionFilter) getExpression() string {
 		return fmt.Sprintf("this.%s %s \"%s\"", c.Key, oper, c.Value)
 	case This:
 		return "true" // event self is happen
+	case tsl.TypeArray:
+		// 数组中任意元素满足条件，neq时所有元素都不等于
+		value := c.Value
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			value = strconv.Quote(value)
+		}
+		if oper == "!=" {
+			return fmt.Sprintf("(this.%s || []).every(function(e) { return e %s %s })", c.Key, oper, value)
+		}
+		return fmt.Sprintf("(this.%s || []).some(function(e) { return e %s %s })", c.Key, oper, value)
 	default:
 		return fmt.Sprintf("this.%s %s %s", c.Key, oper, c.Value)
 	}
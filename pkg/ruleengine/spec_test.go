@@ -154,3 +154,33 @@ func TestTirgger(t *testing.T) {
 	assert.Nil(t, err)
 	assert.False(t, res)
 }
+
+func TestTirggerArray(t *testing.T) {
+	trigger := ruleengine.Trigger{
+		FilterType: "properties",
+		Filters: []ruleengine.ConditionFilter{
+			{Key: "rssi", Operator: "gt", Value: "-50", DataType: "array"},
+		},
+	}
+	assert.Equal(t, "(this.rssi || []).some(function(e) { return e > -50 })", trigger.GetExpression())
+	res, err := trigger.Evaluate(map[string]any{"rssi": []any{-80, -40}})
+	assert.Nil(t, err)
+	assert.True(t, res)
+	res, err = trigger.Evaluate(map[string]any{"rssi": []any{-80, -60}})
+	assert.Nil(t, err)
+	assert.False(t, res)
+	res, err = trigger.Evaluate(map[string]any{})
+	assert.Nil(t, err)
+	assert.False(t, res)
+
+	trigger = ruleengine.Trigger{
+		FilterType: "properties",
+		Filters: []ruleengine.ConditionFilter{
+			{Key: "tags", Operator: "neq", Value: "err", DataType: "array"},
+		},
+	}
+	assert.Equal(t, "(this.tags || []).every(function(e) { return e != \"err\" })", trigger.GetExpression())
+	res, err = trigger.Evaluate(map[string]any{"tags": []any{"ok", "err"}})
+	assert.Nil(t, err)
+	assert.False(t, res)
+}
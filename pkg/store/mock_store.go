@@ -7,13 +7,15 @@ import (
 )
 
 func NewMockDeviceStore() core.DeviceStore {
-	return &mockDeviceStore{cache: sync.Map{}, deviceData: map[string]map[string]any{}}
+	return &mockDeviceStore{cache: sync.Map{}, deviceData: map[string]map[string]any{}, shadow: map[string]*core.Shadow{}}
 }
 
 // mem device store
 type mockDeviceStore struct {
 	cache      sync.Map
 	deviceData map[string]map[string]any
+	shadow     map[string]*core.Shadow
+	shadowLock sync.Mutex
 }
 
 func (p *mockDeviceStore) Id() string {
@@ -75,3 +77,51 @@ func (m *mockDeviceStore) PutProduct(product *core.Product) {
 func (m *mockDeviceStore) DelProduct(productId string) {
 	m.cache.Delete(productId)
 }
+
+func (m *mockDeviceStore) GetShadow(deviceId string) *core.Shadow {
+	m.shadowLock.Lock()
+	defer m.shadowLock.Unlock()
+	shadow := core.NewShadow(deviceId)
+	if v, ok := m.shadow[deviceId]; ok {
+		for key, val := range v.Reported {
+			shadow.Reported[key] = val
+		}
+		for key, val := range v.Desired {
+			shadow.Desired[key] = val
+		}
+	}
+	return shadow
+}
+
+func (m *mockDeviceStore) PutShadow(deviceId string, section string, values map[string]core.ShadowValue) {
+	m.shadowLock.Lock()
+	defer m.shadowLock.Unlock()
+	shadow, ok := m.shadow[deviceId]
+	if !ok {
+		shadow = core.NewShadow(deviceId)
+		m.shadow[deviceId] = shadow
+	}
+	target := shadow.Reported
+	if section == core.SHADOW_DESIRED {
+		target = shadow.Desired
+	}
+	for key, val := range values {
+		target[key] = val
+	}
+}
+
+func (m *mockDeviceStore) DelShadow(deviceId string, section string, keys ...string) {
+	m.shadowLock.Lock()
+	defer m.shadowLock.Unlock()
+	shadow, ok := m.shadow[deviceId]
+	if !ok {
+		return
+	}
+	target := shadow.Reported
+	if section == core.SHADOW_DESIRED {
+		target = shadow.Desired
+	}
+	for _, key := range keys {
+		delete(target, key)
+	}
+}
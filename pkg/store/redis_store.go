@@ -9,6 +9,7 @@ import (
 	"go-iot/pkg/eventbus"
 	"go-iot/pkg/redis"
 	"go-iot/pkg/util"
+	"strings"
 	"sync"
 	"time"
 
@@ -75,6 +76,7 @@ func (m *redisDeviceStore) GetDevice(deviceId string) *core.Device {
 		device.DeviceType = data["devType"]
 		device.ParentId = data["parentId"]
 		device.ClusterId = data["clusterId"]
+		device.Secret = data["secret"]
 		if str, ok := data["config"]; ok {
 			err = json.Unmarshal([]byte(str), &device.Config)
 			if err != nil {
@@ -108,6 +110,7 @@ func (m *redisDeviceStore) PutDevice(device *core.Device) {
 		"parentId":  device.ParentId,
 		"createId":  fmt.Sprintf("%v", device.CreateId),
 		"clusterId": device.ClusterId,
+		"secret":    device.Secret,
 	}
 	if device.Config != nil {
 		b, err := json.Marshal(device.Config)
@@ -264,3 +267,79 @@ func (m *redisDeviceStore) DelProduct(productId string) {
 	rdb.Del(ctx, productId)
 	m.cache.Delete(productId)
 }
+
+// shadow
+func (m *redisDeviceStore) getShadowKey(deviceId string) string {
+	return "goiot:shadow:" + deviceId
+}
+
+func (m *redisDeviceStore) GetShadow(deviceId string) *core.Shadow {
+	rdb := redis.GetRedisClient()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	shadow := core.NewShadow(deviceId)
+	data, err := rdb.HGetAll(ctx, m.getShadowKey(deviceId)).Result()
+	if err != nil {
+		if err != redis.Nil {
+			logs.Errorf("hgetall shadow error: %v", err)
+		}
+		return shadow
+	}
+	for field, str := range data {
+		section, key, ok := strings.Cut(field, ":")
+		if !ok {
+			continue
+		}
+		var val core.ShadowValue
+		err = json.Unmarshal([]byte(str), &val)
+		if err != nil {
+			logs.Errorf("shadow value parse error: %v", err)
+			continue
+		}
+		if section == core.SHADOW_DESIRED {
+			shadow.Desired[key] = val
+		} else if section == core.SHADOW_REPORTED {
+			shadow.Reported[key] = val
+		}
+	}
+	return shadow
+}
+
+func (m *redisDeviceStore) PutShadow(deviceId string, section string, values map[string]core.ShadowValue) {
+	rdb := redis.GetRedisClient()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	data := map[string]string{}
+	for key, val := range values {
+		b, err := json.Marshal(val)
+		if err != nil {
+			logs.Errorf("shadow value marshal error: %v", err)
+			continue
+		}
+		data[section+":"+key] = string(b)
+	}
+	if len(data) == 0 {
+		return
+	}
+	err := rdb.HSet(ctx, m.getShadowKey(deviceId), data).Err()
+	if err != nil {
+		logs.Errorf("hset shadow error: %v", err)
+	}
+}
+
+func (m *redisDeviceStore) DelShadow(deviceId string, section string, keys ...string) {
+	rdb := redis.GetRedisClient()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	var fields []string
+	for _, key := range keys {
+		fields = append(fields, section+":"+key)
+	}
+	if len(fields) == 0 {
+		return
+	}
+	err := rdb.HDel(ctx, m.getShadowKey(deviceId), fields...).Err()
+	if err != nil {
+		logs.Errorf("hdel shadow error: %v", err)
+	}
+}
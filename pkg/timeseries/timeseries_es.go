@@ -34,6 +34,75 @@ func (t *EsTimeSeries) Id() string {
 }
 
 func (t *EsTimeSeries) PublishModel(product *core.Product, model tsl.TslData) error {
+	return t.publishModel(product, model, 0)
+}
+
+// 迁移模型, 新增字段同步到已存在的索引, 不兼容的变更在下一个月份的索引生效
+func (t *EsTimeSeries) MigrateModel(product *core.Product, old, model tsl.TslData, force bool) error {
+	changes := tsl.Diff(&old, &model)
+	if tsl.HasIncompatible(changes) && !force {
+		return core.ErrIncompatibleModel
+	}
+	templateName := fmt.Sprintf("%s-%s-template", properties_const, product.GetId())
+	version, err := es.GetEsTemplateVersion(templateName)
+	if err != nil {
+		return err
+	}
+	err = t.publishModel(product, model, version+1)
+	if err != nil {
+		return err
+	}
+	mappings := map[string]map[string]any{}
+	for _, c := range changes {
+		var index string
+		path := strings.Split(c.Id, ".")
+		switch c.Scope {
+		case tsl.ScopeProperty:
+			index = fmt.Sprintf("%s-%s-*", properties_const, product.GetId())
+		case tsl.ScopeEvent:
+			// 新增的事件使用新的模板
+			if len(path) == 1 {
+				continue
+			}
+			index = fmt.Sprintf("%s-%s-%s-*", event_const, product.GetId(), path[0])
+			path = path[1:]
+		default:
+			continue
+		}
+		switch c.Kind {
+		case tsl.ChangeAdd:
+			if _, ok := mappings[index]; !ok {
+				mappings[index] = map[string]any{}
+			}
+			t.putMapping(mappings[index], path, t.createElasticProperty(c.New))
+		case tsl.ChangeIncompatible:
+			logs.Warnf("product [%s] %s [%s] type change from %s to %s, effective on the next index", product.GetId(), c.Scope, c.Id, c.OldType, c.NewType)
+		}
+	}
+	for index, properties := range mappings {
+		err := es.PutEsMapping(properties, index)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 按路径设置字段的mapping, 如: obj.a
+func (t *EsTimeSeries) putMapping(properties map[string]any, path []string, mapping any) {
+	if len(path) == 1 {
+		properties[path[0]] = mapping
+		return
+	}
+	object, ok := properties[path[0]].(map[string]any)
+	if !ok {
+		object = map[string]any{"type": "object", "properties": map[string]any{}}
+		properties[path[0]] = object
+	}
+	t.putMapping(object["properties"].(map[string]any), path[1:], mapping)
+}
+
+func (t *EsTimeSeries) publishModel(product *core.Product, model tsl.TslData, version int64) error {
 	{
 		// 属性
 		var properties map[string]any = map[string]any{}
@@ -45,7 +114,7 @@ func (t *EsTimeSeries) PublishModel(product *core.Product, model tsl.TslData) er
 
 		indexPattern := fmt.Sprintf("%s-%s-*", properties_const, product.GetId())
 		templateName := fmt.Sprintf("%s-%s-template", properties_const, product.GetId())
-		err := es.CreateEsTemplate(properties, indexPattern, templateName, "")
+		err := es.CreateEsTemplateVersion(properties, indexPattern, templateName, "", version)
 		if err != nil {
 			return err
 		}
@@ -66,7 +135,7 @@ func (t *EsTimeSeries) PublishModel(product *core.Product, model tsl.TslData) er
 
 			indexPattern := fmt.Sprintf("%s-%s-%s-*", event_const, product.GetId(), e.GetId()) // event-{productId}-{eventId}-*
 			templateName := fmt.Sprintf("%s-%s-%s-template", event_const, product.GetId(), e.GetId())
-			err := es.CreateEsTemplate(properties, indexPattern, templateName, "")
+			err := es.CreateEsTemplateVersion(properties, indexPattern, templateName, "", version)
 			if err != nil {
 				return err
 			}
@@ -339,9 +408,10 @@ func (t *EsTimeSeries) createElasticProperty(p tsl.Property) any {
 		return es.Property{Type: "keyword", IgnoreAbove: "256"}
 	case tsl.TypeDate:
 		return es.Property{Type: "date", Format: es.DefaultDateFormat}
-	// case tsl.TypeArray:
-	// 	array := p.ValueType.(tsl.ValueTypeArray)
-	// 	return t.createElasticProperty(array.ElementType)
+	case tsl.TypeArray:
+		// es中数组与单个值使用相同的mapping
+		array := p.(*tsl.PropertyArray)
+		return t.createElasticProperty(array.ElementType)
 	case tsl.TypeObject:
 		object := p.(*tsl.PropertyObject)
 		var mapping map[string]any = map[string]any{}
@@ -2,6 +2,7 @@ package timeseries
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"go-iot/pkg/core"
@@ -103,6 +104,73 @@ func (t *TdengineTimeSeries) PublishModel(product *core.Product, model tsl.TslDa
 	return nil
 }
 
+// 迁移模型, 新增的属性添加列, 强制迁移时不兼容的列删除后重建, 删除的属性保留历史数据
+func (t *TdengineTimeSeries) MigrateModel(product *core.Product, old, model tsl.TslData, force bool) error {
+	changes := tsl.Diff(&old, &model)
+	if tsl.HasIncompatible(changes) && !force {
+		return core.ErrIncompatibleModel
+	}
+	var alters []string
+	for _, c := range changes {
+		path := strings.Split(c.Id, ".")
+		var stable string
+		switch c.Scope {
+		case tsl.ScopeProperty:
+			// 超级表不存在时发布模型会创建
+			if len(old.Properties) == 0 {
+				continue
+			}
+			stable = t.getStableName(product, core.TIME_TYPE_PROP)
+		case tsl.ScopeEvent:
+			stable = t.getEventStableName(product, core.TIME_TYPE_EVENT, path[0])
+			if len(path) == 1 {
+				// 事件类型变更时重建超级表
+				if c.Kind == tsl.ChangeIncompatible {
+					err := t.dml("DROP STABLE IF EXISTS " + stable + ";")
+					if err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			path = path[1:]
+		default:
+			continue
+		}
+		columnName := strings.Join(path, ".")
+		switch c.Kind {
+		case tsl.ChangeAdd:
+			for _, col := range t.sqlColumns(columnName, c.New) {
+				alters = append(alters, "ALTER STABLE "+stable+" ADD COLUMN "+col+";")
+			}
+		case tsl.ChangeIncompatible:
+			for _, col := range t.sqlColumns(columnName, c.Old) {
+				alters = append(alters, "ALTER STABLE "+stable+" DROP COLUMN "+strings.Fields(col)[0]+";")
+			}
+			for _, col := range t.sqlColumns(columnName, c.New) {
+				alters = append(alters, "ALTER STABLE "+stable+" ADD COLUMN "+col+";")
+			}
+		}
+	}
+	for _, sql := range alters {
+		err := t.dml(sql)
+		if err != nil {
+			return err
+		}
+	}
+	return t.PublishModel(product, model)
+}
+
+// 属性对应的列定义, 对象属性展开为多个列
+func (t *TdengineTimeSeries) sqlColumns(columnName string, p tsl.Property) []string {
+	sb := strings.Builder{}
+	t.createSqlColumn(&sb, columnName, p)
+	if sb.Len() == 0 {
+		return nil
+	}
+	return strings.Split(sb.String(), ", ")
+}
+
 func (t *TdengineTimeSeries) Del(product *core.Product) error {
 	t.dml("DROP STABLE IF EXISTS " + t.getStableName(product, core.TIME_TYPE_PROP) + ";")
 	for _, e := range product.TslData.Events {
@@ -113,7 +181,25 @@ func (t *TdengineTimeSeries) Del(product *core.Product) error {
 }
 
 func (t *TdengineTimeSeries) QueryProperty(product *core.Product, param core.TimeDataSearchRequest) (map[string]any, error) {
-	return t.query(t.getStableName(product, core.TIME_TYPE_PROP), param)
+	result, err := t.query(t.getStableName(product, core.TIME_TYPE_PROP), param)
+	if err != nil {
+		return nil, err
+	}
+	// 数组属性从json字符串还原
+	for _, p := range product.GetTsl().Properties {
+		if p.GetType() != tsl.TypeArray {
+			continue
+		}
+		for _, item := range result["list"].([]map[string]any) {
+			if str, ok := item[p.GetId()].(string); ok {
+				var list []any
+				if json.Unmarshal([]byte(str), &list) == nil {
+					item[p.GetId()] = list
+				}
+			}
+		}
+	}
+	return result, nil
 }
 
 func (t *TdengineTimeSeries) QueryLogs(product *core.Product, param core.TimeDataSearchRequest) (map[string]any, error) {
@@ -483,9 +569,9 @@ func (t *TdengineTimeSeries) createSqlColumn(sb *strings.Builder, columnName str
 		sb.WriteString(" NCHAR(32)")
 	case tsl.TypeDate:
 		sb.WriteString(" TIMESTAMP")
-	// case tsl.TypeArray:
-	// array := p.ValueType.(tsl.ValueTypeArray)
-	// return t.appendSqlColumn(array.ElementType)
+	case tsl.TypeArray:
+		// 数组以json字符串保存
+		sb.WriteString(" NCHAR(1024)")
 	default:
 		if len(p.GetId()) > 0 {
 			sb.WriteString(" NCHAR(32)")
@@ -529,6 +615,9 @@ func (t *TdengineTimeSeries) insertSql(sTableName string, type_ string, columns
 
 func (t *TdengineTimeSeries) whereValueRewrite(value any) string {
 	switch value.(type) {
+	case []any, []map[string]any:
+		b, _ := json.Marshal(value)
+		return "'" + strings.ReplaceAll(string(b), "'", "\\'") + "'"
 	case string:
 		return "'" + strings.ReplaceAll(fmt.Sprintf("%v", value), "'", "\\'") + "'"
 	default:
@@ -2,6 +2,7 @@ package tsl
 
 import (
 	"fmt"
+	"reflect"
 	"strconv"
 
 	logs "go-iot/pkg/logger"
@@ -25,79 +26,118 @@ func ValueConvert1(propMap map[string]Property, data *map[string]interface{}) er
 		if prop, ok := propMap[key]; !ok {
 			delete(*data, key)
 		} else {
-			valType := fmt.Sprintf("%v", prop.GetType())
-			switch valType {
-			case TypeEnum:
-				switch value.(type) {
-				case string:
-				default:
-					(*data)[key] = fmt.Sprintf("%v", value)
-				}
-			case TypeInt:
-				switch value.(type) {
-				case int:
-				case int16:
-				case int32:
-				case int64:
-				default:
-					s := fmt.Sprintf("%v", value)
-					f, err := strconv.ParseInt(s, 10, 0)
-					if err != nil {
-						logs.Errorf(err.Error())
-					} else {
-						(*data)[key] = f
-					}
-				}
-			case TypeString:
-				(*data)[key] = fmt.Sprintf("%v", value)
-			case TypeFloat:
-				switch value.(type) {
-				case float32:
-				case float64:
-				default:
-					s := fmt.Sprintf("%v", value)
-					f, err := strconv.ParseFloat(s, 32)
-					if err != nil {
-						logs.Errorf(err.Error())
-					} else {
-						(*data)[key] = f
-					}
-				}
-			case TypeDouble:
-				switch value.(type) {
-				case float32:
-				case float64:
-				default:
-					s := fmt.Sprintf("%v", value)
-					f, err := strconv.ParseFloat(s, 64)
-					if err != nil {
-						logs.Errorf(err.Error())
-					} else {
-						(*data)[key] = f
-					}
-				}
-			case TypeBool:
-				switch value.(type) {
-				case bool:
-				default:
-					s := fmt.Sprintf("%v", value)
-					if s == "1" || s == "true" {
-						(*data)[key] = true
-					} else {
-						(*data)[key] = false
-					}
+			v, err := convertValue(key, prop, value)
+			if err != nil {
+				return err
+			}
+			(*data)[key] = v
+		}
+	}
+	return nil
+}
+
+// 按属性类型转换单个值
+func convertValue(key string, prop Property, value any) (any, error) {
+	valType := fmt.Sprintf("%v", prop.GetType())
+	switch valType {
+	case TypeEnum:
+		switch value.(type) {
+		case string:
+		default:
+			return fmt.Sprintf("%v", value), nil
+		}
+	case TypeInt:
+		switch value.(type) {
+		case int:
+		case int16:
+		case int32:
+		case int64:
+		default:
+			s := fmt.Sprintf("%v", value)
+			f, err := strconv.ParseInt(s, 10, 0)
+			if err != nil {
+				logs.Errorf(err.Error())
+			} else {
+				return f, nil
+			}
+		}
+	case TypeString:
+		return fmt.Sprintf("%v", value), nil
+	case TypeFloat:
+		switch value.(type) {
+		case float32:
+		case float64:
+		default:
+			s := fmt.Sprintf("%v", value)
+			f, err := strconv.ParseFloat(s, 32)
+			if err != nil {
+				logs.Errorf(err.Error())
+			} else {
+				return f, nil
+			}
+		}
+	case TypeDouble:
+		switch value.(type) {
+		case float32:
+		case float64:
+		default:
+			s := fmt.Sprintf("%v", value)
+			f, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				logs.Errorf(err.Error())
+			} else {
+				return f, nil
+			}
+		}
+	case TypeBool:
+		switch value.(type) {
+		case bool:
+		default:
+			s := fmt.Sprintf("%v", value)
+			if s == "1" || s == "true" {
+				return true, nil
+			} else {
+				return false, nil
+			}
+		}
+	case TypeObject:
+		switch value.(type) {
+		case map[string]interface{}:
+		default:
+			return nil, fmt.Errorf("the property [%s] is not map[string]interface{} [%v]", key, value)
+		}
+	case TypeArray:
+		array := prop.(*PropertyArray)
+		rv := reflect.ValueOf(value)
+		if value == nil || (rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array) {
+			return nil, fmt.Errorf("the property [%s] is not array [%v]", key, value)
+		}
+		list := make([]any, 0, rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			elemKey := fmt.Sprintf("%s[%d]", key, i)
+			elem := rv.Index(i).Interface()
+			if obj, ok := array.ElementType.IsObject(); ok {
+				m, ok := elem.(map[string]any)
+				if !ok {
+					return nil, fmt.Errorf("the property [%s] is not map[string]interface{} [%v]", elemKey, elem)
 				}
-			case TypeObject:
-				switch value.(type) {
-				case map[string]interface{}:
-				default:
-					return fmt.Errorf("the property [%s] is not map[string]interface{} [%v]", key, value)
+				err := ValueConvert1(obj.PropertiesMap(), &m)
+				if err != nil {
+					return nil, err
 				}
-			case TypeDate:
-				(*data)[key] = value
-			default:
+				list = append(list, m)
+				continue
 			}
+			v, err := convertValue(elemKey, array.ElementType, elem)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
 		}
+		return list, nil
+	case TypeDate:
+		return value, nil
+	default:
 	}
-	return nil
+	return value, nil
 }
@@ -0,0 +1,141 @@
+package tsl
+
+import (
+	"sort"
+)
+
+const (
+	// 变更类型
+	ChangeAdd          = "add"          // 新增
+	ChangeRemove       = "remove"       // 删除
+	ChangeIncompatible = "incompatible" // 类型不兼容变更
+
+	// 变更范围
+	ScopeProperty = "property"
+	ScopeEvent    = "event"
+	ScopeFunction = "function"
+)
+
+// 物模型变更
+type TslChange struct {
+	Kind    string   `json:"kind"`
+	Scope   string   `json:"scope"`
+	Id      string   `json:"id"` // 对象的子属性使用.连接, 如: obj.a
+	OldType string   `json:"oldType,omitempty"`
+	NewType string   `json:"newType,omitempty"`
+	Old     Property `json:"-"`
+	New     Property `json:"-"`
+}
+
+// 对比两个版本的物模型, old为nil时全部为新增
+func Diff(old, new *TslData) []TslChange {
+	if old == nil {
+		old = NewTslData()
+	}
+	if new == nil {
+		new = NewTslData()
+	}
+	var changes []TslChange
+	changes = diffPropertys(changes, ScopeProperty, "", old.PropertiesMap(), new.PropertiesMap())
+	changes = diffPropertys(changes, ScopeEvent, "", old.EventsMap(), new.EventsMap())
+	oldFuncs, newFuncs := old.FunctionsMap(), new.FunctionsMap()
+	for id, f := range newFuncs {
+		of, ok := oldFuncs[id]
+		if !ok {
+			changes = append(changes, TslChange{Kind: ChangeAdd, Scope: ScopeFunction, Id: id})
+			continue
+		}
+		changes = diffPropertys(changes, ScopeFunction, id+".", toPropertyMap(of.Inputs), toPropertyMap(f.Inputs))
+	}
+	for id := range oldFuncs {
+		if _, ok := newFuncs[id]; !ok {
+			changes = append(changes, TslChange{Kind: ChangeRemove, Scope: ScopeFunction, Id: id})
+		}
+	}
+	sort.SliceStable(changes, func(i, j int) bool {
+		if changes[i].Scope != changes[j].Scope {
+			return changes[i].Scope < changes[j].Scope
+		}
+		return changes[i].Id < changes[j].Id
+	})
+	return changes
+}
+
+// 是否存在不兼容的变更
+func HasIncompatible(changes []TslChange) bool {
+	for _, c := range changes {
+		if c.Kind == ChangeIncompatible {
+			return true
+		}
+	}
+	return false
+}
+
+func toPropertyMap(list []Property) map[string]Property {
+	m := map[string]Property{}
+	for _, p := range list {
+		m[p.GetId()] = p
+	}
+	return m
+}
+
+func diffPropertys(changes []TslChange, scope, prefix string, old, new map[string]Property) []TslChange {
+	for id, p := range new {
+		op, ok := old[id]
+		if !ok {
+			changes = append(changes, TslChange{Kind: ChangeAdd, Scope: scope, Id: prefix + id, NewType: p.GetType(), New: p})
+			continue
+		}
+		// 对象比较子属性
+		oldObj, ok1 := op.IsObject()
+		newObj, ok2 := p.IsObject()
+		if ok1 && ok2 {
+			changes = diffPropertys(changes, scope, prefix+id+".", oldObj.PropertiesMap(), newObj.PropertiesMap())
+			continue
+		}
+		if !compatible(op, p) {
+			changes = append(changes, TslChange{Kind: ChangeIncompatible, Scope: scope, Id: prefix + id,
+				OldType: typeName(op), NewType: typeName(p), Old: op, New: p})
+		}
+	}
+	for id, op := range old {
+		if _, ok := new[id]; !ok {
+			changes = append(changes, TslChange{Kind: ChangeRemove, Scope: scope, Id: prefix + id, OldType: op.GetType(), Old: op})
+		}
+	}
+	return changes
+}
+
+// 类型名称, 数组带上元素类型, 如: array<int>
+func typeName(p Property) string {
+	if array, ok := p.(*PropertyArray); ok && array.ElementType != nil {
+		return TypeArray + "<" + array.ElementType.GetType() + ">"
+	}
+	return p.GetType()
+}
+
+// 存储类型是否兼容, 字符类型之间可以互相转换
+func compatible(old, new Property) bool {
+	if old.GetType() == new.GetType() {
+		if old.GetType() != TypeArray {
+			return true
+		}
+		oa, na := old.(*PropertyArray), new.(*PropertyArray)
+		oldObj, ok1 := oa.ElementType.IsObject()
+		newObj, ok2 := na.ElementType.IsObject()
+		if ok1 && ok2 {
+			for _, c := range diffPropertys(nil, "", "", oldObj.PropertiesMap(), newObj.PropertiesMap()) {
+				if c.Kind == ChangeIncompatible {
+					return false
+				}
+			}
+			return true
+		}
+		return compatible(oa.ElementType, na.ElementType)
+	}
+	return isCharType(old.GetType()) && isCharType(new.GetType())
+}
+
+func isCharType(t string) bool {
+	return t == TypeString || t == TypeEnum || t == TypePassword
+}
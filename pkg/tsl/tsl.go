@@ -23,9 +23,14 @@ const (
 	TypePassword = "password"
 	TypeFile     = "file"
 	TypeObject   = "object"
-	// TypeArray    = "array"
+	TypeArray    = "array"
 
 	PropertyDeviceId = "deviceId"
+
+	// 属性访问模式
+	AccessModeRead   = "read"   // 可读取
+	AccessModeWrite  = "write"  // 可写入
+	AccessModeReport = "report" // 可上报, 不可上报的属性只在读取、写入的回复中保存
 )
 
 type TslData struct {
@@ -63,8 +68,12 @@ func (tsl *TslData) FromJson(text string) error {
 	return nil
 }
 
+// 没有物模型时返回空的map
 func (tsl *TslData) PropertiesMap() map[string]Property {
 	tslP := map[string]Property{}
+	if tsl == nil {
+		return tslP
+	}
 	for _, p := range tsl.Properties {
 		tslP[p.GetId()] = p
 	}
@@ -73,6 +82,9 @@ func (tsl *TslData) PropertiesMap() map[string]Property {
 
 func (tsl *TslData) FunctionsMap() map[string]Function {
 	tslF := map[string]Function{}
+	if tsl == nil {
+		return tslF
+	}
 	for _, p := range tsl.Functions {
 		tslF[p.Id] = p
 	}
@@ -81,6 +93,9 @@ func (tsl *TslData) FunctionsMap() map[string]Function {
 
 func (tsl *TslData) EventsMap() map[string]Property {
 	tslF := map[string]Property{}
+	if tsl == nil {
+		return tslF
+	}
 	for _, p := range tsl.Events {
 		tslF[p.GetId()] = p
 	}
@@ -105,6 +120,10 @@ type Property interface {
 	GetType() string
 	GetExpands() map[string]string
 	IsObject() (*PropertyObject, bool)
+	// 是否支持访问模式 read, write, report
+	HasAccessMode(mode string) bool
+	// 值约束
+	GetConstraint() *Constraint
 	setId(string)
 	setType(string)
 }
@@ -115,6 +134,22 @@ type tslProperty struct {
 	Type        string            `json:"type"`
 	Expands     map[string]string `json:"expands,omitempty"`
 	Description string            `json:"description,omitempty"`
+	AccessMode  []string          `json:"accessMode,omitempty"` // read, write, report
+	Constraint
+}
+
+// 值约束，为空时不校验
+type Constraint struct {
+	Min       *Number `json:"min,omitempty"`       // 最小值
+	Max       *Number `json:"max,omitempty"`       // 最大值
+	Step      *Number `json:"step,omitempty"`      // 步长
+	MaxLength *Number `json:"maxLength,omitempty"` // 字符串最大长度、数组最大元素个数
+	Pattern   string  `json:"pattern,omitempty"`   // 字符串正则
+	Precision *Number `json:"precision,omitempty"` // 浮点数保留的小数位数, 超出时四舍五入
+}
+
+func (p *tslProperty) GetConstraint() *Constraint {
+	return &p.Constraint
 }
 
 func (p *tslProperty) GetId() string {
@@ -133,6 +168,22 @@ func (p *tslProperty) IsObject() (*PropertyObject, bool) {
 	return nil, false
 }
 
+// 没有配置访问模式时默认可读取、可上报，expands.readOnly为false时可写入
+func (p *tslProperty) HasAccessMode(mode string) bool {
+	if len(p.AccessMode) == 0 {
+		if mode == AccessModeWrite {
+			return p.Expands["readOnly"] == "false"
+		}
+		return mode == AccessModeRead || mode == AccessModeReport
+	}
+	for _, m := range p.AccessMode {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
 func (p *tslProperty) setId(t string) {
 	p.Id = t
 }
@@ -333,14 +384,20 @@ func (p *PropertyObject) PropertiesMap() map[string]Property {
 	return tslP
 }
 
-// type PropertyArray struct {
-// 	TslProperty
-// 	ElementType TslProperty `json:"elementType"`
-// }
+type PropertyArray struct {
+	tslProperty
+	ElementType Property `json:"elementType"`
+}
 
-// func (p *PropertyArray) GetType() string {
-// 	return TypeArray
-// }
+func NewPropertyArray(id, name string, elementType Property) *PropertyArray {
+	p := &PropertyArray{tslProperty: tslProperty{Id: id, Name: name}, ElementType: elementType}
+	p.setType(p.GetType())
+	return p
+}
+
+func (p *PropertyArray) GetType() string {
+	return TypeArray
+}
 
 func parseFunctions(d string) ([]Function, error) {
 	list := []Function{}
@@ -474,10 +531,8 @@ func parseProperty(value gjson.Result, idMustNotNull bool) (Property, error) {
 		property = &PropertyFile{}
 	case TypeObject:
 		property = &PropertyObject{}
-	// case TypeArray:
-	// 	valueType := ValueTypeArray{}
-	// 	err = convert(alias.ValueType, &valueType)
-	// 	p.ValueType = valueType
+	case TypeArray:
+		property = &PropertyArray{}
 	default:
 		err = fmt.Errorf("type %v is not support", typeName)
 		return nil, err
@@ -493,6 +548,10 @@ func parseProperty(value gjson.Result, idMustNotNull bool) (Property, error) {
 			d1.Expands[key.String()] = value.String()
 			return true
 		})
+		value.Get("accessMode").ForEach(func(key, value gjson.Result) bool {
+			d1.AccessMode = append(d1.AccessMode, value.String())
+			return true
+		})
 		var properties []Property
 		value.Get("properties").ForEach(func(key, value gjson.Result) bool {
 			p, e := parseProperty(value, idMustNotNull)
@@ -504,6 +563,21 @@ func parseProperty(value gjson.Result, idMustNotNull bool) (Property, error) {
 			return true
 		})
 		d1.Properties = properties
+	case *PropertyArray:
+		elementType := value.Get("elementType")
+		if !elementType.IsObject() {
+			return nil, fmt.Errorf("array [%s] must have elementType", value.Get("id").String())
+		}
+		var element Property
+		element, err = parseProperty(elementType, false)
+		if err != nil {
+			return nil, err
+		}
+		if element.GetType() == TypeArray {
+			return nil, fmt.Errorf("array [%s] elementType must not be array", value.Get("id").String())
+		}
+		d1.ElementType = element
+		err = convert(value.Raw, &d1.tslProperty)
 	default:
 		err = convert(value.Raw, property)
 	}
@@ -520,6 +594,18 @@ func parseProperty(value gjson.Result, idMustNotNull bool) (Property, error) {
 			return nil, err
 		}
 	}
+	for _, mode := range value.Get("accessMode").Array() {
+		switch mode.String() {
+		case AccessModeRead, AccessModeWrite, AccessModeReport:
+		default:
+			return nil, fmt.Errorf("accessMode [%s] of [%s] is invalid, must be read,write,report", mode.String(), property.GetId())
+		}
+	}
+	if pattern := property.GetConstraint().Pattern; len(pattern) > 0 {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return nil, fmt.Errorf("pattern of [%s] is invalid: %v", property.GetId(), err)
+		}
+	}
 	return property, err
 }
 
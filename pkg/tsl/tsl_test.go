@@ -228,6 +228,12 @@ func TestTsl(t *testing.T) {
 	assert.Equal(t, nil, d.Functions[3].Output)
 	assert.Equal(t, 0, len(d.Functions[3].Inputs))
 
+	// 没有物模型的产品
+	var empty *tsl.TslData
+	assert.Empty(t, empty.PropertiesMap())
+	assert.Empty(t, empty.EventsMap())
+	assert.Empty(t, empty.FunctionsMap())
+
 	s := fmt.Sprintf("%v", 1)
 	log.Println(s)
 	s = fmt.Sprintf("%v", 11.22)
@@ -239,3 +245,175 @@ func TestTsl(t *testing.T) {
 	s = fmt.Sprintf("%v", "100000ff")
 	log.Println(s)
 }
+
+func TestAccessMode(t *testing.T) {
+	d := tsl.TslData{}
+	err := d.FromJson(`{"properties": [
+		{"id": "light", "name": "亮度", "type": "int", "accessMode": ["read", "write"]},
+		{"id": "current", "name": "电流", "type": "double"},
+		{"id": "switch", "name": "开关", "type": "bool", "expands": {"readOnly": "false"}},
+		{"id": "obj", "name": "obj", "type": "object", "accessMode": ["report"], "properties": [{"id": "name", "name": "名称", "type": "string"}]}
+	]}`)
+	assert.Nil(t, err)
+	props := d.PropertiesMap()
+	assert.True(t, props["light"].HasAccessMode(tsl.AccessModeRead))
+	assert.True(t, props["light"].HasAccessMode(tsl.AccessModeWrite))
+	assert.False(t, props["light"].HasAccessMode(tsl.AccessModeReport))
+	assert.True(t, props["current"].HasAccessMode(tsl.AccessModeRead))
+	assert.True(t, props["current"].HasAccessMode(tsl.AccessModeReport))
+	assert.False(t, props["current"].HasAccessMode(tsl.AccessModeWrite))
+	assert.True(t, props["switch"].HasAccessMode(tsl.AccessModeWrite))
+	assert.True(t, props["obj"].HasAccessMode(tsl.AccessModeReport))
+	assert.False(t, props["obj"].HasAccessMode(tsl.AccessModeRead))
+
+	err = d.FromJson(`{"properties": [{"id": "light", "name": "亮度", "type": "int", "accessMode": ["execute"]}]}`)
+	assert.NotNil(t, err)
+}
+
+func TestArray(t *testing.T) {
+	d := tsl.TslData{}
+	err := d.FromJson(`{"properties": [
+		{"id": "rssi", "name": "信号", "type": "array", "elementType": {"type": "int"}},
+		{"id": "channels", "name": "通道", "type": "array", "elementType": {"type": "object", "properties": [
+			{"id": "no", "name": "编号", "type": "int"},
+			{"id": "value", "name": "值", "type": "double"}
+		]}}
+	]}`)
+	assert.Nil(t, err)
+	assert.IsType(t, &tsl.PropertyArray{}, d.Properties[0])
+	array := d.Properties[0].(*tsl.PropertyArray)
+	assert.Equal(t, "rssi", array.GetId())
+	assert.Equal(t, tsl.TypeArray, array.GetType())
+	assert.IsType(t, &tsl.PropertyInt{}, array.ElementType)
+	array = d.Properties[1].(*tsl.PropertyArray)
+	obj, ok := array.ElementType.IsObject()
+	assert.True(t, ok)
+	assert.Equal(t, 2, len(obj.Properties))
+
+	data := map[string]any{
+		"rssi":     []any{"-10", 20},
+		"channels": []any{map[string]any{"no": "1", "value": "2.5", "other": 1}},
+	}
+	err = tsl.ValueConvert1(d.PropertiesMap(), &data)
+	assert.Nil(t, err)
+	assert.Equal(t, []any{int64(-10), 20}, data["rssi"])
+	assert.Equal(t, []any{map[string]any{"no": int64(1), "value": 2.5}}, data["channels"])
+
+	data = map[string]any{"rssi": 1}
+	err = tsl.ValueConvert1(d.PropertiesMap(), &data)
+	assert.NotNil(t, err)
+
+	err = d.FromJson(`{"properties": [{"id": "rssi", "name": "信号", "type": "array"}]}`)
+	assert.NotNil(t, err)
+}
+
+func TestValid(t *testing.T) {
+	d := tsl.TslData{}
+	err := d.FromJson(`{"properties": [
+		{"id": "temp", "name": "温度", "type": "int", "min": -20, "max": "60", "step": 2},
+		{"id": "current", "name": "电流", "type": "double", "scale": 2, "min": ""},
+		{"id": "humidity", "name": "湿度", "type": "float", "scale": 1, "precision": "2", "max": 100},
+		{"id": "name", "name": "名称", "type": "string", "maxLength": "4", "pattern": "^[a-z]+$"},
+		{"id": "code", "name": "编码", "type": "string", "max": 3},
+		{"id": "status", "name": "状态", "type": "enum", "elements": [{"text": "开", "value": "on"}, {"text": "关", "value": "off"}]},
+		{"id": "switch", "name": "开关", "type": "bool", "trueValue": "open", "falseValue": "close"},
+		{"id": "rssi", "name": "信号", "type": "array", "maxLength": 2, "elementType": {"type": "int", "max": 0}}
+	]}`)
+	assert.Nil(t, err)
+	props := d.PropertiesMap()
+	assert.Nil(t, tsl.ValidValue(props["temp"], 20))
+	assert.Nil(t, tsl.ValidValue(props["temp"], "-20"))
+	assert.NotNil(t, tsl.ValidValue(props["temp"], 61))
+	assert.NotNil(t, tsl.ValidValue(props["temp"], -21))
+	assert.NotNil(t, tsl.ValidValue(props["temp"], 21))
+	assert.NotNil(t, tsl.ValidValue(props["temp"], 20.5))
+	assert.NotNil(t, tsl.ValidValue(props["temp"], "abc"))
+	assert.Nil(t, tsl.ValidValue(props["current"], 1.25))
+	assert.Nil(t, tsl.ValidValue(props["current"], -1000))
+	// scale只用于展示, 不限制小数位数
+	assert.Nil(t, tsl.ValidValue(props["current"], 1.255))
+	assert.Nil(t, tsl.ValidValue(props["current"], float64(float32(25.3))))
+	// 按精度四舍五入后保存
+	data := map[string]any{"humidity": float64(float32(25.3)), "current": float64(float32(25.3))}
+	assert.Empty(t, tsl.ValidData(props, data))
+	assert.Equal(t, 25.3, data["humidity"])
+	assert.Equal(t, float64(float32(25.3)), data["current"])
+	assert.Equal(t, 23.46, tsl.RoundValue(props["humidity"], "23.456"))
+	assert.NotNil(t, tsl.ValidData(props, map[string]any{"humidity": 100.006})["humidity"])
+	assert.Nil(t, tsl.ValidValue(props["name"], "abcd"))
+	assert.NotNil(t, tsl.ValidValue(props["name"], "abcde"))
+	assert.NotNil(t, tsl.ValidValue(props["name"], "ab1"))
+	assert.Nil(t, tsl.ValidValue(props["code"], "abc"))
+	assert.NotNil(t, tsl.ValidValue(props["code"], "abcd"))
+	assert.Nil(t, tsl.ValidValue(props["status"], "on"))
+	assert.NotNil(t, tsl.ValidValue(props["status"], "unknown"))
+	assert.Nil(t, tsl.ValidValue(props["switch"], true))
+	assert.Nil(t, tsl.ValidValue(props["switch"], "open"))
+	assert.NotNil(t, tsl.ValidValue(props["switch"], "half"))
+	assert.Nil(t, tsl.ValidValue(props["rssi"], []any{-1, -2}))
+	assert.NotNil(t, tsl.ValidValue(props["rssi"], []any{-1, -2, -3}))
+	assert.NotNil(t, tsl.ValidValue(props["rssi"], []any{1}))
+
+	errs := tsl.ValidData(props, map[string]any{"deviceId": "1", "temp": 100, "name": "ok", "other": 1})
+	assert.Equal(t, 1, len(errs))
+	assert.Contains(t, errs, "temp")
+
+	err = d.FromJson(`{"properties": [{"id": "name", "name": "名称", "type": "string", "pattern": "[a-"}]}`)
+	assert.NotNil(t, err)
+	// 不是数值的约束不校验
+	err = d.FromJson(`{"properties": [{"id": "temp", "name": "温度", "type": "int", "min": "abc"}]}`)
+	assert.Nil(t, err)
+	assert.Nil(t, tsl.ValidValue(d.PropertiesMap()["temp"], -100))
+
+	// 对象按属性定义顺序返回第一个错误
+	err = d.FromJson(`{"properties": [{"id": "pos", "name": "位置", "type": "object", "properties": [
+		{"id": "x", "name": "x", "type": "int", "max": 1}, {"id": "y", "name": "y", "type": "int", "max": 1}
+	]}]}`)
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		err = tsl.ValidValue(d.PropertiesMap()["pos"], map[string]any{"y": 2, "x": 2})
+		assert.Equal(t, "x [2] must less than or equal to 1", err.Error())
+	}
+}
+
+func TestDiff(t *testing.T) {
+	old := tsl.TslData{}
+	err := old.FromJson(`{"properties": [
+		{"id": "temp", "name": "温度", "type": "int"},
+		{"id": "mode", "name": "模式", "type": "string"},
+		{"id": "pos", "name": "位置", "type": "object", "properties": [{"id": "x", "name": "x", "type": "float"}]},
+		{"id": "old", "name": "旧属性", "type": "int"}
+	], "events": [{"id": "alarm", "name": "告警", "type": "int"}]}`)
+	assert.Nil(t, err)
+	model := tsl.TslData{}
+	err = model.FromJson(`{"properties": [
+		{"id": "temp", "name": "温度", "type": "double"},
+		{"id": "mode", "name": "模式", "type": "enum", "elements": [{"value": "a", "text": "a"}]},
+		{"id": "pos", "name": "位置", "type": "object", "properties": [
+			{"id": "x", "name": "x", "type": "float"}, {"id": "y", "name": "y", "type": "float"}
+		]},
+		{"id": "hum", "name": "湿度", "type": "int"}
+	], "events": [{"id": "alarm", "name": "告警", "type": "int"}]}`)
+	assert.Nil(t, err)
+
+	changes := tsl.Diff(&old, &model)
+	assert.Equal(t, 4, len(changes))
+	kinds := map[string]string{}
+	for _, c := range changes {
+		assert.Equal(t, tsl.ScopeProperty, c.Scope)
+		kinds[c.Id] = c.Kind
+	}
+	assert.Equal(t, map[string]string{
+		"hum":   tsl.ChangeAdd,
+		"old":   tsl.ChangeRemove,
+		"pos.y": tsl.ChangeAdd,
+		"temp":  tsl.ChangeIncompatible,
+	}, kinds)
+	assert.True(t, tsl.HasIncompatible(changes))
+
+	// 未发布过的物模型全部为新增
+	changes = tsl.Diff(nil, &model)
+	assert.Equal(t, 5, len(changes))
+	assert.False(t, tsl.HasIncompatible(changes))
+	assert.Empty(t, tsl.Diff(&model, &model))
+}
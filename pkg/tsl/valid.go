@@ -0,0 +1,213 @@
+package tsl
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/spf13/cast"
+)
+
+// 约束中的数值，兼容字符串格式如 "maxLength": "32"，空字符串或不是数值时表示没有约束
+type Number float64
+
+func (n *Number) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(strings.TrimSpace(string(b)), `"`)
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		// 兼容已保存的物模型中不是数值的约束
+		f = math.NaN()
+	}
+	*n = Number(f)
+	return nil
+}
+
+func (n Number) MarshalJSON() ([]byte, error) {
+	if math.IsNaN(float64(n)) {
+		return []byte("null"), nil
+	}
+	return json.Marshal(float64(n))
+}
+
+func (n *Number) valid() bool {
+	return n != nil && !math.IsNaN(float64(*n))
+}
+
+func (n *Number) value() float64 {
+	return float64(*n)
+}
+
+// 校验数据是否满足物模型，返回不满足约束的属性错误，没有定义的属性不校验
+// 约束了精度的浮点数先按精度四舍五入
+func ValidData(propMap map[string]Property, data map[string]any) map[string]error {
+	errs := map[string]error{}
+	for key, value := range data {
+		prop, ok := propMap[key]
+		if !ok || key == PropertyDeviceId {
+			continue
+		}
+		value = RoundValue(prop, value)
+		data[key] = value
+		if err := ValidValue(prop, value); err != nil {
+			errs[key] = err
+		}
+	}
+	return errs
+}
+
+// 校验值是否满足属性的类型与约束
+func ValidValue(prop Property, value any) error {
+	if value == nil {
+		return nil
+	}
+	c := prop.GetConstraint()
+	switch p := prop.(type) {
+	case *PropertyInt, *PropertyLong:
+		f, err := cast.ToFloat64E(value)
+		if err != nil {
+			return fmt.Errorf("[%v] is not number", value)
+		}
+		if f != math.Trunc(f) {
+			return fmt.Errorf("[%v] is not integer", value)
+		}
+		return c.validNumber(f)
+	case *PropertyFloat, *PropertyDouble:
+		f, err := cast.ToFloat64E(value)
+		if err != nil {
+			return fmt.Errorf("[%v] is not number", value)
+		}
+		return c.validNumber(f)
+	case *PropertyPassword:
+		return c.validString(fmt.Sprintf("%v", value), p.Max)
+	case *PropertyString:
+		return c.validString(fmt.Sprintf("%v", value), p.Max)
+	case *PropertyEnum:
+		s := fmt.Sprintf("%v", value)
+		if len(p.Elements) == 0 {
+			return nil
+		}
+		for _, e := range p.Elements {
+			if e.Value == s {
+				return nil
+			}
+		}
+		return fmt.Errorf("[%v] is not in enum elements", value)
+	case *PropertyBool:
+		if _, ok := value.(bool); ok {
+			return nil
+		}
+		s := fmt.Sprintf("%v", value)
+		switch s {
+		case "true", "false", "1", "0", p.TrueValue, p.FalseValue:
+			return nil
+		}
+		return fmt.Errorf("[%v] is not bool", value)
+	case *PropertyObject:
+		m, ok := value.(map[string]any)
+		if !ok {
+			return fmt.Errorf("[%v] is not object", value)
+		}
+		// 按定义顺序校验，错误信息保持稳定
+		for _, prop := range p.Properties {
+			v, ok := m[prop.GetId()]
+			if !ok {
+				continue
+			}
+			if err := ValidValue(prop, v); err != nil {
+				return fmt.Errorf("%s %v", prop.GetId(), err)
+			}
+		}
+	case *PropertyArray:
+		rv := reflect.ValueOf(value)
+		if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+			return fmt.Errorf("[%v] is not array", value)
+		}
+		if c.MaxLength.valid() && float64(rv.Len()) > c.MaxLength.value() {
+			return fmt.Errorf("array length must less than or equal to %v", c.MaxLength.value())
+		}
+		for i := 0; i < rv.Len(); i++ {
+			if err := ValidValue(p.ElementType, rv.Index(i).Interface()); err != nil {
+				return fmt.Errorf("[%d] %v", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Constraint) validNumber(f float64) error {
+	if c.Min.valid() && f < c.Min.value() {
+		return fmt.Errorf("[%v] must great than or equal to %v", f, c.Min.value())
+	}
+	if c.Max.valid() && f > c.Max.value() {
+		return fmt.Errorf("[%v] must less than or equal to %v", f, c.Max.value())
+	}
+	if c.Step.valid() && c.Step.value() > 0 {
+		base := 0.0
+		if c.Min.valid() {
+			base = c.Min.value()
+		}
+		n := (f - base) / c.Step.value()
+		if math.Abs(n-math.Round(n)) > 1e-9 {
+			return fmt.Errorf("[%v] is not match step %v", f, c.Step.value())
+		}
+	}
+	return nil
+}
+
+// 按属性约束的精度四舍五入浮点数, 对象与数组中的值原地修改, 其它值原样返回
+func RoundValue(prop Property, value any) any {
+	switch p := prop.(type) {
+	case *PropertyFloat, *PropertyDouble:
+		precision := prop.GetConstraint().Precision
+		if !precision.valid() || precision.value() < 0 {
+			return value
+		}
+		f, err := cast.ToFloat64E(value)
+		if err != nil {
+			return value
+		}
+		pow := math.Pow10(int(precision.value()))
+		return math.Round(f*pow) / pow
+	case *PropertyObject:
+		if m, ok := value.(map[string]any); ok {
+			for _, prop := range p.Properties {
+				if v, ok := m[prop.GetId()]; ok {
+					m[prop.GetId()] = RoundValue(prop, v)
+				}
+			}
+		}
+	case *PropertyArray:
+		if arr, ok := value.([]any); ok {
+			for i, v := range arr {
+				arr[i] = RoundValue(p.ElementType, v)
+			}
+		}
+	}
+	return value
+}
+
+func (c *Constraint) validString(s string, max int32) error {
+	length := utf8.RuneCountInString(s)
+	if c.MaxLength.valid() && float64(length) > c.MaxLength.value() {
+		return fmt.Errorf("length must less than or equal to %v", c.MaxLength.value())
+	}
+	if !c.MaxLength.valid() && max > 0 && length > int(max) {
+		return fmt.Errorf("length must less than or equal to %v", max)
+	}
+	if len(c.Pattern) > 0 {
+		matched, err := regexp.MatchString(c.Pattern, s)
+		if err != nil {
+			return errors.New("pattern is invalid: " + err.Error())
+		}
+		if !matched {
+			return fmt.Errorf("[%s] is not match pattern %s", s, c.Pattern)
+		}
+	}
+	return nil
+}
@@ -3,6 +3,8 @@ package util
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
+	"reflect"
 
 	logs "go-iot/pkg/logger"
 )
@@ -34,3 +36,44 @@ func getBinaryData(val interface{}) (dataBytes []byte, err error) {
 	dataBytes = buf.Bytes()
 	return dataBytes, err
 }
+
+// 转换为字节数组, 支持字符串, 字节数组, 数字数组与有Bytes方法的对象
+func ToBytes(v any) ([]byte, error) {
+	switch b := v.(type) {
+	case nil:
+		return nil, nil
+	case []byte:
+		return b, nil
+	case string:
+		return []byte(b), nil
+	case interface{ Bytes() []byte }:
+		return b.Bytes(), nil
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, fmt.Errorf("can not convert %T to bytes", v)
+	}
+	result := make([]byte, rv.Len())
+	for i := 0; i < rv.Len(); i++ {
+		e := reflect.Indirect(rv.Index(i))
+		if e.Kind() == reflect.Interface {
+			e = reflect.Indirect(e.Elem())
+		}
+		var n int64
+		switch {
+		case e.CanInt():
+			n = e.Int()
+		case e.CanUint():
+			n = int64(e.Uint())
+		case e.CanFloat():
+			n = int64(e.Float())
+		default:
+			return nil, fmt.Errorf("can not convert %v at index %d to byte", e, i)
+		}
+		if n < -128 || n > 255 {
+			return nil, fmt.Errorf("value %d at index %d out of byte range", n, i)
+		}
+		result[i] = byte(n)
+	}
+	return result, nil
+}
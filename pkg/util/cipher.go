@@ -0,0 +1,109 @@
+package util
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// 对称加密参数
+type CipherOption struct {
+	Algorithm string // aes, sm4
+	Mode      string // ecb, cbc, 默认ecb
+	Padding   string // pkcs7, zero, none, 默认pkcs7
+	Key       []byte
+	Iv        []byte // cbc模式的初始向量
+}
+
+func (o CipherOption) block() (cipher.Block, error) {
+	switch strings.ToLower(o.Algorithm) {
+	case "aes":
+		return aes.NewCipher(o.Key)
+	case "sm4":
+		return NewSM4Cipher(o.Key)
+	default:
+		return nil, fmt.Errorf("unsupported algorithm: %s", o.Algorithm)
+	}
+}
+
+// 对称加密
+func Encrypt(data []byte, o CipherOption) ([]byte, error) {
+	block, err := o.block()
+	if err != nil {
+		return nil, err
+	}
+	size := block.BlockSize()
+	switch strings.ToLower(o.Padding) {
+	case "", "pkcs7":
+		n := size - len(data)%size
+		data = append(append([]byte{}, data...), bytes.Repeat([]byte{byte(n)}, n)...)
+	case "zero":
+		if len(data)%size != 0 {
+			data = append(append([]byte{}, data...), make([]byte, size-len(data)%size)...)
+		}
+	case "none":
+	default:
+		return nil, fmt.Errorf("unsupported padding: %s", o.Padding)
+	}
+	if len(data)%size != 0 {
+		return nil, errors.New("data is not a multiple of the block size")
+	}
+	out := make([]byte, len(data))
+	switch strings.ToLower(o.Mode) {
+	case "", "ecb":
+		for i := 0; i < len(data); i += size {
+			block.Encrypt(out[i:], data[i:i+size])
+		}
+	case "cbc":
+		if len(o.Iv) != size {
+			return nil, fmt.Errorf("iv length must be %d", size)
+		}
+		cipher.NewCBCEncrypter(block, o.Iv).CryptBlocks(out, data)
+	default:
+		return nil, fmt.Errorf("unsupported mode: %s", o.Mode)
+	}
+	return out, nil
+}
+
+// 对称解密
+func Decrypt(data []byte, o CipherOption) ([]byte, error) {
+	block, err := o.block()
+	if err != nil {
+		return nil, err
+	}
+	size := block.BlockSize()
+	if len(data) == 0 || len(data)%size != 0 {
+		return nil, errors.New("data is not a multiple of the block size")
+	}
+	out := make([]byte, len(data))
+	switch strings.ToLower(o.Mode) {
+	case "", "ecb":
+		for i := 0; i < len(data); i += size {
+			block.Decrypt(out[i:], data[i:i+size])
+		}
+	case "cbc":
+		if len(o.Iv) != size {
+			return nil, fmt.Errorf("iv length must be %d", size)
+		}
+		cipher.NewCBCDecrypter(block, o.Iv).CryptBlocks(out, data)
+	default:
+		return nil, fmt.Errorf("unsupported mode: %s", o.Mode)
+	}
+	switch strings.ToLower(o.Padding) {
+	case "", "pkcs7":
+		n := int(out[len(out)-1])
+		if n == 0 || n > size || !bytes.Equal(out[len(out)-n:], bytes.Repeat([]byte{byte(n)}, n)) {
+			return nil, errors.New("invalid pkcs7 padding")
+		}
+		out = out[:len(out)-n]
+	case "zero":
+		out = bytes.TrimRight(out, "\x00")
+	case "none":
+	default:
+		return nil, fmt.Errorf("unsupported padding: %s", o.Padding)
+	}
+	return out, nil
+}
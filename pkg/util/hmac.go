@@ -0,0 +1,28 @@
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+)
+
+// hmac签名, signatureMethod支持sha1, sha256, md5
+func HmacEncrypt(data, key []byte, signatureMethod string) ([]byte, error) {
+	var fn func() hash.Hash
+	switch signatureMethod {
+	case "sha1":
+		fn = sha1.New
+	case "sha256":
+		fn = sha256.New
+	case "md5":
+		fn = md5.New
+	default:
+		return nil, fmt.Errorf("unsupported signatureMethod: %s", signatureMethod)
+	}
+	h := hmac.New(fn, key)
+	h.Write(data)
+	return h.Sum(nil), nil
+}
@@ -1,6 +1,7 @@
 package util
 
 import (
+	"encoding/hex"
 	"go-iot/pkg/logger"
 	"testing"
 
@@ -16,3 +17,51 @@ func TestCrc16(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, "f2f4", err)
 }
+
+func TestSM4(t *testing.T) {
+	key, _ := hex.DecodeString("0123456789abcdeffedcba9876543210")
+	c, err := NewSM4Cipher(key)
+	assert.Nil(t, err)
+	dst := make([]byte, SM4BlockSize)
+	c.Encrypt(dst, key)
+	assert.Equal(t, "681edf34d206965e86b3e94f536e4246", hex.EncodeToString(dst))
+	c.Decrypt(dst, dst)
+	assert.Equal(t, key, dst)
+	_, err = NewSM4Cipher(key[:8])
+	assert.NotNil(t, err)
+}
+
+func TestCipher(t *testing.T) {
+	key := []byte("1234567890abcdef")
+	data := []byte("hello go-iot, binary frame")
+	for _, algorithm := range []string{"aes", "sm4"} {
+		for _, mode := range []string{"ecb", "cbc"} {
+			for _, padding := range []string{"pkcs7", "zero"} {
+				o := CipherOption{Algorithm: algorithm, Mode: mode, Padding: padding, Key: key, Iv: key}
+				enc, err := Encrypt(data, o)
+				assert.Nil(t, err)
+				assert.Equal(t, 32, len(enc))
+				dec, err := Decrypt(enc, o)
+				assert.Nil(t, err)
+				assert.Equal(t, data, dec)
+			}
+		}
+	}
+	_, err := Encrypt(data, CipherOption{Algorithm: "aes", Padding: "none", Key: key})
+	assert.NotNil(t, err)
+	_, err = Encrypt(data, CipherOption{Algorithm: "des", Key: key})
+	assert.NotNil(t, err)
+}
+
+func TestToBytes(t *testing.T) {
+	b, err := ToBytes("ab")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("ab"), b)
+	b, err = ToBytes([]any{int64(1), 2.0, int64(255), int64(-1)})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{1, 2, 255, 255}, b)
+	_, err = ToBytes([]any{int64(256)})
+	assert.NotNil(t, err)
+	_, err = ToBytes(map[string]any{})
+	assert.NotNil(t, err)
+}